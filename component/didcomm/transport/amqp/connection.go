@@ -0,0 +1,188 @@
+/*
+Copyright Scoir, Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package amqp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/hyperledger/aries-framework-go/pkg/common/log"
+	"github.com/pkg/errors"
+	"github.com/streadway/amqp"
+)
+
+const (
+	heartbeat = 10 * time.Second
+	locale    = "en_US"
+)
+
+// dialConfig holds the settings for connecting to an AMQP server.
+type dialConfig struct {
+	certFile, keyFile string
+	caFile            string
+	tlsConfig         *tls.Config
+	tlsMinVersion     uint16
+	externalAuth      bool
+}
+
+// tls returns the TLS configuration for the connection, or nil if no TLS settings have been made.
+// The connection is only made over TLS for amqps:// URLs; without any settings, the system defaults are used.
+func (c *dialConfig) tls() (*tls.Config, error) {
+	if c.tlsConfig == nil && c.caFile == "" && (c.certFile == "" || c.keyFile == "") {
+		return nil, nil
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS13}
+	if c.tlsConfig != nil {
+		config = c.tlsConfig.Clone()
+	}
+
+	if c.tlsMinVersion != 0 {
+		config.MinVersion = c.tlsMinVersion
+	}
+
+	err := c.loadCertificates(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// loadCertificates adds the client certificate and the root CAs from the configured files to config.
+func (c *dialConfig) loadCertificates(config *tls.Config) error {
+	if c.certFile != "" && c.keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+		if err != nil {
+			return errors.Wrap(err, "invalid cert")
+		}
+
+		config.Certificates = append(config.Certificates, cert)
+	}
+
+	if c.caFile == "" {
+		return nil
+	}
+
+	pem, err := ioutil.ReadFile(c.caFile)
+	if err != nil {
+		return errors.Wrap(err, "unable to read CA bundle")
+	}
+
+	config.RootCAs = x509.NewCertPool()
+
+	if !config.RootCAs.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("no certificates found in CA bundle %s", c.caFile)
+	}
+
+	return nil
+}
+
+// externalAuth is the SASL EXTERNAL mechanism, with which the server identifies the client by its TLS certificate.
+type externalAuth struct{}
+
+func (externalAuth) Mechanism() string {
+	return "EXTERNAL"
+}
+
+func (externalAuth) Response() string {
+	return ""
+}
+
+// dial connects to the AMQP server at url.
+func dial(url string, c *dialConfig) (*amqp.Connection, error) {
+	tlsConfig, err := c.tls()
+	if err != nil {
+		return nil, err
+	}
+
+	config := amqp.Config{
+		Heartbeat:       heartbeat,
+		Locale:          locale,
+		TLSClientConfig: tlsConfig,
+	}
+
+	if c.externalAuth {
+		config.SASL = []amqp.Authentication{externalAuth{}}
+	}
+
+	conn, err := amqp.DialConfig(url, config)
+	if err != nil {
+		if tlsConfig != nil {
+			return nil, errors.Wrap(err, "unable to connect to AMQP server")
+		}
+
+		return nil, errors.Wrapf(err, "unable to connect to AMQP server at %s", url)
+	}
+
+	return conn, nil
+}
+
+// ConnectionStatus is the state of the connection between an Inbound transport and the AMQP server.
+type ConnectionStatus int
+
+const (
+	// Disconnected means that the transport hasn't been started yet or has been stopped.
+	Disconnected ConnectionStatus = iota
+	// Connected means that the transport is connected and consuming messages.
+	Connected
+	// Reconnecting means that the connection was lost and the transport is trying to connect again.
+	Reconnecting
+)
+
+func (s ConnectionStatus) String() string {
+	switch s {
+	case Disconnected:
+		return "disconnected"
+	case Connected:
+		return "connected"
+	case Reconnecting:
+		return "reconnecting"
+	default:
+		return fmt.Sprintf("ConnectionStatus(%d)", int(s))
+	}
+}
+
+// session is an open connection and channel to the AMQP server.
+type session struct {
+	conn       io.Closer
+	ch         channel
+	connClosed <-chan *amqp.Error
+	chClosed   <-chan *amqp.Error
+}
+
+// closeReason returns why the session's deliveries stopped. The AMQP client notifies close listeners before it
+// closes the deliveries channel, so the error (if any) is already buffered by the time this is called.
+func (s *session) closeReason() error {
+	for _, closed := range []<-chan *amqp.Error{s.chClosed, s.connClosed} {
+		select {
+		case err := <-closed:
+			if err != nil {
+				return err
+			}
+		default:
+		}
+	}
+
+	return errors.New("consumer was cancelled by the server")
+}
+
+func closeSession(s *session, logger *log.Log) {
+	if s.ch != nil {
+		if err := s.ch.Close(); err != nil && !errors.Is(err, amqp.ErrClosed) {
+			logger.Debugf("channel shutdown failed: %v", err)
+		}
+	}
+
+	if err := s.conn.Close(); err != nil && !errors.Is(err, amqp.ErrClosed) {
+		logger.Debugf("connection shutdown failed: %v", err)
+	}
+}
@@ -0,0 +1,110 @@
+/*
+Copyright Scoir, Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package amqp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeCert writes a self-signed certificate and its key to PEM files in dir.
+func writeCert(t *testing.T, dir string) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "aries"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	require.NoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		0o600))
+
+	return certFile, keyFile
+}
+
+func TestDialConfig_TLS(t *testing.T) {
+	certFile, keyFile := writeCert(t, t.TempDir())
+
+	t.Run("no TLS settings", func(t *testing.T) {
+		config, err := (&dialConfig{certFile: certFile}).tls()
+		require.NoError(t, err)
+		require.Nil(t, config)
+	})
+
+	t.Run("client certificate", func(t *testing.T) {
+		config, err := (&dialConfig{certFile: certFile, keyFile: keyFile}).tls()
+		require.NoError(t, err)
+		require.Equal(t, uint16(tls.VersionTLS13), config.MinVersion)
+		require.Len(t, config.Certificates, 1)
+		require.Nil(t, config.RootCAs)
+	})
+
+	t.Run("custom config with lower minimum version", func(t *testing.T) {
+		custom := &tls.Config{ServerName: "broker.example.com"} // nolint:gosec // MinVersion is set by the option
+
+		config, err := (&dialConfig{tlsConfig: custom, tlsMinVersion: tls.VersionTLS12}).tls()
+		require.NoError(t, err)
+		require.NotSame(t, custom, config)
+		require.Equal(t, "broker.example.com", config.ServerName)
+		require.Equal(t, uint16(tls.VersionTLS12), config.MinVersion)
+		require.Zero(t, custom.MinVersion)
+	})
+
+	t.Run("CA bundle", func(t *testing.T) {
+		config, err := (&dialConfig{caFile: certFile}).tls()
+		require.NoError(t, err)
+		require.NotNil(t, config.RootCAs)
+		require.Empty(t, config.Certificates)
+	})
+
+	t.Run("failures", func(t *testing.T) {
+		_, err := (&dialConfig{certFile: certFile, keyFile: certFile}).tls()
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "invalid cert")
+
+		_, err = (&dialConfig{caFile: filepath.Join(t.TempDir(), "missing.pem")}).tls()
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "unable to read CA bundle")
+
+		_, err = (&dialConfig{caFile: keyFile}).tls()
+		require.EqualError(t, err, "no certificates found in CA bundle "+keyFile)
+	})
+}
+
+func TestExternalAuth(t *testing.T) {
+	require.Equal(t, "EXTERNAL", externalAuth{}.Mechanism())
+	require.Empty(t, externalAuth{}.Response())
+}
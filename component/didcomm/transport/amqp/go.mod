@@ -11,6 +11,9 @@ require (
 	github.com/hyperledger/aries-framework-go v0.1.6
 	github.com/ory/dockertest/v3 v3.6.2
 	github.com/pkg/errors v0.9.1
+	github.com/prometheus/client_golang v1.11.0
 	github.com/streadway/amqp v1.0.0
 	github.com/stretchr/testify v1.7.0
+	go.opentelemetry.io/otel v1.0.1
+	go.opentelemetry.io/otel/trace v1.0.1
 )
@@ -4,39 +4,338 @@ Copyright Scoir, Inc. All Rights Reserved.
 SPDX-License-Identifier: Apache-2.0
 */
 
-// Package amqp implements an inbound DIDComm transport for Aries (aries-framework-go).
-//
+// Package amqp implements inbound and outbound DIDComm transports for Aries (aries-framework-go).
 package amqp
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
+	"io"
+	"sync"
+	"time"
 
+	"github.com/cenkalti/backoff"
+	"github.com/google/uuid"
 	"github.com/hyperledger/aries-framework-go/pkg/common/log"
 	commtransport "github.com/hyperledger/aries-framework-go/pkg/didcomm/common/transport"
 	"github.com/hyperledger/aries-framework-go/pkg/didcomm/protocol/decorator"
 	"github.com/hyperledger/aries-framework-go/pkg/didcomm/transport"
+	"github.com/hyperledger/aries-framework-go/pkg/vdr/fingerprint"
 	"github.com/pkg/errors"
 	"github.com/streadway/amqp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
+const (
+	// RetryCountHeader is the message header holding the number of times a message has been retried after its
+	// processing failed. It is only used when consuming with manual acknowledgements (see WithManualAck).
+	RetryCountHeader = "x-aries-retry-count"
+	// FailureReasonHeader is set on messages published to the dead-letter exchange and holds the last processing error.
+	FailureReasonHeader = "x-aries-failure-reason"
+
+	defaultReconnectInitialInterval = 500 * time.Millisecond
+	defaultReconnectMaxInterval     = 30 * time.Second
+	defaultShutdownTimeout          = 30 * time.Second
+)
+
+// channel is the part of an AMQP channel used by the inbound transport.
+type channel interface {
+	publisher
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+	Cancel(consumer string, noWait bool) error
+	QueueInspect(name string) (amqp.Queue, error)
+	Qos(prefetchCount, prefetchSize int, global bool) error
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool,
+		args amqp.Table) (<-chan amqp.Delivery, error)
+}
+
+// topology describes the queue, exchange and bindings declared by the inbound transport.
+type topology struct {
+	durable         bool
+	queueArgs       amqp.Table
+	exchange        string
+	exchangeKind    string
+	exchangeDurable bool
+	bindingKeys     []string
+}
+
 // Inbound amqp type.
 type Inbound struct {
-	internalAddr      string
-	externalAddr      string
-	queueName         string
-	conn              *amqp.Connection
-	ch                *amqp.Channel
-	que               amqp.Queue
-	certFile, keyFile string
-	packager          commtransport.Packager
-	msgHandler        transport.InboundMessageHandler
-	logger            *log.Log
+	internalAddr             string
+	externalAddr             string
+	queueName                string
+	consumerTag              string
+	conn                     io.Closer
+	ch                       channel
+	que                      amqp.Queue
+	dialConfig               dialConfig
+	manualAck                bool
+	maxRetries               int
+	deadLetterExchange       string
+	deadLetterKey            string
+	topology                 topology
+	workers                  int
+	prefetchCount            int
+	senderOrdering           bool
+	reconnectInitialInterval time.Duration
+	reconnectMaxInterval     time.Duration
+	statusListener           func(status ConnectionStatus, cause error)
+	shutdownTimeout          time.Duration
+	status                   ConnectionStatus
+	stopped                  bool
+	cancel                   context.CancelFunc
+	done                     chan struct{}
+	open                     func() (*session, error)
+	lock                     sync.RWMutex
+	packager                 commtransport.Packager
+	msgHandler               transport.InboundMessageHandler
+	ctxMsgHandler            ContextMessageHandler
+	routes                   *replyRoutes
+	metrics                  Metrics
+	queueDepthInterval       time.Duration
+	tracer                   trace.Tracer
+	propagator               propagation.TextMapPropagator
+	logger                   *log.Log
+}
+
+// InboundOption configures an AMQP Inbound transport.
+type InboundOption func(opts *Inbound)
+
+// ContextMessageHandler handles the messages received by an Inbound transport, like a
+// transport.InboundMessageHandler. Its context carries the span that traces the handling of the message.
+type ContextMessageHandler func(ctx context.Context, message []byte, myDID, theirDID string) error
+
+// WithManualAck is an option for consuming messages with manual acknowledgements instead of auto-ack.
+// A message is only acknowledged once it has been unpacked and handled successfully. If either step fails, then the
+// message is published to the queue again with an incremented RetryCountHeader, up to maxRetries times. After that,
+// it is sent to the dead-letter exchange set with WithDeadLetterExchange or, if none is set, rejected without
+// requeueing so that the broker can apply its own dead-letter policy for the queue.
+func WithManualAck(maxRetries int) InboundOption {
+	return func(opts *Inbound) {
+		opts.manualAck = true
+		opts.maxRetries = maxRetries
+	}
+}
+
+// WithDeadLetterExchange is an option for setting the exchange that messages are published to once they have
+// exhausted their retries. If routingKey is blank, then the queue name is used as the routing key.
+// This option only has an effect together with WithManualAck.
+func WithDeadLetterExchange(exchange, routingKey string) InboundOption {
+	return func(opts *Inbound) {
+		opts.deadLetterExchange = exchange
+		opts.deadLetterKey = routingKey
+	}
+}
+
+// WithDurableQueue is an option for declaring the queue as durable so that it survives a broker restart.
+// Note that messages also need to be published as persistent in order to survive a restart.
+func WithDurableQueue() InboundOption {
+	return func(opts *Inbound) {
+		opts.topology.durable = true
+	}
+}
+
+// WithQuorumQueue is an option for declaring the queue as a durable, replicated quorum queue.
+func WithQuorumQueue() InboundOption {
+	return func(opts *Inbound) {
+		opts.topology.durable = true
+		opts.setQueueArg("x-queue-type", "quorum")
+	}
+}
+
+// WithQueueArgs is an option for passing additional arguments to the queue declaration, such as
+// "x-message-ttl", "x-max-length" or "x-dead-letter-exchange". These are merged with the arguments set by other
+// options.
+func WithQueueArgs(args amqp.Table) InboundOption {
+	return func(opts *Inbound) {
+		for k, v := range args {
+			opts.setQueueArg(k, v)
+		}
+	}
+}
+
+// WithMessageTTL is an option for setting how long messages may stay in the queue before the broker discards
+// (or dead-letters) them.
+func WithMessageTTL(ttl time.Duration) InboundOption {
+	return func(opts *Inbound) {
+		opts.setQueueArg("x-message-ttl", ttl.Milliseconds())
+	}
+}
+
+// WithMaxLength is an option for setting the maximum number of messages the queue holds.
+func WithMaxLength(maxLength int64) InboundOption {
+	return func(opts *Inbound) {
+		opts.setQueueArg("x-max-length", maxLength)
+	}
+}
+
+// WithQueueDeadLetterExchange is an option for declaring the queue with a broker-side dead-letter exchange, which
+// receives messages that expire, overflow the queue or are rejected without requeueing.
+// Unlike WithDeadLetterExchange, this is handled entirely by the broker.
+func WithQueueDeadLetterExchange(exchange string) InboundOption {
+	return func(opts *Inbound) {
+		opts.setQueueArg("x-dead-letter-exchange", exchange)
+	}
+}
+
+// WithExchange is an option for declaring an exchange of the given kind ("direct", "fanout", "topic" or "headers")
+// and binding the queue to it. See WithBindingKeys.
+func WithExchange(name, kind string, durable bool) InboundOption {
+	return func(opts *Inbound) {
+		opts.topology.exchange = name
+		opts.topology.exchangeKind = kind
+		opts.topology.exchangeDurable = durable
+	}
+}
+
+// WithBindingKeys is an option for setting the routing keys the queue is bound to the exchange with.
+// If not set, then the queue is bound using the queue name. This option only has an effect together with
+// WithExchange.
+func WithBindingKeys(keys ...string) InboundOption {
+	return func(opts *Inbound) {
+		opts.topology.bindingKeys = keys
+	}
+}
+
+// WithWorkers is an option for handling up to workers deliveries concurrently. Defaults to 1, which handles
+// deliveries one at a time in the order they are received. See WithSenderOrdering and WithPrefetchCount.
+func WithWorkers(workers int) InboundOption {
+	return func(opts *Inbound) {
+		opts.workers = workers
+	}
+}
+
+// WithPrefetchCount is an option for limiting how many unacknowledged deliveries the broker sends to this consumer
+// at a time. It only has an effect together with WithManualAck, and should be at least the number of workers to
+// keep all of them busy. By default, there is no limit.
+func WithPrefetchCount(prefetchCount int) InboundOption {
+	return func(opts *Inbound) {
+		opts.prefetchCount = prefetchCount
+	}
+}
+
+// WithSenderOrdering is an option for preserving the order of messages from the same sender (FromDID) when
+// handling deliveries with more than one worker. Messages from different senders are still handled concurrently.
+func WithSenderOrdering() InboundOption {
+	return func(opts *Inbound) {
+		opts.senderOrdering = true
+	}
+}
+
+// WithReconnectBackOff is an option for setting the exponential back-off used to reconnect to the AMQP server after
+// the connection is lost. Defaults to an initial interval of 500ms, growing up to 30s between attempts.
+func WithReconnectBackOff(initialInterval, maxInterval time.Duration) InboundOption {
+	return func(opts *Inbound) {
+		opts.reconnectInitialInterval = initialInterval
+		opts.reconnectMaxInterval = maxInterval
+	}
+}
+
+// WithStatusListener is an option for registering a function that is called whenever the connection status changes.
+// For Reconnecting, cause holds the error that caused the connection to be lost.
+// The listener is called synchronously and must not block.
+func WithStatusListener(listener func(status ConnectionStatus, cause error)) InboundOption {
+	return func(opts *Inbound) {
+		opts.statusListener = listener
+	}
+}
+
+// WithTLSConfig is an option for connecting with the given TLS configuration instead of the default one, for example
+// to set the server name or the root CAs to verify the server certificate against. The client certificate passed to
+// NewInbound, if any, is added to the configuration's certificates. TLS is only used for amqps:// URLs.
+func WithTLSConfig(config *tls.Config) InboundOption {
+	return func(opts *Inbound) {
+		opts.dialConfig.tlsConfig = config
+	}
+}
+
+// WithCACertFile is an option for verifying the server certificate against the CA certificates in the given PEM
+// bundle instead of the system's root CAs.
+func WithCACertFile(caFile string) InboundOption {
+	return func(opts *Inbound) {
+		opts.dialConfig.caFile = caFile
+	}
+}
+
+// WithTLSMinVersion is an option for the minimum TLS version to accept, for example tls.VersionTLS12 for servers
+// that do not support TLS 1.3. Defaults to TLS 1.3, unless a configuration set with WithTLSConfig says otherwise.
+func WithTLSMinVersion(version uint16) InboundOption {
+	return func(opts *Inbound) {
+		opts.dialConfig.tlsMinVersion = version
+	}
+}
+
+// WithExternalAuth is an option for authenticating with the SASL EXTERNAL mechanism, with which the server
+// identifies the client by its TLS certificate instead of the username and password in the URL. The server must
+// have this mechanism enabled, e.g. with the rabbitmq_auth_mechanism_ssl plugin.
+func WithExternalAuth() InboundOption {
+	return func(opts *Inbound) {
+		opts.dialConfig.externalAuth = true
+	}
+}
+
+// WithShutdownTimeout is an option for how long Stop waits for messages that are being handled to finish before it
+// closes the connection anyway. Defaults to 30 seconds. See Shutdown for setting a deadline per call.
+func WithShutdownTimeout(timeout time.Duration) InboundOption {
+	return func(opts *Inbound) {
+		opts.shutdownTimeout = timeout
+	}
+}
+
+// WithMetrics is an option for reporting measurements of the messages received by the transport, e.g. to Prometheus
+// with NewPrometheusMetrics. By default, no measurements are taken.
+func WithMetrics(metrics Metrics) InboundOption {
+	return func(opts *Inbound) {
+		opts.metrics = metrics
+	}
+}
+
+// WithQueueDepthInterval is an option for how often the number of messages waiting in the queue is reported to the
+// Metrics set with WithMetrics. By default, it is only reported when the queue is declared.
+func WithQueueDepthInterval(interval time.Duration) InboundOption {
+	return func(opts *Inbound) {
+		opts.queueDepthInterval = interval
+	}
+}
+
+// WithTracerProvider is an option for the OpenTelemetry tracer provider used to trace the handling of messages.
+// Defaults to the global tracer provider.
+func WithTracerProvider(provider trace.TracerProvider) InboundOption {
+	return func(opts *Inbound) {
+		opts.tracer = provider.Tracer(tracerName)
+	}
+}
+
+// WithPropagator is an option for the OpenTelemetry propagator used to read the trace context from the headers of
+// received messages, so that their handling is traced as part of the trace they were sent in. Defaults to the global
+// propagator.
+func WithPropagator(propagator propagation.TextMapPropagator) InboundOption {
+	return func(opts *Inbound) {
+		opts.propagator = propagator
+	}
+}
+
+// WithContextMessageHandler is an option for handling received messages with handler instead of the provider's
+// inbound message handler, so that the handling can be traced as part of the trace the messages were sent in, e.g. by
+// starting spans from the handler's context.
+func WithContextMessageHandler(handler ContextMessageHandler) InboundOption {
+	return func(opts *Inbound) {
+		opts.ctxMsgHandler = handler
+	}
 }
 
 // NewInbound creates a new AMQP inbound transport instance.
-func NewInbound(amqpServerURL, externalAddr, queueName, certFile, keyFile string) (*Inbound, error) {
+// By default, a non-durable queue named queueName is declared and consumed with auto-ack. Options can be used to
+// change the queue topology, how messages are acknowledged and how the connection is managed.
+func NewInbound(amqpServerURL, externalAddr, queueName, certFile, keyFile string,
+	opts ...InboundOption) (*Inbound, error) {
 	if amqpServerURL == "" {
 		return nil, errors.New("AMQP URL is mandatory")
 	}
@@ -45,140 +344,715 @@ func NewInbound(amqpServerURL, externalAddr, queueName, certFile, keyFile string
 		return nil, errors.New("external address is mandatory")
 	}
 
-	return &Inbound{
-		certFile:     certFile,
-		keyFile:      keyFile,
+	i := &Inbound{
+		dialConfig:   dialConfig{certFile: certFile, keyFile: keyFile},
 		internalAddr: amqpServerURL,
 		externalAddr: externalAddr,
 		queueName:    queueName,
+		consumerTag:  uuid.New().String(),
 		logger:       log.New("aries-framework/transport/amqp"),
-	}, nil
+	}
+
+	i.open = i.openSession
+
+	for _, opt := range opts {
+		opt(i)
+	}
+
+	if i.metrics == nil {
+		i.metrics = noopMetrics{}
+	}
+
+	if i.tracer == nil {
+		i.tracer = otel.GetTracerProvider().Tracer(tracerName)
+	}
+
+	if i.propagator == nil {
+		i.propagator = otel.GetTextMapPropagator()
+	}
+
+	if i.reconnectInitialInterval <= 0 {
+		i.reconnectInitialInterval = defaultReconnectInitialInterval
+	}
+
+	if i.reconnectMaxInterval <= 0 {
+		i.reconnectMaxInterval = defaultReconnectMaxInterval
+	}
+
+	if i.reconnectMaxInterval < i.reconnectInitialInterval {
+		i.reconnectMaxInterval = i.reconnectInitialInterval
+	}
+
+	if i.shutdownTimeout <= 0 {
+		i.shutdownTimeout = defaultShutdownTimeout
+	}
+
+	if i.maxRetries < 0 {
+		i.maxRetries = 0
+	}
+
+	if i.deadLetterExchange != "" && i.deadLetterKey == "" {
+		i.deadLetterKey = queueName
+	}
+
+	return i, nil
+}
+
+func (i *Inbound) setQueueArg(key string, value interface{}) {
+	if i.topology.queueArgs == nil {
+		i.topology.queueArgs = amqp.Table{}
+	}
+
+	i.topology.queueArgs[key] = value
 }
 
 // Start the AMQP message loop.
+// If the connection to the AMQP server is lost after starting, then the transport reconnects in the background,
+// declares the queue again and resumes consuming. See WithReconnectBackOff and WithStatusListener.
 func (i *Inbound) Start(prov transport.Provider) error {
 	if prov == nil || prov.InboundMessageHandler() == nil {
 		return errors.New("creation of inbound handler failed")
 	}
 
-	conn, err := i.connection()
+	s, msgs, err := i.connect()
 	if err != nil {
 		return err
 	}
 
+	i.packager = prov.Packager()
+	i.msgHandler = prov.InboundMessageHandler()
+	i.routes = getReplyRoutes(prov.AriesFrameworkID())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	i.lock.Lock()
+	i.conn = s.conn
+	i.ch = s.ch
+	i.stopped = false
+	i.cancel = cancel
+	i.done = done
+	i.lock.Unlock()
+
+	i.setStatus(Connected, nil)
+
+	go func() {
+		defer close(done)
+
+		i.run(ctx, s, msgs)
+	}()
+
+	if i.queueDepthInterval > 0 {
+		go i.monitorQueue(ctx)
+	}
+
+	return nil
+}
+
+// Status returns the current state of the connection to the AMQP server.
+func (i *Inbound) Status() ConnectionStatus {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	return i.status
+}
+
+func (i *Inbound) connection() (*amqp.Connection, error) {
+	return dial(i.internalAddr, &i.dialConfig)
+}
+
+// openSession connects to the AMQP server, opens a channel and declares the queue.
+func (i *Inbound) openSession() (*session, error) {
+	conn, err := i.connection()
+	if err != nil {
+		return nil, err
+	}
+
 	ch, err := conn.Channel()
 	if err != nil {
-		return errors.Wrap(err, "unable to get channel")
+		closeSession(&session{conn: conn}, i.logger)
+
+		return nil, errors.Wrap(err, "unable to get channel")
+	}
+
+	s := &session{
+		conn:       conn,
+		ch:         ch,
+		connClosed: conn.NotifyClose(make(chan *amqp.Error, 1)),
+		chClosed:   ch.NotifyClose(make(chan *amqp.Error, 1)),
+	}
+
+	err = i.prepare(ch)
+	if err != nil {
+		closeSession(s, i.logger)
+
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// prepare sets the channel's prefetch count and declares the topology.
+func (i *Inbound) prepare(ch channel) error {
+	if i.prefetchCount > 0 {
+		err := ch.Qos(i.prefetchCount, 0, false)
+		if err != nil {
+			return errors.Wrap(err, "unable to set prefetch count")
+		}
+	}
+
+	return i.declare(ch)
+}
+
+// declare declares the queue, and the exchange and bindings if configured.
+func (i *Inbound) declare(ch channel) error {
+	t := i.topology
+
+	if t.exchange != "" {
+		err := ch.ExchangeDeclare(
+			t.exchange,        // name
+			t.exchangeKind,    // kind
+			t.exchangeDurable, // durable
+			false,             // delete when unused
+			false,             // internal
+			false,             // no-wait
+			nil,               // arguments
+		)
+		if err != nil {
+			return errors.Wrapf(err, "unable to declare exchange %s", t.exchange)
+		}
 	}
 
 	q, err := ch.QueueDeclare(
 		i.queueName, // name
-		false,       // durable
+		t.durable,   // durable
 		false,       // delete when unused
 		false,       // exclusive
 		false,       // no-wait
-		nil,         // arguments
+		t.queueArgs, // arguments
 	)
 	if err != nil {
 		return errors.Wrap(err, "unable to declare queue")
 	}
 
-	i.conn = conn
-	i.ch = ch
 	i.que = q
-	i.packager = prov.Packager()
-	i.msgHandler = prov.InboundMessageHandler()
+	i.metrics.QueueDepth(i.queueName, q.Messages)
 
-	go func() {
-		if err := i.listenAndServe(); err != nil {
-			i.logger.Fatalf("AMQP start with address [%s] failed, cause:  %v", i.externalAddr, err)
+	if t.exchange == "" {
+		return nil
+	}
+
+	bindingKeys := t.bindingKeys
+	if len(bindingKeys) == 0 {
+		bindingKeys = []string{i.queueName}
+	}
+
+	for _, key := range bindingKeys {
+		err = ch.QueueBind(i.queueName, key, t.exchange, false, nil)
+		if err != nil {
+			return errors.Wrapf(err, "unable to bind queue to exchange %s with key %s", t.exchange, key)
 		}
-	}()
+	}
 
 	return nil
 }
 
-func (i *Inbound) connection() (*amqp.Connection, error) {
-	var conn *amqp.Connection
+func (i *Inbound) connect() (*session, <-chan amqp.Delivery, error) {
+	s, err := i.open()
+	if err != nil {
+		return nil, nil, err
+	}
 
-	var err error
+	msgs, err := i.consume(s.ch)
+	if err != nil {
+		closeSession(s, i.logger)
 
-	if i.certFile != "" && i.keyFile != "" {
-		config := &tls.Config{MinVersion: tls.VersionTLS13}
-		config.Certificates = make([]tls.Certificate, 1)
+		return nil, nil, err
+	}
 
-		config.Certificates[0], err = tls.LoadX509KeyPair(i.certFile, i.keyFile)
-		if err != nil {
-			return nil, errors.Wrap(err, "invalid cert")
+	return s, msgs, nil
+}
+
+func (i *Inbound) consume(ch channel) (<-chan amqp.Delivery, error) {
+	msgs, err := ch.Consume(
+		i.queueName,   // queue
+		i.consumerTag, // consumer
+		!i.manualAck,  // auto-ack
+		false,         // exclusive
+		false,         // no-local
+		false,         // no-wait
+		nil,           // args
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to consume")
+	}
+
+	return msgs, nil
+}
+
+// run serves deliveries until the transport is stopped, reconnecting whenever the session is lost.
+func (i *Inbound) run(ctx context.Context, s *session, msgs <-chan amqp.Delivery) {
+	for {
+		i.serve(msgs)
+
+		if ctx.Err() != nil {
+			return
 		}
 
-		conn, err = amqp.DialTLS(i.internalAddr, config)
+		cause := s.closeReason()
+
+		i.logger.Warnf("AMQP connection to [%s] lost, reconnecting: %v", i.externalAddr, cause)
+		i.setStatus(Reconnecting, cause)
+
+		closeSession(s, i.logger)
+
+		var err error
+
+		s, msgs, err = i.reconnect(ctx)
 		if err != nil {
-			return nil, errors.Wrap(err, "unable to connect to AMQP server")
+			return
 		}
-	} else {
-		conn, err = amqp.Dial(i.internalAddr)
-		if err != nil {
-			return nil, errors.Wrapf(err, "unable to connect to AMQP server at %s", i.internalAddr)
+
+		i.lock.Lock()
+
+		if i.stopped {
+			i.lock.Unlock()
+			closeSession(s, i.logger)
+
+			return
 		}
+
+		i.conn = s.conn
+		i.ch = s.ch
+		i.lock.Unlock()
+
+		i.logger.Infof("AMQP connection to [%s] re-established", i.externalAddr)
+		i.setStatus(Connected, nil)
 	}
+}
+
+// monitorQueue reports the number of messages waiting in the queue periodically until ctx is cancelled.
+func (i *Inbound) monitorQueue(ctx context.Context) {
+	ticker := time.NewTicker(i.queueDepthInterval)
+	defer ticker.Stop()
 
-	return conn, nil
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			i.lock.RLock()
+			ch := i.ch
+			i.lock.RUnlock()
+
+			q, err := ch.QueueInspect(i.queueName)
+			if err != nil {
+				i.logger.Debugf("unable to inspect queue %s: %v", i.queueName, err)
+
+				continue
+			}
+
+			i.metrics.QueueDepth(i.queueName, q.Messages)
+		}
+	}
 }
 
-func (i *Inbound) listenAndServe() error {
-	msgs, err := i.ch.Consume(
-		i.queueName, // queue
-		"",          // consumer
-		true,        // auto-ack
-		false,       // exclusive
-		false,       // no-local
-		false,       // no-wait
-		nil,         // args
+// reconnect retries connecting with an exponential back-off until it succeeds or ctx is cancelled.
+func (i *Inbound) reconnect(ctx context.Context) (*session, <-chan amqp.Delivery, error) {
+	var (
+		s    *session
+		msgs <-chan amqp.Delivery
 	)
+
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = i.reconnectInitialInterval
+	b.MaxInterval = i.reconnectMaxInterval
+	b.MaxElapsedTime = 0
+
+	err := backoff.RetryNotify(func() error {
+		var err error
+
+		s, msgs, err = i.connect()
+
+		return err
+	}, backoff.WithContext(b, ctx), func(err error, wait time.Duration) {
+		i.logger.Warnf("AMQP reconnect to [%s] failed, retrying in %s: %v", i.externalAddr, wait, err)
+	})
 	if err != nil {
-		return errors.Wrap(err, "unable to consume")
+		return nil, nil, err
+	}
+
+	return s, msgs, nil
+}
+
+// serve handles deliveries until msgs is closed and all handlers have returned.
+// With a single worker, deliveries are handled one at a time in order. With more workers, they share a single queue
+// of deliveries unless sender ordering is enabled, in which case each delivery is unpacked first and routed to a
+// worker picked by its sender DID, so that deliveries from the same sender are handled in order.
+func (i *Inbound) serve(msgs <-chan amqp.Delivery) {
+	if i.workers <= 1 {
+		for d := range msgs {
+			i.handleDelivery(&job{delivery: d})
+		}
+
+		return
+	}
+
+	queues := make([]chan *job, 1)
+	if i.senderOrdering {
+		queues = make([]chan *job, i.workers)
+	}
+
+	for n := range queues {
+		queues[n] = make(chan *job)
+	}
+
+	var wg sync.WaitGroup
+
+	for n := 0; n < i.workers; n++ {
+		wg.Add(1)
+
+		go func(jobs <-chan *job) {
+			defer wg.Done()
+
+			for j := range jobs {
+				i.handleDelivery(j)
+			}
+		}(queues[n%len(queues)])
 	}
 
 	for d := range msgs {
-		message := d.Body
+		j := &job{delivery: d}
 
-		unpackMsg, err := i.packager.UnpackMessage(message)
-		if err != nil {
-			i.logger.Errorf("failed to unpack msg: %v", err)
+		queue := queues[0]
+
+		if i.senderOrdering {
+			i.unpack(j)
 
-			continue
+			queue = queues[workerFor(j.envelope, len(queues))]
 		}
 
-		trans := &decorator.Transport{}
+		queue <- j
+	}
 
-		err = json.Unmarshal(unpackMsg.Message, trans)
-		if err != nil {
-			i.logger.Errorf("unmarshal transport decorator : %v", err)
-		}
+	for _, queue := range queues {
+		close(queue)
+	}
 
-		messageHandler := i.msgHandler
+	wg.Wait()
+}
 
-		err = messageHandler(unpackMsg.Message, unpackMsg.ToDID, unpackMsg.FromDID)
-		if err != nil {
-			i.logger.Errorf("incoming msg processing failed: %v", err)
+func (i *Inbound) setStatus(status ConnectionStatus, cause error) {
+	i.lock.Lock()
+	i.status = status
+	i.lock.Unlock()
+
+	if i.statusListener != nil {
+		i.statusListener(status, cause)
+	}
+}
+
+// job is a delivery waiting to be handled. The delivery is unpacked by the worker handling it, unless it has been
+// unpacked already in order to pick that worker.
+type job struct {
+	delivery amqp.Delivery
+	unpacked bool
+	envelope *commtransport.Envelope
+	err      error
+}
+
+func (i *Inbound) handleDelivery(j *job) {
+	err := i.processMessage(j)
+
+	if !i.manualAck {
+		return
+	}
+
+	d := j.delivery
+
+	if err == nil {
+		if errAck := d.Ack(false); errAck != nil {
+			i.logger.Errorf("failed to ack msg: %v", errAck)
 		}
+
+		return
+	}
+
+	retries := retryCount(d.Headers)
+	if retries < i.maxRetries {
+		i.retry(d, retries+1)
+
+		return
+	}
+
+	i.deadLetter(d, err)
+}
+
+func (i *Inbound) unpack(j *job) {
+	if j.unpacked {
+		return
+	}
+
+	j.unpacked = true
+
+	j.envelope, j.err = i.packager.UnpackMessage(j.delivery.Body)
+	if j.err != nil {
+		i.logger.Errorf("failed to unpack msg: %v", j.err)
+	}
+}
+
+func (i *Inbound) processMessage(j *job) error {
+	i.metrics.MessageReceived(i.queueName)
+
+	ctx, span := i.startSpan(j.delivery)
+	defer span.End()
+
+	i.unpack(j)
+
+	if j.err != nil {
+		i.metrics.UnpackFailed(i.queueName)
+		recordError(span, j.err)
+
+		return j.err
+	}
+
+	unpackMsg := j.envelope
+
+	trans := &decorator.Transport{}
+
+	err := json.Unmarshal(unpackMsg.Message, trans)
+	if err != nil {
+		i.logger.Errorf("unmarshal transport decorator : %v", err)
+	}
+
+	i.addReplyRoute(j.delivery, unpackMsg, trans)
+
+	start := time.Now()
+
+	err = i.handleMessage(ctx, unpackMsg)
+
+	i.metrics.MessageHandled(i.queueName, time.Since(start))
+
+	if err != nil {
+		i.logger.Errorf("incoming msg processing failed: %v", err)
+		i.metrics.HandlerFailed(i.queueName)
+		recordError(span, err)
+
+		return err
 	}
 
 	return nil
 }
 
+// handleMessage passes an unpacked message to the handler set with WithContextMessageHandler, if any, or else to the
+// provider's inbound message handler.
+func (i *Inbound) handleMessage(ctx context.Context, envelope *commtransport.Envelope) error {
+	if i.ctxMsgHandler != nil {
+		return i.ctxMsgHandler(ctx, envelope.Message, envelope.ToDID, envelope.FromDID)
+	}
+
+	return i.msgHandler(envelope.Message, envelope.ToDID, envelope.FromDID)
+}
+
+// addReplyRoute remembers the queue to send responses to if the message asks for them to be returned on the route it
+// came in on, so that the Outbound transport can send them there. Only the "all" return route option is supported.
+func (i *Inbound) addReplyRoute(d amqp.Delivery, envelope *commtransport.Envelope, trans *decorator.Transport) {
+	if d.ReplyTo == "" || len(envelope.FromKey) == 0 || i.routes == nil {
+		return
+	}
+
+	if trans.ReturnRoute == nil || trans.ReturnRoute.Value != decorator.TransportReturnRouteAll {
+		return
+	}
+
+	didKey, _ := fingerprint.CreateDIDKey(envelope.FromKey)
+
+	i.routes.add(didKey, &replyRoute{inbound: i, replyTo: d.ReplyTo, correlationID: d.CorrelationId})
+}
+
+// publish publishes a message on the current channel.
+func (i *Inbound) publish(exchange, key string, msg amqp.Publishing) error {
+	i.lock.RLock()
+	ch := i.ch
+	i.lock.RUnlock()
+
+	if ch == nil {
+		return errors.New("inbound transport is not started")
+	}
+
+	return ch.Publish(exchange, key, false, false, msg)
+}
+
+// retry publishes a copy of the delivery back to the queue with the given retry count and acks the original.
+// Nack with requeue can't be used for this since it doesn't allow the headers to be changed.
+func (i *Inbound) retry(d amqp.Delivery, retries int) {
+	msg := publishingFromDelivery(d)
+	msg.Headers[RetryCountHeader] = int32(retries)
+
+	err := i.publish("", i.queueName, msg)
+	if err != nil {
+		i.logger.Errorf("failed to republish msg for retry %d: %v", retries, err)
+		i.nack(d, true)
+
+		return
+	}
+
+	i.metrics.MessageRetried(i.queueName)
+
+	if err = d.Ack(false); err != nil {
+		i.logger.Errorf("failed to ack msg after republishing it: %v", err)
+	}
+}
+
+func (i *Inbound) deadLetter(d amqp.Delivery, cause error) {
+	if i.deadLetterExchange == "" {
+		i.logger.Warnf("msg failed after %d retries, rejecting it", i.maxRetries)
+		i.metrics.MessageDeadLettered(i.queueName)
+		i.nack(d, false)
+
+		return
+	}
+
+	msg := publishingFromDelivery(d)
+	msg.Headers[FailureReasonHeader] = cause.Error()
+
+	err := i.publish(i.deadLetterExchange, i.deadLetterKey, msg)
+	if err != nil {
+		i.logger.Errorf("failed to publish msg to dead-letter exchange %s: %v", i.deadLetterExchange, err)
+		i.nack(d, true)
+
+		return
+	}
+
+	i.logger.Warnf("msg failed after %d retries, sent to dead-letter exchange %s", i.maxRetries,
+		i.deadLetterExchange)
+	i.metrics.MessageDeadLettered(i.queueName)
+
+	if err = d.Ack(false); err != nil {
+		i.logger.Errorf("failed to ack msg after dead-lettering it: %v", err)
+	}
+}
+
+func (i *Inbound) nack(d amqp.Delivery, requeue bool) {
+	if err := d.Nack(false, requeue); err != nil {
+		i.logger.Errorf("failed to nack msg: %v", err)
+	}
+}
+
+func retryCount(headers amqp.Table) int {
+	switch v := headers[RetryCountHeader].(type) {
+	case int:
+		return v
+	case int16:
+		return int(v)
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	default:
+		return 0
+	}
+}
+
+// workerFor picks the worker for an envelope by hashing its sender DID. Envelopes that could not be unpacked all go
+// to the same worker.
+func workerFor(envelope *commtransport.Envelope, workers int) int {
+	var fromDID string
+
+	if envelope != nil {
+		fromDID = envelope.FromDID
+	}
+
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(fromDID)) // nolint:errcheck // hash.Hash never returns an error
+
+	return int(h.Sum32() % uint32(workers))
+}
+
+func publishingFromDelivery(d amqp.Delivery) amqp.Publishing {
+	headers := amqp.Table{}
+
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+
+	return amqp.Publishing{
+		Headers:         headers,
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		DeliveryMode:    d.DeliveryMode,
+		Priority:        d.Priority,
+		CorrelationId:   d.CorrelationId,
+		ReplyTo:         d.ReplyTo,
+		Expiration:      d.Expiration,
+		MessageId:       d.MessageId,
+		Timestamp:       d.Timestamp,
+		Type:            d.Type,
+		UserId:          d.UserId,
+		AppId:           d.AppId,
+		Body:            d.Body,
+	}
+}
+
 // Stop the AMQP message loop.
+// Stop waits up to the timeout set with WithShutdownTimeout for messages that are being handled to finish. See
+// Shutdown.
 func (i *Inbound) Stop() error {
-	if err := i.ch.Close(); err != nil {
+	ctx, cancel := context.WithTimeout(context.Background(), i.shutdownTimeout)
+	defer cancel()
+
+	return i.Shutdown(ctx)
+}
+
+// Shutdown stops the AMQP message loop gracefully. The consumer is cancelled first so that the server stops sending
+// messages, then Shutdown waits for the messages that have already been received to be handled before it closes the
+// channel and connection. If ctx is done before that, then the channel and connection are closed anyway and the
+// context's error is returned; messages that were not acknowledged yet are redelivered by the server later.
+// Shutdown does nothing if the transport is not started.
+func (i *Inbound) Shutdown(ctx context.Context) error {
+	i.lock.Lock()
+
+	if i.stopped || i.cancel == nil {
+		i.lock.Unlock()
+
+		return nil
+	}
+
+	i.stopped = true
+	i.cancel()
+
+	ch, done := i.ch, i.done
+	i.lock.Unlock()
+
+	defer i.setStatus(Disconnected, nil)
+
+	i.routes.removeInbound(i)
+
+	if err := ch.Cancel(i.consumerTag, false); err != nil {
+		i.logger.Debugf("consumer cancellation failed: %v", err)
+	}
+
+	var errWait error
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		errWait = errors.Wrap(ctx.Err(), "timed out waiting for messages to be handled")
+	}
+
+	i.lock.RLock()
+	conn, ch := i.conn, i.ch
+	i.lock.RUnlock()
+
+	if err := ch.Close(); err != nil && !errors.Is(err, amqp.ErrClosed) {
 		return fmt.Errorf("channel shutdown failed: %w", err)
 	}
 
-	if err := i.conn.Close(); err != nil {
+	if err := conn.Close(); err != nil && !errors.Is(err, amqp.ErrClosed) {
 		return fmt.Errorf("connection shutdown failed: %w", err)
 	}
 
-	return nil
+	return errWait
 }
 
 // Endpoint provides the AMQP connection details.
@@ -0,0 +1,748 @@
+/*
+Copyright Scoir, Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package amqp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	commontransport "github.com/hyperledger/aries-framework-go/pkg/didcomm/common/transport"
+	"github.com/hyperledger/aries-framework-go/pkg/didcomm/transport"
+	mockpackager "github.com/hyperledger/aries-framework-go/pkg/mock/didcomm/packager"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/require"
+)
+
+type mockAcknowledger struct {
+	lock    sync.Mutex
+	acked   []uint64
+	nacked  []uint64
+	requeue []bool
+	errAck  error
+}
+
+func (m *mockAcknowledger) Ack(tag uint64, _ bool) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.acked = append(m.acked, tag)
+
+	return m.errAck
+}
+
+func (m *mockAcknowledger) Nack(tag uint64, _, requeue bool) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.nacked = append(m.nacked, tag)
+	m.requeue = append(m.requeue, requeue)
+
+	return nil
+}
+
+func (m *mockAcknowledger) Reject(tag uint64, requeue bool) error {
+	return m.Nack(tag, false, requeue)
+}
+
+// mockChannel is an in-process stand-in for an AMQP channel.
+type mockChannel struct {
+	mockPublisher
+	deliveries chan amqp.Delivery
+	errConsume error
+	autoAck    bool
+	closeOnce  sync.Once
+
+	exchanges  []declaredExchange
+	queues     []declaredQueue
+	bindings   []string
+	errDeclare error
+	errBind    error
+	prefetch   int
+	errQos     error
+	consumer   string
+	cancelled  []string
+	messages   int
+	errInspect error
+}
+
+type declaredExchange struct {
+	name, kind string
+	durable    bool
+}
+
+type declaredQueue struct {
+	name    string
+	durable bool
+	args    amqp.Table
+}
+
+func (m *mockChannel) ExchangeDeclare(name, kind string, durable, _, _, _ bool, _ amqp.Table) error {
+	m.exchanges = append(m.exchanges, declaredExchange{name: name, kind: kind, durable: durable})
+
+	return m.errDeclare
+}
+
+func (m *mockChannel) QueueDeclare(name string, durable, _, _, _ bool, args amqp.Table) (amqp.Queue, error) {
+	m.queues = append(m.queues, declaredQueue{name: name, durable: durable, args: args})
+
+	return amqp.Queue{Name: name}, m.errDeclare
+}
+
+func (m *mockChannel) QueueBind(name, key, exchange string, _ bool, _ amqp.Table) error {
+	m.bindings = append(m.bindings, exchange+"->"+name+":"+key)
+
+	return m.errBind
+}
+
+func (m *mockChannel) QueueInspect(name string) (amqp.Queue, error) {
+	return amqp.Queue{Name: name, Messages: m.messages}, m.errInspect
+}
+
+func (m *mockChannel) Qos(prefetchCount, _ int, _ bool) error {
+	m.prefetch = prefetchCount
+
+	return m.errQos
+}
+
+func (m *mockChannel) Consume(_, consumer string, autoAck, _, _, _ bool, _ amqp.Table) (<-chan amqp.Delivery, error) {
+	m.consumer = consumer
+	m.autoAck = autoAck
+
+	return m.deliveries, m.errConsume
+}
+
+// Cancel closes the deliveries channel the same way the AMQP client does when a consumer is cancelled.
+func (m *mockChannel) Cancel(consumer string, _ bool) error {
+	m.cancelled = append(m.cancelled, consumer)
+	m.closeDeliveries()
+
+	return nil
+}
+
+// Close closes the deliveries channel the same way the AMQP client does when a channel is closed.
+func (m *mockChannel) Close() error {
+	m.closeDeliveries()
+
+	return m.mockPublisher.Close()
+}
+
+func (m *mockChannel) closeDeliveries() {
+	m.closeOnce.Do(func() {
+		close(m.deliveries)
+	})
+}
+
+type mockConn struct {
+	closed bool
+}
+
+func (m *mockConn) Close() error {
+	m.closed = true
+
+	return nil
+}
+
+type mockProvider struct{}
+
+func (p *mockProvider) InboundMessageHandler() transport.InboundMessageHandler {
+	return func([]byte, string, string) error {
+		return nil
+	}
+}
+
+func (p *mockProvider) Packager() commontransport.Packager {
+	return &mockpackager.Packager{UnpackValue: &commontransport.Envelope{Message: []byte("data")}}
+}
+
+func (p *mockProvider) AriesFrameworkID() string {
+	return "framework-id"
+}
+
+func newMockSession() (*session, *mockChannel, chan *amqp.Error) {
+	ch := &mockChannel{deliveries: make(chan amqp.Delivery, 10)}
+	connClosed := make(chan *amqp.Error, 1)
+
+	return &session{conn: &mockConn{}, ch: ch, connClosed: connClosed}, ch, connClosed
+}
+
+func newTestInbound(t *testing.T, handlerErr error, opts ...InboundOption) (*Inbound, *mockChannel) {
+	t.Helper()
+
+	i, err := NewInbound("amqp://example.com", "http://example.com", "queue", "", "", opts...)
+	require.NoError(t, err)
+
+	ch := &mockChannel{deliveries: make(chan amqp.Delivery, 10)}
+
+	i.ch = ch
+	i.packager = &mockpackager.Packager{UnpackValue: &commontransport.Envelope{Message: []byte("data")}}
+	i.msgHandler = func([]byte, string, string) error {
+		return handlerErr
+	}
+
+	return i, ch
+}
+
+func TestInbound_ManualAck(t *testing.T) {
+	t.Run("auto-ack by default", func(t *testing.T) {
+		i, ch := newTestInbound(t, errors.New("handler failed"))
+		ack := &mockAcknowledger{}
+
+		ch.deliveries <- amqp.Delivery{Acknowledger: ack, DeliveryTag: 1}
+		ch.closeDeliveries()
+
+		msgs, err := i.consume(ch)
+		require.NoError(t, err)
+		i.serve(msgs)
+
+		require.True(t, ch.autoAck)
+		require.Empty(t, ack.acked)
+		require.Empty(t, ack.nacked)
+		require.Empty(t, ch.published)
+	})
+
+	t.Run("ack after successful handling", func(t *testing.T) {
+		i, ch := newTestInbound(t, nil, WithManualAck(3))
+		ack := &mockAcknowledger{}
+
+		ch.deliveries <- amqp.Delivery{Acknowledger: ack, DeliveryTag: 1}
+		ch.deliveries <- amqp.Delivery{Acknowledger: ack, DeliveryTag: 2}
+		ch.closeDeliveries()
+
+		msgs, err := i.consume(ch)
+		require.NoError(t, err)
+		i.serve(msgs)
+
+		require.False(t, ch.autoAck)
+		require.Equal(t, []uint64{1, 2}, ack.acked)
+		require.Empty(t, ack.nacked)
+	})
+
+	t.Run("failed message is republished with an incremented retry count", func(t *testing.T) {
+		i, ch := newTestInbound(t, errors.New("handler failed"), WithManualAck(3))
+		ack := &mockAcknowledger{}
+
+		i.handleDelivery(&job{delivery: amqp.Delivery{
+			Acknowledger: ack, DeliveryTag: 1, Body: []byte("msg"), CorrelationId: "id",
+			Headers: amqp.Table{RetryCountHeader: int32(1), "other": "value"},
+		}})
+
+		require.Equal(t, []uint64{1}, ack.acked)
+		require.Len(t, ch.published, 1)
+		require.Equal(t, "", ch.published[0].exchange)
+		require.Equal(t, "queue", ch.published[0].key)
+		require.Equal(t, int32(2), ch.published[0].msg.Headers[RetryCountHeader])
+		require.Equal(t, "value", ch.published[0].msg.Headers["other"])
+		require.Equal(t, "id", ch.published[0].msg.CorrelationId)
+		require.Equal(t, []byte("msg"), ch.published[0].msg.Body)
+	})
+
+	t.Run("unpack failure is retried", func(t *testing.T) {
+		i, ch := newTestInbound(t, nil, WithManualAck(1))
+		i.packager = &mockpackager.Packager{UnpackErr: errors.New("unpack failed")}
+		ack := &mockAcknowledger{}
+
+		i.handleDelivery(&job{delivery: amqp.Delivery{Acknowledger: ack, DeliveryTag: 1}})
+
+		require.Equal(t, []uint64{1}, ack.acked)
+		require.Len(t, ch.published, 1)
+		require.Equal(t, int32(1), ch.published[0].msg.Headers[RetryCountHeader])
+	})
+
+	t.Run("message is requeued if republishing fails", func(t *testing.T) {
+		i, ch := newTestInbound(t, errors.New("handler failed"), WithManualAck(3))
+		ch.errPublish = errors.New("publish failed")
+		ack := &mockAcknowledger{}
+
+		i.handleDelivery(&job{delivery: amqp.Delivery{Acknowledger: ack, DeliveryTag: 1}})
+
+		require.Empty(t, ack.acked)
+		require.Equal(t, []uint64{1}, ack.nacked)
+		require.Equal(t, []bool{true}, ack.requeue)
+	})
+
+	t.Run("exhausted message is sent to the dead-letter exchange", func(t *testing.T) {
+		i, ch := newTestInbound(t, errors.New("handler failed"), WithManualAck(2),
+			WithDeadLetterExchange("dlx", ""))
+		ack := &mockAcknowledger{}
+
+		i.handleDelivery(&job{delivery: amqp.Delivery{
+			Acknowledger: ack, DeliveryTag: 1, Headers: amqp.Table{RetryCountHeader: int64(2)},
+		}})
+
+		require.Equal(t, []uint64{1}, ack.acked)
+		require.Len(t, ch.published, 1)
+		require.Equal(t, "dlx", ch.published[0].exchange)
+		require.Equal(t, "queue", ch.published[0].key)
+		require.Equal(t, "handler failed", ch.published[0].msg.Headers[FailureReasonHeader])
+	})
+
+	t.Run("exhausted message is requeued if dead-lettering fails", func(t *testing.T) {
+		i, ch := newTestInbound(t, errors.New("handler failed"), WithManualAck(0),
+			WithDeadLetterExchange("dlx", "poison"))
+		ch.errPublish = errors.New("publish failed")
+		ack := &mockAcknowledger{}
+
+		i.handleDelivery(&job{delivery: amqp.Delivery{Acknowledger: ack, DeliveryTag: 1}})
+
+		require.Empty(t, ack.acked)
+		require.Equal(t, []bool{true}, ack.requeue)
+	})
+
+	t.Run("exhausted message is rejected without a dead-letter exchange", func(t *testing.T) {
+		i, ch := newTestInbound(t, errors.New("handler failed"), WithManualAck(-1))
+		ack := &mockAcknowledger{}
+
+		i.handleDelivery(&job{delivery: amqp.Delivery{Acknowledger: ack, DeliveryTag: 1}})
+
+		require.Empty(t, ack.acked)
+		require.Empty(t, ch.published)
+		require.Equal(t, []uint64{1}, ack.nacked)
+		require.Equal(t, []bool{false}, ack.requeue)
+	})
+
+	t.Run("message is requeued if the channel is gone", func(t *testing.T) {
+		// The message is retried with the first options, and dead-lettered with the second.
+		for _, opts := range [][]InboundOption{
+			{WithManualAck(1)},
+			{WithManualAck(0), WithDeadLetterExchange("dlx", "")},
+		} {
+			i, _ := newTestInbound(t, errors.New("handler failed"), opts...)
+			ack := &mockAcknowledger{}
+
+			i.lock.Lock()
+			i.ch = nil
+			i.lock.Unlock()
+
+			i.handleDelivery(&job{delivery: amqp.Delivery{Acknowledger: ack, DeliveryTag: 1}})
+
+			require.Empty(t, ack.acked)
+			require.Equal(t, []bool{true}, ack.requeue)
+		}
+	})
+
+	t.Run("consume failure", func(t *testing.T) {
+		i, ch := newTestInbound(t, nil, WithManualAck(1))
+		ch.errConsume = errors.New("consume failed")
+
+		_, err := i.consume(ch)
+		require.EqualError(t, err, "unable to consume: consume failed")
+	})
+}
+
+func TestRetryCount(t *testing.T) {
+	require.Equal(t, 0, retryCount(nil))
+	require.Equal(t, 0, retryCount(amqp.Table{RetryCountHeader: "1"}))
+	require.Equal(t, 1, retryCount(amqp.Table{RetryCountHeader: 1}))
+	require.Equal(t, 2, retryCount(amqp.Table{RetryCountHeader: int16(2)}))
+	require.Equal(t, 3, retryCount(amqp.Table{RetryCountHeader: int32(3)}))
+	require.Equal(t, 4, retryCount(amqp.Table{RetryCountHeader: int64(4)}))
+}
+
+func TestInbound_Reconnect(t *testing.T) {
+	t.Run("reconnects after the connection is lost", func(t *testing.T) {
+		var statuses []ConnectionStatus
+
+		statusChanged := make(chan struct{}, 10)
+
+		i, err := NewInbound("amqp://example.com", "http://example.com", "queue", "", "",
+			WithReconnectBackOff(time.Millisecond, 5*time.Millisecond),
+			WithStatusListener(func(status ConnectionStatus, cause error) {
+				if status == Reconnecting {
+					require.EqualError(t, cause, "Exception (320) Reason: \"CONNECTION_FORCED\"")
+				}
+
+				statuses = append(statuses, status)
+				statusChanged <- struct{}{}
+			}))
+		require.NoError(t, err)
+		require.Equal(t, Disconnected, i.Status())
+
+		first, firstCh, firstClosed := newMockSession()
+		second, secondCh, _ := newMockSession()
+
+		var attempts int
+
+		i.open = func() (*session, error) {
+			attempts++
+
+			switch attempts {
+			case 1:
+				return first, nil
+			case 2:
+				return nil, errors.New("connection refused")
+			default:
+				return second, nil
+			}
+		}
+
+		require.NoError(t, i.Start(&mockProvider{}))
+		<-statusChanged
+		require.Equal(t, Connected, i.Status())
+
+		firstClosed <- &amqp.Error{Code: amqp.ConnectionForced, Reason: "CONNECTION_FORCED"}
+		firstCh.closeDeliveries()
+
+		<-statusChanged
+		<-statusChanged
+		require.Equal(t, Connected, i.Status())
+		require.Equal(t, []ConnectionStatus{Connected, Reconnecting, Connected}, statuses)
+		require.Equal(t, 3, attempts)
+		require.True(t, first.conn.(*mockConn).closed)
+
+		ack := &mockAcknowledger{}
+		secondCh.deliveries <- amqp.Delivery{Acknowledger: ack, DeliveryTag: 1}
+
+		require.NoError(t, i.Stop())
+		<-statusChanged
+		require.Equal(t, Disconnected, i.Status())
+		require.True(t, secondCh.closed)
+		require.True(t, second.conn.(*mockConn).closed)
+	})
+
+	t.Run("consumer cancelled by the server", func(t *testing.T) {
+		s, _, _ := newMockSession()
+
+		require.EqualError(t, s.closeReason(), "consumer was cancelled by the server")
+	})
+
+	t.Run("stops reconnecting when stopped", func(t *testing.T) {
+		reconnecting := make(chan struct{})
+
+		i, err := NewInbound("amqp://example.com", "http://example.com", "queue", "", "",
+			WithReconnectBackOff(time.Millisecond, time.Millisecond),
+			WithStatusListener(func(status ConnectionStatus, _ error) {
+				if status == Reconnecting {
+					close(reconnecting)
+				}
+			}))
+		require.NoError(t, err)
+
+		first, firstCh, _ := newMockSession()
+
+		i.open = func() (*session, error) {
+			if first != nil {
+				s := first
+				first = nil
+
+				return s, nil
+			}
+
+			return nil, errors.New("connection refused")
+		}
+
+		require.NoError(t, i.Start(&mockProvider{}))
+
+		require.NoError(t, firstCh.Close())
+		<-reconnecting
+
+		require.NoError(t, i.Stop())
+	})
+}
+
+func TestInbound_Shutdown(t *testing.T) {
+	newStartedInbound := func(t *testing.T, handler transport.InboundMessageHandler) (*Inbound, *session,
+		*mockChannel) {
+		t.Helper()
+
+		i, err := NewInbound("amqp://example.com", "http://example.com", "queue", "", "", WithManualAck(0))
+		require.NoError(t, err)
+
+		s, ch, _ := newMockSession()
+
+		i.open = func() (*session, error) {
+			return s, nil
+		}
+
+		require.NoError(t, i.Start(&mockProvider{}))
+		i.msgHandler = handler
+
+		return i, s, ch
+	}
+
+	t.Run("not started", func(t *testing.T) {
+		i, err := NewInbound("amqp://example.com", "http://example.com", "queue", "", "")
+		require.NoError(t, err)
+
+		require.NoError(t, i.Stop())
+		require.NoError(t, i.Stop())
+	})
+
+	t.Run("waits for messages being handled", func(t *testing.T) {
+		started := make(chan struct{})
+		release := make(chan struct{})
+
+		var (
+			conn                *mockConn
+			closedWhileHandling bool
+		)
+
+		i, s, ch := newStartedInbound(t, func([]byte, string, string) error {
+			close(started)
+			<-release
+
+			closedWhileHandling = conn.closed
+
+			return nil
+		})
+		conn = s.conn.(*mockConn)
+
+		ack := &mockAcknowledger{}
+		ch.deliveries <- amqp.Delivery{Acknowledger: ack, DeliveryTag: 1}
+		<-started
+
+		stopped := make(chan error)
+
+		go func() {
+			stopped <- i.Stop()
+		}()
+
+		close(release)
+
+		require.NoError(t, <-stopped)
+		require.False(t, closedWhileHandling)
+		require.Equal(t, []uint64{1}, ack.acked)
+		require.Equal(t, []string{ch.consumer}, ch.cancelled)
+		require.NotEmpty(t, ch.consumer)
+		require.True(t, ch.closed)
+		require.True(t, conn.closed)
+		require.Equal(t, Disconnected, i.Status())
+
+		require.NoError(t, i.Stop())
+		require.Len(t, ch.cancelled, 1)
+	})
+
+	t.Run("closes the connection when the deadline is exceeded", func(t *testing.T) {
+		started := make(chan struct{})
+		release := make(chan struct{})
+
+		defer close(release)
+
+		i, s, ch := newStartedInbound(t, func([]byte, string, string) error {
+			close(started)
+			<-release
+
+			return nil
+		})
+
+		ch.deliveries <- amqp.Delivery{Acknowledger: &mockAcknowledger{}, DeliveryTag: 1}
+		<-started
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		require.EqualError(t, i.Shutdown(ctx),
+			"timed out waiting for messages to be handled: context deadline exceeded")
+		require.True(t, ch.closed)
+		require.True(t, s.conn.(*mockConn).closed)
+	})
+}
+
+func TestInbound_Declare(t *testing.T) {
+	t.Run("default topology", func(t *testing.T) {
+		i, ch := newTestInbound(t, nil)
+
+		require.NoError(t, i.declare(ch))
+		require.Empty(t, ch.exchanges)
+		require.Equal(t, []declaredQueue{{name: "queue"}}, ch.queues)
+		require.Empty(t, ch.bindings)
+		require.Equal(t, "queue", i.que.Name)
+	})
+
+	t.Run("durable queue with arguments", func(t *testing.T) {
+		i, ch := newTestInbound(t, nil,
+			WithDurableQueue(),
+			WithMessageTTL(time.Minute),
+			WithMaxLength(1000),
+			WithQueueDeadLetterExchange("dlx"),
+			WithQueueArgs(amqp.Table{"x-overflow": "reject-publish"}))
+
+		require.NoError(t, i.declare(ch))
+		require.Equal(t, []declaredQueue{{name: "queue", durable: true, args: amqp.Table{
+			"x-message-ttl":          int64(60000),
+			"x-max-length":           int64(1000),
+			"x-dead-letter-exchange": "dlx",
+			"x-overflow":             "reject-publish",
+		}}}, ch.queues)
+	})
+
+	t.Run("quorum queue", func(t *testing.T) {
+		i, ch := newTestInbound(t, nil, WithQuorumQueue())
+
+		require.NoError(t, i.declare(ch))
+		require.Equal(t, []declaredQueue{{name: "queue", durable: true, args: amqp.Table{
+			"x-queue-type": "quorum",
+		}}}, ch.queues)
+	})
+
+	t.Run("exchange with binding keys", func(t *testing.T) {
+		i, ch := newTestInbound(t, nil, WithExchange("didcomm", "topic", true), WithBindingKeys("a.*", "b.#"))
+
+		require.NoError(t, i.declare(ch))
+		require.Equal(t, []declaredExchange{{name: "didcomm", kind: "topic", durable: true}}, ch.exchanges)
+		require.Equal(t, []string{"didcomm->queue:a.*", "didcomm->queue:b.#"}, ch.bindings)
+	})
+
+	t.Run("exchange without binding keys binds with the queue name", func(t *testing.T) {
+		i, ch := newTestInbound(t, nil, WithExchange("didcomm", "direct", false))
+
+		require.NoError(t, i.declare(ch))
+		require.Equal(t, []string{"didcomm->queue:queue"}, ch.bindings)
+	})
+
+	t.Run("failures", func(t *testing.T) {
+		i, ch := newTestInbound(t, nil, WithExchange("didcomm", "direct", false))
+		ch.errDeclare = errors.New("declare failed")
+
+		require.EqualError(t, i.declare(ch), "unable to declare exchange didcomm: declare failed")
+
+		i, ch = newTestInbound(t, nil)
+		ch.errDeclare = errors.New("declare failed")
+
+		require.EqualError(t, i.declare(ch), "unable to declare queue: declare failed")
+
+		i, ch = newTestInbound(t, nil, WithExchange("didcomm", "direct", false))
+		ch.errBind = errors.New("bind failed")
+
+		require.EqualError(t, i.declare(ch),
+			"unable to bind queue to exchange didcomm with key queue: bind failed")
+	})
+}
+
+// senderPackager unpacks messages of the form "<from DID>|<message ID>".
+type senderPackager struct{}
+
+func (p *senderPackager) PackMessage(envelope *commontransport.Envelope) ([]byte, error) {
+	return envelope.Message, nil
+}
+
+func (p *senderPackager) UnpackMessage(encMessage []byte) (*commontransport.Envelope, error) {
+	parts := strings.SplitN(string(encMessage), "|", 2)
+
+	return &commontransport.Envelope{
+		Message: []byte(fmt.Sprintf(`{"@id":%q}`, parts[1])),
+		FromDID: parts[0],
+	}, nil
+}
+
+func TestInbound_Workers(t *testing.T) {
+	t.Run("deliveries are handled concurrently", func(t *testing.T) {
+		const workers = 3
+
+		i, ch := newTestInbound(t, nil, WithManualAck(0), WithWorkers(workers))
+		ack := &mockAcknowledger{}
+
+		started := make(chan struct{}, workers)
+		release := make(chan struct{})
+
+		i.msgHandler = func([]byte, string, string) error {
+			started <- struct{}{}
+			<-release
+
+			return nil
+		}
+
+		for n := 1; n <= workers; n++ {
+			ch.deliveries <- amqp.Delivery{Acknowledger: ack, DeliveryTag: uint64(n)}
+		}
+
+		ch.closeDeliveries()
+
+		done := make(chan struct{})
+
+		go func() {
+			i.serve(ch.deliveries)
+			close(done)
+		}()
+
+		for n := 0; n < workers; n++ {
+			<-started
+		}
+
+		close(release)
+		<-done
+
+		require.ElementsMatch(t, []uint64{1, 2, 3}, ack.acked)
+	})
+
+	t.Run("deliveries from the same sender are handled in order", func(t *testing.T) {
+		i, ch := newTestInbound(t, nil, WithWorkers(4), WithSenderOrdering())
+		i.packager = &senderPackager{}
+
+		var lock sync.Mutex
+
+		handled := make(map[string][]string)
+
+		i.msgHandler = func(msg []byte, _, fromDID string) error {
+			lock.Lock()
+			defer lock.Unlock()
+
+			handled[fromDID] = append(handled[fromDID], string(msg))
+
+			return nil
+		}
+
+		expected := make(map[string][]string)
+
+		for n := 0; n < 10; n++ {
+			for _, from := range []string{"did:a", "did:b", "did:c"} {
+				expected[from] = append(expected[from], fmt.Sprintf(`{"@id":"%d"}`, n))
+			}
+		}
+
+		go func() {
+			for n := 0; n < 10; n++ {
+				for _, from := range []string{"did:a", "did:b", "did:c"} {
+					ch.deliveries <- amqp.Delivery{Body: []byte(fmt.Sprintf("%s|%d", from, n))}
+				}
+			}
+
+			ch.closeDeliveries()
+		}()
+
+		i.serve(ch.deliveries)
+
+		require.Equal(t, expected, handled)
+	})
+
+	t.Run("worker is picked by sender", func(t *testing.T) {
+		a := workerFor(&commontransport.Envelope{FromDID: "did:a"}, 8)
+		require.Equal(t, a, workerFor(&commontransport.Envelope{FromDID: "did:a"}, 8))
+		require.True(t, a >= 0 && a < 8)
+		require.Equal(t, workerFor(nil, 8), workerFor(&commontransport.Envelope{}, 8))
+	})
+
+	t.Run("prefetch count", func(t *testing.T) {
+		i, ch := newTestInbound(t, nil)
+
+		require.NoError(t, i.prepare(ch))
+		require.Zero(t, ch.prefetch)
+
+		i, ch = newTestInbound(t, nil, WithPrefetchCount(10))
+
+		require.NoError(t, i.prepare(ch))
+		require.Equal(t, 10, ch.prefetch)
+		require.Len(t, ch.queues, 1)
+
+		i, ch = newTestInbound(t, nil, WithPrefetchCount(10))
+		ch.errQos = errors.New("qos failed")
+
+		require.EqualError(t, i.prepare(ch), "unable to set prefetch count: qos failed")
+		require.Empty(t, ch.queues)
+	})
+}
+
+func TestConnectionStatus_String(t *testing.T) {
+	require.Equal(t, "disconnected", Disconnected.String())
+	require.Equal(t, "connected", Connected.String())
+	require.Equal(t, "reconnecting", Reconnecting.String())
+	require.Equal(t, "ConnectionStatus(7)", ConnectionStatus(7).String())
+}
@@ -166,6 +166,37 @@ func TestInboundDataProcessing(t *testing.T) {
 		require.NoError(t, err)
 	})
 
+	t.Run("test inbound transport - durable queue bound to an exchange", func(t *testing.T) {
+		queue := "queue-durable"
+		inbound, err := NewInbound(amqpAddr, "http://example.com", queue, "", "",
+			WithDurableQueue(), WithMessageTTL(time.Minute),
+			WithExchange("didcomm", "direct", true), WithBindingKeys("agent"))
+		require.NoError(t, err)
+
+		mockPackager := &mockpackager.Packager{UnpackValue: &commontransport.Envelope{Message: []byte("valid-data")}}
+		err = inbound.Start(&mockProvider{packagerValue: mockPackager})
+		require.NoError(t, err)
+
+		ch, cleanup := amqpClient(t, amqpAddr)
+		defer cleanup()
+
+		wait := make(chan amqp.Confirmation, 1)
+		_ = ch.NotifyPublish(wait)
+		err = ch.Publish(
+			"didcomm", // exchange
+			"agent",   // routing key
+			false,     // mandatory
+			false,     // immediate
+			amqp.Publishing{
+				ContentType: "text/plain",
+				Body:        []byte("random"),
+			})
+		require.NoError(t, err)
+		require.True(t, (<-wait).Ack)
+
+		require.NoError(t, inbound.Stop())
+	})
+
 	t.Run("test inbound transport - unpacking error", func(t *testing.T) {
 		addr := amqpAddr
 		queue := "queue2"
@@ -0,0 +1,146 @@
+/*
+Copyright Scoir, Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package amqp
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics receives measurements from an Inbound transport. Each method is passed the name of the queue the
+// transport consumes. Implementations must be safe for concurrent use. See WithMetrics.
+type Metrics interface {
+	// MessageReceived is called for every delivery.
+	MessageReceived(queue string)
+	// UnpackFailed is called when a delivery can't be unpacked.
+	UnpackFailed(queue string)
+	// HandlerFailed is called when the inbound message handler returns an error.
+	HandlerFailed(queue string)
+	// MessageHandled is called with how long the inbound message handler took, whether it failed or not.
+	MessageHandled(queue string, duration time.Duration)
+	// MessageRetried is called when a failed delivery is published to the queue again. See WithManualAck.
+	MessageRetried(queue string)
+	// MessageDeadLettered is called when a failed delivery is given up on. See WithManualAck.
+	MessageDeadLettered(queue string)
+	// QueueDepth is called with the number of messages that are ready to be delivered from the queue.
+	// See WithQueueDepthInterval.
+	QueueDepth(queue string, messages int)
+}
+
+// noopMetrics discards all measurements.
+type noopMetrics struct{}
+
+func (noopMetrics) MessageReceived(string) {}
+
+func (noopMetrics) UnpackFailed(string) {}
+
+func (noopMetrics) HandlerFailed(string) {}
+
+func (noopMetrics) MessageHandled(string, time.Duration) {}
+
+func (noopMetrics) MessageRetried(string) {}
+
+func (noopMetrics) MessageDeadLettered(string) {}
+
+func (noopMetrics) QueueDepth(string, int) {}
+
+const (
+	metricsNamespace = "aries"
+	metricsSubsystem = "amqp_inbound"
+	queueLabel       = "queue"
+)
+
+// PrometheusMetrics exposes the measurements of Inbound transports as Prometheus metrics, labelled by queue.
+type PrometheusMetrics struct {
+	received     *prometheus.CounterVec
+	unpackFailed *prometheus.CounterVec
+	failed       *prometheus.CounterVec
+	duration     *prometheus.HistogramVec
+	retried      *prometheus.CounterVec
+	deadLettered *prometheus.CounterVec
+	queueDepth   *prometheus.GaugeVec
+}
+
+// NewPrometheusMetrics creates the Prometheus metrics for Inbound transports and registers them with registerer,
+// e.g. prometheus.DefaultRegisterer. The same instance can be shared by several transports.
+func NewPrometheusMetrics(registerer prometheus.Registerer) (*PrometheusMetrics, error) {
+	m := &PrometheusMetrics{
+		received:     newCounter("messages_received_total", "Number of messages received."),
+		unpackFailed: newCounter("unpack_failures_total", "Number of messages that could not be unpacked."),
+		failed:       newCounter("handler_failures_total", "Number of messages the message handler failed on."),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "handler_duration_seconds",
+			Help:      "Time taken by the message handler.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{queueLabel}),
+		retried:      newCounter("messages_retried_total", "Number of failed messages queued again for a retry."),
+		deadLettered: newCounter("messages_dead_lettered_total", "Number of failed messages that were given up on."),
+		queueDepth: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "queue_messages",
+			Help:      "Number of messages ready to be delivered from the queue.",
+		}, []string{queueLabel}),
+	}
+
+	for _, c := range []prometheus.Collector{
+		m.received, m.unpackFailed, m.failed, m.duration, m.retried, m.deadLettered, m.queueDepth,
+	} {
+		if err := registerer.Register(c); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+func newCounter(name, help string) *prometheus.CounterVec {
+	return prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      name,
+		Help:      help,
+	}, []string{queueLabel})
+}
+
+// MessageReceived counts a delivery.
+func (m *PrometheusMetrics) MessageReceived(queue string) {
+	m.received.WithLabelValues(queue).Inc()
+}
+
+// UnpackFailed counts a delivery that could not be unpacked.
+func (m *PrometheusMetrics) UnpackFailed(queue string) {
+	m.unpackFailed.WithLabelValues(queue).Inc()
+}
+
+// HandlerFailed counts a message the handler failed on.
+func (m *PrometheusMetrics) HandlerFailed(queue string) {
+	m.failed.WithLabelValues(queue).Inc()
+}
+
+// MessageHandled observes how long the handler took.
+func (m *PrometheusMetrics) MessageHandled(queue string, duration time.Duration) {
+	m.duration.WithLabelValues(queue).Observe(duration.Seconds())
+}
+
+// MessageRetried counts a delivery that was queued again.
+func (m *PrometheusMetrics) MessageRetried(queue string) {
+	m.retried.WithLabelValues(queue).Inc()
+}
+
+// MessageDeadLettered counts a delivery that was given up on.
+func (m *PrometheusMetrics) MessageDeadLettered(queue string) {
+	m.deadLettered.WithLabelValues(queue).Inc()
+}
+
+// QueueDepth sets the number of messages ready to be delivered from the queue.
+func (m *PrometheusMetrics) QueueDepth(queue string, messages int) {
+	m.queueDepth.WithLabelValues(queue).Set(float64(messages))
+}
@@ -0,0 +1,192 @@
+/*
+Copyright Scoir, Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package amqp
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	mockpackager "github.com/hyperledger/aries-framework-go/pkg/mock/didcomm/packager"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// recordingMetrics records the names of the measurements it receives.
+type recordingMetrics struct {
+	lock   sync.Mutex
+	events []string
+	depths chan int
+}
+
+func (m *recordingMetrics) record(event string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.events = append(m.events, event)
+}
+
+func (m *recordingMetrics) MessageReceived(string) {
+	m.record("received")
+}
+
+func (m *recordingMetrics) UnpackFailed(string) {
+	m.record("unpack failed")
+}
+
+func (m *recordingMetrics) HandlerFailed(string) {
+	m.record("handler failed")
+}
+
+func (m *recordingMetrics) MessageHandled(string, time.Duration) {
+	m.record("handled")
+}
+
+func (m *recordingMetrics) MessageRetried(string) {
+	m.record("retried")
+}
+
+func (m *recordingMetrics) MessageDeadLettered(string) {
+	m.record("dead-lettered")
+}
+
+func (m *recordingMetrics) QueueDepth(_ string, messages int) {
+	if m.depths != nil {
+		m.depths <- messages
+	}
+}
+
+func TestInbound_Metrics(t *testing.T) {
+	t.Run("handled message", func(t *testing.T) {
+		metrics := &recordingMetrics{}
+		i, _ := newTestInbound(t, nil, WithMetrics(metrics))
+
+		i.handleDelivery(&job{delivery: amqp.Delivery{}})
+		require.Equal(t, []string{"received", "handled"}, metrics.events)
+	})
+
+	t.Run("failed messages", func(t *testing.T) {
+		metrics := &recordingMetrics{}
+		i, _ := newTestInbound(t, errors.New("handler failed"), WithMetrics(metrics), WithManualAck(1))
+
+		i.handleDelivery(&job{delivery: amqp.Delivery{Acknowledger: &mockAcknowledger{}}})
+		require.Equal(t, []string{"received", "handled", "handler failed", "retried"}, metrics.events)
+
+		metrics.events = nil
+		i.packager = &mockpackager.Packager{UnpackErr: errors.New("unpack failed")}
+
+		i.handleDelivery(&job{delivery: amqp.Delivery{
+			Acknowledger: &mockAcknowledger{}, Headers: amqp.Table{RetryCountHeader: int32(1)},
+		}})
+		require.Equal(t, []string{"received", "unpack failed", "dead-lettered"}, metrics.events)
+	})
+
+	t.Run("queue depth", func(t *testing.T) {
+		metrics := &recordingMetrics{depths: make(chan int, 10)}
+		i, err := NewInbound("amqp://example.com", "http://example.com", "queue", "", "",
+			WithMetrics(metrics), WithQueueDepthInterval(time.Millisecond))
+		require.NoError(t, err)
+
+		s, ch, _ := newMockSession()
+		ch.messages = 7
+
+		i.open = func() (*session, error) {
+			return s, nil
+		}
+
+		require.NoError(t, i.declare(ch))
+		require.Equal(t, 0, <-metrics.depths)
+
+		require.NoError(t, i.Start(&mockProvider{}))
+		require.Equal(t, 7, <-metrics.depths)
+		require.NoError(t, i.Stop())
+	})
+}
+
+func TestPrometheusMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+
+	m, err := NewPrometheusMetrics(registry)
+	require.NoError(t, err)
+
+	m.MessageReceived("queue")
+	m.MessageReceived("queue")
+	m.UnpackFailed("queue")
+	m.HandlerFailed("queue")
+	m.MessageHandled("queue", time.Second)
+	m.MessageRetried("queue")
+	m.MessageDeadLettered("queue")
+	m.QueueDepth("queue", 42)
+
+	require.Equal(t, float64(2), testutil.ToFloat64(m.received))
+	require.Equal(t, float64(1), testutil.ToFloat64(m.unpackFailed))
+	require.Equal(t, float64(1), testutil.ToFloat64(m.failed))
+	require.Equal(t, float64(1), testutil.ToFloat64(m.retried))
+	require.Equal(t, float64(1), testutil.ToFloat64(m.deadLettered))
+	require.Equal(t, float64(42), testutil.ToFloat64(m.queueDepth))
+	require.Equal(t, 1, testutil.CollectAndCount(m.duration))
+
+	_, err = NewPrometheusMetrics(registry)
+	require.Error(t, err)
+}
+
+func TestInbound_Tracing(t *testing.T) {
+	i, err := NewInbound("amqp://example.com", "http://example.com", "queue", "", "",
+		WithTracerProvider(trace.NewNoopTracerProvider()), WithPropagator(propagation.TraceContext{}))
+	require.NoError(t, err)
+
+	ctx, span := i.startSpan(amqp.Delivery{Headers: amqp.Table{
+		"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	}})
+	defer span.End()
+
+	require.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", span.SpanContext().TraceID().String())
+	require.Equal(t, span.SpanContext(), trace.SpanContextFromContext(ctx))
+
+	_, span = i.startSpan(amqp.Delivery{})
+	defer span.End()
+
+	require.False(t, span.SpanContext().IsValid())
+}
+
+func TestInbound_ContextMessageHandler(t *testing.T) {
+	var handled context.Context
+
+	i, _ := newTestInbound(t, errors.New("provider handler called"),
+		WithTracerProvider(trace.NewNoopTracerProvider()), WithPropagator(propagation.TraceContext{}),
+		WithContextMessageHandler(func(ctx context.Context, message []byte, _, _ string) error {
+			handled = ctx
+
+			require.Equal(t, []byte("data"), message)
+
+			return nil
+		}))
+
+	err := i.processMessage(&job{delivery: amqp.Delivery{Headers: amqp.Table{
+		"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	}}})
+	require.NoError(t, err)
+
+	require.NotNil(t, handled)
+	require.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", trace.SpanContextFromContext(handled).TraceID().String())
+}
+
+func TestHeaderCarrier(t *testing.T) {
+	c := headerCarrier{"number": int32(1)}
+	c.Set("traceparent", "value")
+
+	require.Equal(t, "value", c.Get("traceparent"))
+	require.Empty(t, c.Get("number"))
+	require.Empty(t, c.Get("missing"))
+	require.ElementsMatch(t, []string{"number", "traceparent"}, c.Keys())
+}
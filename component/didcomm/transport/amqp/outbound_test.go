@@ -0,0 +1,65 @@
+/*
+Copyright Scoir, Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package amqp_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hyperledger/aries-framework-go/pkg/didcomm/common/service"
+	"github.com/stretchr/testify/require"
+
+	. "github.com/hyperledger/aries-framework-go-ext/component/didcomm/transport/amqp"
+)
+
+func TestOutboundTransport(t *testing.T) {
+	t.Run("test outbound transport - publish to queue", func(t *testing.T) {
+		queue := "outbound-queue1"
+
+		ch, cleanup := amqpClient(t, amqpAddr)
+		defer cleanup()
+
+		_, err := ch.QueueDeclare(queue, false, false, false, false, nil)
+		require.NoError(t, err)
+
+		outbound, err := NewOutbound("", "")
+		require.NoError(t, err)
+		require.NoError(t, outbound.Start(&mockProvider{}))
+
+		defer func() {
+			require.NoError(t, outbound.Close())
+		}()
+
+		endpoint := amqpAddr + "/?queue=" + queue
+		require.True(t, outbound.Accept(endpoint))
+
+		for i := 0; i < 2; i++ {
+			_, err = outbound.Send([]byte("packed"), &service.Destination{ServiceEndpoint: endpoint})
+			require.NoError(t, err)
+		}
+
+		for i := 0; i < 2; i++ {
+			require.Eventually(t, func() bool {
+				msg, ok, errGet := ch.Get(queue, true)
+				require.NoError(t, errGet)
+
+				return ok && string(msg.Body) == "packed"
+			}, 5*time.Second, 50*time.Millisecond)
+		}
+	})
+
+	t.Run("test outbound transport - server not reachable", func(t *testing.T) {
+		outbound, err := NewOutbound("", "")
+		require.NoError(t, err)
+
+		_, err = outbound.Send([]byte("packed"), &service.Destination{
+			ServiceEndpoint: "amqp://127.0.0.1:5555/?queue=queue",
+		})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "unable to connect to AMQP server")
+	})
+}
@@ -0,0 +1,93 @@
+/*
+Copyright Scoir, Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package amqp
+
+import (
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+// replyRoute is where to send the responses for a sender that asked for them to be returned on the route its
+// message came in on, i.e. to the queue named in the message's ReplyTo property.
+type replyRoute struct {
+	inbound       *Inbound
+	replyTo       string
+	correlationID string
+}
+
+func (r *replyRoute) send(data []byte) error {
+	return r.inbound.publish("", r.replyTo, amqp.Publishing{
+		ContentType:   envelopeContentType,
+		CorrelationId: r.correlationID,
+		Body:          data,
+	})
+}
+
+// replyRoutes are the reply routes of an Aries framework instance by sender key (did:key), shared between its AMQP
+// inbound and outbound transports.
+type replyRoutes struct {
+	routes map[string]*replyRoute
+	sync.RWMutex
+}
+
+// nolint: gochecknoglobals
+var (
+	routeRegistry     = make(map[string]*replyRoutes)
+	routeRegistryLock sync.Mutex
+)
+
+func getReplyRoutes(frameworkID string) *replyRoutes {
+	routeRegistryLock.Lock()
+	defer routeRegistryLock.Unlock()
+
+	if _, ok := routeRegistry[frameworkID]; !ok {
+		routeRegistry[frameworkID] = &replyRoutes{routes: make(map[string]*replyRoute)}
+	}
+
+	return routeRegistry[frameworkID]
+}
+
+func (r *replyRoutes) add(key string, route *replyRoute) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.routes[key] = route
+}
+
+// fetch returns the route for the first of keys that has one.
+func (r *replyRoutes) fetch(keys []string) (string, *replyRoute) {
+	r.RLock()
+	defer r.RUnlock()
+
+	for _, key := range keys {
+		if route, ok := r.routes[key]; ok {
+			return key, route
+		}
+	}
+
+	return "", nil
+}
+
+func (r *replyRoutes) remove(key string) {
+	r.Lock()
+	defer r.Unlock()
+
+	delete(r.routes, key)
+}
+
+// removeInbound removes the routes learned by an inbound transport.
+func (r *replyRoutes) removeInbound(i *Inbound) {
+	r.Lock()
+	defer r.Unlock()
+
+	for key, route := range r.routes {
+		if route.inbound == i {
+			delete(r.routes, key)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+/*
+Copyright Scoir, Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package amqp
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/hyperledger/aries-framework-go/pkg/didcomm/common/service"
+	commontransport "github.com/hyperledger/aries-framework-go/pkg/didcomm/common/transport"
+	mockpackager "github.com/hyperledger/aries-framework-go/pkg/mock/didcomm/packager"
+	"github.com/hyperledger/aries-framework-go/pkg/vdr/fingerprint"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReturnRoute(t *testing.T) {
+	fromKey := []byte("sender-public-key")
+	didKey, _ := fingerprint.CreateDIDKey(fromKey)
+
+	newInbound := func(t *testing.T, message string) (*Inbound, *mockChannel) {
+		t.Helper()
+
+		i, ch := newTestInbound(t, nil)
+		i.routes = getReplyRoutes("framework-id")
+		i.packager = &mockpackager.Packager{UnpackValue: &commontransport.Envelope{
+			Message: []byte(message),
+			FromKey: fromKey,
+		}}
+
+		t.Cleanup(func() {
+			i.routes.removeInbound(i)
+		})
+
+		return i, ch
+	}
+
+	newOutbound := func(t *testing.T) *Outbound {
+		t.Helper()
+
+		o, err := NewOutbound("", "")
+		require.NoError(t, err)
+		require.NoError(t, o.Start(&mockProvider{}))
+
+		return o
+	}
+
+	delivery := amqp.Delivery{Acknowledger: &mockAcknowledger{}, ReplyTo: "reply-queue", CorrelationId: "request-id"}
+
+	t.Run("responses are sent to the reply queue", func(t *testing.T) {
+		i, ch := newInbound(t, `{"~transport":{"~return_route":"all"}}`)
+		o := newOutbound(t)
+
+		require.False(t, o.AcceptRecipient([]string{didKey}))
+
+		i.handleDelivery(&job{delivery: delivery})
+		require.True(t, o.AcceptRecipient([]string{"other", didKey}))
+
+		_, err := o.Send([]byte("response"), &service.Destination{
+			ServiceEndpoint: "http://example.com",
+			RecipientKeys:   []string{didKey},
+		})
+		require.NoError(t, err)
+		require.Len(t, ch.published, 1)
+		require.Equal(t, "", ch.published[0].exchange)
+		require.Equal(t, "reply-queue", ch.published[0].key)
+		require.Equal(t, "request-id", ch.published[0].msg.CorrelationId)
+		require.Equal(t, []byte("response"), ch.published[0].msg.Body)
+
+		i.routes.removeInbound(i)
+		require.False(t, o.AcceptRecipient([]string{didKey}))
+	})
+
+	t.Run("no route without the return route option or a reply queue", func(t *testing.T) {
+		i, _ := newInbound(t, `{"~transport":{"~return_route":"thread"}}`)
+		o := newOutbound(t)
+
+		i.handleDelivery(&job{delivery: delivery})
+		require.False(t, o.AcceptRecipient([]string{didKey}))
+
+		i, _ = newInbound(t, `{"~transport":{"~return_route":"all"}}`)
+
+		i.handleDelivery(&job{delivery: amqp.Delivery{Acknowledger: &mockAcknowledger{}}})
+		require.False(t, o.AcceptRecipient([]string{didKey}))
+	})
+
+	t.Run("failed reply", func(t *testing.T) {
+		i, ch := newInbound(t, `{"~transport":{"~return_route":"all"}}`)
+		ch.errPublish = errors.New("publish failed")
+		o := newOutbound(t)
+
+		i.handleDelivery(&job{delivery: delivery})
+
+		_, err := o.Send([]byte("response"), &service.Destination{
+			ServiceEndpoint: "http://example.com",
+			RoutingKeys:     []string{didKey},
+		})
+		require.EqualError(t, err, "unable to send reply to queue reply-queue: publish failed")
+		require.False(t, o.AcceptRecipient([]string{didKey}))
+
+		i.handleDelivery(&job{delivery: delivery})
+
+		pub := &mockPublisher{}
+		o.openPublisher = func(string) (replyPublisher, error) {
+			return pub, nil
+		}
+
+		_, err = o.Send([]byte("response"), &service.Destination{
+			ServiceEndpoint: "amqp://example.com/?queue=inbox",
+			RecipientKeys:   []string{didKey},
+		})
+		require.NoError(t, err)
+		require.Len(t, pub.published, 1)
+		require.Equal(t, "inbox", pub.published[0].key)
+	})
+
+	t.Run("inbound not started", func(t *testing.T) {
+		i, err := NewInbound("amqp://example.com", "http://example.com", "queue", "", "")
+		require.NoError(t, err)
+
+		route := &replyRoute{inbound: i, replyTo: "reply-queue"}
+		require.EqualError(t, route.send([]byte("response")), "inbound transport is not started")
+	})
+}
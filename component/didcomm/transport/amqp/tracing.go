@@ -0,0 +1,71 @@
+/*
+Copyright Scoir, Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package amqp
+
+import (
+	"context"
+
+	"github.com/streadway/amqp"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	tracerName      = "github.com/hyperledger/aries-framework-go-ext/component/didcomm/transport/amqp"
+	messagingSystem = "rabbitmq"
+)
+
+// headerCarrier lets trace context be read from and written to AMQP message headers.
+type headerCarrier amqp.Table
+
+// Get returns the value of the header, or "" if it isn't set or isn't a string.
+func (c headerCarrier) Get(key string) string {
+	value, ok := c[key].(string)
+	if !ok {
+		return ""
+	}
+
+	return value
+}
+
+// Set sets the header.
+func (c headerCarrier) Set(key, value string) {
+	c[key] = value
+}
+
+// Keys lists the header names.
+func (c headerCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+
+	for key := range c {
+		keys = append(keys, key)
+	}
+
+	return keys
+}
+
+// startSpan starts the span for processing a delivery, as a child of the trace context in its headers if there is
+// one. The returned context carries the span.
+func (i *Inbound) startSpan(d amqp.Delivery) (context.Context, trace.Span) {
+	ctx := i.propagator.Extract(context.Background(), headerCarrier(d.Headers))
+
+	return i.tracer.Start(ctx, i.queueName+" process",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			semconv.MessagingSystemKey.String(messagingSystem),
+			semconv.MessagingDestinationKey.String(i.queueName),
+			semconv.MessagingDestinationKindQueue,
+			semconv.MessagingOperationProcess,
+			semconv.MessagingMessageIDKey.String(d.MessageId),
+		))
+}
+
+func recordError(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
@@ -12,7 +12,10 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"math"
+	"net/http"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
@@ -34,6 +37,11 @@ const (
 	mapReduceDesignDocumentName         = "AriesStorageMapReduceDesignDocument"
 	mapReduceDesignDocumentNameWithPath = "_design/" + mapReduceDesignDocumentName
 	countViewNameTemplate               = "%s_count"
+	// The index on the expiry times of documents put with a TTL is kept in a design document of its own, so that it's
+	// never mistaken for the index of a tag.
+	expiryDesignDocumentName         = "AriesStorageExpiryDesignDocument"
+	expiryDesignDocumentNameWithPath = "_design/" + expiryDesignDocumentName
+	expireAtIndexName                = "expireAt_index"
 
 	// Hardcoded strings returned from Kivik/CouchDB that we check for.
 	docNotFoundErrMsgFromKivik                            = "Not Found: missing"
@@ -66,12 +74,27 @@ const (
 	failSendRequestToFindEndpoint = "failure while sending request to CouchDB find endpoint: %w"
 	failGetDocs                   = "failure while getting documents: %w"
 
-	expressionTagNameOnlyLength     = 1
-	expressionTagNameAndValueLength = 2
+	equalsOperator = ":"
+	prefixOperator = "*"
+
+	notExpiredSelectorTemplate = `{"$or":[{"expireAt":{"$exists":false}},{"expireAt":{"$gt":%d}}]}`
+	expiredSelectorTemplate    = `{"expireAt":{"$lte":%d}}`
+	andSelectorTemplate        = `{"$and":[%s,%s]}`
+
+	defaultExpiredDocumentPurgeInterval = time.Minute
+	// The maximum number of expired documents deleted by a single bulk docs call.
+	purgeBatchSize = 1000
+
+	// Sorts after any other character in CouchDB's collation, so that a range from a prefix to the prefix followed by
+	// this character covers all strings starting with the prefix.
+	highestCollatingCharacter = "\ufff0"
 
 	fieldNameExistsSelectorTemplate   = `{"tags.%s":{"$exists":true}}`
 	fieldNameAndValueSelectorTemplate = `{"tags.%s":"%s"}`
 	sortOptionsTemplate               = `[{"tags.%s": "%s"}]`
+
+	// The number of document IDs fetched at a time when counting the results of a query with several tags.
+	countPageSize = 1000
 )
 
 type findQuery struct {
@@ -80,10 +103,59 @@ type findQuery struct {
 	Bookmark string          `json:"bookmark,omitempty"`
 	Sort     json.RawMessage `json:"sort,omitempty"`
 	Skip     int             `json:"skip,omitempty"`
+	Fields   []string        `json:"fields,omitempty"`
+}
+
+// batchError is the storage.MultiError returned by Batch when some of its operations fail.
+type batchError struct {
+	errs []error
+}
+
+// newBatchError returns a batchError holding the failure of each of operations, or nil if there are none.
+// Operations that were superseded by a later one on the same key share its outcome.
+func newBatchError(operations []storage.Operation, failures map[string]error) error {
+	if len(failures) == 0 {
+		return nil
+	}
+
+	errs := make([]error, len(operations))
+
+	for i, operation := range operations {
+		errs[i] = failures[operation.Key]
+	}
+
+	return &batchError{errs: errs}
+}
+
+func (e *batchError) Error() string {
+	var failedCount int
+
+	var firstErr error
+
+	for _, err := range e.errs {
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+
+			failedCount++
+		}
+	}
+
+	return fmt.Sprintf("%d of %d batch operations failed. First failure: %s", failedCount, len(e.errs), firstErr)
 }
 
+// Errors returns the errors of the batch's operations, in order. The errors of the operations that succeeded are nil.
+func (e *batchError) Errors() []error {
+	return e.errs
+}
+
+// ErrVersionConflict is returned by VersionedStore.PutIfVersion when the document's current revision isn't the one
+// given.
+var ErrVersionConflict = errors.New("version conflict")
+
 var errInvalidQueryExpressionFormat = errors.New("invalid expression format. " +
-	"it must be in the following format: TagName:TagValue")
+	"it must be in the following format: TagName:TagValue, optionally combined with others using && and ||")
 
 type marshalFunc func(interface{}) ([]byte, error)
 
@@ -117,6 +189,52 @@ type document struct {
 	Deleted    bool                   `json:"_deleted,omitempty"` // CouchDB-internal field
 	Value      []byte                 `json:"value,omitempty"`    // Our custom field
 	Tags       map[string]interface{} `json:"tags,omitempty"`     // Our custom field
+	ExpireAt   int64                  `json:"expireAt,omitempty"` // Our custom field, in Unix milliseconds
+	// Our custom field, holding the tag values stored in tags as numbers that wouldn't be read back as they were
+	// written, e.g. "1.50".
+	TagValues map[string]string `json:"tagValues,omitempty"`
+}
+
+// TTLStore is implemented by the stores opened by a Provider. It lets entries be put with a time to live.
+type TTLStore interface {
+	storage.Store
+
+	// PutWithTTL stores the key + value pair along with the (optional) tags, like Put, and has the entry deleted
+	// once ttl has elapsed. A later Put of the same key removes the TTL. Expired entries are hidden from Get, GetTags,
+	// GetBulk and Query straight away, and are deleted by the Provider periodically
+	// (see WithExpiredDocumentPurgeInterval).
+	PutWithTTL(key string, value []byte, ttl time.Duration, tags ...storage.Tag) error
+}
+
+// VersionedStore is implemented by the stores opened by a Provider. It lets a document be read, modified and written
+// back safely by several writers, since the write only succeeds if nobody else has put the document in the meantime.
+type VersionedStore interface {
+	storage.Store
+
+	// GetWithVersion returns the value stored under key along with the document's current version, which is its
+	// revision ID.
+	GetWithVersion(key string) (value []byte, version string, err error)
+
+	// PutIfVersion stores the key + value pair along with the (optional) tags, like Put, provided the document's
+	// current version is version. A blank version means the document mustn't exist. It returns the document's new
+	// version, or ErrVersionConflict if the document's current version is a different one.
+	PutIfVersion(key string, value []byte, version string, tags ...storage.Tag) (string, error)
+}
+
+// ContextStore is implemented by the stores opened by a Provider. Its methods do the same as the storage.Store methods
+// of the same names, but the requests they make to CouchDB are abandoned once ctx is done, in which case ctx's error
+// is returned (wrapped). The context given to QueryWithContext also applies to the iterator it returns, which fetches
+// further pages and counts the results using it.
+type ContextStore interface {
+	storage.Store
+
+	PutWithContext(ctx context.Context, key string, value []byte, tags ...storage.Tag) error
+	GetWithContext(ctx context.Context, key string) ([]byte, error)
+	GetTagsWithContext(ctx context.Context, key string) ([]storage.Tag, error)
+	GetBulkWithContext(ctx context.Context, keys ...string) ([][]byte, error)
+	QueryWithContext(ctx context.Context, expression string, options ...storage.QueryOption) (storage.Iterator, error)
+	DeleteWithContext(ctx context.Context, key string) error
+	BatchWithContext(ctx context.Context, operations []storage.Operation) error
 }
 
 type db interface {
@@ -131,6 +249,14 @@ type db interface {
 	BulkGet(ctx context.Context, docs []kivik.BulkGetReference, options ...kivik.Options) (*kivik.Rows, error)
 	Close(ctx context.Context) error
 	BulkDocs(ctx context.Context, docs []interface{}, options ...kivik.Options) (*kivik.BulkResults, error)
+	Changes(ctx context.Context, options ...kivik.Options) (*kivik.Changes, error)
+}
+
+type bulkResults interface {
+	Next() bool
+	Err() error
+	ID() string
+	UpdateErr() error
 }
 
 type rows interface {
@@ -150,6 +276,7 @@ type Provider struct {
 	dbPrefix                   string
 	openStores                 map[string]*store
 	maxDocumentConflictRetries int
+	purgeInterval              time.Duration
 	lock                       sync.RWMutex
 }
 
@@ -173,6 +300,14 @@ func WithMaxDocumentConflictRetries(maxRetries int) Option {
 	}
 }
 
+// WithExpiredDocumentPurgeInterval is an option for specifying how often each open store deletes the documents whose
+// TTL has elapsed. interval must be > 0. If not set (or set to an invalid value), it will default to one minute.
+func WithExpiredDocumentPurgeInterval(interval time.Duration) Option {
+	return func(opts *Provider) {
+		opts.purgeInterval = interval
+	}
+}
+
 // WithLogger is an option for specifying a custom logger.
 // The standard Golang logger will be used if this option is not provided.
 func WithLogger(logger logger) Option {
@@ -183,6 +318,10 @@ func WithLogger(logger logger) Option {
 
 // PingCouchDB performs a readiness check on the CouchDB instance located at url.
 func PingCouchDB(url string) error {
+	return pingCouchDB(context.Background(), url)
+}
+
+func pingCouchDB(ctx context.Context, url string) error {
 	if url == "" {
 		return errors.New("url can't be blank")
 	}
@@ -192,7 +331,7 @@ func PingCouchDB(url string) error {
 		return err
 	}
 
-	exists, err := client.DBExists(context.Background(), couchDBUsersTable)
+	exists, err := client.DBExists(ctx, couchDBUsersTable)
 	if err != nil {
 		return fmt.Errorf("failed to probe couchdb for '%s' DB at %s: %w", couchDBUsersTable, url, err)
 	}
@@ -206,9 +345,14 @@ func PingCouchDB(url string) error {
 }
 
 // NewProvider instantiates a new CouchDB Provider.
-// TODO (#48): Allow context to be passed in.
 func NewProvider(hostURL string, opts ...Option) (*Provider, error) {
-	err := PingCouchDB(hostURL)
+	return NewProviderWithContext(context.Background(), hostURL, opts...)
+}
+
+// NewProviderWithContext instantiates a new CouchDB Provider, giving up on reaching the CouchDB instance if ctx is
+// done first.
+func NewProviderWithContext(ctx context.Context, hostURL string, opts ...Option) (*Provider, error) {
+	err := pingCouchDB(ctx, hostURL)
 	if err != nil {
 		return nil, fmt.Errorf("failed to ping couchDB: %w", err)
 	}
@@ -232,6 +376,10 @@ func NewProvider(hostURL string, opts ...Option) (*Provider, error) {
 		p.maxDocumentConflictRetries = 3
 	}
 
+	if p.purgeInterval <= 0 {
+		p.purgeInterval = defaultExpiredDocumentPurgeInterval
+	}
+
 	if p.logger == nil {
 		p.logger = &defaultLogger{
 			log.New(os.Stdout, "CouchDB-Provider ", log.Ldate|log.Ltime|log.LUTC),
@@ -241,8 +389,10 @@ func NewProvider(hostURL string, opts ...Option) (*Provider, error) {
 	return p, nil
 }
 
-// OpenStore opens a store with the given name and returns a handle.
+// OpenStore opens a store with the given name and returns a handle, which is also a TTLStore, a VersionedStore, a
+// ContextStore and a WatchableStore.
 // If the store has never been opened before, then it is created.
+// Until it's closed, the store deletes its expired documents periodically.
 func (p *Provider) OpenStore(name string) (storage.Store, error) {
 	if name == "" {
 		return nil, fmt.Errorf("store name cannot be empty")
@@ -315,7 +465,9 @@ func (p *Provider) GetStoreConfig(name string) (storage.StoreConfiguration, erro
 	var tags []string
 
 	for _, index := range indexes {
-		if index.Name != "_all_docs" { // _all_docs is the CouchDB default index on the document ID
+		// _all_docs is the CouchDB default index on the document ID, and the expiry index isn't set by the store
+		// configuration.
+		if index.Name != "_all_docs" && index.DesignDoc != expiryDesignDocumentNameWithPath {
 			tags = append(tags, strings.TrimSuffix(index.Name, "_index"))
 		}
 	}
@@ -384,11 +536,19 @@ func (p *Provider) createStore(name string) (storage.Store, error) {
 		return nil, fmt.Errorf(failGetDatabaseHandle, err)
 	}
 
+	// Creating an index that already exists does nothing.
+	err = p.createIndex(db, expiryDesignDocumentName, expireAtIndexName, `{"fields": ["expireAt"]}`, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create expiry index: %w", err)
+	}
+
 	newStore := &store{
 		name: name, logger: p.logger, db: db, maxDocumentConflictRetries: p.maxDocumentConflictRetries,
-		marshal: json.Marshal, close: p.removeStore,
+		marshal: json.Marshal, close: p.removeStore, closed: make(chan struct{}),
 	}
 
+	go newStore.purgeExpiredDocumentsPeriodically(p.purgeInterval)
+
 	p.openStores[name] = newStore
 
 	return newStore, nil
@@ -431,8 +591,8 @@ func (p *Provider) updateIndexes(db db, config storage.StoreConfiguration,
 	tagNameIndexesAlreadyConfigured := make(map[string]struct{})
 
 	for _, existingIndex := range existingIndexes {
-		// Ignore _all_docs, which is the CouchDB default index on the document ID field
-		if existingIndex.Name != "_all_docs" {
+		// Ignore _all_docs, which is the CouchDB default index on the document ID field, and the expiry index
+		if existingIndex.Name != "_all_docs" && existingIndex.DesignDoc != expiryDesignDocumentNameWithPath {
 			existingTagName := strings.TrimSuffix(existingIndex.Name, "_index")
 
 			var existingTagIsInNewConfig bool
@@ -478,41 +638,44 @@ func (p *Provider) updateIndexes(db db, config storage.StoreConfiguration,
 
 func (p *Provider) createIndexes(db db, tagNamesNeedIndexCreation []string, storeName string) error {
 	for _, tagName := range tagNamesNeedIndexCreation {
-		var attemptsMade int
-
-		err := backoff.Retry(func() error {
-			attemptsMade++
+		err := p.createIndex(db, designDocumentName, tagName+"_index", `{"fields": ["tags.`+tagName+`"]}`, storeName)
+		if err != nil {
+			return err
+		}
+	}
 
-			err := db.CreateIndex(context.Background(), designDocumentName, tagName+"_index",
-				`{"fields": ["tags.`+tagName+`"]}`)
-			if err != nil {
-				// If there are multiple CouchDB Providers trying to set store configurations, it's possible
-				// to get a document update conflict. In cases where those multiple CouchDB providers are trying
-				// to set the exact same store configuration, retrying here allows them to succeed without failing
-				// unnecessarily.
-				if err.Error() == mangoIndexDesignDocumentUpdateConflictErrMsgFromKivik {
-					p.logger.Infof("[Store name: %s] Attempt %d - design document update conflict while creating "+
-						"index for %s. This can happen if multiple CouchDB providers set the store configuration at the "+
-						"same time.", storeName, attemptsMade, tagName)
-
-					return fmt.Errorf(failCreateIndexDueToConflict, attemptsMade, err)
-				}
+	return nil
+}
 
-				// This is an unexpected error.
-				return backoff.Permanent(fmt.Errorf(failCreateIndex, err))
-			}
+func (p *Provider) createIndex(db db, designDocName, indexName, index, storeName string) error {
+	var attemptsMade int
 
-			p.logger.Infof("[Store name: %s] Attempt %d - successfully created index for %s.",
-				storeName, attemptsMade, tagName)
+	return backoff.Retry(func() error {
+		attemptsMade++
 
-			return nil
-		}, backoff.WithMaxRetries(backoff.NewConstantBackOff(time.Millisecond), uint64(p.maxDocumentConflictRetries)))
+		err := db.CreateIndex(context.Background(), designDocName, indexName, index)
 		if err != nil {
-			return err
+			// If there are multiple CouchDB Providers trying to set store configurations, it's possible
+			// to get a document update conflict. In cases where those multiple CouchDB providers are trying
+			// to set the exact same store configuration, retrying here allows them to succeed without failing
+			// unnecessarily.
+			if err.Error() == mangoIndexDesignDocumentUpdateConflictErrMsgFromKivik {
+				p.logger.Infof("[Store name: %s] Attempt %d - design document update conflict while creating "+
+					"index %s. This can happen if multiple CouchDB providers set the store configuration at the "+
+					"same time.", storeName, attemptsMade, indexName)
+
+				return fmt.Errorf(failCreateIndexDueToConflict, attemptsMade, err)
+			}
+
+			// This is an unexpected error.
+			return backoff.Permanent(fmt.Errorf(failCreateIndex, err))
 		}
-	}
 
-	return nil
+		p.logger.Infof("[Store name: %s] Attempt %d - successfully created index %s.",
+			storeName, attemptsMade, indexName)
+
+		return nil
+	}, backoff.WithMaxRetries(backoff.NewConstantBackOff(time.Millisecond), uint64(p.maxDocumentConflictRetries)))
 }
 
 func (p *Provider) updateMapReduceDesignDocument(name string, config storage.StoreConfiguration, db db) error {
@@ -602,6 +765,8 @@ type store struct {
 	maxDocumentConflictRetries int
 	marshal                    marshalFunc
 	close                      closer
+	closed                     chan struct{}
+	closeOnce                  sync.Once
 }
 
 // Put stores the key + value pair along with the (optional) tags.
@@ -609,6 +774,102 @@ type store struct {
 //  Should all store implementations require tags to be defined in store config before allowing them to be used?
 // TODO (#81) If data is binary and large, store as CouchDB attachment instead.
 func (s *store) Put(k string, v []byte, tags ...storage.Tag) error {
+	return s.PutWithContext(context.Background(), k, v, tags...)
+}
+
+// PutWithContext stores the key + value pair along with the (optional) tags, giving up once ctx is done.
+func (s *store) PutWithContext(ctx context.Context, k string, v []byte, tags ...storage.Tag) error {
+	return s.putValue(ctx, k, v, tags, 0)
+}
+
+// PutWithTTL stores the key + value pair along with the (optional) tags, and has the entry deleted once ttl has
+// elapsed. ttl must be positive.
+func (s *store) PutWithTTL(k string, v []byte, ttl time.Duration, tags ...storage.Tag) error {
+	if ttl <= 0 {
+		return errors.New("ttl must be positive")
+	}
+
+	return s.putValue(context.Background(), k, v, tags, unixMilli(time.Now().Add(ttl)))
+}
+
+// PutIfVersion stores the key + value pair along with the (optional) tags, provided the document's current revision ID
+// is version, or provided there's no document if version is blank. Unlike Put, it doesn't retry on document update
+// conflicts, but returns ErrVersionConflict. It returns the document's new revision ID.
+func (s *store) PutIfVersion(k string, v []byte, version string, tags ...storage.Tag) (string, error) {
+	errInputValidation := validatePutInput(k, v, tags)
+	if errInputValidation != nil {
+		return "", errInputValidation
+	}
+
+	if version != "" {
+		// CouchDB would accept the revision of an expired document that hasn't been purged yet, but the document
+		// counts as missing, so no version matches it.
+		_, err := s.getDocument(context.Background(), k)
+		if errors.Is(err, storage.ErrDataNotFound) {
+			return "", ErrVersionConflict
+		}
+
+		if err != nil {
+			return "", err
+		}
+	}
+
+	newDocument := document{RevisionID: version, Value: v}
+
+	setDocumentTags(&newDocument, tags)
+
+	newVersion, err := s.putRevision(context.Background(), k, newDocument)
+	if !errors.Is(err, ErrVersionConflict) || version != "" {
+		return newVersion, err
+	}
+
+	// An expired document that hasn't been purged yet counts as missing, so it's overwritten.
+	expiredRevID, errExpired := s.getExpiredRevID(context.Background(), k)
+	if errExpired != nil || expiredRevID == "" {
+		return "", err
+	}
+
+	newDocument.RevisionID = expiredRevID
+
+	return s.putRevision(context.Background(), k, newDocument)
+}
+
+// putRevision puts documentToPut as is, returning ErrVersionConflict if its revision ID isn't the current one.
+func (s *store) putRevision(ctx context.Context, k string, documentToPut document) (string, error) {
+	documentBytes, err := s.marshal(documentToPut)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal document: %w", err)
+	}
+
+	revID, err := s.db.Put(ctx, k, documentBytes)
+	if err != nil {
+		if err.Error() == documentUpdateConflictErrMsgFromKivik {
+			return "", ErrVersionConflict
+		}
+
+		return "", fmt.Errorf(failPutValueViaClient, err)
+	}
+
+	return revID, nil
+}
+
+// getExpiredRevID returns the revision ID of the document stored under k if it has expired, or a blank ID otherwise.
+func (s *store) getExpiredRevID(ctx context.Context, k string) (string, error) {
+	var retrievedDocument document
+
+	err := s.db.Get(ctx, k).ScanDoc(&retrievedDocument)
+	if err != nil {
+		return "", err
+	}
+
+	if !isExpired(&retrievedDocument) {
+		return "", nil
+	}
+
+	return retrievedDocument.RevisionID, nil
+}
+
+func (s *store) putValue(ctx context.Context, k string, v []byte, tags []storage.Tag, expireAt int64) error {
 	errInputValidation := validatePutInput(k, v, tags)
 	if errInputValidation != nil {
 		return errInputValidation
@@ -617,10 +878,11 @@ func (s *store) Put(k string, v []byte, tags ...storage.Tag) error {
 	var newDocument document
 
 	newDocument.Value = v
+	newDocument.ExpireAt = expireAt
 
 	setDocumentTags(&newDocument, tags)
 
-	err := s.put(k, newDocument)
+	err := s.put(ctx, k, newDocument)
 	if err != nil {
 		return fmt.Errorf("failure while putting document into CouchDB database: %w", err)
 	}
@@ -630,35 +892,44 @@ func (s *store) Put(k string, v []byte, tags ...storage.Tag) error {
 
 // Get fetches the value associated with the given key.
 func (s *store) Get(k string) ([]byte, error) {
-	if k == "" {
-		return nil, errors.New("key is mandatory")
-	}
+	return s.GetWithContext(context.Background(), k)
+}
 
-	var retrievedDocument document
+// GetWithContext fetches the value associated with the given key, giving up once ctx is done.
+func (s *store) GetWithContext(ctx context.Context, k string) ([]byte, error) {
+	retrievedDocument, err := s.getDocument(ctx, k)
+	if err != nil {
+		return nil, err
+	}
 
-	row := s.db.Get(context.Background(), k)
+	return retrievedDocument.Value, nil
+}
 
-	err := row.ScanDoc(&retrievedDocument)
+// GetWithVersion fetches the value associated with the given key, along with the document's current revision ID,
+// which is its version.
+func (s *store) GetWithVersion(k string) ([]byte, string, error) {
+	retrievedDocument, err := s.getDocument(context.Background(), k)
 	if err != nil {
-		if err.Error() == docNotFoundErrMsgFromKivik || err.Error() == docDeletedErrMsgFromKivik {
-			return nil, fmt.Errorf(failureWhileScanningRow, storage.ErrDataNotFound)
-		}
-
-		return nil, fmt.Errorf(failureWhileScanningRow, err)
+		return nil, "", err
 	}
 
-	return retrievedDocument.Value, nil
+	return retrievedDocument.Value, retrievedDocument.RevisionID, nil
 }
 
 // GetTags fetches all tags associated with the given key.
 func (s *store) GetTags(k string) ([]storage.Tag, error) {
+	return s.GetTagsWithContext(context.Background(), k)
+}
+
+// GetTagsWithContext fetches all tags associated with the given key, giving up once ctx is done.
+func (s *store) GetTagsWithContext(ctx context.Context, k string) ([]storage.Tag, error) {
 	if k == "" {
 		return nil, errors.New("key is mandatory")
 	}
 
 	var retrievedDocument document
 
-	row := s.db.Get(context.Background(), k)
+	row := s.db.Get(ctx, k)
 
 	err := row.ScanDoc(&retrievedDocument)
 	if err != nil {
@@ -669,6 +940,10 @@ func (s *store) GetTags(k string) ([]storage.Tag, error) {
 		return nil, err
 	}
 
+	if isExpired(&retrievedDocument) {
+		return nil, storage.ErrDataNotFound
+	}
+
 	tags, err := getTagsFromDocument(&retrievedDocument)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get tags from document: %w", err)
@@ -680,11 +955,16 @@ func (s *store) GetTags(k string) ([]storage.Tag, error) {
 // GetBulk fetches the values associated with the given keys.
 // If a key doesn't exist, then a nil []byte is returned for that value. It is not considered an error.
 func (s *store) GetBulk(keys ...string) ([][]byte, error) {
+	return s.GetBulkWithContext(context.Background(), keys...)
+}
+
+// GetBulkWithContext fetches the values associated with the given keys, giving up once ctx is done.
+func (s *store) GetBulkWithContext(ctx context.Context, keys ...string) ([][]byte, error) {
 	if len(keys) == 0 {
 		return nil, errors.New("keys slice must contain at least one key")
 	}
 
-	documents, err := s.getDocuments(keys)
+	documents, err := s.getDocuments(ctx, keys)
 	if err != nil {
 		return nil, fmt.Errorf(failGetDocs, err)
 	}
@@ -694,20 +974,33 @@ func (s *store) GetBulk(keys ...string) ([][]byte, error) {
 
 // Query returns all data that satisfies the expression. Expression format: TagName:TagValue.
 // If TagValue is not provided, then all data associated with the TagName will be returned.
-// For now, expression can only be a single tag Name + Value pair.
+// Several TagName:TagValue (or TagName) pairs may be combined with && and ||, with && binding tighter than ||.
+// For example, "TagName1:TagValue1&&TagName2||TagName3" returns all data that either has both a TagName1 tag with a
+// value of TagValue1 and a TagName2 tag, or has a TagName3 tag.
+// Instead of a TagValue, a prefix may be given, as in "TagName:Prefix*", or a tag value may be compared using <, <=, >
+// and >=, as in "TagName<=1700000000". Comparisons are numeric if the value in the expression is a number.
+// Prefixes only match tag values stored as strings, so tag values that are numbers, e.g. "1600000000" or "1.5", are
+// never matched by a prefix; use a range instead. Since a trailing * always makes the value a prefix, tag values that
+// end in * can't be matched exactly.
 // If no options are provided, then defaults will be used.
 // If sorting is used, then the tag used for sorting must be indexed.
-// For improved performance with large datasets, ensure that the tag name you are querying is included in the store
-// config, as this will ensure that it's indexed in CouchDB.
+// For improved performance with large datasets, ensure that the tag names you are querying are included in the store
+// config, as this will ensure that they're indexed in CouchDB.
 func (s *store) Query(expression string, options ...storage.QueryOption) (storage.Iterator, error) {
-	if expression == "" {
-		return &couchDBResultsIterator{}, errInvalidQueryExpressionFormat
+	return s.QueryWithContext(context.Background(), expression, options...)
+}
+
+// QueryWithContext returns all data that satisfies the expression, like Query, giving up once ctx is done.
+// The returned iterator also uses ctx for fetching further pages and for counting the results.
+func (s *store) QueryWithContext(ctx context.Context, expression string,
+	options ...storage.QueryOption) (storage.Iterator, error) {
+	disjunction, err := parseQueryExpression(expression)
+	if err != nil {
+		return &couchDBResultsIterator{}, err
 	}
 
 	queryOptions := getQueryOptions(options)
 
-	expressionSplit := strings.Split(expression, ":")
-
 	query := findQuery{
 		Limit: queryOptions.PageSize,
 		Skip:  queryOptions.InitialPageNum * queryOptions.PageSize,
@@ -725,34 +1018,34 @@ func (s *store) Query(expression string, options ...storage.QueryOption) (storag
 			sortOptionsTemplate, queryOptions.SortOptions.TagName, sortOrder))
 	}
 
-	var resultRows *kivik.Rows
+	selector, err := createMangoSelector(disjunction)
+	if err != nil {
+		return nil, err
+	}
+
+	query.Selector = json.RawMessage(fmt.Sprintf(andSelectorTemplate, selector,
+		fmt.Sprintf(notExpiredSelectorTemplate, unixMilli(time.Now()))))
 
 	var queryTagName, queryTagValue string
 
-	switch len(expressionSplit) {
-	case expressionTagNameOnlyLength:
-		queryTagName = expressionSplit[0]
-		query.Selector = json.RawMessage(fmt.Sprintf(fieldNameExistsSelectorTemplate, queryTagName))
-	case expressionTagNameAndValueLength:
-		queryTagName = expressionSplit[0]
-		queryTagValue = expressionSplit[1]
-		query.Selector = json.RawMessage(fmt.Sprintf(fieldNameAndValueSelectorTemplate,
-			queryTagName, queryTagValue))
-	default:
-		return &couchDBResultsIterator{}, errInvalidQueryExpressionFormat
+	if len(disjunction) == 1 && len(disjunction[0]) == 1 && isCountableByView(disjunction[0][0]) {
+		queryTagName = disjunction[0][0].name
+		queryTagValue = disjunction[0][0].value
 	}
 
-	resultRows, err := s.executeFindQuery(&query)
+	resultRows, err := s.executeFindQuery(ctx, &query)
 	if err != nil {
 		return nil, err
 	}
 
 	return &couchDBResultsIterator{
+		ctx:           ctx,
 		store:         s,
 		resultRows:    resultRows,
 		pageSize:      queryOptions.PageSize,
 		queryTagName:  queryTagName,
 		queryTagValue: queryTagValue,
+		selector:      selector,
 		findQuery:     query,
 		marshal:       json.Marshal,
 	}, nil
@@ -760,11 +1053,16 @@ func (s *store) Query(expression string, options ...storage.QueryOption) (storag
 
 // Delete deletes the key + value pair (and all tags) associated with k.
 func (s *store) Delete(k string) error {
+	return s.DeleteWithContext(context.Background(), k)
+}
+
+// DeleteWithContext deletes the key + value pair (and all tags) associated with k, giving up once ctx is done.
+func (s *store) DeleteWithContext(ctx context.Context, k string) error {
 	if k == "" {
 		return errors.New("key is mandatory")
 	}
 
-	revID, err := s.getRevID(k)
+	revID, err := s.getRevID(ctx, k)
 	if err != nil {
 		return fmt.Errorf(failGetRevisionID, err)
 	}
@@ -775,7 +1073,7 @@ func (s *store) Delete(k string) error {
 		return nil
 	}
 
-	_, err = s.db.Delete(context.TODO(), k, revID)
+	_, err = s.db.Delete(ctx, k, revID)
 	if err != nil {
 		return fmt.Errorf("failed to delete document via client: %w", err)
 	}
@@ -784,7 +1082,16 @@ func (s *store) Delete(k string) error {
 }
 
 // Batch performs multiple Put and/or Delete operations in order.
+// Operations that fail due to a document update conflict, which can happen if multiple CouchDB providers store data
+// under the same keys at the same time, are retried up to the maximum number of document conflict retries. If any
+// operations still fail, then a storage.MultiError is returned, holding an error for each operation in operations,
+// which is nil for the operations that succeeded.
 func (s *store) Batch(operations []storage.Operation) error {
+	return s.BatchWithContext(context.Background(), operations)
+}
+
+// BatchWithContext performs multiple Put and/or Delete operations in order, like Batch, giving up once ctx is done.
+func (s *store) BatchWithContext(ctx context.Context, operations []storage.Operation) error {
 	if len(operations) == 0 {
 		return errors.New("batch requires at least one operation")
 	}
@@ -793,17 +1100,61 @@ func (s *store) Batch(operations []storage.Operation) error {
 	// disregard the rest. We want the opposite behaviour - we need it to only keep the last operation and disregard
 	// the earlier ones as if they've been overwritten or deleted.
 	// Note that due to this, CouchDB will not have any revision history of those duplicates.
-	operations = removeDuplicatesKeepingOnlyLast(operations)
+	pendingOperations := removeDuplicatesKeepingOnlyLast(append([]storage.Operation(nil), operations...))
+
+	// The error of the last attempt at each operation that failed, by key.
+	failures := make(map[string]error)
+
+	var attemptsMade int
+
+	var errBulkDocs error
+
+	errConflicts := backoff.Retry(func() error {
+		attemptsMade++
+
+		pendingOperations, errBulkDocs = s.bulkDocs(ctx, pendingOperations, failures)
+		if errBulkDocs != nil {
+			return backoff.Permanent(errBulkDocs)
+		}
+
+		if len(pendingOperations) > 0 {
+			s.logger.Infof("[Store name: %s] Attempt %d - %d document update conflicts in batch. "+
+				"This can happen if multiple CouchDB providers store data under the same key at the same time.",
+				s.name, attemptsMade, len(pendingOperations))
 
+			return errors.New("document update conflicts in batch")
+		}
+
+		return nil
+	}, backoff.WithMaxRetries(backoff.NewConstantBackOff(time.Millisecond), uint64(s.maxDocumentConflictRetries)))
+	if errBulkDocs != nil {
+		return errBulkDocs
+	}
+
+	if errConflicts != nil {
+		for _, operation := range pendingOperations {
+			failures[operation.Key] = fmt.Errorf(failUpdateDocumentDueToConflict,
+				operation.Key, attemptsMade, failures[operation.Key])
+		}
+	}
+
+	return newBatchError(operations, failures)
+}
+
+// bulkDocs does the operations, which must all be on different keys, in a single bulk docs call. Failures are recorded
+// in failures by key, and the keys of operations that succeeded are removed from it.
+// It returns the operations that failed due to a document update conflict, which may succeed if they're retried.
+func (s *store) bulkDocs(ctx context.Context, operations []storage.Operation,
+	failures map[string]error) ([]storage.Operation, error) {
 	keys := make([]string, len(operations))
 
 	for i, operation := range operations {
 		keys[i] = operation.Key
 	}
 
-	existingDocuments, err := s.getDocuments(keys)
+	existingDocuments, err := s.getDocuments(ctx, keys)
 	if err != nil {
-		return fmt.Errorf(failGetDocs, err)
+		return nil, fmt.Errorf(failGetDocs, err)
 	}
 
 	documentsToPut := make([]interface{}, len(existingDocuments))
@@ -831,19 +1182,59 @@ func (s *store) Batch(operations []storage.Operation) error {
 		documentsToPut[i] = newDocument
 	}
 
-	// TODO (#50): Examine BulkResults value returned from s.db.BulkDocs and return a storage.MultiError.
-	_, err = s.db.BulkDocs(context.Background(), documentsToPut)
+	results, err := s.db.BulkDocs(ctx, documentsToPut)
 	if err != nil {
-		return fmt.Errorf("failure while doing CouchDB bulk docs call: %w", err)
+		return nil, fmt.Errorf("failure while doing CouchDB bulk docs call: %w", err)
 	}
 
-	return nil
+	return checkBulkResults(operations, results, failures)
+}
+
+// checkBulkResults records the outcome of each operation, as given by results, in failures.
+// It returns the operations that failed due to a document update conflict.
+func checkBulkResults(operations []storage.Operation, results bulkResults,
+	failures map[string]error) ([]storage.Operation, error) {
+	operationsByKey := make(map[string]storage.Operation, len(operations))
+
+	for _, operation := range operations {
+		operationsByKey[operation.Key] = operation
+	}
+
+	var conflictingOperations []storage.Operation
+
+	for results.Next() {
+		errUpdate := results.UpdateErr()
+		if errUpdate == nil {
+			delete(failures, results.ID())
+
+			continue
+		}
+
+		failures[results.ID()] = errUpdate
+
+		if kivik.StatusCode(errUpdate) == http.StatusConflict {
+			conflictingOperations = append(conflictingOperations, operationsByKey[results.ID()])
+		}
+	}
+
+	err := results.Err()
+	if err != nil {
+		return nil, fmt.Errorf("failure during iteration of bulk docs results: %w", err)
+	}
+
+	return conflictingOperations, nil
 }
 
 // Close closes this store.
 func (s *store) Close() error {
 	s.close(s.name)
 
+	s.closeOnce.Do(func() {
+		if s.closed != nil {
+			close(s.closed)
+		}
+	})
+
 	err := s.db.Close(context.Background())
 	if err != nil {
 		return fmt.Errorf("failed to close database client: %w", err)
@@ -857,13 +1248,75 @@ func (s *store) Flush() error {
 	return nil
 }
 
-func (s *store) put(k string, documentToPut document) error {
+// purgeExpiredDocumentsPeriodically deletes this store's expired documents every interval until the store is closed.
+func (s *store) purgeExpiredDocumentsPeriodically(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-ticker.C:
+			err := s.purgeExpiredDocuments()
+			if err != nil {
+				s.logger.Warnf("[Store name: %s] Failed to purge expired documents: %s", s.name, err.Error())
+			}
+		}
+	}
+}
+
+// purgeExpiredDocuments deletes the documents that have expired, purgeBatchSize documents at a time.
+func (s *store) purgeExpiredDocuments() error {
+	query := findQuery{
+		Selector: json.RawMessage(fmt.Sprintf(expiredSelectorTemplate, unixMilli(time.Now()))),
+		Limit:    purgeBatchSize,
+		Fields:   []string{"_id", "_rev"},
+	}
+
+	for {
+		resultRows, err := s.executeFindQuery(context.Background(), &query)
+		if err != nil {
+			return err
+		}
+
+		expiredDocuments, err := getDocumentsFromRows(resultRows)
+		if err != nil {
+			return fmt.Errorf("failed to get documents from rows: %w", err)
+		}
+
+		if len(expiredDocuments) == 0 {
+			return nil
+		}
+
+		documentsToDelete := make([]interface{}, len(expiredDocuments))
+
+		for i, expiredDocument := range expiredDocuments {
+			documentsToDelete[i] = document{ID: expiredDocument.ID, RevisionID: expiredDocument.RevisionID, Deleted: true}
+		}
+
+		// Documents updated since they were found are left alone, since the deletion conflicts. If they're still
+		// expired, they'll be deleted next time.
+		_, err = s.db.BulkDocs(context.Background(), documentsToDelete)
+		if err != nil {
+			return fmt.Errorf("failure while doing CouchDB bulk docs call: %w", err)
+		}
+
+		if len(expiredDocuments) < purgeBatchSize {
+			return nil
+		}
+
+		query.Bookmark = resultRows.Bookmark()
+	}
+}
+
+func (s *store) put(ctx context.Context, k string, documentToPut document) error {
 	var attemptsMade int
 
 	err := backoff.Retry(func() error {
 		attemptsMade++
 
-		revID, err := s.getRevID(k)
+		revID, err := s.getRevID(ctx, k)
 		if err != nil {
 			// This is an unexpected error. Return a backoff.Permanent wrapped error to prevent further retries.
 			return backoff.Permanent(fmt.Errorf(failGetRevisionID, err))
@@ -878,7 +1331,7 @@ func (s *store) put(k string, documentToPut document) error {
 			return fmt.Errorf("failed to marshal document: %w", err)
 		}
 
-		_, err = s.db.Put(context.Background(), k, documentBytes)
+		_, err = s.db.Put(ctx, k, documentBytes)
 		if err != nil {
 			if err.Error() == documentUpdateConflictErrMsgFromKivik {
 				// This means that the document was updated since we got the revision ID.
@@ -904,11 +1357,36 @@ func (s *store) put(k string, documentToPut document) error {
 	return nil
 }
 
+func (s *store) getDocument(ctx context.Context, k string) (*document, error) {
+	if k == "" {
+		return nil, errors.New("key is mandatory")
+	}
+
+	var retrievedDocument document
+
+	row := s.db.Get(ctx, k)
+
+	err := row.ScanDoc(&retrievedDocument)
+	if err != nil {
+		if err.Error() == docNotFoundErrMsgFromKivik || err.Error() == docDeletedErrMsgFromKivik {
+			return nil, fmt.Errorf(failureWhileScanningRow, storage.ErrDataNotFound)
+		}
+
+		return nil, fmt.Errorf(failureWhileScanningRow, err)
+	}
+
+	if isExpired(&retrievedDocument) {
+		return nil, fmt.Errorf(failureWhileScanningRow, storage.ErrDataNotFound)
+	}
+
+	return &retrievedDocument, nil
+}
+
 // If the document can't be found, then a blank ID is returned.
-func (s *store) getRevID(k string) (string, error) {
+func (s *store) getRevID(ctx context.Context, k string) (string, error) {
 	var retrievedDocument document
 
-	row := s.db.Get(context.Background(), k)
+	row := s.db.Get(ctx, k)
 
 	err := row.ScanDoc(&retrievedDocument)
 	if err != nil {
@@ -925,13 +1403,13 @@ func (s *store) getRevID(k string) (string, error) {
 
 // getDocuments returns documents from CouchDB using a bulk REST call.
 // If a document is not found, then the document will be nil. It is not considered an error.
-func (s *store) getDocuments(keys []string) ([]*document, error) {
+func (s *store) getDocuments(ctx context.Context, keys []string) ([]*document, error) {
 	bulkGetReferences := make([]kivik.BulkGetReference, len(keys))
 	for i, key := range keys {
 		bulkGetReferences[i].ID = key
 	}
 
-	rows, err := s.db.BulkGet(context.Background(), bulkGetReferences)
+	rows, err := s.db.BulkGet(ctx, bulkGetReferences)
 	if err != nil {
 		return nil, fmt.Errorf("failure while sending request to CouchDB bulk docs endpoint: %w", err)
 	}
@@ -948,13 +1426,13 @@ func (s *store) getDocuments(keys []string) ([]*document, error) {
 	return documents, nil
 }
 
-func (s *store) executeFindQuery(query *findQuery) (*kivik.Rows, error) {
+func (s *store) executeFindQuery(ctx context.Context, query *findQuery) (*kivik.Rows, error) {
 	findQueryBytes, err := s.marshal(query)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal find query to JSON: %w", err)
 	}
 
-	resultRows, err := s.db.Find(context.Background(), findQueryBytes)
+	resultRows, err := s.db.Find(ctx, findQueryBytes)
 	if err != nil {
 		return nil, fmt.Errorf(failSendRequestToFindEndpoint, err)
 	}
@@ -963,11 +1441,13 @@ func (s *store) executeFindQuery(query *findQuery) (*kivik.Rows, error) {
 }
 
 type couchDBResultsIterator struct {
+	ctx                            context.Context
 	store                          *store
 	resultRows                     rows
 	pageSize                       int
 	queryTagName                   string
 	queryTagValue                  string
+	selector                       json.RawMessage
 	findQuery                      findQuery
 	numDocumentsReturnedInThisPage int
 	marshal                        marshalFunc
@@ -1075,7 +1555,33 @@ func (i *couchDBResultsIterator) Tags() ([]storage.Tag, error) {
 
 // This runs a separate query on CouchDB, so the total item count returned reflects the current state of the database,
 // which may have changed since this iterator was created.
+// Queries combining several tags, or matching tag values by prefix or comparison, can't be counted using a view, so
+// their results are counted using the find endpoint instead.
+// Views also count documents that have expired but haven't been purged yet, so those are counted separately and
+// taken off.
 func (i *couchDBResultsIterator) TotalItems() (int, error) {
+	now := unixMilli(time.Now())
+
+	if i.queryTagName == "" {
+		return i.countFindQueryResults(json.RawMessage(fmt.Sprintf(andSelectorTemplate, i.selector,
+			fmt.Sprintf(notExpiredSelectorTemplate, now))))
+	}
+
+	count, err := i.countViewResults()
+	if err != nil {
+		return -1, err
+	}
+
+	expiredCount, err := i.countFindQueryResults(json.RawMessage(fmt.Sprintf(andSelectorTemplate, i.selector,
+		fmt.Sprintf(expiredSelectorTemplate, now))))
+	if err != nil {
+		return -1, err
+	}
+
+	return count - expiredCount, nil
+}
+
+func (i *couchDBResultsIterator) countViewResults() (int, error) {
 	var options kivik.Options
 
 	if i.queryTagValue != "" {
@@ -1084,7 +1590,7 @@ func (i *couchDBResultsIterator) TotalItems() (int, error) {
 		}
 	}
 
-	resultRows, err := i.store.db.Query(context.Background(),
+	resultRows, err := i.store.db.Query(i.ctx,
 		mapReduceDesignDocumentName,
 		fmt.Sprintf(countViewNameTemplate, i.queryTagName),
 		options)
@@ -1116,6 +1622,49 @@ func (i *couchDBResultsIterator) TotalItems() (int, error) {
 	return count, nil
 }
 
+// countFindQueryResults counts the documents matching selector by fetching their IDs from the find endpoint, one page
+// at a time.
+func (i *couchDBResultsIterator) countFindQueryResults(selector json.RawMessage) (int, error) {
+	query := findQuery{
+		Selector: selector,
+		Limit:    countPageSize,
+		Fields:   []string{"_id"},
+	}
+
+	var count int
+
+	for {
+		findQueryBytes, err := i.marshal(query)
+		if err != nil {
+			return -1, fmt.Errorf("failed to marshal find query to JSON: %w", err)
+		}
+
+		resultRows, err := i.store.db.Find(i.ctx, findQueryBytes)
+		if err != nil {
+			return -1, fmt.Errorf(failSendRequestToFindEndpoint, err)
+		}
+
+		var numDocumentsInPage int
+
+		for resultRows.Next() {
+			numDocumentsInPage++
+		}
+
+		err = resultRows.Err()
+		if err != nil {
+			return -1, fmt.Errorf("failure during iteration of result rows: %w", err)
+		}
+
+		count += numDocumentsInPage
+
+		if numDocumentsInPage < countPageSize {
+			return count, nil
+		}
+
+		query.Bookmark = resultRows.Bookmark()
+	}
+}
+
 func (i *couchDBResultsIterator) fetchAnotherPage() (bool, error) {
 	var err error
 
@@ -1129,7 +1678,7 @@ func (i *couchDBResultsIterator) fetchAnotherPage() (bool, error) {
 		return false, fmt.Errorf("failed to marshal find query to JSON: %w", err)
 	}
 
-	i.resultRows, err = i.store.db.Find(context.Background(), findQueryBytes)
+	i.resultRows, err = i.store.db.Find(i.ctx, findQueryBytes)
 	if err != nil {
 		return false, fmt.Errorf("failure while sending request to CouchDB find endpoint: %w", err)
 	}
@@ -1196,8 +1745,9 @@ func getValuesFromDocuments(documents []*document) [][]byte {
 		}
 
 		// CouchDB still returns a document if the key has been deleted, so if this is a "deleted" document
-		// then we need to return nil to indicate that the value could not be found.
-		if document.Deleted {
+		// then we need to return nil to indicate that the value could not be found. The same goes for documents that
+		// have expired but haven't been purged yet.
+		if document.Deleted || isExpired(document) {
 			storedValues[i] = nil
 
 			continue
@@ -1242,9 +1792,14 @@ func getTagsFromDocument(document *document) ([]storage.Tag, error) {
 	for tagName, tagValue := range document.Tags {
 		tagValueAsFloat64, isFloat64 := tagValue.(float64)
 		if isFloat64 {
+			tagValueAsString, isNonCanonical := document.TagValues[tagName]
+			if !isNonCanonical {
+				tagValueAsString = strconv.FormatFloat(tagValueAsFloat64, 'f', -1, 64)
+			}
+
 			tags[counter] = storage.Tag{
 				Name:  tagName,
-				Value: fmt.Sprintf("%.0f", tagValueAsFloat64),
+				Value: tagValueAsString,
 			}
 		} else {
 			tagValueAsString, isString := tagValue.(string)
@@ -1346,15 +1901,263 @@ func removeDuplicatesKeepingOnlyLast(operations []storage.Operation) []storage.O
 	return operations
 }
 
+// tagCondition is a condition on a tag, as found in a query expression. A blank operator means that the tag only
+// needs to exist.
+type tagCondition struct {
+	name     string
+	operator string
+	value    string
+}
+
+// parseQueryExpression splits expression into terms joined by ||, each of which is a list of tag conditions joined
+// by &&.
+func parseQueryExpression(expression string) ([][]tagCondition, error) {
+	if expression == "" {
+		return nil, errInvalidQueryExpressionFormat
+	}
+
+	var disjunction [][]tagCondition
+
+	for _, conjunctionExpression := range strings.Split(expression, "||") {
+		var conjunction []tagCondition
+
+		for _, conditionExpression := range strings.Split(conjunctionExpression, "&&") {
+			condition, ok := parseTagCondition(conditionExpression)
+			if !ok {
+				return nil, errInvalidQueryExpressionFormat
+			}
+
+			conjunction = append(conjunction, condition)
+		}
+
+		disjunction = append(disjunction, conjunction)
+	}
+
+	return disjunction, nil
+}
+
+// parseTagCondition parses a condition in one of the formats TagName, TagName:TagValue, TagName:TagValuePrefix*,
+// TagName<TagValue, TagName<=TagValue, TagName>TagValue or TagName>=TagValue. It returns false if conditionExpression
+// isn't in any of these formats.
+func parseTagCondition(conditionExpression string) (tagCondition, bool) {
+	operatorIndex := strings.IndexAny(conditionExpression, ":<>")
+	if operatorIndex == -1 {
+		return tagCondition{name: conditionExpression}, conditionExpression != ""
+	}
+
+	condition := tagCondition{
+		name:     conditionExpression[:operatorIndex],
+		operator: conditionExpression[operatorIndex : operatorIndex+1],
+		value:    conditionExpression[operatorIndex+1:],
+	}
+
+	switch {
+	case condition.operator != equalsOperator:
+		if strings.HasPrefix(condition.value, "=") {
+			condition.operator += "="
+			condition.value = condition.value[1:]
+		}
+
+		if condition.value == "" {
+			return condition, false
+		}
+	case strings.HasSuffix(condition.value, "*"):
+		condition.operator = prefixOperator
+		condition.value = strings.TrimSuffix(condition.value, "*")
+	case condition.value == "":
+		condition.operator = ""
+	}
+
+	return condition, condition.name != "" && !strings.Contains(condition.value, ":")
+}
+
+// createMangoSelector translates a parsed query expression into a Mango selector, using $and and $or only where
+// needed.
+func createMangoSelector(disjunction [][]tagCondition) (json.RawMessage, error) {
+	conjunctionSelectors := make([]json.RawMessage, len(disjunction))
+
+	for i, conjunction := range disjunction {
+		tagSelectors := make([]json.RawMessage, len(conjunction))
+
+		for j, condition := range conjunction {
+			tagSelector, err := createTagSelector(condition)
+			if err != nil {
+				return nil, err
+			}
+
+			tagSelectors[j] = tagSelector
+		}
+
+		conjunctionSelectors[i] = tagSelectors[0]
+
+		if len(tagSelectors) > 1 {
+			selector, err := json.Marshal(map[string][]json.RawMessage{"$and": tagSelectors})
+			if err != nil {
+				return nil, fmt.Errorf("failed to marshal selector to JSON: %w", err)
+			}
+
+			conjunctionSelectors[i] = selector
+		}
+	}
+
+	if len(conjunctionSelectors) == 1 {
+		return conjunctionSelectors[0], nil
+	}
+
+	selector, err := json.Marshal(map[string][]json.RawMessage{"$or": conjunctionSelectors})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal selector to JSON: %w", err)
+	}
+
+	return selector, nil
+}
+
+// createTagSelector returns the selector for a single tag condition.
+// CouchDB orders all numbers before all strings, so comparisons are restricted to values of the same type as the
+// value in the expression. Tag values that are decimal numbers are stored as numbers, so a number only matches those.
+// A prefix is matched with a range, which can use an index on the tag, narrowed down by a regular expression since
+// the collation CouchDB uses for ranges ignores case differences in the prefix.
+func createTagSelector(condition tagCondition) (json.RawMessage, error) {
+	var operators map[string]interface{}
+
+	switch condition.operator {
+	case "":
+		return json.RawMessage(fmt.Sprintf(fieldNameExistsSelectorTemplate, condition.name)), nil
+	case equalsOperator:
+		return createTagValueSelector(condition)
+	case prefixOperator:
+		operators = map[string]interface{}{
+			"$gte":   condition.value,
+			"$lt":    condition.value + highestCollatingCharacter,
+			"$regex": "^" + regexp.QuoteMeta(condition.value),
+		}
+	default:
+		value, valueType := comparisonValue(condition.value)
+
+		operators = map[string]interface{}{
+			comparisonOperator(condition.operator): value,
+			"$type":                                valueType,
+		}
+	}
+
+	selector, err := json.Marshal(map[string]interface{}{"tags." + condition.name: operators})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal selector to JSON: %w", err)
+	}
+
+	return selector, nil
+}
+
+// createTagValueSelector returns the selector for a TagName:TagValue condition. A tag value that's stored as a number
+// is matched as one, unless it wouldn't be read back as it was written, in which case the value as it was written is
+// matched instead, so that e.g. "1.5" and "1.50" don't match each other. Documents put before decimal tag values
+// were stored as numbers have them stored as strings, so those are matched too.
+func createTagValueSelector(condition tagCondition) (json.RawMessage, error) {
+	number, isNumber := tagValueAsNumber(condition.value)
+	if !isNumber {
+		return json.RawMessage(fmt.Sprintf(fieldNameAndValueSelectorTemplate, condition.name, condition.value)), nil
+	}
+
+	numberSelector := map[string]interface{}{"tagValues." + condition.name: condition.value}
+
+	if isCanonicalNumber(number, condition.value) {
+		numberSelector = map[string]interface{}{
+			"tags." + condition.name:      number,
+			"tagValues." + condition.name: map[string]interface{}{"$exists": false},
+		}
+	}
+
+	selectorBytes, err := json.Marshal(map[string]interface{}{"$or": []interface{}{
+		numberSelector, map[string]interface{}{"tags." + condition.name: condition.value},
+	}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal selector to JSON: %w", err)
+	}
+
+	return selectorBytes, nil
+}
+
+// isCountableByView returns whether the documents matching the only condition of a query can be counted using a view.
+// Views can only count the documents with a tag, or with a tag value that's stored as a string.
+func isCountableByView(condition tagCondition) bool {
+	if condition.operator == "" {
+		return true
+	}
+
+	_, isNumber := tagValueAsNumber(condition.value)
+
+	return condition.operator == equalsOperator && !isNumber
+}
+
+// comparisonOperator returns the Mango operator for one of the comparison operators of query expressions.
+func comparisonOperator(operator string) string {
+	switch operator {
+	case "<":
+		return "$lt"
+	case "<=":
+		return "$lte"
+	case ">":
+		return "$gt"
+	default:
+		return "$gte"
+	}
+}
+
+// comparisonValue returns the number value represents along with the "number" type, or value itself along with the
+// "string" type if it isn't a number.
+func comparisonValue(value string) (interface{}, string) {
+	number, isNumber := tagValueAsNumber(value)
+	if !isNumber {
+		return value, "string"
+	}
+
+	return number, "number"
+}
+
+// tagValueAsNumber returns the number a tag value represents, and whether it's a decimal number. Such tag values are
+// stored as numbers, so that they're sorted and compared numerically.
+func tagValueAsNumber(value string) (float64, bool) {
+	number, err := strconv.ParseFloat(value, 64)
+
+	return number, err == nil && !math.IsInf(number, 0) && !math.IsNaN(number)
+}
+
+// isCanonicalNumber returns whether a number stored for value would be read back as value.
+func isCanonicalNumber(number float64, value string) bool {
+	return strconv.FormatFloat(number, 'f', -1, 64) == value
+}
+
+func isExpired(document *document) bool {
+	return document.ExpireAt != 0 && document.ExpireAt <= unixMilli(time.Now())
+}
+
+// unixMilli returns t as the number of milliseconds elapsed since the Unix epoch.
+func unixMilli(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// setDocumentTags sets the tags of document. Tag values that are decimal numbers are stored as numbers, along with
+// the values as they were written if they wouldn't be read back the same.
 func setDocumentTags(document *document, tags []storage.Tag) {
 	document.Tags = make(map[string]interface{})
+	document.TagValues = nil
 
 	for _, tag := range tags {
-		tagValueAsInt, err := strconv.Atoi(tag.Value)
-		if err != nil {
+		number, isNumber := tagValueAsNumber(tag.Value)
+		if !isNumber {
 			document.Tags[tag.Name] = tag.Value
-		} else {
-			document.Tags[tag.Name] = tagValueAsInt
+
+			continue
+		}
+
+		document.Tags[tag.Name] = number
+
+		if !isCanonicalNumber(number, tag.Value) {
+			if document.TagValues == nil {
+				document.TagValues = make(map[string]string)
+			}
+
+			document.TagValues[tag.Name] = tag.Value
 		}
 	}
 }
@@ -9,11 +9,14 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-kivik/kivik/v3"
 	spi "github.com/hyperledger/aries-framework-go/spi/storage"
@@ -27,6 +30,7 @@ type mockDB struct {
 	getRowBodyData string
 	errGetRow      error
 	errBulkGet     error
+	errChanges     error
 }
 
 func (m *mockDB) Get(context.Context, string, ...kivik.Options) *kivik.Row {
@@ -76,6 +80,10 @@ func (m *mockDB) BulkDocs(context.Context, []interface{}, ...kivik.Options) (*ki
 	panic("implement me")
 }
 
+func (m *mockDB) Changes(context.Context, ...kivik.Options) (*kivik.Changes, error) {
+	return nil, m.errChanges
+}
+
 type mockRows struct {
 	err      error
 	errClose error
@@ -107,6 +115,88 @@ func (m *mockRows) Bookmark() string {
 	return ""
 }
 
+type bulkResult struct {
+	id        string
+	errUpdate error
+}
+
+type mockBulkResults struct {
+	results []bulkResult
+	current int
+	err     error
+}
+
+func (m *mockBulkResults) Next() bool {
+	m.current++
+
+	return m.current <= len(m.results)
+}
+
+func (m *mockBulkResults) Err() error {
+	return m.err
+}
+
+func (m *mockBulkResults) ID() string {
+	return m.results[m.current-1].id
+}
+
+func (m *mockBulkResults) UpdateErr() error {
+	return m.results[m.current-1].errUpdate
+}
+
+type mockChange struct {
+	id       string
+	deleted  bool
+	seq      string
+	document string
+}
+
+type mockChangesFeed struct {
+	changes []mockChange
+	current int
+	err     error
+}
+
+func (m *mockChangesFeed) Next() bool {
+	m.current++
+
+	return m.current <= len(m.changes)
+}
+
+func (m *mockChangesFeed) Err() error {
+	return m.err
+}
+
+func (m *mockChangesFeed) Close() error {
+	return errors.New("mockChangesFeed Close always fails")
+}
+
+func (m *mockChangesFeed) ID() string {
+	return m.changes[m.current-1].id
+}
+
+func (m *mockChangesFeed) Deleted() bool {
+	return m.changes[m.current-1].deleted
+}
+
+func (m *mockChangesFeed) Seq() string {
+	return m.changes[m.current-1].seq
+}
+
+func (m *mockChangesFeed) ScanDoc(dest interface{}) error {
+	return json.Unmarshal([]byte(m.changes[m.current-1].document), dest)
+}
+
+type channelLogger struct {
+	warnings chan string
+}
+
+func (*channelLogger) Infof(string, ...interface{}) {}
+
+func (c *channelLogger) Warnf(msg string, args ...interface{}) {
+	c.warnings <- fmt.Sprintf(msg, args...)
+}
+
 func failingMarshal(interface{}) ([]byte, error) {
 	return nil, errors.New("marshal failure")
 }
@@ -156,6 +246,64 @@ func TestStore_Put_Internal(t *testing.T) {
 		require.EqualError(t, err, "failure while putting document into CouchDB database: "+
 			"failed to get revision ID: get error")
 	})
+	t.Run("Invalid TTL", func(t *testing.T) {
+		store := &store{db: &mockDB{}, marshal: json.Marshal}
+
+		err := store.PutWithTTL("key", []byte("value"), -time.Second)
+		require.EqualError(t, err, "ttl must be positive")
+	})
+}
+
+func TestStore_PutIfVersion_Internal(t *testing.T) {
+	t.Run("Document update conflict", func(t *testing.T) {
+		store := &store{
+			db: &mockDB{
+				errPut:         errors.New(documentUpdateConflictErrMsgFromKivik),
+				getRowBodyData: `{"_rev":"SomeRevID"}`,
+			},
+			marshal: json.Marshal,
+		}
+
+		version, err := store.PutIfVersion("key", []byte("value"), "OtherRevID")
+		require.True(t, errors.Is(err, ErrVersionConflict), "unexpected error or no error")
+		require.Empty(t, version)
+
+		// The document exists and hasn't expired.
+		version, err = store.PutIfVersion("key", []byte("value"), "")
+		require.True(t, errors.Is(err, ErrVersionConflict), "unexpected error or no error")
+		require.Empty(t, version)
+	})
+	t.Run("Expired document", func(t *testing.T) {
+		store := &store{
+			db:      &mockDB{getRowBodyData: `{"_rev":"SomeRevID","value":"dmFsdWU=","expireAt":1}`},
+			marshal: json.Marshal,
+		}
+
+		version, err := store.PutIfVersion("key", []byte("value"), "SomeRevID")
+		require.True(t, errors.Is(err, ErrVersionConflict), "unexpected error or no error")
+		require.Empty(t, version)
+	})
+	t.Run("Failure while getting the document", func(t *testing.T) {
+		store := &store{db: &mockDB{errGetRow: errors.New("get error")}, marshal: json.Marshal}
+
+		version, err := store.PutIfVersion("key", []byte("value"), "SomeRevID")
+		require.EqualError(t, err, "failure while scanning row: get error")
+		require.Empty(t, version)
+	})
+	t.Run("Other error while putting value via client", func(t *testing.T) {
+		store := &store{db: &mockDB{errPut: errors.New("other error")}, marshal: json.Marshal}
+
+		version, err := store.PutIfVersion("key", []byte("value"), "")
+		require.EqualError(t, err, "failed to put value via client: other error")
+		require.Empty(t, version)
+	})
+	t.Run("Fail to marshal document", func(t *testing.T) {
+		store := &store{marshal: failingMarshal}
+
+		version, err := store.PutIfVersion("key", []byte("value"), "")
+		require.EqualError(t, err, "failed to marshal document: marshal failure")
+		require.Empty(t, version)
+	})
 }
 
 func TestStore_Get_Internal(t *testing.T) {
@@ -166,6 +314,184 @@ func TestStore_Get_Internal(t *testing.T) {
 		require.EqualError(t, err, "failure while scanning row: get error")
 		require.Nil(t, value)
 	})
+	t.Run("Expired document", func(t *testing.T) {
+		store := &store{db: &mockDB{getRowBodyData: `{"value":"dmFsdWU=","expireAt":1}`}}
+
+		value, err := store.Get("key")
+		require.True(t, errors.Is(err, spi.ErrDataNotFound), "unexpected error or no error")
+		require.Nil(t, value)
+
+		tags, err := store.GetTags("key")
+		require.True(t, errors.Is(err, spi.ErrDataNotFound), "unexpected error or no error")
+		require.Nil(t, tags)
+	})
+	t.Run("With version", func(t *testing.T) {
+		store := &store{db: &mockDB{getRowBodyData: `{"_rev":"SomeRevID","value":"dmFsdWU="}`}}
+
+		value, version, err := store.GetWithVersion("key")
+		require.NoError(t, err)
+		require.Equal(t, []byte("value"), value)
+		require.Equal(t, "SomeRevID", version)
+	})
+}
+
+func TestStore_PurgeExpiredDocuments_Internal(t *testing.T) {
+	t.Run("Failure sending query to find endpoint", func(t *testing.T) {
+		store := &store{db: &mockDB{}, marshal: json.Marshal}
+
+		err := store.purgeExpiredDocuments()
+		require.EqualError(t, err,
+			"failure while sending request to CouchDB find endpoint: mockDB Find always fails")
+	})
+	t.Run("Failure is logged and purging stops once the store is closed", func(t *testing.T) {
+		logger := &channelLogger{warnings: make(chan string)}
+		store := &store{
+			name: "TestStore", logger: logger, db: &mockDB{}, marshal: json.Marshal,
+			close: func(string) {}, closed: make(chan struct{}),
+		}
+
+		stopped := make(chan struct{})
+
+		go func() {
+			store.purgeExpiredDocumentsPeriodically(time.Millisecond)
+			close(stopped)
+		}()
+
+		require.Equal(t, "[Store name: TestStore] Failed to purge expired documents: "+
+			"failure while sending request to CouchDB find endpoint: mockDB Find always fails", <-logger.warnings)
+
+		go func() {
+			for range logger.warnings { // Keep the purge loop from blocking until it stops.
+			}
+		}()
+
+		require.EqualError(t, store.Close(), "failed to close database client: mockDB Close always fails")
+		<-stopped
+		close(logger.warnings)
+	})
+}
+
+func TestCheckBulkResults(t *testing.T) {
+	operations := []spi.Operation{
+		{Key: "key1", Value: []byte("value1")},
+		{Key: "key2", Value: []byte("value2")},
+		{Key: "key3"},
+	}
+
+	t.Run("Success", func(t *testing.T) {
+		failures := map[string]error{"key1": errors.New("failure from earlier attempt")}
+
+		conflictingOperations, err := checkBulkResults(operations, &mockBulkResults{
+			results: []bulkResult{{id: "key1"}, {id: "key2"}, {id: "key3"}},
+		}, failures)
+		require.NoError(t, err)
+		require.Empty(t, conflictingOperations)
+		require.Empty(t, failures)
+	})
+	t.Run("Conflicts and other failures", func(t *testing.T) {
+		failures := make(map[string]error)
+
+		conflictingOperations, err := checkBulkResults(operations, &mockBulkResults{
+			results: []bulkResult{
+				{id: "key1", errUpdate: &kivik.Error{HTTPStatus: http.StatusConflict, Message: "conflict"}},
+				{id: "key2"},
+				{id: "key3", errUpdate: &kivik.Error{HTTPStatus: http.StatusForbidden, Message: "forbidden"}},
+			},
+		}, failures)
+		require.NoError(t, err)
+		require.Equal(t, []spi.Operation{operations[0]}, conflictingOperations)
+		require.Len(t, failures, 2)
+		require.EqualError(t, failures["key1"], "conflict")
+		require.EqualError(t, failures["key3"], "forbidden")
+	})
+	t.Run("Failure during iteration", func(t *testing.T) {
+		conflictingOperations, err := checkBulkResults(operations, &mockBulkResults{
+			err: errors.New("iteration failure"),
+		}, make(map[string]error))
+		require.EqualError(t, err, "failure during iteration of bulk docs results: iteration failure")
+		require.Nil(t, conflictingOperations)
+	})
+}
+
+func TestBatchError(t *testing.T) {
+	var err error = &batchError{errs: []error{nil, errors.New("first failure"), errors.New("second failure")}}
+
+	var multiError spi.MultiError
+
+	require.True(t, errors.As(err, &multiError))
+	require.EqualError(t, err, "2 of 3 batch operations failed. First failure: first failure")
+	require.Len(t, multiError.Errors(), 3)
+	require.NoError(t, multiError.Errors()[0])
+	require.EqualError(t, multiError.Errors()[2], "second failure")
+}
+
+func TestStore_Watch_Internal(t *testing.T) {
+	store := &store{db: &mockDB{errChanges: errors.New("changes failure")}}
+
+	changeStream, err := store.Watch(context.Background())
+	require.EqualError(t, err, "failed to open CouchDB changes feed: changes failure")
+	require.Nil(t, changeStream)
+}
+
+func TestCouchDBChangeStream_Next_Internal(t *testing.T) {
+	t.Run("Puts and deletions", func(t *testing.T) {
+		changeStream := &couchDBChangeStream{
+			ctx: context.Background(),
+			feed: &mockChangesFeed{changes: []mockChange{
+				{id: "_design/AriesStorageDesignDocument", seq: "1", document: `{}`},
+				{id: "key1", seq: "2", document: `{"value":"dmFsdWUx","tags":{"TagName1":"TagValue1"}}`},
+				{id: "key2", seq: "3", document: `{"value":"dmFsdWUy","tags":{"TagName2":"TagValue2"}}`},
+				{id: "key1", seq: "4", deleted: true, document: `{"_deleted":true}`},
+			}},
+			tagFilter: &spi.Tag{Name: "TagName1"},
+		}
+
+		change, err := changeStream.Next()
+		require.NoError(t, err)
+		require.Equal(t, Change{
+			Type: ChangePut, Key: "key1", Value: []byte("value1"),
+			Tags: []spi.Tag{{Name: "TagName1", Value: "TagValue1"}}, Checkpoint: "2",
+		}, change)
+
+		// The put of key2 doesn't pass the tag filter, but deletions always do.
+		change, err = changeStream.Next()
+		require.NoError(t, err)
+		require.Equal(t, Change{Type: ChangeDelete, Key: "key1", Checkpoint: "4"}, change)
+
+		_, err = changeStream.Next()
+		require.EqualError(t, err, "CouchDB changes feed ended")
+
+		require.EqualError(t, changeStream.Close(),
+			"failed to close CouchDB changes feed: mockChangesFeed Close always fails")
+	})
+	t.Run("Failure while scanning changed document", func(t *testing.T) {
+		changeStream := &couchDBChangeStream{
+			ctx:  context.Background(),
+			feed: &mockChangesFeed{changes: []mockChange{{id: "key1", seq: "1", document: `not JSON`}}},
+		}
+
+		_, err := changeStream.Next()
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "failed to scan changed document")
+	})
+	t.Run("Failure while reading feed", func(t *testing.T) {
+		changeStream := &couchDBChangeStream{
+			ctx:  context.Background(),
+			feed: &mockChangesFeed{err: errors.New("feed failure")},
+		}
+
+		_, err := changeStream.Next()
+		require.EqualError(t, err, "failure while reading CouchDB changes feed: feed failure")
+	})
+	t.Run("Context done", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		changeStream := &couchDBChangeStream{ctx: ctx, feed: &mockChangesFeed{}}
+
+		_, err := changeStream.Next()
+		require.True(t, errors.Is(err, context.Canceled), "unexpected error or no error")
+	})
 }
 
 func TestStore_GetBulk_Internal(t *testing.T) {
@@ -196,6 +522,111 @@ func TestStore_Query_Internal(t *testing.T) {
 			"failed to marshal find query to JSON: marshal failure")
 		require.Empty(t, iterator)
 	})
+	t.Run("Invalid boolean expressions", func(t *testing.T) {
+		store := &store{db: &mockDB{}, marshal: json.Marshal}
+
+		for _, expression := range []string{
+			"tagName1&&", "||tagName1", "tagName1:tagValue1&&:tagValue2", "tagName1<", "tagName1>=tagValue1:tagValue2",
+		} {
+			iterator, err := store.Query(expression)
+			require.EqualError(t, err, "invalid expression format. it must be in the following format: "+
+				"TagName:TagValue, optionally combined with others using && and ||")
+			require.Empty(t, iterator)
+		}
+	})
+}
+
+func TestCreateMangoSelector(t *testing.T) {
+	testCases := []struct {
+		expression       string
+		expectedSelector string
+	}{
+		{
+			expression:       "tagName1",
+			expectedSelector: `{"tags.tagName1":{"$exists":true}}`,
+		},
+		{
+			expression:       "tagName1:tagValue1",
+			expectedSelector: `{"tags.tagName1":"tagValue1"}`,
+		},
+		{
+			expression:       "tagName1:tagValue1&&tagName2",
+			expectedSelector: `{"$and":[{"tags.tagName1":"tagValue1"},{"tags.tagName2":{"$exists":true}}]}`,
+		},
+		{
+			expression:       "tagName1:tagValue1||tagName1:tagValue2",
+			expectedSelector: `{"$or":[{"tags.tagName1":"tagValue1"},{"tags.tagName1":"tagValue2"}]}`,
+		},
+		{
+			expression: "tagName1:tagValue1&&tagName2||tagName3",
+			expectedSelector: `{"$or":[{"$and":[{"tags.tagName1":"tagValue1"},{"tags.tagName2":{"$exists":true}}]},` +
+				`{"tags.tagName3":{"$exists":true}}]}`,
+		},
+		{
+			expression:       "tagName1<=1700000000",
+			expectedSelector: `{"tags.tagName1":{"$lte":1700000000,"$type":"number"}}`,
+		},
+		{
+			expression: "tagName1:1.5",
+			expectedSelector: `{"$or":[{"tags.tagName1":1.5,"tagValues.tagName1":{"$exists":false}},` +
+				`{"tags.tagName1":"1.5"}]}`,
+		},
+		{
+			expression:       "tagName1:1.50",
+			expectedSelector: `{"$or":[{"tagValues.tagName1":"1.50"},{"tags.tagName1":"1.50"}]}`,
+		},
+		{
+			expression:       "tagName1>-0.5",
+			expectedSelector: `{"tags.tagName1":{"$gt":-0.5,"$type":"number"}}`,
+		},
+		{
+			expression:       "tagName1>tagValue1",
+			expectedSelector: `{"tags.tagName1":{"$gt":"tagValue1","$type":"string"}}`,
+		},
+		{
+			expression: "tagName1:tag.Value*",
+			expectedSelector: `{"tags.tagName1":{"$gte":"tag.Value","$lt":"tag.Value\ufff0",` +
+				`"$regex":"^tag\\.Value"}}`,
+		},
+	}
+
+	for _, testCase := range testCases {
+		disjunction, err := parseQueryExpression(testCase.expression)
+		require.NoError(t, err)
+
+		selector, err := createMangoSelector(disjunction)
+		require.NoError(t, err)
+		require.JSONEq(t, testCase.expectedSelector, string(selector), testCase.expression)
+	}
+}
+
+func TestSetDocumentTags(t *testing.T) {
+	tags := []spi.Tag{
+		{Name: "string", Value: "value"},
+		{Name: "integer", Value: "42"},
+		{Name: "decimal", Value: "-1.25"},
+		{Name: "nonCanonicalDecimal", Value: "1.50"},
+		{Name: "exponent", Value: "1e3"},
+		{Name: "infinity", Value: "Inf"},
+	}
+
+	var newDocument document
+
+	setDocumentTags(&newDocument, tags)
+
+	documentBytes, err := json.Marshal(newDocument)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"tags":{"string":"value","integer":42,"decimal":-1.25,"nonCanonicalDecimal":1.5,`+
+		`"exponent":1000,"infinity":"Inf"},"tagValues":{"nonCanonicalDecimal":"1.50","exponent":"1e3"}}`,
+		string(documentBytes))
+
+	var retrievedDocument document
+
+	require.NoError(t, json.Unmarshal(documentBytes, &retrievedDocument))
+
+	retrievedTags, err := getTagsFromDocument(&retrievedDocument)
+	require.NoError(t, err)
+	require.ElementsMatch(t, tags, retrievedTags)
 }
 
 func TestStore_Close_Internal(t *testing.T) {
@@ -273,6 +704,27 @@ func TestCouchDBResultsIterator_Next_Internal(t *testing.T) {
 	})
 }
 
+func TestCouchDBResultsIterator_TotalItems_Internal(t *testing.T) {
+	t.Run("Failure counting the results of a query with several tags", func(t *testing.T) {
+		iterator := &couchDBResultsIterator{
+			store:   &store{db: &mockDB{}},
+			marshal: json.Marshal,
+		}
+
+		totalItems, err := iterator.TotalItems()
+		require.EqualError(t, err,
+			"failure while sending request to CouchDB find endpoint: mockDB Find always fails")
+		require.Equal(t, -1, totalItems)
+	})
+	t.Run("Fail to marshal count query", func(t *testing.T) {
+		iterator := &couchDBResultsIterator{marshal: failingMarshal}
+
+		totalItems, err := iterator.TotalItems()
+		require.EqualError(t, err, "failed to marshal find query to JSON: marshal failure")
+		require.Equal(t, -1, totalItems)
+	})
+}
+
 func TestCouchDBResultsIterator_Release_Internal(t *testing.T) {
 	t.Run("Fail to close result rows", func(t *testing.T) {
 		iterator := &couchDBResultsIterator{
@@ -7,15 +7,20 @@ SPDX-License-Identifier: Apache-2.0
 package couchdb_test
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"path/filepath"
+	"regexp"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/cenkalti/backoff"
+	"github.com/go-kivik/kivik/v3"
 	spi "github.com/hyperledger/aries-framework-go/spi/storage"
 	commontest "github.com/hyperledger/aries-framework-go/test/component/storage"
 	dctest "github.com/ory/dockertest/v3"
@@ -221,11 +226,13 @@ func TestNoIndexSetWarning(t *testing.T) {
 	require.False(t, anotherEntry)
 	require.NoError(t, err)
 
-	require.Equal(t, `[Store name: noindexteststore] Received warning from CouchDB. Message: `+
+	// The query also excludes expired documents, using the time it was made at.
+	require.Regexp(t, `^`+regexp.QuoteMeta(`[Store name: noindexteststore] Received warning from CouchDB. Message: `+
 		`No matching index found, create an index to optimize query time. Original query: `+
-		`{"selector":{"tags.TagNameThatWasNeverSetInStoreConfig":{"$exists":true}},"limit":25}. `+
+		`{"selector":{"$and":[{"tags.TagNameThatWasNeverSetInStoreConfig":{"$exists":true}},`+
+		`{"$or":[{"expireAt":{"$exists":false}},{"expireAt":{"$gt":`)+`\d+`+regexp.QuoteMeta(`}}]}]},"limit":25}. `+
 		`To resolve this, make sure the store configuration has been set using the Store.SetStoreConfig method. `+
-		`The store configuration must contain the tag name used in the query.`, stringLogger.log)
+		`The store configuration must contain the tag name used in the query.`)+`$`, stringLogger.log)
 }
 
 func TestMultipleProvidersSettingSameStoreConfigurationAtTheSameTime(t *testing.T) {
@@ -266,6 +273,56 @@ func TestMultipleProvidersSettingSameStoreConfigurationAtTheSameTime(t *testing.
 	waitGroup.Wait()
 }
 
+func TestMultipleProvidersBatchingSameKeysAtTheSameTime(t *testing.T) {
+	providers := make([]*Provider, 5)
+
+	for i := 0; i < 5; i++ {
+		provider, err := NewProvider(couchDBURL, WithMaxDocumentConflictRetries(20))
+		require.NoError(t, err)
+
+		providers[i] = provider
+	}
+
+	stores := make([]spi.Store, 5)
+
+	for i := 0; i < 5; i++ {
+		store, err := providers[i].OpenStore("MultipleProviderBatchTest")
+		require.NoError(t, err)
+
+		stores[i] = store
+	}
+
+	var waitGroup sync.WaitGroup
+
+	for i := 0; i < 5; i++ {
+		i := i
+
+		waitGroup.Add(1)
+
+		batch := func() {
+			defer waitGroup.Done()
+
+			value := []byte(fmt.Sprintf("value%d", i))
+
+			err := stores[i].Batch([]spi.Operation{
+				{Key: "key1", Value: value},
+				{Key: "key2", Value: value},
+				{Key: "key3", Value: value},
+			})
+			require.NoError(t, err)
+		}
+		go batch()
+	}
+
+	waitGroup.Wait()
+
+	for _, key := range []string{"key1", "key2", "key3"} {
+		value, err := stores[0].Get(key)
+		require.NoError(t, err)
+		require.Regexp(t, "^value[0-4]$", string(value))
+	}
+}
+
 func TestIteratorTotalItemsCountWithTagsWithBlankTagValues(t *testing.T) {
 	prov, err := NewProvider(couchDBURL)
 	require.NoError(t, err)
@@ -302,3 +359,460 @@ func TestIteratorTotalItemsCountWithTagsWithBlankTagValues(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, 2, totalCount)
 }
+
+func TestQueryWithBooleanExpressions(t *testing.T) {
+	prov, err := NewProvider(couchDBURL)
+	require.NoError(t, err)
+
+	store, err := prov.OpenStore("BooleanExpressionQueryTest")
+	require.NoError(t, err)
+
+	err = prov.SetStoreConfig("BooleanExpressionQueryTest",
+		spi.StoreConfiguration{TagNames: []string{"tagName1", "tagName2", "tagName3"}})
+	require.NoError(t, err)
+
+	require.NoError(t, store.Put("key1", []byte("value1"),
+		spi.Tag{Name: "tagName1", Value: "tagValue1"}, spi.Tag{Name: "tagName2", Value: "tagValue2"}))
+	require.NoError(t, store.Put("key2", []byte("value2"), spi.Tag{Name: "tagName1", Value: "tagValue1"}))
+	require.NoError(t, store.Put("key3", []byte("value3"), spi.Tag{Name: "tagName1", Value: "tagValue3"}))
+	require.NoError(t, store.Put("key4", []byte("value4"), spi.Tag{Name: "tagName3"}))
+
+	testCases := []struct {
+		expression   string
+		expectedKeys []string
+	}{
+		{expression: "tagName1:tagValue1&&tagName2:tagValue2", expectedKeys: []string{"key1"}},
+		{expression: "tagName1:tagValue1&&tagName2", expectedKeys: []string{"key1"}},
+		{expression: "tagName1:tagValue1||tagName1:tagValue3", expectedKeys: []string{"key1", "key2", "key3"}},
+		{expression: "tagName2||tagName3", expectedKeys: []string{"key1", "key4"}},
+		{expression: "tagName1:tagValue3||tagName1&&tagName2", expectedKeys: []string{"key1", "key3"}},
+		{expression: "tagName1:tagValue3&&tagName2", expectedKeys: nil},
+	}
+
+	for _, testCase := range testCases {
+		// A small page size makes sure that paging works with compound selectors.
+		iterator, errQuery := store.Query(testCase.expression, spi.WithPageSize(1))
+		require.NoError(t, errQuery)
+
+		var keys []string
+
+		for {
+			more, errNext := iterator.Next()
+			require.NoError(t, errNext)
+
+			if !more {
+				break
+			}
+
+			key, errKey := iterator.Key()
+			require.NoError(t, errKey)
+
+			keys = append(keys, key)
+		}
+
+		require.ElementsMatch(t, testCase.expectedKeys, keys, testCase.expression)
+
+		totalItems, errTotalItems := iterator.TotalItems()
+		require.NoError(t, errTotalItems)
+		require.Equal(t, len(testCase.expectedKeys), totalItems, testCase.expression)
+
+		require.NoError(t, iterator.Close())
+	}
+}
+
+func TestQueryWithRangesAndPrefixes(t *testing.T) {
+	prov, err := NewProvider(couchDBURL)
+	require.NoError(t, err)
+
+	store, err := prov.OpenStore("RangeAndPrefixQueryTest")
+	require.NoError(t, err)
+
+	err = prov.SetStoreConfig("RangeAndPrefixQueryTest",
+		spi.StoreConfiguration{TagNames: []string{"expiry", "type"}})
+	require.NoError(t, err)
+
+	require.NoError(t, store.Put("key1", []byte("value1"),
+		spi.Tag{Name: "expiry", Value: "1600000000"}, spi.Tag{Name: "type", Value: "credential-vc"}))
+	require.NoError(t, store.Put("key2", []byte("value2"),
+		spi.Tag{Name: "expiry", Value: "1700000000"}, spi.Tag{Name: "type", Value: "credential-vp"}))
+	require.NoError(t, store.Put("key3", []byte("value3"),
+		spi.Tag{Name: "expiry", Value: "900000000"}, spi.Tag{Name: "type", Value: "did.document"}))
+	require.NoError(t, store.Put("key4", []byte("value4"),
+		spi.Tag{Name: "expiry", Value: "never"}, spi.Tag{Name: "type", Value: "DIDxdocument"}))
+	require.NoError(t, store.Put("key5", []byte("value5"),
+		spi.Tag{Name: "expiry", Value: "1650000000.50"}, spi.Tag{Name: "type", Value: "other"}))
+
+	// Decimal tag values are compared as numbers, but read back as they were written.
+	tags, err := store.GetTags("key5")
+	require.NoError(t, err)
+	require.ElementsMatch(t, []spi.Tag{{Name: "expiry", Value: "1650000000.50"}, {Name: "type", Value: "other"}}, tags)
+
+	testCases := []struct {
+		expression   string
+		expectedKeys []string
+	}{
+		// 900000000 is less than 1700000000 as a number, but not lexicographically.
+		{expression: "expiry<=1700000000", expectedKeys: []string{"key1", "key2", "key3", "key5"}},
+		{expression: "expiry<1700000000", expectedKeys: []string{"key1", "key3", "key5"}},
+		{expression: "expiry>1000000000", expectedKeys: []string{"key1", "key2", "key5"}},
+		{expression: "expiry>1650000000.25", expectedKeys: []string{"key2", "key5"}},
+		{expression: "expiry>=1700000000.5", expectedKeys: nil},
+		{expression: "expiry:1650000000.50", expectedKeys: []string{"key5"}},
+		{expression: "expiry:1650000000.5", expectedKeys: nil},
+		{expression: "expiry>m", expectedKeys: []string{"key4"}},
+		{expression: "type:credential*", expectedKeys: []string{"key1", "key2"}},
+		{expression: "type:did*", expectedKeys: []string{"key3"}},
+		{expression: "type:credential*&&expiry<1700000000||type:DID*", expectedKeys: []string{"key1", "key4"}},
+	}
+
+	for _, testCase := range testCases {
+		iterator, errQuery := store.Query(testCase.expression, spi.WithPageSize(1))
+		require.NoError(t, errQuery)
+
+		var keys []string
+
+		for {
+			more, errNext := iterator.Next()
+			require.NoError(t, errNext)
+
+			if !more {
+				break
+			}
+
+			key, errKey := iterator.Key()
+			require.NoError(t, errKey)
+
+			keys = append(keys, key)
+		}
+
+		require.ElementsMatch(t, testCase.expectedKeys, keys, testCase.expression)
+
+		totalItems, errTotalItems := iterator.TotalItems()
+		require.NoError(t, errTotalItems)
+		require.Equal(t, len(testCase.expectedKeys), totalItems, testCase.expression)
+
+		require.NoError(t, iterator.Close())
+	}
+}
+
+func TestPutWithTTL(t *testing.T) {
+	prov, err := NewProvider(couchDBURL, WithExpiredDocumentPurgeInterval(time.Second))
+	require.NoError(t, err)
+
+	store, err := prov.OpenStore("PutWithTTLTest")
+	require.NoError(t, err)
+
+	err = prov.SetStoreConfig("PutWithTTLTest", spi.StoreConfiguration{TagNames: []string{"TagName1"}})
+	require.NoError(t, err)
+
+	ttlStore, ok := store.(TTLStore)
+	require.True(t, ok)
+
+	err = ttlStore.PutWithTTL("key1", []byte("value1"), 0)
+	require.EqualError(t, err, "ttl must be positive")
+
+	tag := spi.Tag{Name: "TagName1", Value: "TagValue1"}
+
+	require.NoError(t, ttlStore.PutWithTTL("key1", []byte("value1"), time.Second, tag))
+	require.NoError(t, ttlStore.PutWithTTL("key2", []byte("value2"), time.Second, tag))
+	require.NoError(t, ttlStore.PutWithTTL("key3", []byte("value3"), time.Hour, tag))
+
+	// Putting the key again without a TTL keeps it.
+	require.NoError(t, ttlStore.Put("key2", []byte("value2"), tag))
+
+	// The expiry index isn't part of the store configuration.
+	config, err := prov.GetStoreConfig("PutWithTTLTest")
+	require.NoError(t, err)
+	require.Equal(t, []string{"TagName1"}, config.TagNames)
+
+	time.Sleep(time.Second)
+
+	_, err = ttlStore.Get("key1")
+	require.True(t, errors.Is(err, spi.ErrDataNotFound), "unexpected error or no error")
+
+	_, err = ttlStore.GetTags("key1")
+	require.True(t, errors.Is(err, spi.ErrDataNotFound), "unexpected error or no error")
+
+	values, err := ttlStore.GetBulk("key1", "key2", "key3")
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{nil, []byte("value2"), []byte("value3")}, values)
+
+	for _, expression := range []string{"TagName1:TagValue1", "TagName1:TagValue1&&TagName1"} {
+		iterator, errQuery := ttlStore.Query(expression)
+		require.NoError(t, errQuery)
+
+		var keys []string
+
+		for {
+			more, errNext := iterator.Next()
+			require.NoError(t, errNext)
+
+			if !more {
+				break
+			}
+
+			key, errKey := iterator.Key()
+			require.NoError(t, errKey)
+
+			keys = append(keys, key)
+		}
+
+		require.ElementsMatch(t, []string{"key2", "key3"}, keys, expression)
+
+		totalItems, errTotalItems := iterator.TotalItems()
+		require.NoError(t, errTotalItems)
+		require.Equal(t, 2, totalItems, expression)
+
+		require.NoError(t, iterator.Close())
+	}
+
+	client, err := kivik.New("couch", couchDBURL)
+	require.NoError(t, err)
+
+	db := client.DB(context.Background(), "putwithttltest")
+
+	// Wait for the expired document to be purged.
+	err = backoff.Retry(func() error {
+		var document map[string]interface{}
+
+		errScan := db.Get(context.Background(), "key1").ScanDoc(&document)
+		if errScan == nil {
+			return errors.New("expired document hasn't been purged yet")
+		}
+
+		if kivik.StatusCode(errScan) != http.StatusNotFound {
+			return backoff.Permanent(errScan)
+		}
+
+		return nil
+	}, backoff.WithMaxRetries(backoff.NewConstantBackOff(time.Second), 5))
+	require.NoError(t, err)
+
+	require.NoError(t, store.Close())
+}
+
+func TestPutIfVersion(t *testing.T) {
+	prov, err := NewProvider(couchDBURL)
+	require.NoError(t, err)
+
+	store, err := prov.OpenStore("PutIfVersionTest")
+	require.NoError(t, err)
+
+	versionedStore, ok := store.(VersionedStore)
+	require.True(t, ok)
+
+	version, err := versionedStore.PutIfVersion("key1", []byte("value1"), "")
+	require.NoError(t, err)
+
+	// The document exists now.
+	_, err = versionedStore.PutIfVersion("key1", []byte("value1"), "")
+	require.True(t, errors.Is(err, ErrVersionConflict), "unexpected error or no error")
+
+	newVersion, err := versionedStore.PutIfVersion("key1", []byte("value2"), version, spi.Tag{Name: "TagName1"})
+	require.NoError(t, err)
+	require.NotEqual(t, version, newVersion)
+
+	// The version read by another writer is now stale.
+	_, err = versionedStore.PutIfVersion("key1", []byte("value3"), version)
+	require.True(t, errors.Is(err, ErrVersionConflict), "unexpected error or no error")
+
+	value, currentVersion, err := versionedStore.GetWithVersion("key1")
+	require.NoError(t, err)
+	require.Equal(t, []byte("value2"), value)
+	require.Equal(t, newVersion, currentVersion)
+
+	// Any other put changes the version.
+	require.NoError(t, versionedStore.Put("key1", []byte("value4")))
+
+	_, err = versionedStore.PutIfVersion("key1", []byte("value3"), currentVersion)
+	require.True(t, errors.Is(err, ErrVersionConflict), "unexpected error or no error")
+
+	// A deleted document, or one that has expired, counts as missing.
+	require.NoError(t, versionedStore.Delete("key1"))
+
+	_, err = versionedStore.PutIfVersion("key1", []byte("value5"), "")
+	require.NoError(t, err)
+
+	ttlStore, ok := store.(TTLStore)
+	require.True(t, ok)
+
+	require.NoError(t, ttlStore.PutWithTTL("key2", []byte("value"), time.Second))
+
+	_, expiringVersion, err := versionedStore.GetWithVersion("key2")
+	require.NoError(t, err)
+
+	time.Sleep(time.Second)
+
+	// The version of the expired document is stale, as it is once a document has been deleted.
+	_, err = versionedStore.PutIfVersion("key2", []byte("value"), expiringVersion)
+	require.True(t, errors.Is(err, ErrVersionConflict), "unexpected error or no error")
+
+	_, err = versionedStore.PutIfVersion("key2", []byte("value"), "")
+	require.NoError(t, err)
+
+	_, _, err = versionedStore.GetWithVersion("key3")
+	require.True(t, errors.Is(err, spi.ErrDataNotFound), "unexpected error or no error")
+
+	require.NoError(t, store.Close())
+}
+
+func TestContextStore(t *testing.T) {
+	canceledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	t.Run("NewProviderWithContext", func(t *testing.T) {
+		_, err := NewProviderWithContext(canceledCtx, couchDBURL)
+		require.True(t, errors.Is(err, context.Canceled), "unexpected error or no error")
+	})
+
+	prov, err := NewProviderWithContext(context.Background(), couchDBURL)
+	require.NoError(t, err)
+
+	store, err := prov.OpenStore("ContextStoreTest")
+	require.NoError(t, err)
+
+	require.NoError(t, prov.SetStoreConfig("ContextStoreTest", spi.StoreConfiguration{TagNames: []string{"TagName1"}}))
+
+	contextStore, ok := store.(ContextStore)
+	require.True(t, ok)
+
+	ctx := context.Background()
+
+	require.NoError(t, contextStore.PutWithContext(ctx, "key1", []byte("value1"), spi.Tag{Name: "TagName1"}))
+	require.NoError(t, contextStore.BatchWithContext(ctx, []spi.Operation{
+		{Key: "key2", Value: []byte("value2"), Tags: []spi.Tag{{Name: "TagName1"}}},
+	}))
+
+	value, err := contextStore.GetWithContext(ctx, "key1")
+	require.NoError(t, err)
+	require.Equal(t, []byte("value1"), value)
+
+	tags, err := contextStore.GetTagsWithContext(ctx, "key1")
+	require.NoError(t, err)
+	require.Equal(t, []spi.Tag{{Name: "TagName1"}}, tags)
+
+	values, err := contextStore.GetBulkWithContext(ctx, "key1", "key2")
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte("value1"), []byte("value2")}, values)
+
+	iterator, err := contextStore.QueryWithContext(ctx, "TagName1", spi.WithPageSize(1))
+	require.NoError(t, err)
+
+	totalItems, err := iterator.TotalItems()
+	require.NoError(t, err)
+	require.Equal(t, 2, totalItems)
+
+	require.NoError(t, contextStore.DeleteWithContext(ctx, "key2"))
+
+	t.Run("Canceled context", func(t *testing.T) {
+		err = contextStore.PutWithContext(canceledCtx, "key1", []byte("value2"))
+		require.True(t, errors.Is(err, context.Canceled), "unexpected error or no error")
+
+		err = contextStore.BatchWithContext(canceledCtx, []spi.Operation{{Key: "key1", Value: []byte("value2")}})
+		require.True(t, errors.Is(err, context.Canceled), "unexpected error or no error")
+
+		_, err = contextStore.GetWithContext(canceledCtx, "key1")
+		require.True(t, errors.Is(err, context.Canceled), "unexpected error or no error")
+
+		_, err = contextStore.GetTagsWithContext(canceledCtx, "key1")
+		require.True(t, errors.Is(err, context.Canceled), "unexpected error or no error")
+
+		_, err = contextStore.GetBulkWithContext(canceledCtx, "key1")
+		require.True(t, errors.Is(err, context.Canceled), "unexpected error or no error")
+
+		_, err = contextStore.QueryWithContext(canceledCtx, "TagName1")
+		require.True(t, errors.Is(err, context.Canceled), "unexpected error or no error")
+
+		err = contextStore.DeleteWithContext(canceledCtx, "key1")
+		require.True(t, errors.Is(err, context.Canceled), "unexpected error or no error")
+
+		// The value is unchanged.
+		value, err = store.Get("key1")
+		require.NoError(t, err)
+		require.Equal(t, []byte("value1"), value)
+	})
+	t.Run("Iterator uses the query's context", func(t *testing.T) {
+		queryCtx, cancelQuery := context.WithCancel(context.Background())
+
+		iterator, err = contextStore.QueryWithContext(queryCtx, "TagName1", spi.WithPageSize(1))
+		require.NoError(t, err)
+
+		more, err := iterator.Next()
+		require.NoError(t, err)
+		require.True(t, more)
+
+		cancelQuery()
+
+		// The next page is fetched using the canceled context.
+		_, err = iterator.Next()
+		require.True(t, errors.Is(err, context.Canceled), "unexpected error or no error")
+	})
+
+	require.NoError(t, store.Close())
+}
+
+func TestWatch(t *testing.T) {
+	prov, err := NewProvider(couchDBURL)
+	require.NoError(t, err)
+
+	store, err := prov.OpenStore("WatchTest")
+	require.NoError(t, err)
+
+	watchableStore, ok := store.(WatchableStore)
+	require.True(t, ok)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	changeStream, err := watchableStore.Watch(ctx, WithTagFilter(spi.Tag{Name: "TagName1"}))
+	require.NoError(t, err)
+
+	require.NoError(t, store.Put("key1", []byte("value1"), spi.Tag{Name: "TagName1", Value: "TagValue1"}))
+
+	// Each change is read before the next is made, since the feed may only report the last of several quick
+	// changes to the same document.
+	change, err := changeStream.Next()
+	require.NoError(t, err)
+	require.Equal(t, ChangePut, change.Type)
+	require.Equal(t, "key1", change.Key)
+	require.Equal(t, []byte("value1"), change.Value)
+	require.Equal(t, []spi.Tag{{Name: "TagName1", Value: "TagValue1"}}, change.Tags)
+
+	checkpoint := change.Checkpoint
+
+	require.NoError(t, store.Put("key2", []byte("value2"), spi.Tag{Name: "TagName2"}))
+	require.NoError(t, store.Delete("key1"))
+
+	// The put of key2 doesn't pass the tag filter.
+	change, err = changeStream.Next()
+	require.NoError(t, err)
+	require.Equal(t, ChangeDelete, change.Type)
+	require.Equal(t, "key1", change.Key)
+
+	cancel()
+
+	_, err = changeStream.Next()
+	require.True(t, errors.Is(err, context.Canceled), "unexpected error or no error")
+
+	require.NoError(t, changeStream.Close())
+
+	// Resuming from the checkpoint streams the changes made after it, like after a restart.
+	resumeCtx, cancelResume := context.WithCancel(context.Background())
+	defer cancelResume()
+
+	changeStream, err = watchableStore.Watch(resumeCtx, WithCheckpoint(checkpoint))
+	require.NoError(t, err)
+
+	change, err = changeStream.Next()
+	require.NoError(t, err)
+	require.Equal(t, ChangePut, change.Type)
+	require.Equal(t, "key2", change.Key)
+
+	change, err = changeStream.Next()
+	require.NoError(t, err)
+	require.Equal(t, ChangeDelete, change.Type)
+	require.Equal(t, "key1", change.Key)
+
+	require.NoError(t, changeStream.Close())
+	require.NoError(t, store.Close())
+}
@@ -0,0 +1,205 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package couchdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-kivik/kivik/v3"
+	"github.com/hyperledger/aries-framework-go/spi/storage"
+)
+
+// changesFeedHeartbeat is how often, in milliseconds, CouchDB sends a heartbeat down an idle changes feed, which
+// keeps the connection from timing out.
+const changesFeedHeartbeat = 10000
+
+// ChangeType says what kind of change was made to an entry.
+type ChangeType int
+
+const (
+	// ChangePut is the type of the changes made by putting an entry.
+	ChangePut ChangeType = iota
+	// ChangeDelete is the type of the changes made by deleting an entry, which includes the purging of expired
+	// entries.
+	ChangeDelete
+)
+
+// Change describes a change made to an entry of a store.
+type Change struct {
+	Type ChangeType
+	Key  string
+	// Value and Tags are those the entry was put with. They're nil for deletions.
+	Value []byte
+	Tags  []storage.Tag
+	// Checkpoint identifies this change, which is its sequence ID in the CouchDB changes feed. A watch started with
+	// WithCheckpoint(Checkpoint) resumes with the changes made after this one.
+	Checkpoint string
+}
+
+// ChangeStream streams the changes made to a store's entries, in the order they were made.
+type ChangeStream interface {
+	// Next blocks until there's another change and returns it. Once the context given to Watch is done, it returns
+	// the context's error.
+	Next() (Change, error)
+
+	// Close stops the stream.
+	Close() error
+}
+
+// WatchableStore is implemented by the stores opened by a Provider. It lets the changes made to the store's entries,
+// by any Provider using the same CouchDB instance, be watched as they happen. It's backed by the CouchDB changes feed.
+type WatchableStore interface {
+	storage.Store
+
+	// Watch streams the changes made to the store's entries until ctx is done. Unless WithCheckpoint is used to resume
+	// from an earlier change, only the changes made after Watch is called are streamed.
+	// If several changes are made to an entry in quick succession, then CouchDB may only report the last of them.
+	Watch(ctx context.Context, options ...WatchOption) (ChangeStream, error)
+}
+
+// WatchOption represents an option for WatchableStore.Watch.
+type WatchOption func(opts *watchOptions)
+
+type watchOptions struct {
+	checkpoint string
+	tagFilter  *storage.Tag
+}
+
+// WithCheckpoint is an option for resuming a watch with the changes made after the one identified by checkpoint,
+// such as after a restart. checkpoint is the Checkpoint of a Change.
+func WithCheckpoint(checkpoint string) WatchOption {
+	return func(opts *watchOptions) {
+		opts.checkpoint = checkpoint
+	}
+}
+
+// WithTagFilter is an option for only streaming the puts of entries that have a tag with tag's name and, unless it's
+// blank, tag's value. Deletions are always streamed, since the tags of the deleted entries aren't known.
+func WithTagFilter(tag storage.Tag) WatchOption {
+	return func(opts *watchOptions) {
+		opts.tagFilter = &tag
+	}
+}
+
+type changesFeed interface {
+	Next() bool
+	Err() error
+	Close() error
+	ID() string
+	Deleted() bool
+	Seq() string
+	ScanDoc(dest interface{}) error
+}
+
+// Watch streams the changes made to the store's documents until ctx is done.
+func (s *store) Watch(ctx context.Context, options ...WatchOption) (ChangeStream, error) {
+	var opts watchOptions
+
+	for _, option := range options {
+		option(&opts)
+	}
+
+	since := opts.checkpoint
+	if since == "" {
+		since = "now"
+	}
+
+	feed, err := s.db.Changes(ctx, kivik.Options{
+		"feed":         "continuous",
+		"since":        since,
+		"include_docs": true,
+		"heartbeat":    changesFeedHeartbeat,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open CouchDB changes feed: %w", err)
+	}
+
+	return &couchDBChangeStream{ctx: ctx, feed: feed, tagFilter: opts.tagFilter}, nil
+}
+
+type couchDBChangeStream struct {
+	ctx       context.Context
+	feed      changesFeed
+	tagFilter *storage.Tag
+}
+
+// Next blocks until there's another change to a document that passes the tag filter, skipping design documents.
+func (c *couchDBChangeStream) Next() (Change, error) {
+	for c.feed.Next() {
+		if strings.HasPrefix(c.feed.ID(), "_design/") {
+			continue
+		}
+
+		change := Change{Key: c.feed.ID(), Checkpoint: c.feed.Seq()}
+
+		if c.feed.Deleted() {
+			change.Type = ChangeDelete
+
+			return change, nil
+		}
+
+		var changedDocument document
+
+		err := c.feed.ScanDoc(&changedDocument)
+		if err != nil {
+			return Change{}, fmt.Errorf("failed to scan changed document: %w", err)
+		}
+
+		tags, err := getTagsFromDocument(&changedDocument)
+		if err != nil {
+			return Change{}, fmt.Errorf("failed to get tags from document: %w", err)
+		}
+
+		if !matchesTagFilter(c.tagFilter, tags) {
+			continue
+		}
+
+		change.Type = ChangePut
+		change.Value = changedDocument.Value
+		change.Tags = tags
+
+		return change, nil
+	}
+
+	err := c.feed.Err()
+	if err != nil {
+		return Change{}, fmt.Errorf("failure while reading CouchDB changes feed: %w", err)
+	}
+
+	if c.ctx.Err() != nil {
+		return Change{}, c.ctx.Err()
+	}
+
+	return Change{}, errors.New("CouchDB changes feed ended")
+}
+
+// Close stops the stream.
+func (c *couchDBChangeStream) Close() error {
+	err := c.feed.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close CouchDB changes feed: %w", err)
+	}
+
+	return nil
+}
+
+// matchesTagFilter returns whether tags include one matching tagFilter, if there is a filter.
+func matchesTagFilter(tagFilter *storage.Tag, tags []storage.Tag) bool {
+	if tagFilter == nil {
+		return true
+	}
+
+	for _, tag := range tags {
+		if tag.Name == tagFilter.Name && (tagFilter.Value == "" || tag.Value == tagFilter.Value) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,245 @@
+/*
+Copyright Scoir Inc Technologies Inc, SecureKey Technologies Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/aries-framework-go/spi/storage"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	mongooptions "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The prefixes of the names of the indexes set using SetStoreConfigWithIndexes. Since tag names can't contain ':',
+// these names can't clash with the names of the indexes created for the tag names in a store configuration.
+const (
+	sortIndexNamePrefix   = "index:"
+	uniqueIndexNamePrefix = "unique:"
+
+	// The number of tag names in the name of an index set using SetStoreConfigWithIndexes, after the prefix.
+	indexNameTagNames = 2
+
+	// The message MongoDB gives when a query's hint names an index that doesn't exist, and the error code it gives
+	// when the indexes of a collection that doesn't exist are listed.
+	badHintErrMsg            = "hint provided does not correspond to an existing index"
+	namespaceNotFoundErrCode = 26
+)
+
+// ErrUniqueIndexViolation is returned (wrapped) when a put would give an entry the same tag values as another entry,
+// for the tags of an Index with Unique set.
+var ErrUniqueIndexViolation = errors.New("unique index violation")
+
+// Index describes an index for Provider.SetStoreConfigWithIndexes, in addition to the single-tag indexes created for
+// the tag names in a store configuration.
+type Index struct {
+	// TagName is the name of the tag the index is on.
+	TagName string
+	// SortTagName, if set, makes the index a compound index on TagName and then SortTagName. This lets queries for
+	// TagName:TagValue with results sorted by SortTagName be served by the index, without MongoDB having to sort the
+	// results in memory, which it can't do for more than 32MB of them.
+	SortTagName string
+	// Unique, if true, means no two entries can have the same value for TagName (and for SortTagName, if it's set).
+	// Entries without the tags aren't constrained. A put that violates the constraint fails with
+	// ErrUniqueIndexViolation. Unique indexes only enforce the constraint, and aren't used for sorted queries.
+	Unique bool
+}
+
+// name returns the name of the index, which identifies its definition.
+func (i Index) name() string {
+	prefix := sortIndexNamePrefix
+	if i.Unique {
+		prefix = uniqueIndexNamePrefix
+	}
+
+	return prefix + i.TagName + ":" + i.SortTagName
+}
+
+func (i Index) validate() error {
+	if i.TagName == "" {
+		return errors.New("index tag name can't be blank")
+	}
+
+	for _, tagName := range []string{i.TagName, i.SortTagName} {
+		if strings.Contains(tagName, ":") {
+			return fmt.Errorf(invalidTagName, tagName)
+		}
+	}
+
+	return nil
+}
+
+// validateIndexes checks the tag names in config and the definitions of indexes.
+func validateIndexes(config storage.StoreConfiguration, indexes []Index) error {
+	for _, tagName := range config.TagNames {
+		if strings.Contains(tagName, ":") {
+			return fmt.Errorf(invalidTagName, tagName)
+		}
+	}
+
+	for _, index := range indexes {
+		err := index.validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (i Index) model() mongo.IndexModel {
+	keys := bson.D{{Key: fmt.Sprintf("tags.%s", i.TagName), Value: 1}}
+	partialFilter := bson.D{{Key: fmt.Sprintf("tags.%s", i.TagName), Value: bson.D{{Key: "$exists", Value: true}}}}
+
+	if i.SortTagName != "" {
+		keys = append(keys, bson.E{Key: fmt.Sprintf("tags.%s", i.SortTagName), Value: 1})
+		partialFilter = append(partialFilter, bson.E{
+			Key: fmt.Sprintf("tags.%s", i.SortTagName), Value: bson.D{{Key: "$exists", Value: true}},
+		})
+	}
+
+	indexOptions := mongooptions.Index().SetName(i.name())
+
+	// Documents that lack a tag are indexed as having a null value for it, so without the partial filter only one of
+	// them would be allowed.
+	if i.Unique {
+		indexOptions.SetUnique(true).SetPartialFilterExpression(partialFilter)
+	}
+
+	return mongo.IndexModel{Keys: keys, Options: indexOptions}
+}
+
+// indexModels returns the models of the indexes for the tag names in config, followed by those of indexes.
+func indexModels(config storage.StoreConfiguration, indexes []Index) []mongo.IndexModel {
+	models := make([]mongo.IndexModel, 0, len(config.TagNames)+len(indexes))
+
+	for _, tagName := range config.TagNames {
+		models = append(models, mongo.IndexModel{
+			Keys:    bson.D{{Key: fmt.Sprintf("tags.%s", tagName), Value: 1}},
+			Options: mongooptions.Index().SetName(tagName),
+		})
+	}
+
+	for _, index := range indexes {
+		models = append(models, index.model())
+	}
+
+	return models
+}
+
+// setSortIndexes records the compound indexes that sorted queries can be served by.
+func (s *store) setSortIndexes(indexes []Index) {
+	var sortIndexes []Index
+
+	for _, index := range indexes {
+		if index.SortTagName != "" && !index.Unique {
+			sortIndexes = append(sortIndexes, index)
+		}
+	}
+
+	s.sortIndexesLock.Lock()
+	defer s.sortIndexesLock.Unlock()
+
+	s.sortIndexes = sortIndexes
+	s.sortIndexesLoaded = true
+}
+
+// loadSortIndexes records the compound indexes that sorted queries can be served by, as listed by MongoDB, unless
+// they're already known. They're only known once they've been set using this Provider or loaded, so this lets a
+// store use the indexes set by another Provider, e.g. before a restart.
+func (s *store) loadSortIndexes(ctx context.Context) error {
+	s.sortIndexesLock.RLock()
+	loaded := s.sortIndexesLoaded
+	s.sortIndexesLock.RUnlock()
+
+	if loaded {
+		return nil
+	}
+
+	ctxWithTimeout, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	indexSpecifications, err := s.coll.Indexes().ListSpecifications(ctxWithTimeout)
+
+	var commandErr mongo.CommandError
+	if err != nil && !(errors.As(err, &commandErr) && commandErr.Code == namespaceNotFoundErrCode) {
+		return fmt.Errorf("failed to get list of indexes from MongoDB: %w", err)
+	}
+
+	var indexes []Index
+
+	for _, indexSpecification := range indexSpecifications {
+		if !strings.HasPrefix(indexSpecification.Name, sortIndexNamePrefix) {
+			continue
+		}
+
+		tagNames := strings.Split(strings.TrimPrefix(indexSpecification.Name, sortIndexNamePrefix), ":")
+		if len(tagNames) == indexNameTagNames {
+			indexes = append(indexes, Index{TagName: tagNames[0], SortTagName: tagNames[1]})
+		}
+	}
+
+	s.setSortIndexes(indexes)
+
+	return nil
+}
+
+// forgetSortIndexes has the compound indexes that sorted queries can be served by loaded again by the next sorted
+// query, e.g. because one of them has been dropped.
+func (s *store) forgetSortIndexes() {
+	s.sortIndexesLock.Lock()
+	defer s.sortIndexesLock.Unlock()
+
+	s.sortIndexes = nil
+	s.sortIndexesLoaded = false
+}
+
+// isBadHintError returns whether err means a query's hint names an index that doesn't exist.
+func isBadHintError(err error) bool {
+	var commandErr mongo.CommandError
+
+	return errors.As(err, &commandErr) && strings.Contains(commandErr.Message, badHintErrMsg)
+}
+
+// sortIndexHint returns the name of a compound index that serves a query for disjunction, sorted by sortTagName, or
+// a blank string if there's none. That's the case if the query is a single conjunction that includes a
+// TagName:TagValue condition on the index's TagName, and the index's SortTagName is sortTagName.
+func (s *store) sortIndexHint(disjunction [][]tagCondition, sortTagName string) string {
+	if len(disjunction) != 1 {
+		return ""
+	}
+
+	s.sortIndexesLock.RLock()
+	defer s.sortIndexesLock.RUnlock()
+
+	for _, index := range s.sortIndexes {
+		if index.SortTagName != sortTagName {
+			continue
+		}
+
+		for _, condition := range disjunction[0] {
+			if condition.name == index.TagName && condition.operator == equalsOperator {
+				return index.name()
+			}
+		}
+	}
+
+	return ""
+}
+
+// wrapUniqueIndexViolation returns ErrUniqueIndexViolation (wrapped) if err is a duplicate key error for any index
+// other than the one on the key, and err otherwise.
+func wrapUniqueIndexViolation(err error) error {
+	if mongo.IsDuplicateKeyError(err) && !strings.Contains(err.Error(), " index: _id_ ") {
+		return fmt.Errorf("%w: %s", ErrUniqueIndexViolation, err.Error())
+	}
+
+	return err
+}
@@ -15,7 +15,9 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"math"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
@@ -24,6 +26,7 @@ import (
 	"github.com/cenkalti/backoff/v4"
 	"github.com/hyperledger/aries-framework-go/spi/storage"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	mongooptions "go.mongodb.org/mongo-driver/mongo/options"
 )
@@ -36,12 +39,26 @@ const (
 	invalidTagValue                      = `"%s" is an invalid tag value since it contains one or more ':' characters`
 	failCreateIndexesInMongoDBCollection = "failed to create indexes in MongoDB collection: %w"
 
-	expressionTagNameOnlyLength     = 1
-	expressionTagNameAndValueLength = 2
+	equalsOperator = ":"
+	prefixOperator = "*"
+
+	// The field holding the time at which an entry put with a TTL expires, and the name of the TTL index on it.
+	// Since tag names can't contain ':', the index name can't clash with the name of a tag index.
+	expireAtFieldName = "expireAt"
+	expireAtIndexName = "ttl:expireAt"
+
+	// The field holding an entry's version, which is incremented every time the entry is put.
+	versionFieldName = "version"
+
+	// The field holding the tag values stored as numbers that wouldn't be read back as they were written, e.g. "1.50".
+	tagValuesFieldName = "tagValues"
 )
 
+// ErrVersionConflict is returned by VersionedStore.PutIfVersion when the entry's current version isn't the one given.
+var ErrVersionConflict = errors.New("version conflict")
+
 var errInvalidQueryExpressionFormat = errors.New("invalid expression format. " +
-	"it must be in the following format: TagName:TagValue")
+	"it must be in the following format: TagName:TagValue, optionally combined with others using && and ||")
 
 type logger interface {
 	Infof(msg string, args ...interface{})
@@ -58,15 +75,60 @@ func (d *defaultLogger) Infof(msg string, args ...interface{}) {
 type closer func(storeName string)
 
 type jsonDataWrapper struct {
-	Key   string                 `bson:"_id"`
-	Value map[string]interface{} `bson:"value,omitempty"`
-	Tags  map[string]interface{} `bson:"tags,omitempty"`
+	Key       string                 `bson:"_id"`
+	Value     map[string]interface{} `bson:"value,omitempty"`
+	Tags      map[string]interface{} `bson:"tags,omitempty"`
+	TagValues map[string]string      `bson:"tagValues,omitempty"`
+	ExpireAt  *time.Time             `bson:"expireAt,omitempty"`
 }
 
 type binaryDataWrapper struct {
-	Key   string                 `bson:"_id"`
-	Value []byte                 `bson:"value,omitempty"`
-	Tags  map[string]interface{} `bson:"tags,omitempty"`
+	Key       string                 `bson:"_id"`
+	Value     []byte                 `bson:"value,omitempty"`
+	Tags      map[string]interface{} `bson:"tags,omitempty"`
+	TagValues map[string]string      `bson:"tagValues,omitempty"`
+	ExpireAt  *time.Time             `bson:"expireAt,omitempty"`
+}
+
+// TTLStore is implemented by the stores opened by a Provider. It lets entries be put with a time to live.
+type TTLStore interface {
+	storage.Store
+
+	// PutWithTTL stores the key + value pair along with the (optional) tags, like Put, and has MongoDB remove the
+	// entry once ttl has elapsed. A later Put of the same key removes the TTL. Expired entries are hidden from Get,
+	// GetTags, GetBulk and Query until MongoDB's TTL monitor removes them, which it does about once a minute.
+	PutWithTTL(key string, value []byte, ttl time.Duration, tags ...storage.Tag) error
+}
+
+// VersionedStore is implemented by the stores opened by a Provider. It lets an entry be read, modified and written
+// back safely by several writers, since the write only succeeds if nobody else has put the entry in the meantime.
+type VersionedStore interface {
+	storage.Store
+
+	// GetWithVersion returns the value stored under key along with the entry's current version, which changes every
+	// time the entry is put.
+	GetWithVersion(key string) (value []byte, version string, err error)
+
+	// PutIfVersion stores the key + value pair along with the (optional) tags, like Put, provided the entry's current
+	// version is version. A blank version means the entry mustn't exist. It returns the entry's new version, or
+	// ErrVersionConflict if the entry's current version is a different one.
+	PutIfVersion(key string, value []byte, version string, tags ...storage.Tag) (string, error)
+}
+
+// ContextStore is implemented by the stores opened by a Provider. Its methods do the same as the storage.Store methods
+// of the same names, but the calls they make to MongoDB are abandoned once ctx is done, in which case ctx's error is
+// returned (wrapped). The timeout set by WithTimeout still applies to each call. The context given to
+// QueryWithContext also applies to the iterator it returns, which fetches further results and counts them using it.
+type ContextStore interface {
+	storage.Store
+
+	PutWithContext(ctx context.Context, key string, value []byte, tags ...storage.Tag) error
+	GetWithContext(ctx context.Context, key string) ([]byte, error)
+	GetTagsWithContext(ctx context.Context, key string) ([]storage.Tag, error)
+	GetBulkWithContext(ctx context.Context, keys ...string) ([][]byte, error)
+	QueryWithContext(ctx context.Context, expression string, options ...storage.QueryOption) (storage.Iterator, error)
+	DeleteWithContext(ctx context.Context, key string) error
+	BatchWithContext(ctx context.Context, operations []storage.Operation) error
 }
 
 // Option represents an option for a MongoDB Provider.
@@ -89,7 +151,8 @@ func WithLogger(logger logger) Option {
 }
 
 // WithTimeout is an option for specifying the timeout for all calls to the MongoDB instance..
-// The timeout is 10 seconds by default.
+// The timeout is 10 seconds by default. It also applies to the calls made by the ContextStore methods, which may be
+// given a shorter deadline.
 func WithTimeout(timeout time.Duration) Option {
 	return func(opts *Provider) {
 		opts.timeout = timeout
@@ -126,6 +189,8 @@ type Provider struct {
 	timeout                                 time.Duration
 	maxIndexCreationConflictRetries         uint64
 	indexCreationConflictTimeBetweenRetries time.Duration
+	transactionalBatches                    bool
+	allowNonTransactionalBatches            bool
 }
 
 // NewProvider instantiates a new MongoDB Provider.
@@ -158,7 +223,8 @@ func NewProvider(connString string, opts ...Option) (*Provider, error) {
 	return p, nil
 }
 
-// OpenStore opens a Store with the given name and returns a handle.
+// OpenStore opens a Store with the given name and returns a handle, which is also a TTLStore, a VersionedStore, a
+// ContextStore and a WatchableStore.
 // If the underlying database for the given name has never been created before, then it is created.
 // Store names are not case-sensitive. If name is blank, then an error will be returned.
 func (p *Provider) OpenStore(name string) (storage.Store, error) {
@@ -180,10 +246,13 @@ func (p *Provider) OpenStore(name string) (storage.Store, error) {
 		// The storage interface doesn't have the concept of a nested database, so we have no real use for the
 		// collection abstraction MongoDB uses. Since we have to use at least one collection, we keep the collection
 		// name as short as possible to avoid hitting the index size limit.
-		coll:    p.getCollectionHandle(name),
-		name:    name,
-		close:   p.removeStore,
-		timeout: p.timeout,
+		coll:                         p.getCollectionHandle(name),
+		name:                         name,
+		close:                        p.removeStore,
+		timeout:                      p.timeout,
+		logger:                       p.logger,
+		transactionalBatches:         p.transactionalBatches,
+		allowNonTransactionalBatches: p.allowNonTransactionalBatches,
 	}
 
 	p.openStores[name] = newStore
@@ -193,13 +262,24 @@ func (p *Provider) OpenStore(name string) (storage.Store, error) {
 
 // SetStoreConfig sets the configuration on a store.
 // Indexes are created based on the tag names in config. This allows the store.Query method to operate faster.
-// Existing tag names/indexes in the store that are not in the config passed in here will be removed.
+// Existing tag names/indexes in the store that are not in the config passed in here will be removed, including any
+// set using SetStoreConfigWithIndexes.
 // The store must already be open in this provider from a prior call to OpenStore. The name parameter cannot be blank.
 func (p *Provider) SetStoreConfig(storeName string, config storage.StoreConfiguration) error {
-	for _, tagName := range config.TagNames {
-		if strings.Contains(tagName, ":") {
-			return fmt.Errorf(invalidTagName, tagName)
-		}
+	return p.SetStoreConfigWithIndexes(storeName, config)
+}
+
+// SetStoreConfigWithIndexes sets the configuration on a store, like SetStoreConfig, and also creates the given
+// compound and unique indexes. Existing indexes that are neither for the tag names in config nor in indexes are
+// removed.
+// Sorted queries are served by a matching compound index (see Index). A store knows which indexes were set using its
+// own Provider, and lists those set using other Providers, e.g. before a restart, the first time it's queried with
+// sorting.
+func (p *Provider) SetStoreConfigWithIndexes(storeName string, config storage.StoreConfiguration,
+	indexes ...Index) error {
+	err := validateIndexes(config, indexes)
+	if err != nil {
+		return err
 	}
 
 	storeNameWithPrefix := strings.ToLower(p.dbPrefix + storeName)
@@ -211,10 +291,10 @@ func (p *Provider) SetStoreConfig(storeName string, config storage.StoreConfigur
 
 	var attemptsMade int
 
-	err := backoff.Retry(func() error {
+	err = backoff.Retry(func() error {
 		attemptsMade++
 
-		err := p.setIndexes(openStore, config)
+		err := p.setIndexes(openStore, config, indexes)
 		if err != nil {
 			// If there are multiple MongoDB Providers trying to set store configurations, it's possible
 			// to get an error. In cases where those multiple MongoDB providers are trying
@@ -270,11 +350,20 @@ func (p *Provider) GetStoreConfig(name string) (storage.StoreConfiguration, erro
 		return storage.StoreConfiguration{}, storage.ErrStoreNotFound
 	}
 
-	existingIndexedTagNames, err := p.getExistingIndexedTagNames(p.getCollectionHandle(name))
+	existingIndexNames, err := p.getExistingIndexNames(p.getCollectionHandle(name))
 	if err != nil {
 		return storage.StoreConfiguration{}, fmt.Errorf("failed to get existing indexed tag names: %w", err)
 	}
 
+	var existingIndexedTagNames []string
+
+	// The names of the indexes set using SetStoreConfigWithIndexes contain ':', unlike tag names.
+	for _, indexName := range existingIndexNames {
+		if !strings.Contains(indexName, ":") {
+			existingIndexedTagNames = append(existingIndexedTagNames, indexName)
+		}
+	}
+
 	return storage.StoreConfiguration{TagNames: existingIndexedTagNames}, nil
 }
 
@@ -345,86 +434,76 @@ func (p *Provider) getCollectionHandle(name string) *mongo.Collection {
 	return p.client.Database(name).Collection("c")
 }
 
-func (p *Provider) setIndexes(openStore *store, config storage.StoreConfiguration) error {
-	tagNamesNeedIndexCreation, err := p.determineTagNamesNeedIndexCreation(openStore, config)
+func (p *Provider) setIndexes(openStore *store, config storage.StoreConfiguration, indexes []Index) error {
+	modelsNeedCreation, err := p.determineIndexesNeedCreation(openStore, indexModels(config, indexes))
 	if err != nil {
 		return err
 	}
 
-	if len(tagNamesNeedIndexCreation) > 0 {
-		models := make([]mongo.IndexModel, len(tagNamesNeedIndexCreation))
-
-		for i, tagName := range tagNamesNeedIndexCreation {
-			indexOptions := mongooptions.Index()
-			indexOptions.SetName(tagName)
-
-			models[i] = mongo.IndexModel{
-				Keys:    bson.D{{Key: fmt.Sprintf("tags.%s", tagName), Value: 1}},
-				Options: indexOptions,
-			}
-		}
-
-		err = p.createIndexes(openStore, models)
+	if len(modelsNeedCreation) > 0 {
+		err = p.createIndexes(openStore, modelsNeedCreation)
 		if err != nil {
 			return err
 		}
 	}
 
+	openStore.setSortIndexes(indexes)
+
 	return nil
 }
 
-func (p *Provider) determineTagNamesNeedIndexCreation(openStore *store,
-	config storage.StoreConfiguration) ([]string, error) {
-	existingIndexedTagNames, err := p.getExistingIndexedTagNames(openStore.coll)
+func (p *Provider) determineIndexesNeedCreation(openStore *store,
+	models []mongo.IndexModel) ([]mongo.IndexModel, error) {
+	existingIndexNames, err := p.getExistingIndexNames(openStore.coll)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get existing indexed tag names: %w", err)
 	}
 
-	tagNameIndexesAlreadyConfigured := make(map[string]struct{})
+	indexesAlreadyConfigured := make(map[string]struct{})
 
-	for _, existingIndexedTagName := range existingIndexedTagNames {
-		var existingTagIsInNewConfig bool
+	for _, existingIndexName := range existingIndexNames {
+		var existingIndexIsInNewConfig bool
 
-		for _, tagName := range config.TagNames {
-			if existingIndexedTagName == tagName {
-				existingTagIsInNewConfig = true
-				tagNameIndexesAlreadyConfigured[tagName] = struct{}{}
+		for _, model := range models {
+			if existingIndexName == *model.Options.Name {
+				existingIndexIsInNewConfig = true
+				indexesAlreadyConfigured[existingIndexName] = struct{}{}
 
 				p.logger.Infof("[Store name (includes prefix, if any): %s] Skipping index creation for %s "+
-					"since the index already exists.", openStore.name, tagName)
+					"since the index already exists.", openStore.name, existingIndexName)
 
 				break
 			}
 		}
 
-		// If the new store configuration doesn't have the existing index (tag) defined, then we will delete it
-		if !existingTagIsInNewConfig {
+		// If the new store configuration doesn't have the existing index defined, then we will delete it
+		if !existingIndexIsInNewConfig {
 			ctxWithTimeout, cancel := context.WithTimeout(context.Background(), p.timeout)
 
-			_, errDrop := openStore.coll.Indexes().DropOne(ctxWithTimeout, existingIndexedTagName)
+			_, errDrop := openStore.coll.Indexes().DropOne(ctxWithTimeout, existingIndexName)
 			if errDrop != nil {
 				cancel()
 
-				return nil, fmt.Errorf("failed to remove index for %s: %w", existingIndexedTagName, errDrop)
+				return nil, fmt.Errorf("failed to remove index for %s: %w", existingIndexName, errDrop)
 			}
 
 			cancel()
 		}
 	}
 
-	var tagNamesNeedIndexCreation []string
+	var modelsNeedCreation []mongo.IndexModel
 
-	for _, tag := range config.TagNames {
-		_, indexAlreadyCreated := tagNameIndexesAlreadyConfigured[tag]
+	for _, model := range models {
+		_, indexAlreadyCreated := indexesAlreadyConfigured[*model.Options.Name]
 		if !indexAlreadyCreated {
-			tagNamesNeedIndexCreation = append(tagNamesNeedIndexCreation, tag)
+			modelsNeedCreation = append(modelsNeedCreation, model)
 		}
 	}
 
-	return tagNamesNeedIndexCreation, nil
+	return modelsNeedCreation, nil
 }
 
-func (p *Provider) getExistingIndexedTagNames(collection *mongo.Collection) ([]string, error) {
+func (p *Provider) getExistingIndexNames(collection *mongo.Collection) ([]string, error) {
 	indexesCursor, err := p.getIndexesCursor(collection)
 	if err != nil {
 		return nil, err
@@ -444,9 +523,7 @@ func (p *Provider) getExistingIndexedTagNames(collection *mongo.Collection) ([]s
 		return nil, nil
 	}
 
-	existingIndexedTagNames := make([]string, len(results)-1)
-
-	var counter int
+	existingIndexNames := make([]string, 0, len(results)-1)
 
 	for _, result := range results {
 		indexNameRaw, exists := result["name"]
@@ -459,18 +536,16 @@ func (p *Provider) getExistingIndexedTagNames(collection *mongo.Collection) ([]s
 			return nil, errors.New(`index name is of unexpected type`)
 		}
 
-		// The _id_ index is a built-in index in MongoDB. It wasn't one that can be set using SetStoreConfig,
-		// so we omit it here.
-		if indexName == "_id_" {
+		// The _id_ index is a built-in index in MongoDB, and the TTL index is created by PutWithTTL.
+		// Neither can be set using SetStoreConfig, so we omit them here.
+		if indexName == "_id_" || indexName == expireAtIndexName {
 			continue
 		}
 
-		existingIndexedTagNames[counter] = indexName
-
-		counter++
+		existingIndexNames = append(existingIndexNames, indexName)
 	}
 
-	return existingIndexedTagNames, nil
+	return existingIndexNames, nil
 }
 
 func (p *Provider) getIndexesCursor(collection *mongo.Collection) (*mongo.Cursor, error) {
@@ -502,59 +577,166 @@ type store struct {
 	coll    *mongo.Collection
 	close   closer
 	timeout time.Duration
+
+	expireAtIndexLock    sync.Mutex
+	expireAtIndexCreated bool
+
+	// sortIndexes are the compound indexes set using SetStoreConfigWithIndexes that sorted queries can use, once
+	// sortIndexesLoaded is set.
+	sortIndexes       []Index
+	sortIndexesLoaded bool
+	sortIndexesLock   sync.RWMutex
+
+	logger                       logger
+	transactionalBatches         bool
+	allowNonTransactionalBatches bool
+	transactionLock              sync.Mutex
+	collectionCreated            bool
+	transactionsUnsupported      bool
 }
 
 // Put stores the key and the record.
 // If tag values are valid int32 or int64, they will be stored as integers in MongoDB, so we can sort numerically later.
 func (s *store) Put(key string, value []byte, tags ...storage.Tag) error {
+	return s.PutWithContext(context.Background(), key, value, tags...)
+}
+
+// PutWithContext stores the key and the record, like Put, giving up once ctx is done.
+func (s *store) PutWithContext(ctx context.Context, key string, value []byte, tags ...storage.Tag) error {
+	return s.put(ctx, key, value, tags, nil)
+}
+
+// PutWithTTL stores the key and the record, like Put, and has MongoDB remove the record once ttl has elapsed.
+// ttl must be positive. The TTL index this relies on is created the first time it's needed.
+func (s *store) PutWithTTL(key string, value []byte, ttl time.Duration, tags ...storage.Tag) error {
+	if ttl <= 0 {
+		return errors.New("ttl must be positive")
+	}
+
+	err := s.ensureExpireAtIndex()
+	if err != nil {
+		return err
+	}
+
+	expireAt := time.Now().Add(ttl)
+
+	return s.put(context.Background(), key, value, tags, &expireAt)
+}
+
+func (s *store) put(ctx context.Context, key string, value []byte, tags []storage.Tag, expireAt *time.Time) error {
 	err := validatePutInput(key, value, tags)
 	if err != nil {
 		return err
 	}
 
-	opts := &mongooptions.UpdateOptions{}
+	update, err := createUpdate(key, value, tags, expireAt)
+	if err != nil {
+		return err
+	}
 
-	tagsAsMap := convertTagSliceToMap(tags)
+	ctxWithTimeout, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
 
-	if isJSON(value) {
-		var unmarshalledValue map[string]interface{}
+	_, err = s.coll.UpdateOne(ctxWithTimeout, bson.M{"_id": key}, update,
+		mongooptions.Update().SetUpsert(true))
+	if err != nil {
+		return fmt.Errorf("failed to run UpdateOne command in MongoDB: %w", wrapUniqueIndexViolation(err))
+	}
 
-		err = json.Unmarshal(value, &unmarshalledValue)
-		if err != nil {
-			return fmt.Errorf("failed to unmarshal JSON bytes into a map[string]interface{}: %w", err)
-		}
+	return nil
+}
+
+// PutIfVersion stores the key and the record, like Put, provided the record's current version is version, or provided
+// there's no record if version is blank. It returns the record's new version.
+func (s *store) PutIfVersion(key string, value []byte, version string, tags ...storage.Tag) (string, error) {
+	err := validatePutInput(key, value, tags)
+	if err != nil {
+		return "", err
+	}
 
-		ctxWithTimeout, cancel := context.WithTimeout(context.Background(), s.timeout)
-		defer cancel()
+	filter := bson.D{{Key: "_id", Value: key}}
 
-		_, err = s.coll.UpdateOne(ctxWithTimeout, bson.M{"_id": key},
-			bson.M{"$set": jsonDataWrapper{Key: key, Value: unmarshalledValue, Tags: tagsAsMap}},
-			opts.SetUpsert(true))
+	// Expired records count as missing. If there's no record at all, the filter doesn't match and one is inserted.
+	// If there's a record that hasn't expired, the insert fails since its key is taken.
+	if version == "" {
+		filter = append(filter, bson.E{Key: expireAtFieldName, Value: bson.D{{Key: "$lte", Value: time.Now()}}})
 	} else {
-		ctxWithTimeout, cancel := context.WithTimeout(context.Background(), s.timeout)
-		defer cancel()
+		expectedVersion, errParse := strconv.ParseInt(version, 10, 64)
+		if errParse != nil {
+			return "", ErrVersionConflict
+		}
+
+		filter = append(filter, versionFilter(expectedVersion), notExpiredFilter())
+	}
+
+	update, err := createUpdate(key, value, tags, nil)
+	if err != nil {
+		return "", err
+	}
+
+	ctxWithTimeout, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	result := s.coll.FindOneAndUpdate(ctxWithTimeout, filter, update, mongooptions.FindOneAndUpdate().
+		SetUpsert(version == "").
+		SetReturnDocument(mongooptions.After).
+		SetProjection(bson.D{{Key: versionFieldName, Value: 1}}))
+	// A duplicate key error for the key means there's already a record, but one for a unique index isn't a conflict.
+	err = wrapUniqueIndexViolation(result.Err())
+	if errors.Is(err, mongo.ErrNoDocuments) || mongo.IsDuplicateKeyError(err) {
+		return "", ErrVersionConflict
+	} else if err != nil {
+		return "", fmt.Errorf("failed to run FindOneAndUpdate command in MongoDB: %w", err)
+	}
+
+	newVersion, err := getVersionFromMongoDBResult(result)
+	if err != nil {
+		return "", fmt.Errorf("failed to get version from MongoDB result: %w", err)
+	}
+
+	return newVersion, nil
+}
+
+// ensureExpireAtIndex creates the TTL index on the expireAt field, unless this store already did so.
+// Creating an index that already exists with the same options does nothing.
+func (s *store) ensureExpireAtIndex() error {
+	s.expireAtIndexLock.Lock()
+	defer s.expireAtIndexLock.Unlock()
 
-		_, err = s.coll.UpdateOne(ctxWithTimeout, bson.M{"_id": key},
-			bson.M{"$set": binaryDataWrapper{Key: key, Value: value, Tags: tagsAsMap}},
-			opts.SetUpsert(true))
+	if s.expireAtIndexCreated {
+		return nil
 	}
 
+	ctxWithTimeout, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	_, err := s.coll.Indexes().CreateOne(ctxWithTimeout, mongo.IndexModel{
+		Keys:    bson.D{{Key: expireAtFieldName, Value: 1}},
+		Options: mongooptions.Index().SetName(expireAtIndexName).SetExpireAfterSeconds(0),
+	})
 	if err != nil {
-		return fmt.Errorf("failed to run UpdateOne command in MongoDB: %w", err)
+		return fmt.Errorf("failed to create TTL index in MongoDB collection: %w", err)
 	}
 
+	s.expireAtIndexCreated = true
+
 	return nil
 }
 
 func (s *store) Get(k string) ([]byte, error) {
+	return s.GetWithContext(context.Background(), k)
+}
+
+// GetWithContext fetches the value associated with the given key, giving up once ctx is done.
+func (s *store) GetWithContext(ctx context.Context, k string) ([]byte, error) {
 	if k == "" {
 		return nil, errors.New("key is mandatory")
 	}
 
-	ctxWithTimeout, cancel := context.WithTimeout(context.Background(), s.timeout)
+	ctxWithTimeout, cancel := context.WithTimeout(ctx, s.timeout)
 	defer cancel()
 
-	result := s.coll.FindOne(ctxWithTimeout, bson.M{"_id": k})
+	result := s.coll.FindOne(ctxWithTimeout, bson.D{{Key: "_id", Value: k}, notExpiredFilter()})
 	if errors.Is(result.Err(), mongo.ErrNoDocuments) {
 		return nil, storage.ErrDataNotFound
 	} else if result.Err() != nil {
@@ -569,15 +751,50 @@ func (s *store) Get(k string) ([]byte, error) {
 	return value, nil
 }
 
+// GetWithVersion returns the record stored under k along with its current version.
+// Records put by earlier versions of this store, before versions were kept, are at version 0.
+func (s *store) GetWithVersion(k string) ([]byte, string, error) {
+	if k == "" {
+		return nil, "", errors.New("key is mandatory")
+	}
+
+	ctxWithTimeout, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	result := s.coll.FindOne(ctxWithTimeout, bson.D{{Key: "_id", Value: k}, notExpiredFilter()})
+	if errors.Is(result.Err(), mongo.ErrNoDocuments) {
+		return nil, "", storage.ErrDataNotFound
+	} else if result.Err() != nil {
+		return nil, "", fmt.Errorf("failed to run FindOne command in MongoDB: %w", result.Err())
+	}
+
+	_, value, err := getKeyAndValueFromMongoDBResult(result)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get value from MongoDB result: %w", err)
+	}
+
+	version, err := getVersionFromMongoDBResult(result)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get version from MongoDB result: %w", err)
+	}
+
+	return value, version, nil
+}
+
 func (s *store) GetTags(key string) ([]storage.Tag, error) {
+	return s.GetTagsWithContext(context.Background(), key)
+}
+
+// GetTagsWithContext fetches all tags associated with the given key, giving up once ctx is done.
+func (s *store) GetTagsWithContext(ctx context.Context, key string) ([]storage.Tag, error) {
 	if key == "" {
 		return nil, errors.New("key is mandatory")
 	}
 
-	ctxWithTimeout, cancel := context.WithTimeout(context.Background(), s.timeout)
+	ctxWithTimeout, cancel := context.WithTimeout(ctx, s.timeout)
 	defer cancel()
 
-	result := s.coll.FindOne(ctxWithTimeout, bson.M{"_id": key})
+	result := s.coll.FindOne(ctxWithTimeout, bson.D{{Key: "_id", Value: key}, notExpiredFilter()})
 	if errors.Is(result.Err(), mongo.ErrNoDocuments) {
 		return nil, storage.ErrDataNotFound
 	} else if result.Err() != nil {
@@ -593,6 +810,11 @@ func (s *store) GetTags(key string) ([]storage.Tag, error) {
 }
 
 func (s *store) GetBulk(keys ...string) ([][]byte, error) {
+	return s.GetBulkWithContext(context.Background(), keys...)
+}
+
+// GetBulkWithContext fetches the values associated with the given keys, giving up once ctx is done.
+func (s *store) GetBulkWithContext(ctx context.Context, keys ...string) ([][]byte, error) {
 	if len(keys) == 0 {
 		return nil, errors.New("keys slice must contain at least one key")
 	}
@@ -603,17 +825,17 @@ func (s *store) GetBulk(keys ...string) ([][]byte, error) {
 		}
 	}
 
-	ctxWithTimeout, cancel := context.WithTimeout(context.Background(), s.timeout)
+	ctxWithTimeout, cancel := context.WithTimeout(ctx, s.timeout)
 	defer cancel()
 
-	cursor, err := s.coll.Find(ctxWithTimeout, bson.M{"_id": bson.D{
+	cursor, err := s.coll.Find(ctxWithTimeout, bson.D{{Key: "_id", Value: bson.D{
 		{Key: "$in", Value: keys},
-	}})
+	}}, notExpiredFilter()})
 	if err != nil {
 		return nil, fmt.Errorf("failed to run Find command in MongoDB: %w", err)
 	}
 
-	allValues, err := s.collectBulkGetResults(keys, cursor)
+	allValues, err := s.collectBulkGetResults(ctx, keys, cursor)
 	if err != nil {
 		return nil, err
 	}
@@ -623,25 +845,28 @@ func (s *store) GetBulk(keys ...string) ([][]byte, error) {
 
 // Query does a query for data as defined by the documentation in storage.Store (the interface).
 // It's recommended to set up an index using the Provider.SetStoreConfig method in order to speed up queries.
-// TODO (#146) Investigate compound indexes and see if they may be useful for queries with sorts.
+// In addition to TagName and TagName:TagValue, expression may combine these with && and ||, with && binding tighter
+// than ||. For example, "TagName1:TagValue1&&TagName2||TagName3" matches data that either has both a TagName1 tag
+// with a value of TagValue1 and a TagName2 tag, or has a TagName3 tag.
+// Tag values can also be matched by prefix, as in "TagName:Prefix*", or compared using <, <=, > and >=, as in
+// "TagName<=1700000000". Comparisons are numeric if the value in the expression is a number. Tag values that are
+// numbers are stored as numbers, which a prefix never matches, so they have to be matched with a range instead. Tag
+// values ending in * can't be matched exactly, since a trailing * always makes the value a prefix.
+// A sorted query for TagName:TagValue (possibly with other conditions joined by &&) uses the compound index on TagName
+// and the sort tag, if one was set using Provider.SetStoreConfigWithIndexes. Otherwise, MongoDB may have to sort the
+// results in memory, which fails if there's more than 32MB of them. If the index has since been dropped, e.g. by
+// another Provider setting a different store configuration, the query is run without it.
 func (s *store) Query(expression string, options ...storage.QueryOption) (storage.Iterator, error) {
-	if expression == "" {
-		return &iterator{}, errInvalidQueryExpressionFormat
-	}
-
-	expressionSplit := strings.Split(expression, ":")
-
-	var filterValue interface{}
+	return s.QueryWithContext(context.Background(), expression, options...)
+}
 
-	switch len(expressionSplit) {
-	case expressionTagNameOnlyLength:
-		filterValue = bson.D{
-			{Key: "$exists", Value: true},
-		}
-	case expressionTagNameAndValueLength:
-		filterValue = expressionSplit[1]
-	default:
-		return &iterator{}, errInvalidQueryExpressionFormat
+// QueryWithContext does a query for data, like Query, giving up once ctx is done.
+// The returned iterator also uses ctx for fetching further results and for counting them.
+func (s *store) QueryWithContext(ctx context.Context, expression string,
+	options ...storage.QueryOption) (storage.Iterator, error) {
+	disjunction, err := parseQueryExpression(expression)
+	if err != nil {
+		return &iterator{}, err
 	}
 
 	queryOptions := getQueryOptions(options)
@@ -658,37 +883,71 @@ func (s *store) Query(expression string, options ...storage.QueryOption) (storag
 			Key:   fmt.Sprintf("tags.%s", queryOptions.SortOptions.TagName),
 			Value: mongoDBSortOrder,
 		}})
+
+		err = s.loadSortIndexes(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		hint := s.sortIndexHint(disjunction, queryOptions.SortOptions.TagName)
+		if hint != "" {
+			findOptions.SetHint(hint)
+		}
 	}
 
-	filterKey := fmt.Sprintf("tags.%s", expressionSplit[0])
+	filter := createMongoDBFilter(disjunction)
 
-	ctxWithTimeout, cancel := context.WithTimeout(context.Background(), s.timeout)
+	cursor, err := s.find(ctx, append(filter, notExpiredFilter()), findOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	return &iterator{
+		ctx:     ctx,
+		cursor:  cursor,
+		coll:    s.coll,
+		filter:  filter,
+		timeout: s.timeout,
+	}, nil
+}
+
+// find runs a Find command. If its hint names an index that no longer exists, e.g. because another Provider has set
+// a different store configuration, the command is run again without the hint.
+func (s *store) find(ctx context.Context, filter bson.D, findOptions *mongooptions.FindOptions) (*mongo.Cursor, error) {
+	ctxWithTimeout, cancel := context.WithTimeout(ctx, s.timeout)
 	defer cancel()
 
-	cursor, err := s.coll.Find(ctxWithTimeout, bson.D{{
-		Key:   filterKey,
-		Value: filterValue,
-	}}, findOptions)
+	cursor, err := s.coll.Find(ctxWithTimeout, filter, findOptions)
+	if err != nil && findOptions.Hint != nil && isBadHintError(err) {
+		s.logger.Infof("[Store name (includes prefix, if any): %s] The index %v used as a hint for a sorted "+
+			"query no longer exists, so the query is run without it.", s.name, findOptions.Hint)
+
+		s.forgetSortIndexes()
+
+		findOptions.Hint = nil
+
+		cursor, err = s.coll.Find(ctxWithTimeout, filter, findOptions)
+	}
+
 	if err != nil {
 		return nil, fmt.Errorf("failed to run Find command in MongoDB: %w", err)
 	}
 
-	return &iterator{
-		cursor:      cursor,
-		coll:        s.coll,
-		filterKey:   filterKey,
-		filterValue: filterValue,
-		timeout:     s.timeout,
-	}, nil
+	return cursor, nil
 }
 
 // Delete deletes the value (and all tags) associated with key.
 func (s *store) Delete(key string) error {
+	return s.DeleteWithContext(context.Background(), key)
+}
+
+// DeleteWithContext deletes the value (and all tags) associated with key, giving up once ctx is done.
+func (s *store) DeleteWithContext(ctx context.Context, key string) error {
 	if key == "" {
 		return errors.New("key is mandatory")
 	}
 
-	ctxWithTimeout, cancel := context.WithTimeout(context.Background(), s.timeout)
+	ctxWithTimeout, cancel := context.WithTimeout(ctx, s.timeout)
 	defer cancel()
 
 	_, err := s.coll.DeleteOne(ctxWithTimeout, bson.M{"_id": key})
@@ -699,7 +958,14 @@ func (s *store) Delete(key string) error {
 	return err
 }
 
+// Batch performs multiple Put and/or Delete operations in order.
+// Unless the Provider was created using WithTransactionalBatches, a failed operation leaves the ones before it applied.
 func (s *store) Batch(operations []storage.Operation) error {
+	return s.BatchWithContext(context.Background(), operations)
+}
+
+// BatchWithContext performs multiple Put and/or Delete operations in order, giving up once ctx is done.
+func (s *store) BatchWithContext(ctx context.Context, operations []storage.Operation) error {
 	if len(operations) == 0 {
 		return errors.New("batch requires at least one operation")
 	}
@@ -721,12 +987,20 @@ func (s *store) Batch(operations []storage.Operation) error {
 		models[i] = model
 	}
 
-	ctxWithTimeout, cancel := context.WithTimeout(context.Background(), s.timeout)
+	if s.transactionalBatches {
+		return s.bulkWriteInTransaction(ctx, models)
+	}
+
+	return s.bulkWrite(ctx, models)
+}
+
+func (s *store) bulkWrite(ctx context.Context, models []mongo.WriteModel) error {
+	ctxWithTimeout, cancel := context.WithTimeout(ctx, s.timeout)
 	defer cancel()
 
 	_, err := s.coll.BulkWrite(ctxWithTimeout, models)
 	if err != nil {
-		return fmt.Errorf("failed to run BulkWrite command in MongoDB: %w", err)
+		return fmt.Errorf("failed to run BulkWrite command in MongoDB: %w", wrapUniqueIndexViolation(err))
 	}
 
 	return nil
@@ -745,10 +1019,10 @@ func (s *store) Close() error {
 	return nil
 }
 
-func (s *store) collectBulkGetResults(keys []string, cursor *mongo.Cursor) ([][]byte, error) {
+func (s *store) collectBulkGetResults(ctx context.Context, keys []string, cursor *mongo.Cursor) ([][]byte, error) {
 	allValues := make([][]byte, len(keys))
 
-	ctxWithTimeout, cancel := context.WithTimeout(context.Background(), s.timeout)
+	ctxWithTimeout, cancel := context.WithTimeout(ctx, s.timeout)
 	defer cancel()
 
 	for cursor.Next(ctxWithTimeout) {
@@ -786,18 +1060,27 @@ func (s *store) createMongoFindOptions(queryOptions storage.QueryOptions) *mongo
 }
 
 type iterator struct {
-	cursor      *mongo.Cursor
-	coll        *mongo.Collection
-	filterKey   string
-	filterValue interface{}
-	timeout     time.Duration
+	ctx     context.Context
+	cursor  *mongo.Cursor
+	coll    *mongo.Collection
+	filter  bson.D
+	timeout time.Duration
 }
 
 func (i *iterator) Next() (bool, error) {
-	ctxWithTimeout, cancel := context.WithTimeout(context.Background(), i.timeout)
+	ctxWithTimeout, cancel := context.WithTimeout(i.ctx, i.timeout)
 	defer cancel()
 
-	return i.cursor.Next(ctxWithTimeout), nil
+	if i.cursor.Next(ctxWithTimeout) {
+		return true, nil
+	}
+
+	err := i.cursor.Err()
+	if err != nil {
+		return false, fmt.Errorf("failure during iteration of MongoDB cursor: %w", err)
+	}
+
+	return false, nil
 }
 
 func (i *iterator) Key() (string, error) {
@@ -830,13 +1113,10 @@ func (i *iterator) Tags() ([]storage.Tag, error) {
 // TODO (#147) Investigate using aggregates to get total items without doing a separate query.
 
 func (i *iterator) TotalItems() (int, error) {
-	ctxWithTimeout, cancel := context.WithTimeout(context.Background(), i.timeout)
+	ctxWithTimeout, cancel := context.WithTimeout(i.ctx, i.timeout)
 	defer cancel()
 
-	totalItems, err := i.coll.CountDocuments(ctxWithTimeout, bson.D{{
-		Key:   i.filterKey,
-		Value: i.filterValue,
-	}})
+	totalItems, err := i.coll.CountDocuments(ctxWithTimeout, append(i.filter, notExpiredFilter()))
 	if err != nil {
 		return -1, fmt.Errorf("failed to get document count from MongoDB: %w", err)
 	}
@@ -916,30 +1196,48 @@ func isJSON(dataToCheck []byte) bool {
 	return json.Unmarshal(dataToCheck, &js) == nil
 }
 
-func convertTagSliceToMap(tagSlice []storage.Tag) map[string]interface{} {
-	tagsMap := make(map[string]interface{})
+// convertTagSliceToMap returns the tags to store for tagSlice. Tag values that are decimal numbers are stored as
+// numbers, so that they're sorted and compared numerically, and the values as they were written are returned
+// separately for those that wouldn't be read back the same.
+func convertTagSliceToMap(tagSlice []storage.Tag) (tagsMap map[string]interface{}, tagValues map[string]string) {
+	tagsMap = make(map[string]interface{})
 
 	for _, tag := range tagSlice {
-		tagValueAsInt, err := strconv.Atoi(tag.Value)
-		if err != nil {
+		number, isNumber := tagValueAsNumber(tag.Value)
+		if !isNumber {
 			tagsMap[tag.Name] = tag.Value
-		} else {
-			tagsMap[tag.Name] = tagValueAsInt
+
+			continue
+		}
+
+		tagsMap[tag.Name] = number
+
+		if formatTagValue(number) != tag.Value {
+			if tagValues == nil {
+				tagValues = make(map[string]string)
+			}
+
+			tagValues[tag.Name] = tag.Value
 		}
 	}
 
-	return tagsMap
+	return tagsMap, tagValues
 }
 
-func convertTagMapToSlice(tagMap map[string]interface{}) []storage.Tag {
+func convertTagMapToSlice(tagMap map[string]interface{}, tagValues map[string]string) []storage.Tag {
 	tagsSlice := make([]storage.Tag, len(tagMap))
 
 	var counter int
 
 	for tagName, tagValue := range tagMap {
+		tagValueAsString, isNonCanonical := tagValues[tagName]
+		if !isNonCanonical {
+			tagValueAsString = formatTagValue(tagValue)
+		}
+
 		tagsSlice[counter] = storage.Tag{
 			Name:  tagName,
-			Value: fmt.Sprintf("%v", tagValue),
+			Value: tagValueAsString,
 		}
 
 		counter++
@@ -948,6 +1246,29 @@ func convertTagMapToSlice(tagMap map[string]interface{}) []storage.Tag {
 	return tagsSlice
 }
 
+// tagValueAsNumber returns the number a tag value represents, and whether it's a decimal number. Integers are
+// returned as ints so that they're stored exactly.
+func tagValueAsNumber(value string) (interface{}, bool) {
+	integer, err := strconv.Atoi(value)
+	if err == nil {
+		return integer, true
+	}
+
+	number, err := strconv.ParseFloat(value, 64)
+
+	return number, err == nil && !math.IsInf(number, 0) && !math.IsNaN(number)
+}
+
+// formatTagValue returns a stored tag value as a string. Numbers are formatted without exponents.
+func formatTagValue(tagValue interface{}) string {
+	number, isFloat64 := tagValue.(float64)
+	if isFloat64 {
+		return strconv.FormatFloat(number, 'f', -1, 64)
+	}
+
+	return fmt.Sprintf("%v", tagValue)
+}
+
 type decoder interface {
 	Decode(interface{}) error
 }
@@ -976,15 +1297,24 @@ func getTagsFromMongoDBResult(decoder decoder) ([]storage.Tag, error) {
 		return nil, fmt.Errorf("failed to get data wrapper from MongoDB result: %w", err)
 	}
 
-	var tagsToConvert map[string]interface{}
-
 	if jsonData == nil {
-		tagsToConvert = binaryData.Tags
-	} else {
-		tagsToConvert = jsonData.Tags
+		return convertTagMapToSlice(binaryData.Tags, binaryData.TagValues), nil
+	}
+
+	return convertTagMapToSlice(jsonData.Tags, jsonData.TagValues), nil
+}
+
+func getVersionFromMongoDBResult(decoder decoder) (string, error) {
+	var versionData struct {
+		Version int64 `bson:"version"`
 	}
 
-	return convertTagMapToSlice(tagsToConvert), nil
+	err := decoder.Decode(&versionData)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode version from MongoDB: %w", err)
+	}
+
+	return strconv.FormatInt(versionData.Version, 10), nil
 }
 
 // The data wrapper from the MongoDB result may be a jsonDataWrapper or binaryDataWrapper.
@@ -1026,35 +1356,240 @@ func getQueryOptions(options []storage.QueryOption) storage.QueryOptions {
 	return queryOptions
 }
 
+// tagCondition is a condition on a tag, as found in a query expression. A blank operator means that the tag only
+// needs to exist.
+type tagCondition struct {
+	name     string
+	operator string
+	value    string
+}
+
+// parseQueryExpression splits expression into terms joined by ||, each of which is a list of tag conditions joined
+// by &&.
+func parseQueryExpression(expression string) ([][]tagCondition, error) {
+	if expression == "" {
+		return nil, errInvalidQueryExpressionFormat
+	}
+
+	var disjunction [][]tagCondition
+
+	for _, conjunctionExpression := range strings.Split(expression, "||") {
+		var conjunction []tagCondition
+
+		for _, conditionExpression := range strings.Split(conjunctionExpression, "&&") {
+			condition, ok := parseTagCondition(conditionExpression)
+			if !ok {
+				return nil, errInvalidQueryExpressionFormat
+			}
+
+			conjunction = append(conjunction, condition)
+		}
+
+		disjunction = append(disjunction, conjunction)
+	}
+
+	return disjunction, nil
+}
+
+// parseTagCondition parses a condition in one of the formats TagName, TagName:TagValue, TagName:TagValuePrefix*,
+// TagName<TagValue, TagName<=TagValue, TagName>TagValue or TagName>=TagValue. It returns false if conditionExpression
+// isn't in any of these formats.
+func parseTagCondition(conditionExpression string) (tagCondition, bool) {
+	operatorIndex := strings.IndexAny(conditionExpression, ":<>")
+	if operatorIndex == -1 {
+		return tagCondition{name: conditionExpression}, conditionExpression != ""
+	}
+
+	condition := tagCondition{
+		name:     conditionExpression[:operatorIndex],
+		operator: conditionExpression[operatorIndex : operatorIndex+1],
+		value:    conditionExpression[operatorIndex+1:],
+	}
+
+	switch {
+	case condition.operator != equalsOperator:
+		if strings.HasPrefix(condition.value, "=") {
+			condition.operator += "="
+			condition.value = condition.value[1:]
+		}
+
+		if condition.value == "" {
+			return condition, false
+		}
+	case strings.HasSuffix(condition.value, "*"):
+		condition.operator = prefixOperator
+		condition.value = strings.TrimSuffix(condition.value, "*")
+	case condition.value == "":
+		condition.operator = ""
+	}
+
+	return condition, condition.name != "" && !strings.Contains(condition.value, ":")
+}
+
+// createMongoDBFilter translates a parsed query expression into a filter, using $and and $or only where needed.
+func createMongoDBFilter(disjunction [][]tagCondition) bson.D {
+	conjunctionFilters := make([]bson.D, len(disjunction))
+
+	for i, conjunction := range disjunction {
+		tagFilters := make([]bson.D, len(conjunction))
+
+		for j, condition := range conjunction {
+			tagFilters[j] = createMongoDBTagFilter(condition)
+		}
+
+		conjunctionFilters[i] = tagFilters[0]
+
+		if len(tagFilters) > 1 {
+			conjunctionFilters[i] = bson.D{{Key: "$and", Value: tagFilters}}
+		}
+	}
+
+	if len(conjunctionFilters) == 1 {
+		return conjunctionFilters[0]
+	}
+
+	return bson.D{{Key: "$or", Value: conjunctionFilters}}
+}
+
+// createMongoDBTagFilter returns the filter for a single tag condition. A tag value that's stored as a number is
+// matched as one, unless it wouldn't be read back as it was written, in which case the value as it was written is
+// matched instead, so that e.g. "1.5" and "1.50" don't match each other. Documents put before decimal tag values
+// were stored as numbers have them stored as strings, so those are matched too.
+func createMongoDBTagFilter(condition tagCondition) bson.D {
+	tagFieldName := fmt.Sprintf("tags.%s", condition.name)
+
+	number, isNumber := tagValueAsNumber(condition.value)
+	if condition.operator != equalsOperator || !isNumber {
+		return bson.D{{Key: tagFieldName, Value: createMongoDBTagFilterValue(condition)}}
+	}
+
+	tagValueFieldName := fmt.Sprintf("tagValues.%s", condition.name)
+
+	numberFilter := bson.D{{Key: tagValueFieldName, Value: condition.value}}
+
+	if formatTagValue(number) == condition.value {
+		numberFilter = bson.D{
+			{Key: tagFieldName, Value: number},
+			{Key: tagValueFieldName, Value: bson.D{{Key: "$exists", Value: false}}},
+		}
+	}
+
+	return bson.D{{Key: "$or", Value: bson.A{numberFilter, bson.D{{Key: tagFieldName, Value: condition.value}}}}}
+}
+
+// createMongoDBTagFilterValue returns the filter for the tag named in condition.
+// A prefix is matched with an anchored regular expression, which can use an index on the tag.
+func createMongoDBTagFilterValue(condition tagCondition) interface{} {
+	switch condition.operator {
+	case "":
+		return bson.D{{Key: "$exists", Value: true}}
+	case equalsOperator:
+		return condition.value
+	case prefixOperator:
+		return primitive.Regex{Pattern: "^" + regexp.QuoteMeta(condition.value)}
+	default:
+		return bson.D{{Key: comparisonOperator(condition.operator), Value: comparisonValue(condition.value)}}
+	}
+}
+
+// comparisonOperator returns the MongoDB query operator for one of the comparison operators of query expressions.
+func comparisonOperator(operator string) string {
+	switch operator {
+	case "<":
+		return "$lt"
+	case "<=":
+		return "$lte"
+	case ">":
+		return "$gt"
+	default:
+		return "$gte"
+	}
+}
+
+// comparisonValue returns the number value represents, or value itself if it isn't a number.
+// Since MongoDB only compares values of the same type, a number only matches the tag values that are decimal numbers
+// (which are stored as numbers), and any other value only matches the tag values that aren't.
+func comparisonValue(value string) interface{} {
+	number, isNumber := tagValueAsNumber(value)
+	if isNumber {
+		return number
+	}
+
+	return value
+}
+
 func generateModelForBulkWriteCall(operation storage.Operation) (mongo.WriteModel, error) {
 	if operation.Value == nil {
 		return mongo.NewDeleteOneModel().SetFilter(bson.M{"_id": operation.Key}), nil
 	}
 
-	tagsAsMap := convertTagSliceToMap(operation.Tags)
+	update, err := createUpdate(operation.Key, operation.Value, operation.Tags, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return mongo.NewUpdateOneModel().
+		SetFilter(bson.M{"_id": operation.Key}).
+		SetUpdate(update).
+		SetUpsert(true), nil
+}
+
+// createUpdate returns the update that upserts the document for an entry and increments its version. If expireAt is
+// nil, then any expiry time set by an earlier put of the entry is removed. Likewise, tag values kept as they were
+// written by an earlier put are removed if none of the entry's tags need them anymore.
+func createUpdate(key string, value []byte, tags []storage.Tag, expireAt *time.Time) (bson.M, error) {
+	tagsAsMap, tagValues := convertTagSliceToMap(tags)
 
-	if isJSON(operation.Value) {
+	var dataWrapper interface{} = binaryDataWrapper{
+		Key: key, Value: value, Tags: tagsAsMap, TagValues: tagValues, ExpireAt: expireAt,
+	}
+
+	if isJSON(value) {
 		var unmarshalledValue map[string]interface{}
 
-		err := json.Unmarshal(operation.Value, &unmarshalledValue)
+		err := json.Unmarshal(value, &unmarshalledValue)
 		if err != nil {
 			return nil, fmt.Errorf("failed to unmarshal JSON bytes into a map[string]interface{}: %w", err)
 		}
 
-		return mongo.NewUpdateOneModel().
-			SetFilter(bson.M{"_id": operation.Key}).
-			SetUpdate(bson.M{"$set": jsonDataWrapper{
-				Key: operation.Key, Value: unmarshalledValue,
-				Tags: tagsAsMap,
-			}}).
-			SetUpsert(true), nil
+		dataWrapper = jsonDataWrapper{
+			Key: key, Value: unmarshalledValue, Tags: tagsAsMap, TagValues: tagValues, ExpireAt: expireAt,
+		}
 	}
 
-	return mongo.NewUpdateOneModel().
-		SetFilter(bson.M{"_id": operation.Key}).
-		SetUpdate(bson.M{"$set": binaryDataWrapper{
-			Key: operation.Key, Value: operation.Value,
-			Tags: tagsAsMap,
-		}}).
-		SetUpsert(true), nil
+	update := bson.M{"$set": dataWrapper, "$inc": bson.M{versionFieldName: 1}}
+
+	unset := bson.M{}
+
+	if expireAt == nil {
+		unset[expireAtFieldName] = ""
+	}
+
+	if tagValues == nil {
+		unset[tagValuesFieldName] = ""
+	}
+
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+
+	return update, nil
+}
+
+// versionFilter matches the documents at the given version. Documents put before versions were kept have no version
+// field, and are at version 0.
+func versionFilter(version int64) bson.E {
+	if version == 0 {
+		return bson.E{Key: versionFieldName, Value: bson.D{{Key: "$exists", Value: false}}}
+	}
+
+	return bson.E{Key: versionFieldName, Value: version}
+}
+
+// notExpiredFilter matches the documents that weren't put with a TTL, or whose TTL hasn't elapsed yet.
+// MongoDB only removes expired documents periodically, so they have to be filtered out until then.
+func notExpiredFilter() bson.E {
+	return bson.E{Key: expireAtFieldName, Value: bson.D{
+		{Key: "$not", Value: bson.D{{Key: "$lte", Value: time.Now()}}},
+	}}
 }
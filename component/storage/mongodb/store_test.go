@@ -8,9 +8,11 @@ package mongodb_test
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"os"
 	"reflect"
+	"strconv"
 	"sync"
 	"testing"
 	"time"
@@ -79,6 +81,26 @@ func TestProvider_SetStoreConfig_Failure(t *testing.T) {
 		"failed to get list of indexes from MongoDB: server selection error: context deadline exceeded, current topology: { Type: Unknown, Servers: [{ Addr: badurl:27017, Type: Unknown }, ] }") //nolint:lll
 }
 
+func TestProvider_SetStoreConfigWithIndexes_Failure(t *testing.T) {
+	provider, err := mongodb.NewProvider("mongodb://BadURL", mongodb.WithTimeout(1))
+	require.NoError(t, err)
+
+	_, err = provider.OpenStore("StoreName")
+	require.NoError(t, err)
+
+	err = provider.SetStoreConfigWithIndexes("StoreName", storage.StoreConfiguration{},
+		mongodb.Index{SortTagName: "tagName2"})
+	require.EqualError(t, err, "index tag name can't be blank")
+
+	err = provider.SetStoreConfigWithIndexes("StoreName", storage.StoreConfiguration{},
+		mongodb.Index{TagName: "tagName1", SortTagName: "tag:Name2"})
+	require.EqualError(t, err, `"tag:Name2" is an invalid tag name since it contains one or more ':' characters`)
+
+	err = provider.SetStoreConfigWithIndexes("NonExistentStore", storage.StoreConfiguration{},
+		mongodb.Index{TagName: "tagName1"})
+	require.True(t, errors.Is(err, storage.ErrStoreNotFound), "unexpected error or no error")
+}
+
 func TestProvider_GetStoreConfig_Failure(t *testing.T) {
 	provider, err := mongodb.NewProvider("mongodb://BadURL", mongodb.WithTimeout(1))
 	require.NoError(t, err)
@@ -105,6 +127,52 @@ func TestStore_Put_Failure(t *testing.T) {
 		"deadline exceeded, current topology: { Type: Unknown, Servers: [{ Addr: badurl:27017, Type: Unknown }, ] }")
 }
 
+func TestStore_PutWithTTL_Failure(t *testing.T) {
+	provider, err := mongodb.NewProvider("mongodb://BadURL", mongodb.WithTimeout(1))
+	require.NoError(t, err)
+
+	store, err := provider.OpenStore("StoreName")
+	require.NoError(t, err)
+
+	ttlStore, ok := store.(mongodb.TTLStore)
+	require.True(t, ok)
+
+	err = ttlStore.PutWithTTL("key", []byte("value"), 0)
+	require.EqualError(t, err, "ttl must be positive")
+
+	err = ttlStore.PutWithTTL("key", []byte("value"), time.Minute)
+	require.EqualError(t, err, "failed to create TTL index in MongoDB collection: server selection error: "+
+		"context deadline exceeded, current topology: { Type: Unknown, Servers: [{ Addr: badurl:27017, "+
+		"Type: Unknown }, ] }")
+}
+
+func TestStore_PutIfVersion_Failure(t *testing.T) {
+	provider, err := mongodb.NewProvider("mongodb://BadURL", mongodb.WithTimeout(1))
+	require.NoError(t, err)
+
+	store, err := provider.OpenStore("StoreName")
+	require.NoError(t, err)
+
+	versionedStore, ok := store.(mongodb.VersionedStore)
+	require.True(t, ok)
+
+	version, err := versionedStore.PutIfVersion("key", []byte("value"), "not a version")
+	require.True(t, errors.Is(err, mongodb.ErrVersionConflict), "unexpected error or no error")
+	require.Empty(t, version)
+
+	version, err = versionedStore.PutIfVersion("key", []byte("value"), "")
+	require.EqualError(t, err, "failed to run FindOneAndUpdate command in MongoDB: server selection error: "+
+		"context deadline exceeded, current topology: { Type: Unknown, Servers: [{ Addr: badurl:27017, "+
+		"Type: Unknown }, ] }")
+	require.Empty(t, version)
+
+	value, version, err := versionedStore.GetWithVersion("key")
+	require.EqualError(t, err, "failed to run FindOne command in MongoDB: server selection error: context "+
+		"deadline exceeded, current topology: { Type: Unknown, Servers: [{ Addr: badurl:27017, Type: Unknown }, ] }")
+	require.Nil(t, value)
+	require.Empty(t, version)
+}
+
 func TestStore_Get_Failure(t *testing.T) {
 	provider, err := mongodb.NewProvider("mongodb://BadURL", mongodb.WithTimeout(1))
 	require.NoError(t, err)
@@ -167,6 +235,98 @@ func TestStore_Batch_Failure(t *testing.T) {
 	err = store.Batch([]storage.Operation{{Key: "key"}})
 	require.EqualError(t, err, "failed to run BulkWrite command in MongoDB: server selection error: context "+
 		"deadline exceeded, current topology: { Type: Unknown, Servers: [{ Addr: badurl:27017, Type: Unknown }, ] }")
+
+	t.Run("Transactional batches", func(t *testing.T) {
+		transactionalProvider, errNew := mongodb.NewProvider("mongodb://BadURL", mongodb.WithTimeout(1),
+			mongodb.WithTransactionalBatches(false))
+		require.NoError(t, errNew)
+
+		transactionalStore, errOpen := transactionalProvider.OpenStore("StoreName")
+		require.NoError(t, errOpen)
+
+		err = transactionalStore.Batch([]storage.Operation{{Key: "key"}})
+		require.EqualError(t, err, "failed to create MongoDB collection: server selection error: context "+
+			"deadline exceeded, current topology: { Type: Unknown, Servers: [{ Addr: badurl:27017, Type: Unknown }, ] }")
+	})
+}
+
+func TestStore_Query_Failure(t *testing.T) {
+	provider, err := mongodb.NewProvider("mongodb://BadURL", mongodb.WithTimeout(1))
+	require.NoError(t, err)
+
+	store, err := provider.OpenStore("StoreName")
+	require.NoError(t, err)
+
+	for _, expression := range []string{
+		"TagName1&&", "||TagName1", "TagName1:TagValue1&&:TagValue2", "TagName1<", "TagName1>=TagValue1:TagValue2",
+	} {
+		iterator, errQuery := store.Query(expression)
+		require.EqualError(t, errQuery, "invalid expression format. it must be in the following format: "+
+			"TagName:TagValue, optionally combined with others using && and ||")
+		require.Empty(t, iterator)
+	}
+
+	iterator, err := store.Query("TagName1:TagValue1",
+		storage.WithSortOrder(&storage.SortOptions{TagName: "TagName2"}))
+	require.EqualError(t, err, "failed to get list of indexes from MongoDB: server selection error: context "+
+		"deadline exceeded, current topology: { Type: Unknown, Servers: [{ Addr: badurl:27017, Type: Unknown }, ] }")
+	require.Nil(t, iterator)
+}
+
+func TestStore_ContextStore_Failure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	provider, err := mongodb.NewProvider("mongodb://BadURL")
+	require.NoError(t, err)
+
+	store, err := provider.OpenStore("StoreName")
+	require.NoError(t, err)
+
+	contextStore, ok := store.(mongodb.ContextStore)
+	require.True(t, ok)
+
+	// The canceled context applies well before the 10 second default timeout.
+	err = contextStore.PutWithContext(ctx, "key", []byte("value"))
+	require.True(t, errors.Is(err, context.Canceled), "unexpected error or no error")
+
+	_, err = contextStore.GetWithContext(ctx, "key")
+	require.True(t, errors.Is(err, context.Canceled), "unexpected error or no error")
+
+	_, err = contextStore.GetTagsWithContext(ctx, "key")
+	require.True(t, errors.Is(err, context.Canceled), "unexpected error or no error")
+
+	_, err = contextStore.GetBulkWithContext(ctx, "key")
+	require.True(t, errors.Is(err, context.Canceled), "unexpected error or no error")
+
+	_, err = contextStore.QueryWithContext(ctx, "TagName1")
+	require.True(t, errors.Is(err, context.Canceled), "unexpected error or no error")
+
+	err = contextStore.DeleteWithContext(ctx, "key")
+	require.True(t, errors.Is(err, context.Canceled), "unexpected error or no error")
+
+	err = contextStore.BatchWithContext(ctx, []storage.Operation{{Key: "key"}})
+	require.True(t, errors.Is(err, context.Canceled), "unexpected error or no error")
+}
+
+func TestStore_Watch_Failure(t *testing.T) {
+	provider, err := mongodb.NewProvider("mongodb://BadURL", mongodb.WithTimeout(1))
+	require.NoError(t, err)
+
+	store, err := provider.OpenStore("StoreName")
+	require.NoError(t, err)
+
+	watchableStore, ok := store.(mongodb.WatchableStore)
+	require.True(t, ok)
+
+	changeStream, err := watchableStore.Watch(context.Background(), mongodb.WithCheckpoint("not a checkpoint"))
+	require.EqualError(t, err, "invalid checkpoint: not a checkpoint")
+	require.Nil(t, changeStream)
+
+	changeStream, err = watchableStore.Watch(context.Background())
+	require.EqualError(t, err, "failed to open MongoDB change stream: server selection error: context "+
+		"deadline exceeded, current topology: { Type: Unknown, Servers: [{ Addr: badurl:27017, Type: Unknown }, ] }")
+	require.Nil(t, changeStream)
 }
 
 func startContainerAndDoAllTests(t *testing.T, dockerMongoDBTag string) {
@@ -194,6 +354,14 @@ func doAllTests(t *testing.T, connString string) {
 	testGetStoreConfigUnderlyingDatabaseCheck(t, connString)
 	testMultipleProvidersSettingSameStoreConfigurationAtTheSameTime(t, connString)
 	testCloseProviderTwice(t, connString)
+	testQueryWithBooleanExpressions(t, connString)
+	testQueryWithRangesAndPrefixes(t, connString)
+	testPutWithTTL(t, connString)
+	testPutIfVersion(t, connString)
+	testSetStoreConfigWithIndexes(t, connString)
+	testTransactionalBatches(t, connString)
+	testContextStore(t, connString)
+	testWatch(t, connString)
 }
 
 func testGetStoreConfigUnderlyingDatabaseCheck(t *testing.T, connString string) {
@@ -364,6 +532,579 @@ func testCloseProviderTwice(t *testing.T, connString string) {
 	require.NoError(t, provider.Close()) // Should succeed, even if called repeatedly.
 }
 
+func testQueryWithBooleanExpressions(t *testing.T, connString string) {
+	t.Helper()
+
+	provider, err := mongodb.NewProvider(connString)
+	require.NoError(t, err)
+
+	defer func() {
+		require.NoError(t, provider.Close())
+	}()
+
+	store, err := provider.OpenStore("BooleanExpressionTestStore")
+	require.NoError(t, err)
+
+	require.NoError(t, store.Put("key1", []byte("value1"),
+		storage.Tag{Name: "TagName1", Value: "TagValue1"}, storage.Tag{Name: "TagName2", Value: "TagValue2"}))
+	require.NoError(t, store.Put("key2", []byte("value2"), storage.Tag{Name: "TagName1", Value: "TagValue1"}))
+	require.NoError(t, store.Put("key3", []byte("value3"), storage.Tag{Name: "TagName1", Value: "TagValue3"}))
+	require.NoError(t, store.Put("key4", []byte("value4"), storage.Tag{Name: "TagName3"}))
+
+	testCases := []struct {
+		expression   string
+		expectedKeys []string
+	}{
+		{expression: "TagName1:TagValue1&&TagName2:TagValue2", expectedKeys: []string{"key1"}},
+		{expression: "TagName1:TagValue1&&TagName2", expectedKeys: []string{"key1"}},
+		{expression: "TagName1:TagValue1||TagName1:TagValue3", expectedKeys: []string{"key1", "key2", "key3"}},
+		{expression: "TagName2||TagName3", expectedKeys: []string{"key1", "key4"}},
+		{expression: "TagName1:TagValue3||TagName1&&TagName2", expectedKeys: []string{"key1", "key3"}},
+		{expression: "TagName1:TagValue3&&TagName2", expectedKeys: nil},
+	}
+
+	for _, testCase := range testCases {
+		iterator, errQuery := store.Query(testCase.expression)
+		require.NoError(t, errQuery)
+
+		var keys []string
+
+		for {
+			more, errNext := iterator.Next()
+			require.NoError(t, errNext)
+
+			if !more {
+				break
+			}
+
+			key, errKey := iterator.Key()
+			require.NoError(t, errKey)
+
+			keys = append(keys, key)
+		}
+
+		require.ElementsMatch(t, testCase.expectedKeys, keys, testCase.expression)
+
+		totalItems, errTotalItems := iterator.TotalItems()
+		require.NoError(t, errTotalItems)
+		require.Equal(t, len(testCase.expectedKeys), totalItems, testCase.expression)
+
+		require.NoError(t, iterator.Close())
+	}
+}
+
+func testQueryWithRangesAndPrefixes(t *testing.T, connString string) {
+	t.Helper()
+
+	provider, err := mongodb.NewProvider(connString)
+	require.NoError(t, err)
+
+	defer func() {
+		require.NoError(t, provider.Close())
+	}()
+
+	store, err := provider.OpenStore("RangeAndPrefixTestStore")
+	require.NoError(t, err)
+
+	require.NoError(t, provider.SetStoreConfig("RangeAndPrefixTestStore",
+		storage.StoreConfiguration{TagNames: []string{"expiry", "type", "price"}}))
+
+	require.NoError(t, store.Put("key1", []byte("value1"), storage.Tag{Name: "expiry", Value: "1600000000"},
+		storage.Tag{Name: "type", Value: "credential-vc"}, storage.Tag{Name: "price", Value: "1.5"}))
+	require.NoError(t, store.Put("key2", []byte("value2"), storage.Tag{Name: "expiry", Value: "1700000000"},
+		storage.Tag{Name: "type", Value: "credential-vp"}, storage.Tag{Name: "price", Value: "10.25"}))
+	require.NoError(t, store.Put("key3", []byte("value3"), storage.Tag{Name: "expiry", Value: "900000000"},
+		storage.Tag{Name: "type", Value: "did.document"}, storage.Tag{Name: "price", Value: "2.50"}))
+	require.NoError(t, store.Put("key4", []byte("value4"), storage.Tag{Name: "expiry", Value: "never"},
+		storage.Tag{Name: "type", Value: "didxdocument"}, storage.Tag{Name: "price", Value: "free"}))
+
+	// Decimal tag values are read back as they were written.
+	tags, err := store.GetTags("key3")
+	require.NoError(t, err)
+	require.ElementsMatch(t, []storage.Tag{
+		{Name: "expiry", Value: "900000000"}, {Name: "type", Value: "did.document"}, {Name: "price", Value: "2.50"},
+	}, tags)
+
+	testCases := []struct {
+		expression   string
+		expectedKeys []string
+	}{
+		// 900000000 is less than 1700000000 as a number, but not lexicographically.
+		{expression: "expiry<=1700000000", expectedKeys: []string{"key1", "key2", "key3"}},
+		{expression: "expiry<1700000000", expectedKeys: []string{"key1", "key3"}},
+		{expression: "expiry>1000000000", expectedKeys: []string{"key1", "key2"}},
+		{expression: "expiry>=1700000000.5", expectedKeys: nil},
+		{expression: "expiry>m", expectedKeys: []string{"key4"}},
+		{expression: "expiry:1600000000", expectedKeys: []string{"key1"}},
+		// 10.25 is greater than 2.5 as a number, but not lexicographically.
+		{expression: "price<2", expectedKeys: []string{"key1"}},
+		{expression: "price>=2.5", expectedKeys: []string{"key2", "key3"}},
+		{expression: "price:1.5", expectedKeys: []string{"key1"}},
+		{expression: "price:2.50", expectedKeys: []string{"key3"}},
+		{expression: "price:2.5", expectedKeys: nil},
+		{expression: "type:credential*", expectedKeys: []string{"key1", "key2"}},
+		{expression: "type:did.*", expectedKeys: []string{"key3"}},
+		{expression: "type:credential*&&expiry<1700000000||type:did*", expectedKeys: []string{"key1", "key3", "key4"}},
+	}
+
+	for _, testCase := range testCases {
+		iterator, errQuery := store.Query(testCase.expression)
+		require.NoError(t, errQuery)
+
+		var keys []string
+
+		for {
+			more, errNext := iterator.Next()
+			require.NoError(t, errNext)
+
+			if !more {
+				break
+			}
+
+			key, errKey := iterator.Key()
+			require.NoError(t, errKey)
+
+			keys = append(keys, key)
+		}
+
+		require.ElementsMatch(t, testCase.expectedKeys, keys, testCase.expression)
+
+		totalItems, errTotalItems := iterator.TotalItems()
+		require.NoError(t, errTotalItems)
+		require.Equal(t, len(testCase.expectedKeys), totalItems, testCase.expression)
+
+		require.NoError(t, iterator.Close())
+	}
+}
+
+func testPutWithTTL(t *testing.T, connString string) {
+	t.Helper()
+
+	provider, err := mongodb.NewProvider(connString)
+	require.NoError(t, err)
+
+	defer func() {
+		require.NoError(t, provider.Close())
+	}()
+
+	store, err := provider.OpenStore("TTLTestStore")
+	require.NoError(t, err)
+
+	require.NoError(t, provider.SetStoreConfig("TTLTestStore", storage.StoreConfiguration{TagNames: []string{"TagName1"}}))
+
+	ttlStore, ok := store.(mongodb.TTLStore)
+	require.True(t, ok)
+
+	tag := storage.Tag{Name: "TagName1", Value: "TagValue1"}
+
+	require.NoError(t, ttlStore.PutWithTTL("key1", []byte("value1"), time.Second, tag))
+	require.NoError(t, ttlStore.PutWithTTL("key2", []byte(`{"field":"value2"}`), time.Second, tag))
+	require.NoError(t, ttlStore.PutWithTTL("key3", []byte("value3"), time.Hour, tag))
+
+	// Putting the key again without a TTL keeps it.
+	require.NoError(t, ttlStore.Put("key2", []byte(`{"field":"value2"}`), tag))
+
+	// The TTL index isn't part of the store configuration, and setting it again keeps the TTL index.
+	config, err := provider.GetStoreConfig("TTLTestStore")
+	require.NoError(t, err)
+	require.Equal(t, []string{"TagName1"}, config.TagNames)
+	require.NoError(t, provider.SetStoreConfig("TTLTestStore", storage.StoreConfiguration{TagNames: []string{"TagName1"}}))
+
+	// MongoDB may take up to a minute to remove expired documents, but they're hidden as soon as they expire.
+	time.Sleep(time.Second)
+
+	_, err = ttlStore.Get("key1")
+	require.True(t, errors.Is(err, storage.ErrDataNotFound), "unexpected error or no error")
+
+	_, err = ttlStore.GetTags("key1")
+	require.True(t, errors.Is(err, storage.ErrDataNotFound), "unexpected error or no error")
+
+	values, err := ttlStore.GetBulk("key1", "key2", "key3")
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{nil, []byte(`{"field":"value2"}`), []byte("value3")}, values)
+
+	iterator, err := ttlStore.Query("TagName1:TagValue1")
+	require.NoError(t, err)
+
+	var keys []string
+
+	for {
+		more, errNext := iterator.Next()
+		require.NoError(t, errNext)
+
+		if !more {
+			break
+		}
+
+		key, errKey := iterator.Key()
+		require.NoError(t, errKey)
+
+		keys = append(keys, key)
+	}
+
+	require.ElementsMatch(t, []string{"key2", "key3"}, keys)
+
+	totalItems, err := iterator.TotalItems()
+	require.NoError(t, err)
+	require.Equal(t, 2, totalItems)
+	require.NoError(t, iterator.Close())
+}
+
+func testSetStoreConfigWithIndexes(t *testing.T, connString string) {
+	t.Helper()
+
+	provider, err := mongodb.NewProvider(connString)
+	require.NoError(t, err)
+
+	defer func() {
+		require.NoError(t, provider.Close())
+	}()
+
+	store, err := provider.OpenStore("IndexesTestStore")
+	require.NoError(t, err)
+
+	require.NoError(t, provider.SetStoreConfigWithIndexes("IndexesTestStore",
+		storage.StoreConfiguration{TagNames: []string{"Type"}},
+		mongodb.Index{TagName: "Type", SortTagName: "Created"},
+		mongodb.Index{TagName: "Email", Unique: true}))
+
+	// Only the single-tag indexes are part of the store configuration.
+	config, err := provider.GetStoreConfig("IndexesTestStore")
+	require.NoError(t, err)
+	require.Equal(t, []string{"Type"}, config.TagNames)
+
+	for i, created := range []string{"300", "100", "200"} {
+		require.NoError(t, store.Put("key"+strconv.Itoa(i), []byte("value"),
+			storage.Tag{Name: "Type", Value: "user"}, storage.Tag{Name: "Created", Value: created}))
+	}
+
+	require.NoError(t, store.Put("key3", []byte("value"), storage.Tag{Name: "Type", Value: "group"},
+		storage.Tag{Name: "Created", Value: "50"}))
+
+	// Served by the compound index.
+	iterator, err := store.Query("Type:user", storage.WithSortOrder(&storage.SortOptions{
+		Order: storage.SortDescending, TagName: "Created",
+	}), storage.WithPageSize(2))
+	require.NoError(t, err)
+
+	var keys []string
+
+	for {
+		more, errNext := iterator.Next()
+		require.NoError(t, errNext)
+
+		if !more {
+			break
+		}
+
+		key, errKey := iterator.Key()
+		require.NoError(t, errKey)
+
+		keys = append(keys, key)
+	}
+
+	require.Equal(t, []string{"key0", "key2", "key1"}, keys)
+	require.NoError(t, iterator.Close())
+
+	sortedQuery := func(t *testing.T, store storage.Store) {
+		t.Helper()
+
+		sortedIterator, errQuery := store.Query("Type:user", storage.WithSortOrder(&storage.SortOptions{
+			Order: storage.SortDescending, TagName: "Created",
+		}))
+		require.NoError(t, errQuery)
+
+		count, errTotalItems := sortedIterator.TotalItems()
+		require.NoError(t, errTotalItems)
+		require.Equal(t, 3, count)
+		require.NoError(t, sortedIterator.Close())
+	}
+
+	t.Run("Indexes set by another provider", func(t *testing.T) {
+		otherProvider, errNew := mongodb.NewProvider(connString)
+		require.NoError(t, errNew)
+
+		defer func() {
+			require.NoError(t, otherProvider.Close())
+		}()
+
+		otherStore, errOpen := otherProvider.OpenStore("IndexesTestStore")
+		require.NoError(t, errOpen)
+
+		// The compound index is listed and used by the other provider's store.
+		sortedQuery(t, otherStore)
+
+		// Once the other provider drops the compound index, the hint this provider's store gives becomes stale, so
+		// the query is run without it.
+		require.NoError(t, otherProvider.SetStoreConfigWithIndexes("IndexesTestStore",
+			storage.StoreConfiguration{TagNames: []string{"Type"}}, mongodb.Index{TagName: "Email", Unique: true}))
+
+		sortedQuery(t, store)
+		sortedQuery(t, store)
+
+		require.NoError(t, provider.SetStoreConfigWithIndexes("IndexesTestStore",
+			storage.StoreConfiguration{TagNames: []string{"Type"}},
+			mongodb.Index{TagName: "Type", SortTagName: "Created"},
+			mongodb.Index{TagName: "Email", Unique: true}))
+	})
+
+	t.Run("Unique index", func(t *testing.T) {
+		require.NoError(t, store.Put("user1", []byte("value"), storage.Tag{Name: "Email", Value: "a@example.com"}))
+		// Entries without the tag aren't constrained.
+		require.NoError(t, store.Put("user2", []byte("value")))
+		require.NoError(t, store.Put("user3", []byte("value")))
+
+		err = store.Put("user2", []byte("value"), storage.Tag{Name: "Email", Value: "a@example.com"})
+		require.True(t, errors.Is(err, mongodb.ErrUniqueIndexViolation), "unexpected error or no error")
+
+		err = store.Batch([]storage.Operation{
+			{Key: "user3", Value: []byte("value"), Tags: []storage.Tag{{Name: "Email", Value: "a@example.com"}}},
+		})
+		require.True(t, errors.Is(err, mongodb.ErrUniqueIndexViolation), "unexpected error or no error")
+
+		_, err = store.(mongodb.VersionedStore).PutIfVersion("user4", []byte("value"), "",
+			storage.Tag{Name: "Email", Value: "a@example.com"})
+		require.True(t, errors.Is(err, mongodb.ErrUniqueIndexViolation), "unexpected error or no error")
+
+		// The same entry can be put again.
+		require.NoError(t, store.Put("user1", []byte("value2"), storage.Tag{Name: "Email", Value: "a@example.com"}))
+	})
+
+	// A plain store configuration removes the other indexes.
+	require.NoError(t, provider.SetStoreConfig("IndexesTestStore", storage.StoreConfiguration{}))
+	require.NoError(t, store.Put("user2", []byte("value"), storage.Tag{Name: "Email", Value: "a@example.com"}))
+}
+
+func testTransactionalBatches(t *testing.T, connString string) {
+	t.Helper()
+
+	for _, transactional := range []bool{false, true} {
+		providerOptions := []mongodb.Option{mongodb.WithDBPrefix(fmt.Sprintf("transactional_%t_", transactional))}
+		if transactional {
+			providerOptions = append(providerOptions, mongodb.WithTransactionalBatches(false))
+		}
+
+		provider, err := mongodb.NewProvider(connString, providerOptions...)
+		require.NoError(t, err)
+
+		store, err := provider.OpenStore("BatchTestStore")
+		require.NoError(t, err)
+
+		require.NoError(t, provider.SetStoreConfigWithIndexes("BatchTestStore", storage.StoreConfiguration{},
+			mongodb.Index{TagName: "Email", Unique: true}))
+
+		require.NoError(t, store.Batch([]storage.Operation{
+			{Key: "user1", Value: []byte("value1"), Tags: []storage.Tag{{Name: "Email", Value: "a@example.com"}}},
+			{Key: "user2", Value: []byte("value2")},
+		}))
+
+		// The second put violates the unique index.
+		err = store.Batch([]storage.Operation{
+			{Key: "user2"},
+			{Key: "user3", Value: []byte("value3"), Tags: []storage.Tag{{Name: "Email", Value: "a@example.com"}}},
+		})
+		require.True(t, errors.Is(err, mongodb.ErrUniqueIndexViolation), "unexpected error or no error")
+
+		// Only a transactional batch is all or nothing.
+		_, err = store.Get("user2")
+		if transactional {
+			require.NoError(t, err)
+		} else {
+			require.True(t, errors.Is(err, storage.ErrDataNotFound), "unexpected error or no error")
+		}
+
+		require.NoError(t, provider.Close())
+	}
+}
+
+func testPutIfVersion(t *testing.T, connString string) {
+	t.Helper()
+
+	provider, err := mongodb.NewProvider(connString)
+	require.NoError(t, err)
+
+	defer func() {
+		require.NoError(t, provider.Close())
+	}()
+
+	store, err := provider.OpenStore("VersionTestStore")
+	require.NoError(t, err)
+
+	versionedStore, ok := store.(mongodb.VersionedStore)
+	require.True(t, ok)
+
+	version, err := versionedStore.PutIfVersion("key1", []byte("value1"), "")
+	require.NoError(t, err)
+
+	// The entry exists now.
+	_, err = versionedStore.PutIfVersion("key1", []byte("value1"), "")
+	require.True(t, errors.Is(err, mongodb.ErrVersionConflict), "unexpected error or no error")
+
+	newVersion, err := versionedStore.PutIfVersion("key1", []byte(`{"field":"value1"}`), version,
+		storage.Tag{Name: "TagName1"})
+	require.NoError(t, err)
+	require.NotEqual(t, version, newVersion)
+
+	// The version read by another writer is now stale.
+	_, err = versionedStore.PutIfVersion("key1", []byte("value2"), version)
+	require.True(t, errors.Is(err, mongodb.ErrVersionConflict), "unexpected error or no error")
+
+	value, currentVersion, err := versionedStore.GetWithVersion("key1")
+	require.NoError(t, err)
+	require.Equal(t, []byte(`{"field":"value1"}`), value)
+	require.Equal(t, newVersion, currentVersion)
+
+	// Any other put changes the version.
+	require.NoError(t, versionedStore.Put("key1", []byte("value3")))
+
+	_, err = versionedStore.PutIfVersion("key1", []byte("value2"), currentVersion)
+	require.True(t, errors.Is(err, mongodb.ErrVersionConflict), "unexpected error or no error")
+
+	require.NoError(t, versionedStore.Batch([]storage.Operation{{Key: "key2", Value: []byte("value")}}))
+
+	_, version, err = versionedStore.GetWithVersion("key2")
+	require.NoError(t, err)
+
+	_, err = versionedStore.PutIfVersion("key2", []byte("value"), version)
+	require.NoError(t, err)
+
+	// An entry that has expired counts as missing.
+	ttlStore, ok := store.(mongodb.TTLStore)
+	require.True(t, ok)
+
+	require.NoError(t, ttlStore.PutWithTTL("key3", []byte("value"), time.Second))
+
+	time.Sleep(time.Second)
+
+	_, err = versionedStore.PutIfVersion("key3", []byte("value"), "")
+	require.NoError(t, err)
+
+	_, _, err = versionedStore.GetWithVersion("key4")
+	require.True(t, errors.Is(err, storage.ErrDataNotFound), "unexpected error or no error")
+}
+
+func testContextStore(t *testing.T, connString string) {
+	t.Helper()
+
+	provider, err := mongodb.NewProvider(connString)
+	require.NoError(t, err)
+
+	defer func() {
+		require.NoError(t, provider.Close())
+	}()
+
+	store, err := provider.OpenStore("ContextTestStore")
+	require.NoError(t, err)
+
+	contextStore, ok := store.(mongodb.ContextStore)
+	require.True(t, ok)
+
+	ctx := context.Background()
+
+	require.NoError(t, contextStore.PutWithContext(ctx, "key1", []byte("value1"), storage.Tag{Name: "TagName1"}))
+	require.NoError(t, contextStore.BatchWithContext(ctx, []storage.Operation{
+		{Key: "key2", Value: []byte("value2"), Tags: []storage.Tag{{Name: "TagName1"}}},
+	}))
+
+	value, err := contextStore.GetWithContext(ctx, "key1")
+	require.NoError(t, err)
+	require.Equal(t, []byte("value1"), value)
+
+	tags, err := contextStore.GetTagsWithContext(ctx, "key1")
+	require.NoError(t, err)
+	require.Equal(t, []storage.Tag{{Name: "TagName1"}}, tags)
+
+	values, err := contextStore.GetBulkWithContext(ctx, "key1", "key2")
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte("value1"), []byte("value2")}, values)
+
+	require.NoError(t, contextStore.DeleteWithContext(ctx, "key2"))
+
+	queryCtx, cancelQuery := context.WithCancel(context.Background())
+
+	iterator, err := contextStore.QueryWithContext(queryCtx, "TagName1")
+	require.NoError(t, err)
+
+	totalItems, err := iterator.TotalItems()
+	require.NoError(t, err)
+	require.Equal(t, 1, totalItems)
+
+	cancelQuery()
+
+	// The iterator keeps using the query's context.
+	_, err = iterator.TotalItems()
+	require.True(t, errors.Is(err, context.Canceled), "unexpected error or no error")
+
+	require.NoError(t, iterator.Close())
+}
+
+func testWatch(t *testing.T, connString string) {
+	t.Helper()
+
+	provider, err := mongodb.NewProvider(connString)
+	require.NoError(t, err)
+
+	defer func() {
+		require.NoError(t, provider.Close())
+	}()
+
+	store, err := provider.OpenStore("WatchTestStore")
+	require.NoError(t, err)
+
+	watchableStore, ok := store.(mongodb.WatchableStore)
+	require.True(t, ok)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	changeStream, err := watchableStore.Watch(ctx, mongodb.WithTagFilter(storage.Tag{Name: "TagName1"}))
+	require.NoError(t, err)
+
+	require.NoError(t, store.Put("key1", []byte("value1"), storage.Tag{Name: "TagName1", Value: "TagValue1"}))
+
+	// The put is read before key1 is deleted, since the deletion would make the lookup of key1's full document fail.
+	change, err := changeStream.Next()
+	require.NoError(t, err)
+	require.Equal(t, mongodb.ChangePut, change.Type)
+	require.Equal(t, "key1", change.Key)
+	require.Equal(t, []storage.Tag{{Name: "TagName1", Value: "TagValue1"}}, change.Tags)
+
+	checkpoint := change.Checkpoint
+
+	require.NoError(t, store.Put("key2", []byte("value2"), storage.Tag{Name: "TagName2"}))
+	require.NoError(t, store.Delete("key1"))
+
+	// The put of key2 doesn't pass the tag filter.
+	change, err = changeStream.Next()
+	require.NoError(t, err)
+	require.Equal(t, mongodb.ChangeDelete, change.Type)
+	require.Equal(t, "key1", change.Key)
+
+	cancel()
+
+	_, err = changeStream.Next()
+	require.True(t, errors.Is(err, context.Canceled), "unexpected error or no error")
+
+	require.NoError(t, changeStream.Close())
+
+	// Resuming from the checkpoint streams the changes made after it, like after a restart.
+	changeStream, err = watchableStore.Watch(context.Background(), mongodb.WithCheckpoint(checkpoint))
+	require.NoError(t, err)
+
+	change, err = changeStream.Next()
+	require.NoError(t, err)
+	require.Equal(t, mongodb.ChangePut, change.Type)
+	require.Equal(t, "key2", change.Key)
+	require.Equal(t, []byte("value2"), change.Value)
+
+	change, err = changeStream.Next()
+	require.NoError(t, err)
+	require.Equal(t, mongodb.ChangeDelete, change.Type)
+	require.Equal(t, "key1", change.Key)
+
+	require.NoError(t, changeStream.Close())
+}
+
 func startMongoDBContainer(t *testing.T, dockerMongoDBTag string) (*dctest.Pool, *dctest.Resource) {
 	t.Helper()
 
@@ -373,6 +1114,8 @@ func startMongoDBContainer(t *testing.T, dockerMongoDBTag string) (*dctest.Pool,
 	mongoDBResource, err := pool.RunWithOptions(&dctest.RunOptions{
 		Repository: dockerMongoDBImage,
 		Tag:        dockerMongoDBTag,
+		// Change streams are only available on replica sets, so MongoDB is run as a single-member one.
+		Cmd: []string{"--replSet", "rs0"},
 		PortBindings: map[dc.Port][]dc.PortBinding{
 			"27017/tcp": {{HostIP: "", HostPort: "27017"}},
 		},
@@ -380,10 +1123,58 @@ func startMongoDBContainer(t *testing.T, dockerMongoDBTag string) (*dctest.Pool,
 	require.NoError(t, err)
 
 	require.NoError(t, waitForMongoDBToBeUp())
+	require.NoError(t, initiateReplicaSet())
 
 	return pool, mongoDBResource
 }
 
+// initiateReplicaSet makes the MongoDB instance the only member of its replica set, then waits for it to become the
+// primary.
+func initiateReplicaSet() error {
+	mongoClient, err := mongo.NewClient(options.Client().ApplyURI(mongoDBConnString))
+	if err != nil {
+		return err
+	}
+
+	err = mongoClient.Connect(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "error connecting to mongo")
+	}
+
+	defer func() {
+		errDisconnect := mongoClient.Disconnect(context.Background())
+		if errDisconnect != nil {
+			log.Printf("failed to disconnect from MongoDB: %s", errDisconnect)
+		}
+	}()
+
+	err = mongoClient.Database("admin").RunCommand(context.Background(), bson.D{{Key: "replSetInitiate", Value: bson.D{
+		{Key: "_id", Value: "rs0"},
+		{Key: "members", Value: bson.A{bson.D{{Key: "_id", Value: 0}, {Key: "host", Value: "localhost:27017"}}}},
+	}}}).Err()
+	if err != nil {
+		return errors.Wrap(err, "error initiating replica set")
+	}
+
+	return backoff.Retry(func() error {
+		var result struct {
+			IsMaster bool `bson:"ismaster"`
+		}
+
+		errIsMaster := mongoClient.Database("admin").RunCommand(context.Background(),
+			bson.D{{Key: "isMaster", Value: 1}}).Decode(&result)
+		if errIsMaster != nil {
+			return errIsMaster
+		}
+
+		if !result.IsMaster {
+			return errors.New("replica set member isn't the primary yet")
+		}
+
+		return nil
+	}, backoff.WithMaxRetries(backoff.NewConstantBackOff(time.Second), 30))
+}
+
 func waitForMongoDBToBeUp() error {
 	return backoff.Retry(pingMongoDB, backoff.WithMaxRetries(backoff.NewConstantBackOff(time.Second), 30))
 }
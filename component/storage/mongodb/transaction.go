@@ -0,0 +1,132 @@
+/*
+Copyright Scoir Inc Technologies Inc, SecureKey Technologies Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// The error codes MongoDB returns when a collection that's being created already exists, when transactions are
+	// used on a standalone server (IllegalOperation), and when DocumentDB doesn't support a feature.
+	namespaceExistsErrCode     = 48
+	illegalOperationErrCode    = 20
+	featureNotSupportedErrCode = 303
+)
+
+// ErrTransactionsUnsupported is returned (wrapped) by Batch when the Provider was created using
+// WithTransactionalBatches(false) and the MongoDB deployment doesn't support transactions.
+var ErrTransactionsUnsupported = errors.New("transactions are not supported by the MongoDB deployment")
+
+// WithTransactionalBatches is an option for having Batch apply its operations in a multi-document transaction, so that
+// either all of them are applied or, if any of them fails, none are. Transactions are only supported by replica sets
+// and sharded clusters (MongoDB 4.0 and later, and 4.2 and later, respectively), not by standalone servers, and may not
+// be supported by DocumentDB. If the deployment doesn't support them and allowFallback is true, then Batch logs this
+// and falls back to applying the operations without a transaction, as it does by default, in which case a failure
+// may leave the operations before it applied. Otherwise, Batch fails with ErrTransactionsUnsupported.
+func WithTransactionalBatches(allowFallback bool) Option {
+	return func(opts *Provider) {
+		opts.transactionalBatches = true
+		opts.allowNonTransactionalBatches = allowFallback
+	}
+}
+
+// bulkWriteInTransaction runs a BulkWrite command with models in a transaction, unless the deployment turns out not
+// to support transactions and falling back to a plain BulkWrite command is allowed.
+func (s *store) bulkWriteInTransaction(ctx context.Context, models []mongo.WriteModel) error {
+	if s.transactionsFoundUnsupported() {
+		return s.bulkWrite(ctx, models)
+	}
+
+	err := s.ensureCollection(ctx)
+	if err != nil {
+		return err
+	}
+
+	ctxWithTimeout, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	session, err := s.coll.Database().Client().StartSession()
+	if err != nil {
+		return fmt.Errorf("failed to start MongoDB session: %w", err)
+	}
+
+	defer session.EndSession(ctxWithTimeout)
+
+	_, err = session.WithTransaction(ctxWithTimeout, func(sessionContext mongo.SessionContext) (interface{}, error) {
+		return s.coll.BulkWrite(sessionContext, models)
+	})
+	if err == nil {
+		return nil
+	}
+
+	if !isTransactionsUnsupportedError(err) {
+		return fmt.Errorf("failed to run BulkWrite command in MongoDB transaction: %w",
+			wrapUniqueIndexViolation(err))
+	}
+
+	if !s.allowNonTransactionalBatches {
+		return fmt.Errorf("%w: %s", ErrTransactionsUnsupported, err.Error())
+	}
+
+	s.transactionLock.Lock()
+	s.transactionsUnsupported = true
+	s.transactionLock.Unlock()
+
+	s.logger.Infof("[Store name (includes prefix, if any): %s] The MongoDB deployment doesn't support "+
+		"transactions, so batches will be applied without them. Underlying error message: %s", s.name, err.Error())
+
+	return s.bulkWrite(ctx, models)
+}
+
+func (s *store) transactionsFoundUnsupported() bool {
+	s.transactionLock.Lock()
+	defer s.transactionLock.Unlock()
+
+	return s.transactionsUnsupported
+}
+
+// ensureCollection creates the store's collection, unless this store already did so. Before MongoDB 4.4, collections
+// can't be created (implicitly, by an insert) in a transaction.
+func (s *store) ensureCollection(ctx context.Context) error {
+	s.transactionLock.Lock()
+	defer s.transactionLock.Unlock()
+
+	if s.collectionCreated {
+		return nil
+	}
+
+	ctxWithTimeout, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	err := s.coll.Database().CreateCollection(ctxWithTimeout, s.coll.Name())
+
+	var commandErr mongo.CommandError
+	if err != nil && !(errors.As(err, &commandErr) && commandErr.Code == namespaceExistsErrCode) {
+		return fmt.Errorf("failed to create MongoDB collection: %w", err)
+	}
+
+	s.collectionCreated = true
+
+	return nil
+}
+
+// isTransactionsUnsupportedError returns whether err means the deployment doesn't support transactions.
+func isTransactionsUnsupportedError(err error) bool {
+	var commandErr mongo.CommandError
+	if !errors.As(err, &commandErr) {
+		return false
+	}
+
+	return commandErr.Code == featureNotSupportedErrCode ||
+		(commandErr.Code == illegalOperationErrCode && strings.Contains(commandErr.Message, "Transaction numbers"))
+}
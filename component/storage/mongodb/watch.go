@@ -0,0 +1,236 @@
+/*
+Copyright Scoir Inc Technologies Inc, SecureKey Technologies Inc. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package mongodb
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/aries-framework-go/spi/storage"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	mongooptions "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ChangeType says what kind of change was made to an entry.
+type ChangeType int
+
+const (
+	// ChangePut is the type of the changes made by putting an entry.
+	ChangePut ChangeType = iota
+	// ChangeDelete is the type of the changes made by deleting an entry, which includes the removal of expired
+	// entries by MongoDB.
+	ChangeDelete
+)
+
+// Change describes a change made to an entry of a store.
+type Change struct {
+	Type ChangeType
+	Key  string
+	// Value and Tags are those of the entry when the change was read, which may be newer than the change if the entry
+	// was put again in the meantime. They're nil for deletions.
+	Value []byte
+	Tags  []storage.Tag
+	// Checkpoint identifies this change, which is its (encoded) change stream resume token. A watch started with
+	// WithCheckpoint(Checkpoint) resumes with the changes made after this one.
+	Checkpoint string
+}
+
+// ChangeStream streams the changes made to a store's entries, in the order they were made.
+type ChangeStream interface {
+	// Next blocks until there's another change and returns it. Once the context given to Watch is done, it returns
+	// the context's error.
+	Next() (Change, error)
+
+	// Close stops the stream.
+	Close() error
+}
+
+// WatchableStore is implemented by the stores opened by a Provider. It lets the changes made to the store's entries,
+// by any Provider using the same MongoDB deployment, be watched as they happen. It's backed by a MongoDB change
+// stream, so the deployment must be a replica set or a sharded cluster.
+type WatchableStore interface {
+	storage.Store
+
+	// Watch streams the changes made to the store's entries until ctx is done. Unless WithCheckpoint is used to resume
+	// from an earlier change, only the changes made after Watch is called are streamed. A watch can only resume from
+	// a change that's still in the replica set's oplog.
+	Watch(ctx context.Context, options ...WatchOption) (ChangeStream, error)
+}
+
+// WatchOption represents an option for WatchableStore.Watch.
+type WatchOption func(opts *watchOptions)
+
+type watchOptions struct {
+	checkpoint string
+	tagFilter  *storage.Tag
+}
+
+// WithCheckpoint is an option for resuming a watch with the changes made after the one identified by checkpoint,
+// such as after a restart. checkpoint is the Checkpoint of a Change.
+func WithCheckpoint(checkpoint string) WatchOption {
+	return func(opts *watchOptions) {
+		opts.checkpoint = checkpoint
+	}
+}
+
+// WithTagFilter is an option for only streaming the puts of entries that have a tag with tag's name and, unless it's
+// blank, tag's value. Deletions are always streamed, since the tags of the deleted entries aren't known.
+func WithTagFilter(tag storage.Tag) WatchOption {
+	return func(opts *watchOptions) {
+		opts.tagFilter = &tag
+	}
+}
+
+type changeEvent struct {
+	OperationType string `bson:"operationType"`
+	DocumentKey   struct {
+		Key string `bson:"_id"`
+	} `bson:"documentKey"`
+	FullDocument bson.Raw `bson:"fullDocument"`
+}
+
+// rawDecoder lets the documents in change events be decoded like query results.
+type rawDecoder bson.Raw
+
+func (r rawDecoder) Decode(value interface{}) error {
+	return bson.Unmarshal(r, value)
+}
+
+// Watch streams the changes made to the store's records until ctx is done.
+func (s *store) Watch(ctx context.Context, options ...WatchOption) (ChangeStream, error) {
+	var opts watchOptions
+
+	for _, option := range options {
+		option(&opts)
+	}
+
+	// Puts are upserts, which are reported as inserts, updates or replacements. Updates only come with the updated
+	// fields, so the full document is looked up.
+	changeStreamOptions := mongooptions.ChangeStream().SetFullDocument(mongooptions.UpdateLookup)
+
+	if opts.checkpoint != "" {
+		resumeToken, err := base64.RawURLEncoding.DecodeString(opts.checkpoint)
+		if err != nil || bson.Raw(resumeToken).Validate() != nil {
+			return nil, fmt.Errorf("invalid checkpoint: %s", opts.checkpoint)
+		}
+
+		changeStreamOptions.SetResumeAfter(bson.Raw(resumeToken))
+	}
+
+	pipeline := mongo.Pipeline{{{Key: "$match", Value: bson.D{{Key: "operationType", Value: bson.D{
+		{Key: "$in", Value: bson.A{"insert", "update", "replace", "delete"}},
+	}}}}}}
+
+	ctxWithTimeout, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	changeStream, err := s.coll.Watch(ctxWithTimeout, pipeline, changeStreamOptions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open MongoDB change stream: %w", err)
+	}
+
+	return &mongoDBChangeStream{
+		ctx: ctx, changeStream: changeStream, tagFilter: opts.tagFilter, timeout: s.timeout,
+	}, nil
+}
+
+type mongoDBChangeStream struct {
+	ctx          context.Context
+	changeStream *mongo.ChangeStream
+	tagFilter    *storage.Tag
+	timeout      time.Duration
+}
+
+// Next blocks until there's another change to a record that passes the tag filter.
+func (m *mongoDBChangeStream) Next() (Change, error) {
+	for m.changeStream.Next(m.ctx) {
+		var event changeEvent
+
+		err := m.changeStream.Decode(&event)
+		if err != nil {
+			return Change{}, fmt.Errorf("failed to decode MongoDB change event: %w", err)
+		}
+
+		change, ok, err := newChange(&event, m.tagFilter)
+		if err != nil {
+			return Change{}, err
+		}
+
+		if ok {
+			change.Checkpoint = base64.RawURLEncoding.EncodeToString(m.changeStream.ResumeToken())
+
+			return change, nil
+		}
+	}
+
+	err := m.changeStream.Err()
+	if err != nil {
+		return Change{}, fmt.Errorf("failure while reading MongoDB change stream: %w", err)
+	}
+
+	return Change{}, errors.New("MongoDB change stream ended")
+}
+
+// Close stops the stream.
+func (m *mongoDBChangeStream) Close() error {
+	ctxWithTimeout, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+
+	err := m.changeStream.Close(ctxWithTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to close MongoDB change stream: %w", err)
+	}
+
+	return nil
+}
+
+// newChange returns the change reported by event, and whether it should be streamed. Puts are skipped if they don't
+// pass tagFilter, or if the record was deleted before its full document could be looked up.
+func newChange(event *changeEvent, tagFilter *storage.Tag) (Change, bool, error) {
+	if event.OperationType == "delete" {
+		return Change{Type: ChangeDelete, Key: event.DocumentKey.Key}, true, nil
+	}
+
+	if event.FullDocument == nil {
+		return Change{}, false, nil
+	}
+
+	key, value, err := getKeyAndValueFromMongoDBResult(rawDecoder(event.FullDocument))
+	if err != nil {
+		return Change{}, false, fmt.Errorf("failed to get value from MongoDB change event: %w", err)
+	}
+
+	tags, err := getTagsFromMongoDBResult(rawDecoder(event.FullDocument))
+	if err != nil {
+		return Change{}, false, fmt.Errorf("failed to get tags from MongoDB change event: %w", err)
+	}
+
+	if !matchesTagFilter(tagFilter, tags) {
+		return Change{}, false, nil
+	}
+
+	return Change{Type: ChangePut, Key: key, Value: value, Tags: tags}, true, nil
+}
+
+// matchesTagFilter returns whether tags include one matching tagFilter, if there is a filter.
+func matchesTagFilter(tagFilter *storage.Tag, tags []storage.Tag) bool {
+	if tagFilter == nil {
+		return true
+	}
+
+	for _, tag := range tags {
+		if tag.Name == tagFilter.Name && (tagFilter.Value == "" || tag.Value == tagFilter.Value) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,237 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/hyperledger/aries-framework-go/spi/storage"
+)
+
+// batchChunkSize is the maximum number of rows written by a single statement of a batch.
+const batchChunkSize = 100
+
+// batchOperation is a storage.Operation ready to be written. entry is the marshalled DB entry to upsert, or nil
+// if the key is to be deleted.
+type batchOperation struct {
+	key   string
+	entry []byte
+	tags  []storage.Tag
+}
+
+// preparedStatements prepares each distinct statement of a batch once within its transaction, and runs them until
+// ctx is done. The statements are closed when the transaction is committed or rolled back.
+type preparedStatements struct {
+	ctx   context.Context
+	tx    *sql.Tx
+	stmts map[string]*sql.Stmt
+}
+
+func (p *preparedStatements) exec(query string, args ...interface{}) error {
+	stmt, ok := p.stmts[query]
+	if !ok {
+		var err error
+
+		stmt, err = p.tx.PrepareContext(p.ctx, query)
+		if err != nil {
+			return fmt.Errorf("failed to prepare statement: %w", err)
+		}
+
+		p.stmts[query] = stmt
+	}
+
+	_, err := stmt.ExecContext(p.ctx, args...)
+
+	return err
+}
+
+// Batch performs batch upserts and deletions preserving the batch's ordering.
+// All operations, and the changes to tags they imply, are done in a single transaction, so either the whole batch
+// is applied or none of it is. Consecutive operations of the same kind are grouped into multi-row statements of up to
+// batchChunkSize rows, which means the DSN doesn't need `multiStatements` enabled.
+func (s *store) Batch(batch []storage.Operation) error {
+	return s.BatchWithContext(context.Background(), batch)
+}
+
+// BatchWithContext performs batch upserts and deletions in a single transaction, like Batch, giving up once ctx is
+// done, in which case none of the batch is applied.
+func (s *store) BatchWithContext(ctx context.Context, batch []storage.Operation) error {
+	if len(batch) == 0 {
+		return errors.New("batch requires at least one operation")
+	}
+
+	operations := make([]batchOperation, len(batch))
+
+	for i, b := range batch {
+		if b.Key == "" {
+			return errors.New("key cannot be empty")
+		}
+
+		operations[i] = batchOperation{key: b.Key, tags: b.Tags}
+
+		if len(b.Value) > 0 {
+			err := validatePutInput(b.Key, b.Value, b.Tags)
+			if err != nil {
+				return err
+			}
+
+			entry, err := json.Marshal(dbEntry{Value: b.Value, Tags: b.Tags})
+			if err != nil {
+				return fmt.Errorf("failed to marshal dbEntry: %w", err)
+			}
+
+			operations[i].entry = entry
+		}
+	}
+
+	return s.inTransaction(ctx, func(tx *sql.Tx) error {
+		stmts := &preparedStatements{ctx: ctx, tx: tx, stmts: make(map[string]*sql.Stmt)}
+
+		for _, run := range groupOperations(operations) {
+			for start := 0; start < len(run); start += batchChunkSize {
+				end := start + batchChunkSize
+				if end > len(run) {
+					end = len(run)
+				}
+
+				err := s.writeChunk(stmts, run[start:end])
+				if err != nil {
+					return fmt.Errorf(failureWhileExecutingBatchStatementErrMsg, s.tableName, err)
+				}
+			}
+		}
+
+		return s.recordBatchChanges(ctx, tx, operations)
+	})
+}
+
+// recordBatchChanges adds the batch's operations to the change log, in order, if the change log is enabled.
+func (s *store) recordBatchChanges(ctx context.Context, tx *sql.Tx, operations []batchOperation) error {
+	keys := make([]string, len(operations))
+	entries := make([][]byte, len(operations))
+
+	for i, operation := range operations {
+		keys[i] = operation.key
+		entries[i] = operation.entry
+	}
+
+	return s.recordChanges(ctx, tx, keys, entries)
+}
+
+// writeChunk writes operations of the same kind on distinct keys.
+func (s *store) writeChunk(stmts *preparedStatements, chunk []batchOperation) error {
+	keys := make([]interface{}, len(chunk))
+
+	for i, operation := range chunk {
+		keys[i] = operation.key
+	}
+
+	whereKeys := " WHERE `key` IN (" + placeholders("?", len(chunk)) + ")"
+
+	if chunk[0].entry == nil {
+		err := stmts.exec("DELETE FROM "+s.tableName+whereKeys, keys...)
+		if err != nil {
+			return err
+		}
+	} else {
+		values := make([]interface{}, 0, 2*len(chunk))
+
+		for _, operation := range chunk {
+			values = append(values, operation.key, operation.entry)
+		}
+
+		err := stmts.exec("INSERT INTO "+s.tableName+" (`key`, `value`, `version`) VALUES "+
+			placeholders("(?, ?, 1)", len(chunk))+
+			" ON DUPLICATE KEY UPDATE value=VALUES(value), expires_at=NULL, version=version+1", values...)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := stmts.exec("DELETE FROM "+s.tagTableName+whereKeys, keys...)
+	if err != nil {
+		return err
+	}
+
+	return s.insertChunkTags(stmts, chunk)
+}
+
+// insertChunkTags inserts the tags of the upserts in chunk, batchChunkSize tags at a time.
+func (s *store) insertChunkTags(stmts *preparedStatements, chunk []batchOperation) error {
+	var rows [][]interface{}
+
+	for _, operation := range chunk {
+		if operation.entry == nil {
+			continue
+		}
+
+		for _, tag := range operation.tags {
+			rows = append(rows, tagRow(operation.key, tag))
+		}
+	}
+
+	for start := 0; start < len(rows); start += batchChunkSize {
+		end := start + batchChunkSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+
+		values := make([]interface{}, 0, (end-start)*tagColumns)
+
+		for _, row := range rows[start:end] {
+			values = append(values, row...)
+		}
+
+		err := stmts.exec(s.insertTagsStmt(end-start), values...)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// groupOperations splits operations into runs of consecutive upserts or deletions, which can be written together
+// without changing the outcome of the batch. Within a run, only the last operation on each key is kept.
+func groupOperations(operations []batchOperation) [][]batchOperation {
+	var runs [][]batchOperation
+
+	for start := 0; start < len(operations); {
+		end := start + 1
+
+		for end < len(operations) && (operations[end].entry == nil) == (operations[start].entry == nil) {
+			end++
+		}
+
+		runs = append(runs, lastPerKey(operations[start:end]))
+		start = end
+	}
+
+	return runs
+}
+
+// lastPerKey drops the operations that are superseded by a later one on the same key.
+func lastPerKey(operations []batchOperation) []batchOperation {
+	last := make(map[string]int, len(operations))
+
+	for i, operation := range operations {
+		last[operation.key] = i
+	}
+
+	result := make([]batchOperation, 0, len(last))
+
+	for i, operation := range operations {
+		if last[operation.key] == i {
+			result = append(result, operation)
+		}
+	}
+
+	return result
+}
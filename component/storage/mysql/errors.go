@@ -12,10 +12,16 @@ const (
 	failureWhileOpeningMySQLConnectionErrMsg   = "failure while opening MySQL connection using url %s: %w"
 	failureWhileClosingMySQLConnection         = "failure while closing MySQL DB connection: %w"
 	failureWhilePingingMySQLErrMsg             = "failure while pinging MySQL at url %s : %w"
+	failureWhilePingingMySQLServerErrMsg       = "failure while pinging MySQL: %w"
 	failureWhileCreatingDBErrMsg               = "failure while creating DB %s: %w"
 	failureWhileCreatingTableErrMsg            = "failure while creating table %s: %w"
 	failureWhileExecutingInsertStatementErrMsg = "failure while executing insert statement on table %s: %w"
+	failureWhileExecutingUpdateStatementErrMsg = "failure while executing update statement on table %s: %w"
 	failureWhileQueryingRowErrMsg              = "failure while querying row: %w"
+	failureWhileQueryingRowsErrMsg             = "failure while querying rows: %w"
+	failureWhileUpdatingTagsErrMsg             = "failure while updating tags in table %s: %w"
+	failureWhileBeginningTransactionErrMsg     = "failure while beginning transaction: %w"
+	failureWhileCommittingTransactionErrMsg    = "failure while committing transaction: %w"
 	failureWhileExecutingBatchStatementErrMsg  = "failure while executing batch upsert on table %s: %w"
 	// Error messages returned from MySQL that we directly check for.
 	valueNotFoundErrMsgFromMySQL = "no rows"
@@ -24,4 +30,7 @@ const (
 var (
 	errBlankDBPath    = errors.New("DB URL for new mySQL DB provider can't be blank")
 	errBlankStoreName = errors.New("store name is required")
+	errNoCurrentEntry = errors.New("iterator has no current entry")
+	// errChangeLogDisabled is returned by Watch when the Provider wasn't created using WithChangeLog.
+	errChangeLogDisabled = errors.New("the change log isn't enabled, so the store can't be watched")
 )
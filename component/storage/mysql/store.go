@@ -8,53 +8,162 @@ SPDX-License-Identifier: Apache-2.0
 package mysql
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
+	"unicode/utf8"
 
-	// Add as per the documentation - https://github.com/go-sql-driver/mysql
-	_ "github.com/go-sql-driver/mysql" //nolint:gci // False positive, seemingly caused by the MySQL driver comment.
-
+	mysqldriver "github.com/go-sql-driver/mysql"
 	"github.com/hyperledger/aries-framework-go/spi/storage"
 )
 
 const (
-	createDBQuery  = "CREATE DATABASE IF NOT EXISTS `%s`"
-	tagMapKey      = "TagMap"
-	storeConfigKey = "StoreConfig"
-
-	expressionTagNameOnlyLength     = 1
-	expressionTagNameAndValueLength = 2
-	invalidQueryExpressionFormat    = `"%s" is not in a valid expression format. ` +
-		"it must be in the following format: TagName:TagValue"
+	createDBQuery = "CREATE DATABASE IF NOT EXISTS `%s`"
+	// Tag names and values are compared exactly, as in the other providers, rather than ignoring case and accents as
+	// the server's default collation would.
+	createTagTableQuery = "CREATE TABLE IF NOT EXISTS %s (`key` varchar(255) NOT NULL, " +
+		"`name` varchar(255) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin NOT NULL, " +
+		"`value` varchar(255) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin NOT NULL, `numeric_value` double NULL, " +
+		"PRIMARY KEY (`key`, `name`, `value`), INDEX `tag_name_value` (`name`, `value`), " +
+		"INDEX `tag_name_numeric_value` (`name`, `numeric_value`))"
+	addExpiryColumnQuery  = "ALTER TABLE %s ADD COLUMN `expires_at` bigint NULL, ADD INDEX `expires_at` (`expires_at`)"
+	addVersionColumnQuery = "ALTER TABLE %s ADD COLUMN `version` bigint NOT NULL DEFAULT 0"
+	tagMapKey             = "TagMap"
+	storeConfigKey        = "StoreConfig"
+	duplicateEntryErrCode = 1062
+	// The error codes MySQL gives when a transaction is rolled back because of a deadlock, and when a statement times
+	// out waiting for a lock.
+	deadlockErrCode        = 1213
+	lockWaitTimeoutErrCode = 1205
+	// maxTransactionAttempts is how many times a transaction is run before a deadlock or lock wait timeout is returned.
+	maxTransactionAttempts = 3
+	transactionRetryDelay  = 10 * time.Millisecond
+
+	defaultExpiredEntrySweepInterval = time.Minute
+
+	equalsOperator               = ":"
+	prefixOperator               = "*"
+	defaultPageSize              = 25
+	defaultMaxIdleConns          = 2 // The database/sql default.
+	tagColumns                   = 4
+	maxTagLength                 = 255 // The length of the name and value columns of the tag table, in characters.
+	invalidQueryExpressionFormat = `"%s" is not in a valid expression format. ` +
+		"it must be in the following format: TagName:TagValue, optionally combined with others using && and ||"
 	invalidTagName  = `"%s" is an invalid tag name since it contains one or more ':' characters`
 	invalidTagValue = `"%s" is an invalid tag value since it contains one or more ':' characters`
+	tagNameTooLong  = `"%s" is an invalid tag name since it's longer than 255 characters`
+	tagValueTooLong = `"%s" is an invalid tag value since it's longer than 255 characters`
 )
 
-// TODO (#67): Fully implement all methods.
-
 // ErrKeyRequired is returned when key is mandatory.
 var ErrKeyRequired = errors.New("key is mandatory")
 
+// ErrVersionConflict is returned by VersionedStore.PutIfVersion when the entry's current version isn't the one given.
+var ErrVersionConflict = errors.New("version conflict")
+
 type closer func(storeName string)
 
+// rowQuerier is implemented by *sql.DB and *sql.Tx, so that entries can be read either on their own or as part of a
+// transaction.
+type rowQuerier interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+type logger interface {
+	Infof(msg string, args ...interface{})
+	Warnf(msg string, args ...interface{})
+}
+
+type defaultLogger struct {
+	logger *log.Logger
+}
+
+func (d *defaultLogger) Infof(msg string, args ...interface{}) {
+	d.logger.Printf(msg, args...)
+}
+
+func (d *defaultLogger) Warnf(msg string, args ...interface{}) {
+	d.logger.Printf(msg, args...)
+}
+
+// TTLStore is implemented by the stores opened by a Provider. It lets entries be put with a time to live.
+type TTLStore interface {
+	storage.Store
+
+	// PutWithTTL stores the key + value pair along with the (optional) tags, like Put, and has the entry deleted
+	// once ttl has elapsed. A later Put of the same key removes the TTL. Expired entries are hidden from Get, GetTags,
+	// GetBulk and Query straight away, and are deleted by the Provider periodically
+	// (see WithExpiredEntrySweepInterval).
+	PutWithTTL(key string, value []byte, ttl time.Duration, tags ...storage.Tag) error
+}
+
+// VersionedStore is implemented by the stores opened by a Provider. It lets an entry be read, modified and written
+// back safely by several writers, since the write only succeeds if nobody else has put the entry in the meantime.
+type VersionedStore interface {
+	storage.Store
+
+	// GetWithVersion returns the value stored under key along with the entry's current version, which changes every
+	// time the entry is put.
+	GetWithVersion(key string) (value []byte, version string, err error)
+
+	// PutIfVersion stores the key + value pair along with the (optional) tags, like Put, provided the entry's current
+	// version is version. A blank version means the entry mustn't exist. It returns the entry's new version, or
+	// ErrVersionConflict if the entry's current version is a different one.
+	PutIfVersion(key string, value []byte, version string, tags ...storage.Tag) (string, error)
+}
+
+// ContextStore is implemented by the stores opened by a Provider. Its methods do the same as the storage.Store methods
+// of the same names, but the statements they run on the MySQL server are abandoned once ctx is done, in which case
+// ctx's error is returned (wrapped), and any transaction they were in is rolled back. The context given to
+// QueryWithContext also applies to the iterator it returns, which fetches further pages and counts the results
+// using it.
+type ContextStore interface {
+	storage.Store
+
+	PutWithContext(ctx context.Context, key string, value []byte, tags ...storage.Tag) error
+	GetWithContext(ctx context.Context, key string) ([]byte, error)
+	GetTagsWithContext(ctx context.Context, key string) ([]storage.Tag, error)
+	GetBulkWithContext(ctx context.Context, keys ...string) ([][]byte, error)
+	QueryWithContext(ctx context.Context, expression string, options ...storage.QueryOption) (storage.Iterator, error)
+	DeleteWithContext(ctx context.Context, key string) error
+	BatchWithContext(ctx context.Context, operations []storage.Operation) error
+}
+
+// tagMapping is how earlier versions of this provider kept track of tags, in an entry stored under tagMapKey.
 type tagMapping map[string]map[string]struct{} // map[TagName](Set of database Keys)
 
 type dbEntry struct {
 	Value []byte        `json:"value,omitempty"`
 	Tags  []storage.Tag `json:"tags,omitempty"`
+	// The version is kept in a column of its own, so that it can be checked by PutIfVersion.
+	version int64
 }
 
 // Provider represents a MySQL DB implementation of the storage.Provider interface.
+// All the stores opened by a Provider share its pool of connections to the server.
 type Provider struct {
-	dbURL    string
-	db       *sql.DB
-	dbs      map[string]*store
-	dbPrefix string
-	lock     sync.RWMutex
+	db              *sql.DB
+	dbs             map[string]*store
+	dbPrefix        string
+	maxOpenConns    int
+	maxIdleConns    int
+	connMaxLifetime time.Duration
+	connMaxIdleTime time.Duration
+	sweepInterval   time.Duration
+	// changeLogRetention is how long changes are kept in the change log, which is disabled if it's 0.
+	changeLogRetention time.Duration
+	changePollInterval time.Duration
+	logger             logger
+	lock               sync.RWMutex
 }
 
 // Option configures the couchdb provider.
@@ -67,12 +176,59 @@ func WithDBPrefix(dbPrefix string) Option {
 	}
 }
 
+// WithMaxOpenConns option sets the maximum number of open connections to the server, shared by all stores.
+// The default, 0, means there's no limit.
+func WithMaxOpenConns(maxOpenConns int) Option {
+	return func(opts *Provider) {
+		opts.maxOpenConns = maxOpenConns
+	}
+}
+
+// WithMaxIdleConns option sets the maximum number of idle connections kept in the pool.
+// Zero or less means no idle connections are kept. If this option isn't used, the database/sql default applies.
+func WithMaxIdleConns(maxIdleConns int) Option {
+	return func(opts *Provider) {
+		opts.maxIdleConns = maxIdleConns
+	}
+}
+
+// WithConnMaxLifetime option sets the maximum amount of time a connection may be reused for.
+// The default, 0, means connections are reused forever.
+func WithConnMaxLifetime(connMaxLifetime time.Duration) Option {
+	return func(opts *Provider) {
+		opts.connMaxLifetime = connMaxLifetime
+	}
+}
+
+// WithConnMaxIdleTime option sets the maximum amount of time a connection may be idle for before it's closed.
+// The default, 0, means connections aren't closed for being idle.
+func WithConnMaxIdleTime(connMaxIdleTime time.Duration) Option {
+	return func(opts *Provider) {
+		opts.connMaxIdleTime = connMaxIdleTime
+	}
+}
+
+// WithExpiredEntrySweepInterval option sets how often each open store deletes the entries whose TTL has elapsed.
+// If this option isn't used, or interval isn't positive, expired entries are deleted every minute.
+func WithExpiredEntrySweepInterval(interval time.Duration) Option {
+	return func(opts *Provider) {
+		opts.sweepInterval = interval
+	}
+}
+
+// WithLogger is an option for specifying a custom logger.
+// The standard Golang logger will be used if this option is not provided.
+func WithLogger(logger logger) Option {
+	return func(opts *Provider) {
+		opts.logger = logger
+	}
+}
+
 // NewProvider instantiates Provider.
-// Example DB Path root:my-secret-pw@tcp(127.0.0.1:3306)/?interpolateParams=true&multiStatements=true
+// Example DB Path root:my-secret-pw@tcp(127.0.0.1:3306)/
 // This provider's CreateStore(name) implementation creates stores that are backed by a table under a schema
 // with the same name as the table. The fully qualified name of the table is thus `name.name`. The fully qualified
 // name of the table needs to be used with the store's `Query()` method.
-// Use of `Batch()` has additional considerations - please read the docs for Batch() accordingly..
 func NewProvider(dbPath string, opts ...Option) (*Provider, error) {
 	if dbPath == "" {
 		return nil, errBlankDBPath
@@ -83,26 +239,62 @@ func NewProvider(dbPath string, opts ...Option) (*Provider, error) {
 		return nil, fmt.Errorf(failureWhileOpeningMySQLConnectionErrMsg, dbPath, err)
 	}
 
-	err = db.Ping()
-	if err != nil {
-		return nil, fmt.Errorf(failureWhilePingingMySQLErrMsg, dbPath, err)
-	}
-
 	p := &Provider{
-		dbURL: dbPath,
-		db:    db,
-		dbs:   map[string]*store{},
+		db:           db,
+		dbs:          map[string]*store{},
+		maxIdleConns: defaultMaxIdleConns,
 	}
 
 	for _, opt := range opts {
 		opt(p)
 	}
 
+	if p.sweepInterval <= 0 {
+		p.sweepInterval = defaultExpiredEntrySweepInterval
+	}
+
+	if p.changePollInterval <= 0 {
+		p.changePollInterval = defaultChangePollInterval
+	}
+
+	if p.logger == nil {
+		p.logger = &defaultLogger{
+			log.New(os.Stdout, "MySQL-Provider ", log.Ldate|log.Ltime|log.LUTC),
+		}
+	}
+
+	db.SetMaxOpenConns(p.maxOpenConns)
+	db.SetMaxIdleConns(p.maxIdleConns)
+	db.SetConnMaxLifetime(p.connMaxLifetime)
+	db.SetConnMaxIdleTime(p.connMaxIdleTime)
+
+	err = db.Ping()
+	if err != nil {
+		return nil, fmt.Errorf(failureWhilePingingMySQLErrMsg, dbPath, err)
+	}
+
 	return p, nil
 }
 
-// OpenStore opens a store with the given name and returns a handle.
-// If the store has never been opened before, then it is created.
+// Ping checks that the MySQL server can be reached, e.g. for a health check.
+func (p *Provider) Ping(ctx context.Context) error {
+	err := p.db.PingContext(ctx)
+	if err != nil {
+		return fmt.Errorf(failureWhilePingingMySQLServerErrMsg, err)
+	}
+
+	return nil
+}
+
+// Stats returns statistics about the provider's connection pool.
+func (p *Provider) Stats() sql.DBStats {
+	return p.db.Stats()
+}
+
+// OpenStore opens a store with the given name and returns a handle, which is also a TTLStore, a VersionedStore,
+// a ContextStore and a WatchableStore.
+// If the store has never been opened before, then it is created. Until it's closed, the store deletes its expired
+// entries periodically.
 // Store names are not case-sensitive. If name is blank, then an error will be returned.
 func (p *Provider) OpenStore(name string) (storage.Store, error) {
 	if name == "" {
@@ -131,7 +323,8 @@ func (p *Provider) OpenStore(name string) (storage.Store, error) {
 	}
 
 	createTableStmt := fmt.Sprintf(
-		"CREATE Table IF NOT EXISTS `%s`.`%s` (`key` varchar(255) NOT NULL ,`value` BLOB, PRIMARY KEY (`key`))",
+		"CREATE Table IF NOT EXISTS `%s`.`%s` (`key` varchar(255) NOT NULL ,`value` BLOB, `expires_at` bigint NULL, "+
+			"`version` bigint NOT NULL DEFAULT 0, PRIMARY KEY (`key`), INDEX `expires_at` (`expires_at`))",
 		name, name)
 
 	// creating key-value table inside the database
@@ -140,27 +333,56 @@ func (p *Provider) OpenStore(name string) (storage.Store, error) {
 		return nil, fmt.Errorf(failureWhileCreatingTableErrMsg, name, err)
 	}
 
-	// Opening new DB connection
-	storeDB, err := sql.Open("mysql", p.dbURL)
+	tagTableName := fmt.Sprintf("`%s`.`%s_tags`", name, name)
+
+	// creating the table for the tags of the key-value pairs, indexed by tag name and value for queries
+	_, err = p.db.Exec(fmt.Sprintf(createTagTableQuery, tagTableName))
 	if err != nil {
-		return nil, fmt.Errorf(failureWhileOpeningMySQLConnectionErrMsg, p.dbURL, err)
+		return nil, fmt.Errorf(failureWhileCreatingTableErrMsg, name+"_tags", err)
 	}
 
 	store := &store{
-		db:        storeDB,
-		name:      name,
-		tableName: fmt.Sprintf("`%s`.`%s`", name, name),
-		close:     p.removeStore,
+		db:                 p.db,
+		name:               name,
+		tableName:          fmt.Sprintf("`%s`.`%s`", name, name),
+		tagTableName:       tagTableName,
+		changeLogRetention: p.changeLogRetention,
+		changePollInterval: p.changePollInterval,
+		logger:             p.logger,
+		close:              p.removeStore,
+		closed:             make(chan struct{}),
+	}
+
+	err = store.createChangeTableIfEnabled()
+	if err != nil {
+		return nil, err
+	}
+
+	err = store.addColumnIfMissing("expires_at", addExpiryColumnQuery)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add expiry column: %w", err)
+	}
+
+	err = store.addColumnIfMissing("version", addVersionColumnQuery)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add version column: %w", err)
 	}
 
+	err = store.migrateTagMap()
+	if err != nil {
+		return nil, fmt.Errorf("failed to migrate tag map: %w", err)
+	}
+
+	go store.sweepExpiredEntriesPeriodically(p.sweepInterval)
+
 	p.dbs[name] = store
 
 	return store, nil
 }
 
-// SetStoreConfig sets the configuration on a store. This must be done before storing any data in order to make use
-// of the Query method.
-// TODO (#67): Use proper MySQL indexing instead of the "Tag Map".
+// SetStoreConfig sets the configuration on a store.
+// Tags are kept in a table of their own with an index on tag name and value, which serves queries for any of the
+// configured tag names, so no further indexes are created here.
 func (p *Provider) SetStoreConfig(name string, config storage.StoreConfiguration) error {
 	for _, tagName := range config.TagNames {
 		if strings.Contains(tagName, ":") {
@@ -222,9 +444,18 @@ func (p *Provider) GetStoreConfig(name string) (storage.StoreConfiguration, erro
 	return storeConfig, nil
 }
 
-// GetOpenStores is currently not implemented.
+// GetOpenStores returns all Stores currently open in this Provider.
 func (p *Provider) GetOpenStores() []storage.Store {
-	panic("not implemented")
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	openStores := make([]storage.Store, 0, len(p.dbs))
+
+	for _, openStore := range p.dbs {
+		openStores = append(openStores, openStore)
+	}
+
+	return openStores
 }
 
 // Close closes all stores created under this store provider.
@@ -248,6 +479,11 @@ func (p *Provider) Close() error {
 		}
 	}
 
+	err := p.db.Close()
+	if err != nil {
+		return fmt.Errorf(failureWhileClosingMySQLConnection, err)
+	}
+
 	return nil
 }
 
@@ -262,41 +498,168 @@ func (p *Provider) removeStore(name string) {
 }
 
 type store struct {
-	db        *sql.DB
-	name      string
-	tableName string
-	close     closer
-	lock      sync.RWMutex
+	db           *sql.DB
+	name         string
+	tableName    string
+	tagTableName string
+	// changeTableName and changeSeqTableName are blank if the change log isn't enabled.
+	changeTableName    string
+	changeSeqTableName string
+	changeLogRetention time.Duration
+	changePollInterval time.Duration
+	logger             logger
+	close              closer
+	closed             chan struct{}
+	closeOnce          sync.Once
 }
 
 func (s *store) Put(key string, value []byte, tags ...storage.Tag) error {
+	return s.PutWithContext(context.Background(), key, value, tags...)
+}
+
+// PutWithContext stores the key + value pair along with the (optional) tags, giving up once ctx is done.
+func (s *store) PutWithContext(ctx context.Context, key string, value []byte, tags ...storage.Tag) error {
+	return s.put(ctx, key, value, tags, nil)
+}
+
+// PutWithTTL stores the key + value pair along with the (optional) tags, and has the entry deleted once ttl has
+// elapsed. ttl must be positive.
+func (s *store) PutWithTTL(key string, value []byte, ttl time.Duration, tags ...storage.Tag) error {
+	if ttl <= 0 {
+		return errors.New("ttl must be positive")
+	}
+
+	return s.put(context.Background(), key, value, tags, unixMilli(time.Now().Add(ttl)))
+}
+
+// put upserts the entry, which expires at expiresAt (in Unix milliseconds) or never if expiresAt is nil.
+func (s *store) put(ctx context.Context, key string, value []byte, tags []storage.Tag, expiresAt interface{}) error {
 	errInputValidation := validatePutInput(key, value, tags)
 	if errInputValidation != nil {
 		return errInputValidation
 	}
 
-	var newDBEntry dbEntry
-	newDBEntry.Value = value
+	entryBytes, err := json.Marshal(dbEntry{Value: value, Tags: tags})
+	if err != nil {
+		return fmt.Errorf("failed to marshal new DB entry: %w", err)
+	}
 
-	if len(tags) > 0 {
-		newDBEntry.Tags = tags
+	return s.inTransaction(ctx, func(tx *sql.Tx) error {
+		// create upsert query to insert the record, checking whether the key is already mapped to a value in the store.
+		insertStmt := "INSERT INTO " + s.tableName + " (`key`, `value`, `expires_at`, `version`) VALUES (?, ?, ?, 1) " +
+			"ON DUPLICATE KEY UPDATE value=?, expires_at=?, version=version+1"
+		// executing the prepared insert statement
+		_, err = tx.ExecContext(ctx, insertStmt, key, entryBytes, expiresAt, entryBytes, expiresAt)
+		if err != nil {
+			return fmt.Errorf(failureWhileExecutingInsertStatementErrMsg, s.tableName, err)
+		}
 
-		err := s.updateTagMap(key, tags)
+		err = s.replaceTags(ctx, tx, key, tags)
 		if err != nil {
-			return fmt.Errorf("failed to update tag map: %w", err)
+			return err
 		}
+
+		return s.recordChanges(ctx, tx, []string{key}, [][]byte{entryBytes})
+	})
+}
+
+// PutIfVersion stores the key + value pair along with the (optional) tags, provided the entry's current version is
+// version, or provided there's no entry if version is blank. Entries that have expired count as missing.
+// It returns the entry's new version.
+func (s *store) PutIfVersion(key string, value []byte, version string, tags ...storage.Tag) (string, error) {
+	errInputValidation := validatePutInput(key, value, tags)
+	if errInputValidation != nil {
+		return "", errInputValidation
 	}
 
-	entryBytes, err := json.Marshal(newDBEntry)
+	entryBytes, err := json.Marshal(dbEntry{Value: value, Tags: tags})
 	if err != nil {
-		return fmt.Errorf("failed to marshal new DB entry: %w", err)
+		return "", fmt.Errorf("failed to marshal new DB entry: %w", err)
+	}
+
+	var newVersion int64
+
+	ctx := context.Background()
+
+	err = s.inTransaction(ctx, func(tx *sql.Tx) error {
+		updated, errUpdate := s.updateIfVersion(ctx, tx, key, entryBytes, version)
+		if errUpdate != nil {
+			return errUpdate
+		}
+
+		if !updated {
+			if version != "" {
+				return ErrVersionConflict
+			}
+
+			errInsert := s.insert(ctx, tx, key, entryBytes)
+			if errInsert != nil {
+				return errInsert
+			}
+		}
+
+		errQuery := tx.QueryRowContext(ctx, "SELECT `version` FROM "+s.tableName+" WHERE `key` = ?", key).
+			Scan(&newVersion)
+		if errQuery != nil {
+			return fmt.Errorf(failureWhileQueryingRowErrMsg, errQuery)
+		}
+
+		errReplace := s.replaceTags(ctx, tx, key, tags)
+		if errReplace != nil {
+			return errReplace
+		}
+
+		return s.recordChanges(ctx, tx, []string{key}, [][]byte{entryBytes})
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return strconv.FormatInt(newVersion, 10), nil
+}
+
+// updateIfVersion updates the entry if it's at the given version and hasn't expired, or, if version is blank, if it
+// has expired. It returns whether the entry was updated.
+func (s *store) updateIfVersion(ctx context.Context, tx *sql.Tx, key string, entryBytes []byte,
+	version string) (bool, error) {
+	now := unixMilli(time.Now())
+
+	condition, args := "`expires_at` <= ?", []interface{}{now}
+
+	if version != "" {
+		expectedVersion, err := strconv.ParseInt(version, 10, 64)
+		if err != nil { // No entry can be at this version.
+			return false, nil
+		}
+
+		condition, args = "`version` = ? AND "+notExpiredFilter("`expires_at`"), []interface{}{expectedVersion, now}
+	}
+
+	result, err := tx.ExecContext(ctx, "UPDATE "+s.tableName+
+		" SET `value` = ?, `expires_at` = NULL, `version` = `version` + 1 WHERE `key` = ? AND "+condition,
+		append([]interface{}{entryBytes, key}, args...)...)
+	if err != nil {
+		return false, fmt.Errorf(failureWhileExecutingUpdateStatementErrMsg, s.tableName, err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf(failureWhileExecutingUpdateStatementErrMsg, s.tableName, err)
 	}
 
-	// create upsert query to insert the record, checking whether the key is already mapped to a value in the store.
-	insertStmt := "INSERT INTO " + s.tableName + " VALUES (?, ?) ON DUPLICATE KEY UPDATE value=?"
-	// executing the prepared insert statement
-	_, err = s.db.Exec(insertStmt, key, entryBytes, entryBytes)
+	return rowsAffected > 0, nil
+}
+
+// insert inserts a new entry, returning ErrVersionConflict if there's already an entry under key.
+func (s *store) insert(ctx context.Context, tx *sql.Tx, key string, entryBytes []byte) error {
+	_, err := tx.ExecContext(ctx, "INSERT INTO "+s.tableName+" (`key`, `value`, `version`) VALUES (?, ?, 1)",
+		key, entryBytes)
 	if err != nil {
+		var mysqlErr *mysqldriver.MySQLError
+		if errors.As(err, &mysqlErr) && mysqlErr.Number == duplicateEntryErrCode {
+			return ErrVersionConflict
+		}
+
 		return fmt.Errorf(failureWhileExecutingInsertStatementErrMsg, s.tableName, err)
 	}
 
@@ -304,7 +667,12 @@ func (s *store) Put(key string, value []byte, tags ...storage.Tag) error {
 }
 
 func (s *store) Get(k string) ([]byte, error) {
-	retrievedDBEntry, err := s.getDBEntry(k)
+	return s.GetWithContext(context.Background(), k)
+}
+
+// GetWithContext fetches the value associated with the given key, giving up once ctx is done.
+func (s *store) GetWithContext(ctx context.Context, k string) ([]byte, error) {
+	retrievedDBEntry, err := s.getDBEntry(ctx, s.db, k)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get DB entry: %w", err)
 	}
@@ -312,8 +680,24 @@ func (s *store) Get(k string) ([]byte, error) {
 	return retrievedDBEntry.Value, nil
 }
 
+// GetWithVersion fetches the value associated with the given key, along with the entry's current version.
+// Entries put by earlier versions of this provider, before versions were kept, are at version 0.
+func (s *store) GetWithVersion(key string) ([]byte, string, error) {
+	retrievedDBEntry, err := s.getDBEntry(context.Background(), s.db, key)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get DB entry: %w", err)
+	}
+
+	return retrievedDBEntry.Value, strconv.FormatInt(retrievedDBEntry.version, 10), nil
+}
+
 func (s *store) GetTags(key string) ([]storage.Tag, error) {
-	retrievedDBEntry, err := s.getDBEntry(key)
+	return s.GetTagsWithContext(context.Background(), key)
+}
+
+// GetTagsWithContext fetches all tags associated with the given key, giving up once ctx is done.
+func (s *store) GetTagsWithContext(ctx context.Context, key string) ([]storage.Tag, error) {
+	retrievedDBEntry, err := s.getDBEntry(ctx, s.db, key)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get DB entry: %w", err)
 	}
@@ -321,143 +705,201 @@ func (s *store) GetTags(key string) ([]storage.Tag, error) {
 	return retrievedDBEntry.Tags, nil
 }
 
-func (s *store) GetBulk(...string) ([][]byte, error) {
-	return nil, errors.New("not implemented")
+// GetBulk fetches the values associated with the given keys in a single query.
+// If a key doesn't exist, then a nil []byte is returned for that value. It is not considered an error.
+func (s *store) GetBulk(keys ...string) ([][]byte, error) {
+	return s.GetBulkWithContext(context.Background(), keys...)
 }
 
-// This provider doesn't currently support any of the current query options.
-// spi.WithPageSize will simply be ignored since it only relates to performance and not the actual end result.
-// spi.WithInitialPageNum and spi.WithSortOrder will result in an error being returned since those options do
-// affect the results that the Iterator returns.
-func (s *store) Query(expression string, options ...storage.QueryOption) (storage.Iterator, error) {
-	err := checkForUnsupportedQueryOptions(options)
-	if err != nil {
-		return nil, err
+// GetBulkWithContext fetches the values associated with the given keys, giving up once ctx is done.
+func (s *store) GetBulkWithContext(ctx context.Context, keys ...string) ([][]byte, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("keys slice must contain at least one key")
 	}
 
-	if expression == "" {
-		return nil, fmt.Errorf(invalidQueryExpressionFormat, expression)
+	args := make([]interface{}, len(keys), len(keys)+1)
+
+	for i, key := range keys {
+		if key == "" {
+			return nil, ErrKeyRequired
+		}
+
+		args[i] = key
 	}
 
-	expressionSplit := strings.Split(expression, ":")
+	rows, err := s.db.QueryContext(ctx, "SELECT `key`, `value` FROM "+s.tableName+
+		" WHERE `key` IN ("+placeholders("?", len(keys))+") AND "+notExpiredFilter("`expires_at`"),
+		append(args, unixMilli(time.Now()))...)
+	if err != nil {
+		return nil, fmt.Errorf(failureWhileQueryingRowsErrMsg, err)
+	}
 
-	var expressionTagName string
+	valuesByKey, err := collectValues(rows)
 
-	var expressionTagValue string
+	errClose := rows.Close()
+	if err != nil {
+		return nil, err
+	}
 
-	switch len(expressionSplit) {
-	case expressionTagNameOnlyLength:
-		expressionTagName = expressionSplit[0]
-	case expressionTagNameAndValueLength:
-		expressionTagName = expressionSplit[0]
-		expressionTagValue = expressionSplit[1]
-	default:
-		return nil, fmt.Errorf(invalidQueryExpressionFormat, expression)
+	if errClose != nil {
+		return nil, fmt.Errorf("failed to close result rows: %w", errClose)
 	}
 
-	matchingDatabaseKeys, err := s.getDatabaseKeysMatchingQuery(expressionTagName, expressionTagValue)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get database keys matching query: %w", err)
+	values := make([][]byte, len(keys))
+
+	for i, key := range keys {
+		values[i] = valuesByKey[key]
 	}
 
-	return &iterator{keys: matchingDatabaseKeys, store: s}, nil
+	return values, nil
 }
 
-// Delete will delete record with k key.
-func (s *store) Delete(k string) error {
-	if k == "" {
-		return ErrKeyRequired
-	}
+// Query does a query for data as defined by the documentation in storage.Store (the interface).
+// Besides TagName and TagName:TagValue, expression may combine these with && and ||, with && binding tighter than ||,
+// e.g. "TagName1:TagValue1&&TagName2||TagName3". Tag values can also be matched by prefix, as in "TagName:Prefix*",
+// or compared using <, <=, > and >=, as in "TagName<=1700000000".
+// Results are fetched a page at a time (see storage.WithPageSize), using the indexes on the tag table. When sorting,
+// tag values that are decimal numbers are compared numerically and all others lexicographically. Comparisons with a
+// decimal number are numeric, and only match tag values that are decimal numbers.
+func (s *store) Query(expression string, options ...storage.QueryOption) (storage.Iterator, error) {
+	return s.QueryWithContext(context.Background(), expression, options...)
+}
 
-	// delete query to delete the record by key
-	_, err := s.db.Exec("DELETE FROM "+s.tableName+" WHERE `key`= ?", k)
+// QueryWithContext does a query for data, like Query, giving up once ctx is done.
+// The returned iterator also uses ctx for fetching further pages and for counting the results.
+func (s *store) QueryWithContext(ctx context.Context, expression string,
+	options ...storage.QueryOption) (storage.Iterator, error) {
+	disjunction, err := parseQueryExpression(expression)
 	if err != nil {
-		return fmt.Errorf(storage.ErrDataNotFound.Error(), err)
+		return nil, err
+	}
+
+	queryOptions := getQueryOptions(options)
+
+	// Entries that expire while iterating are still returned, so that they don't shift later pages.
+	now := unixMilli(time.Now())
+
+	keyFilter, args := s.keyFilter("`key`", disjunction)
+
+	itr := &iterator{
+		ctx:      ctx,
+		store:    s,
+		pageSize: queryOptions.PageSize,
+		offset:   queryOptions.InitialPageNum * queryOptions.PageSize,
+		countQuery: "SELECT COUNT(*) FROM " + s.tableName + " WHERE (" + keyFilter + ") AND " +
+			notExpiredFilter("`expires_at`"),
+		countArgs: append(args, now),
 	}
 
-	err = s.removeFromTagMap(k)
+	itr.query, itr.args = s.selectMatchingEntries(disjunction, queryOptions.SortOptions, now)
+
+	err = itr.fetchPage()
 	if err != nil {
-		return fmt.Errorf("failed to remove key from tag map: %w", err)
+		return nil, err
 	}
 
-	return nil
+	return itr, nil
 }
 
-// Batch performs batch upserts and deletions preserving the batch's ordering.
-// Batch is a no-op if the batch is empty.
-// Batch needs both `interpolateParams` and `multiStatements` enabled in the dataSourceName
-// - see the following guide: https://github.com/go-sql-driver/mysql#parameters.
-// All operations in the batch are executed in a single multi-statement query due to the ordering
-// requirements. This means we cannot optimize INSERT statements as per
-// https://dev.mysql.com/doc/refman/8.0/en/insert-optimization.html.
-// Executing a single multi-statement query requires O(N) space for the query string and an additional
-// slice with O(2*N) space holding the values for the query. Callers should take care of this additional
-// memory usage by limiting the size of the batch.
-func (s *store) Batch(batch []storage.Operation) error { // nolint:gocyclo
-	if len(batch) == 0 {
-		return errors.New("batch requires at least one operation")
+// selectMatchingEntries returns a query, without its LIMIT clause, for the entries matching disjunction that haven't
+// expired by now, in the order set by sortOptions, along with its arguments.
+func (s *store) selectMatchingEntries(disjunction [][]tagCondition, sortOptions *storage.SortOptions,
+	now int64) (string, []interface{}) {
+	if sortOptions == nil {
+		keyFilter, args := s.keyFilter("`key`", disjunction)
+
+		return "SELECT `key`, `value` FROM " + s.tableName + " WHERE (" + keyFilter + ") AND " +
+			notExpiredFilter("`expires_at`") + " ORDER BY `key`", append(args, now)
 	}
 
-	var (
-		query  string
-		values []interface{}
-	)
+	keyFilter, args := s.keyFilter("e.`key`", disjunction)
 
-	for i := range batch {
-		b := batch[i]
+	order := "ASC"
+	if sortOptions.Order == storage.SortDescending {
+		order = "DESC"
+	}
 
-		if b.Key == "" {
-			return errors.New("key cannot be empty")
-		}
+	query := fmt.Sprintf("SELECT e.`key`, e.`value` FROM %s e LEFT JOIN %s t ON t.`key` = e.`key` AND t.`name` = ? "+
+		"WHERE (%s) AND %s ORDER BY t.`numeric_value` %s, t.`value` %s, e.`key` %s",
+		s.tableName, s.tagTableName, keyFilter, notExpiredFilter("e.`expires_at`"), order, order, order)
 
-		err := s.bulkAppendToQuery(b, &query, &values)
-		if err != nil {
-			return fmt.Errorf(failureWhileExecutingBatchStatementErrMsg, s.tableName, err)
-		}
+	return query, append(append([]interface{}{sortOptions.TagName}, args...), now)
+}
 
-		if len(b.Value) > 0 {
-			err = s.updateTagMap(b.Key, b.Tags)
-			if err != nil && !errors.Is(err, storage.ErrDataNotFound) {
-				return fmt.Errorf("failed to update tag map: %w", err)
-			}
-		} else {
-			err = s.removeFromTagMap(b.Key)
-			if err != nil && !errors.Is(err, storage.ErrDataNotFound) {
-				return fmt.Errorf("failed to remove key from tag map: %w", err)
-			}
+// notExpiredFilter returns a condition that holds for the entries whose expiry time, in column, is after the time
+// given by its argument.
+func notExpiredFilter(column string) string {
+	return "(" + column + " IS NULL OR " + column + " > ?)"
+}
+
+// keyFilter returns a condition on keyColumn that holds for the keys of the entries matching disjunction, along
+// with its arguments. Each tag condition is looked up in the tag table with a subquery served by its indexes.
+func (s *store) keyFilter(keyColumn string, disjunction [][]tagCondition) (string, []interface{}) {
+	conjunctionFilters := make([]string, len(disjunction))
+
+	var args []interface{}
+
+	for i, conjunction := range disjunction {
+		tagFilters := make([]string, len(conjunction))
+
+		for j, condition := range conjunction {
+			tagFilter, tagFilterArgs := tagConditionFilter(condition)
+
+			tagFilters[j] = keyColumn + " IN (SELECT `key` FROM " + s.tagTableName + " WHERE " + tagFilter + ")"
+			args = append(args, tagFilterArgs...)
 		}
+
+		conjunctionFilters[i] = "(" + strings.Join(tagFilters, " AND ") + ")"
 	}
 
-	_, err := s.db.Exec(query, values...)
-	if err != nil {
-		return fmt.Errorf(failureWhileExecutingBatchStatementErrMsg, s.tableName, err)
+	return strings.Join(conjunctionFilters, " OR "), args
+}
+
+// tagConditionFilter returns a condition on the tag table for a single tag condition, along with its arguments.
+// Comparisons are numeric if the value in the expression is a decimal number, and lexicographic otherwise.
+func tagConditionFilter(condition tagCondition) (string, []interface{}) {
+	switch condition.operator {
+	case "":
+		return "`name` = ?", []interface{}{condition.name}
+	case equalsOperator:
+		return "`name` = ? AND `value` = ?", []interface{}{condition.name, condition.value}
+	case prefixOperator:
+		return "`name` = ? AND `value` LIKE ? ESCAPE '!'", []interface{}{condition.name, escapeLike(condition.value) + "%"}
 	}
 
-	return nil
+	// The operator is one of the comparison operators allowed by parseTagCondition, so it's safe to use in the query.
+	if number := numericValue(condition.value); number != nil {
+		return "`name` = ? AND `numeric_value` " + condition.operator + " ?", []interface{}{condition.name, number}
+	}
+
+	return "`name` = ? AND `value` " + condition.operator + " ?", []interface{}{condition.name, condition.value}
 }
 
-func (s *store) bulkAppendToQuery(b storage.Operation, query *string, values *[]interface{}) error {
-	if len(b.Value) > 0 {
-		value, err := json.Marshal(dbEntry{
-			Value: b.Value,
-			Tags:  b.Tags,
-		})
+// Delete will delete record with k key.
+func (s *store) Delete(k string) error {
+	return s.DeleteWithContext(context.Background(), k)
+}
+
+// DeleteWithContext deletes the record with key k, giving up once ctx is done.
+func (s *store) DeleteWithContext(ctx context.Context, k string) error {
+	if k == "" {
+		return ErrKeyRequired
+	}
+
+	return s.inTransaction(ctx, func(tx *sql.Tx) error {
+		// delete query to delete the record by key
+		_, err := tx.ExecContext(ctx, "DELETE FROM "+s.tableName+" WHERE `key`= ?", k)
 		if err != nil {
-			return fmt.Errorf("failed to marshal dbEntry: %w", err)
+			return fmt.Errorf(storage.ErrDataNotFound.Error(), err)
 		}
 
-		*query += fmt.Sprintf(
-			"INSERT INTO %s (`key`, `value`) VALUES (?, ?) ON DUPLICATE KEY UPDATE value=VALUES(value);\n",
-			s.tableName,
-		)
-
-		*values = append(*values, b.Key, value)
-	} else {
-		*query += fmt.Sprintf("DELETE FROM %s WHERE `KEY` = ?;\n", s.tableName)
-		*values = append(*values, b.Key)
-	}
+		err = s.replaceTags(ctx, tx, k, nil)
+		if err != nil {
+			return err
+		}
 
-	return nil
+		return s.recordChanges(ctx, tx, []string{k}, [][]byte{nil})
+	})
 }
 
 // SQL store doesn't queue values, so there's never anything to flush.
@@ -465,233 +907,443 @@ func (s *store) Flush() error {
 	return nil
 }
 
+// Close removes the store from the provider's open stores. The connection pool it uses is shared with the other
+// stores and is closed by Provider.Close.
 func (s *store) Close() error {
 	s.close(s.name)
 
-	err := s.db.Close()
-	if err != nil {
-		return fmt.Errorf(failureWhileClosingMySQLConnection, err)
-	}
+	s.closeOnce.Do(func() {
+		close(s.closed)
+	})
 
 	return nil
 }
 
-func (s *store) updateTagMap(key string, tags []storage.Tag) error {
-	s.lock.Lock()
-	defer s.lock.Unlock()
-
-	tagMap, err := s.getTagMap(true)
-	if err != nil {
-		return fmt.Errorf("failed to get tag map: %w", err)
+// sweepExpiredEntriesPeriodically deletes this store's expired entries every interval until the store is closed.
+func (s *store) sweepExpiredEntriesPeriodically(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-ticker.C:
+			err := s.sweepExpiredEntries()
+			if err != nil {
+				// Expired entries are hidden anyway, and the next sweep tries again.
+				s.logger.Warnf("[Store name: %s] Failed to delete expired entries: %s", s.name, err.Error())
+			}
+		}
 	}
+}
 
-	for _, tag := range tags {
-		if tagMap[tag.Name] == nil {
-			tagMap[tag.Name] = make(map[string]struct{})
+// sweepExpiredEntries deletes the entries that have expired, along with their tags, recording their deletion in the
+// change log. Changes older than the change log's retention are deleted too.
+func (s *store) sweepExpiredEntries() error {
+	now := unixMilli(time.Now())
+
+	ctx := context.Background()
+
+	return s.inTransaction(ctx, func(tx *sql.Tx) error {
+		err := s.recordExpiredEntries(ctx, tx, now)
+		if err != nil {
+			return err
 		}
 
-		tagMap[tag.Name][key] = struct{}{}
+		_, err = tx.ExecContext(ctx, "DELETE FROM "+s.tagTableName+" WHERE `key` IN (SELECT `key` FROM "+s.tableName+
+			" WHERE `expires_at` <= ?)", now)
+		if err != nil {
+			return fmt.Errorf(failureWhileUpdatingTagsErrMsg, s.tagTableName, err)
+		}
+
+		_, err = tx.ExecContext(ctx, "DELETE FROM "+s.tableName+" WHERE `expires_at` <= ?", now)
+		if err != nil {
+			return fmt.Errorf("failure while deleting expired entries from table %s: %w", s.tableName, err)
+		}
+
+		return s.pruneChanges(ctx, tx, now)
+	})
+}
+
+// addColumnIfMissing adds column, using alterQuery, to the table of a store that was created by an earlier version of
+// this provider.
+func (s *store) addColumnIfMissing(column, alterQuery string) error {
+	rows, err := s.db.Query("SHOW COLUMNS FROM " + s.tableName + " LIKE '" + column + "'")
+	if err != nil {
+		return fmt.Errorf(failureWhileQueryingRowsErrMsg, err)
 	}
 
-	tagMapBytes, err := json.Marshal(tagMap)
+	columnExists := rows.Next()
+
+	err = rows.Close()
 	if err != nil {
-		return fmt.Errorf("failed to marshal updated tag map: %w", err)
+		return fmt.Errorf("failed to close result rows: %w", err)
 	}
 
-	err = s.Put(tagMapKey, tagMapBytes)
+	if columnExists {
+		return nil
+	}
+
+	_, err = s.db.Exec(fmt.Sprintf(alterQuery, s.tableName))
 	if err != nil {
-		return fmt.Errorf("failed to put updated tag map back into the store: %w", err)
+		return fmt.Errorf("failure while altering table %s: %w", s.tableName, err)
 	}
 
 	return nil
 }
 
-func (s *store) getTagMap(createIfDoesNotExist bool) (tagMapping, error) {
+// migrateTagMap moves the tags of a store that was created by an earlier version of this provider, which kept track of
+// them in a "tag map" entry, into the tag table and deletes the tag map.
+func (s *store) migrateTagMap() error {
 	tagMapBytes, err := s.Get(tagMapKey)
 	if err != nil {
-		if createIfDoesNotExist && errors.Is(err, storage.ErrDataNotFound) {
-			// Create the tag map if it has never been created before.
-			err = s.Put(tagMapKey, []byte("{}"))
-			if err != nil {
-				return nil, fmt.Errorf(`failed to create tag map for "%s": %w`, s.name, err)
-			}
-
-			tagMapBytes = []byte("{}")
-		} else {
-			return nil, fmt.Errorf("failed to get data: %w", err)
+		if errors.Is(err, storage.ErrDataNotFound) {
+			return nil
 		}
+
+		return fmt.Errorf("failed to get tag map: %w", err)
 	}
 
 	var tagMap tagMapping
 
 	err = json.Unmarshal(tagMapBytes, &tagMap)
 	if err != nil {
-		return nil, fmt.Errorf("failed to unmarshal tag map bytes: %w", err)
+		return fmt.Errorf("failed to unmarshal tag map bytes: %w", err)
 	}
 
-	return tagMap, nil
-}
+	keys := make(map[string]struct{})
 
-func (s *store) getDBEntry(key string) (dbEntry, error) {
-	if key == "" {
-		return dbEntry{}, ErrKeyRequired
+	for _, databaseKeys := range tagMap {
+		for key := range databaseKeys {
+			keys[key] = struct{}{}
+		}
 	}
 
-	var retrievedDBEntryBytes []byte
+	ctx := context.Background()
 
-	// select query to fetch the record by key
-	err := s.db.QueryRow("SELECT `value` FROM "+s.tableName+" "+
-		" WHERE `key` = ?", key).Scan(&retrievedDBEntryBytes)
-	if err != nil {
-		if strings.Contains(err.Error(), valueNotFoundErrMsgFromMySQL) {
-			return dbEntry{}, storage.ErrDataNotFound
+	return s.inTransaction(ctx, func(tx *sql.Tx) error {
+		for key := range keys {
+			// The entry is read in the transaction, which may be holding the only connection to the server.
+			entry, errGet := s.getDBEntry(ctx, tx, key)
+			if errGet != nil && !errors.Is(errGet, storage.ErrDataNotFound) {
+				return fmt.Errorf("failed to get tags: %w", errGet)
+			}
+
+			errReplace := s.replaceTags(ctx, tx, key, entry.Tags)
+			if errReplace != nil {
+				return errReplace
+			}
 		}
 
-		return dbEntry{}, fmt.Errorf(failureWhileQueryingRowErrMsg, err)
+		_, errDelete := tx.ExecContext(ctx, "DELETE FROM "+s.tableName+" WHERE `key`= ?", tagMapKey)
+		if errDelete != nil {
+			return fmt.Errorf("failed to delete tag map: %w", errDelete)
+		}
+
+		return nil
+	})
+}
+
+// replaceTags replaces the tags of key in the tag table.
+func (s *store) replaceTags(ctx context.Context, tx *sql.Tx, key string, tags []storage.Tag) error {
+	_, err := tx.ExecContext(ctx, s.deleteTagsStmt(), key)
+	if err != nil {
+		return fmt.Errorf(failureWhileUpdatingTagsErrMsg, s.tagTableName, err)
 	}
 
-	var retrievedDBEntry dbEntry
+	if len(tags) == 0 {
+		return nil
+	}
 
-	err = json.Unmarshal(retrievedDBEntryBytes, &retrievedDBEntry)
+	values := make([]interface{}, 0, len(tags)*tagColumns)
+
+	for _, tag := range tags {
+		values = append(values, tagRow(key, tag)...)
+	}
+
+	_, err = tx.ExecContext(ctx, s.insertTagsStmt(len(tags)), values...)
 	if err != nil {
-		return dbEntry{}, fmt.Errorf("failed to unmarshaled retrieved DB entry: %w", err)
+		return fmt.Errorf(failureWhileUpdatingTagsErrMsg, s.tagTableName, err)
 	}
 
-	return retrievedDBEntry, nil
+	return nil
 }
 
-func (s *store) removeFromTagMap(keyToRemove string) error {
-	s.lock.Lock()
-	defer s.lock.Unlock()
+func (s *store) deleteTagsStmt() string {
+	return "DELETE FROM " + s.tagTableName + " WHERE `key` = ?"
+}
 
-	tagMap, err := s.getTagMap(false)
-	if err != nil {
-		// If there's no tag map, then this means that tags have never been used. This means that there's no tag map
-		// to update. This isn't a problem.
-		if errors.Is(err, storage.ErrDataNotFound) {
-			return nil
+// insertTagsStmt returns a statement that inserts rowCount tags into the tag table, each given by the values from
+// tagRow. Duplicate tags are ignored.
+func (s *store) insertTagsStmt(rowCount int) string {
+	return "INSERT IGNORE INTO " + s.tagTableName + " (`key`, `name`, `value`, `numeric_value`) VALUES " +
+		placeholders("(?, ?, ?, ?)", rowCount)
+}
+
+// tagRow returns the values of the tag table's columns for a tag of key.
+func tagRow(key string, tag storage.Tag) []interface{} {
+	return []interface{}{key, tag.Name, tag.Value, numericValue(tag.Value)}
+}
+
+// escapeLike escapes the wildcards of LIKE patterns in value with '!', which, unlike LIKE's default escape character,
+// doesn't depend on the NO_BACKSLASH_ESCAPES SQL mode.
+func escapeLike(value string) string {
+	return strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(value)
+}
+
+// placeholders returns count comma-separated copies of placeholder.
+func placeholders(placeholder string, count int) string {
+	return strings.TrimSuffix(strings.Repeat(placeholder+", ", count), ", ")
+}
+
+// unixMilli returns t as the number of milliseconds elapsed since the Unix epoch.
+func unixMilli(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// numericValue returns the number a tag value represents, for sorting, or nil if it isn't a decimal number.
+func numericValue(tagValue string) interface{} {
+	number, err := strconv.ParseFloat(tagValue, 64)
+	if err != nil || math.IsInf(number, 0) || math.IsNaN(number) {
+		return nil
+	}
+
+	return number
+}
+
+// inTransaction runs fn in a transaction, which is committed if fn succeeds and rolled back otherwise.
+// The transaction is also rolled back if ctx is done before it's committed.
+// Transactions that write to the same tables can deadlock, e.g. because InnoDB locks the gaps around keys that are
+// looked up but don't exist, so the transaction is run again, in full, if MySQL rolls it back because of a deadlock or
+// a statement times out waiting for a lock, up to maxTransactionAttempts times in all.
+func (s *store) inTransaction(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	for attempt := 1; ; attempt++ {
+		err := s.runTransaction(ctx, fn)
+		if err == nil || attempt == maxTransactionAttempts || !isLockError(err) {
+			return err
 		}
 
-		return fmt.Errorf("failed to get tag map: %w", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(time.Duration(attempt) * transactionRetryDelay):
+		}
 	}
+}
+
+// isLockError returns whether err means a transaction was rolled back because of a deadlock, or a statement timed
+// out waiting for a lock.
+func isLockError(err error) bool {
+	var mysqlErr *mysqldriver.MySQLError
 
-	for _, tagNameToKeys := range tagMap {
-		delete(tagNameToKeys, keyToRemove)
+	return errors.As(err, &mysqlErr) &&
+		(mysqlErr.Number == deadlockErrCode || mysqlErr.Number == lockWaitTimeoutErrCode)
+}
+
+func (s *store) runTransaction(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf(failureWhileBeginningTransactionErrMsg, err)
 	}
 
-	tagMapBytes, err := json.Marshal(tagMap)
+	err = fn(tx)
 	if err != nil {
-		return fmt.Errorf("failed to marshal updated tag map: %w", err)
+		if errRollback := tx.Rollback(); errRollback != nil {
+			return fmt.Errorf("%w (rollback also failed: %s)", err, errRollback.Error())
+		}
+
+		return err
 	}
 
-	err = s.Put(tagMapKey, tagMapBytes)
+	err = tx.Commit()
 	if err != nil {
-		return fmt.Errorf("failed to put updated tag map back into the store: %w", err)
+		return fmt.Errorf(failureWhileCommittingTransactionErrMsg, err)
 	}
 
 	return nil
 }
 
-func (s *store) getDatabaseKeysMatchingQuery(expressionTagName, expressionTagValue string) ([]string, error) {
-	tagMap, err := s.getTagMap(false)
+func (s *store) getDBEntry(ctx context.Context, querier rowQuerier, key string) (dbEntry, error) {
+	if key == "" {
+		return dbEntry{}, ErrKeyRequired
+	}
+
+	var retrievedDBEntryBytes []byte
+
+	var version int64
+
+	// select query to fetch the record by key, unless it has expired
+	err := querier.QueryRowContext(ctx, "SELECT `value`, `version` FROM "+s.tableName+" "+
+		" WHERE `key` = ? AND "+notExpiredFilter("`expires_at`"), key, unixMilli(time.Now())).
+		Scan(&retrievedDBEntryBytes, &version)
 	if err != nil {
-		// If there's no tag map, then this means that tags have never been used, and therefore no matching results.
-		if errors.Is(err, storage.ErrDataNotFound) {
-			return nil, nil
+		if strings.Contains(err.Error(), valueNotFoundErrMsgFromMySQL) {
+			return dbEntry{}, storage.ErrDataNotFound
 		}
 
-		return nil, fmt.Errorf("failed to get tag map: %w", err)
+		return dbEntry{}, fmt.Errorf(failureWhileQueryingRowErrMsg, err)
 	}
 
-	if expressionTagValue == "" {
-		return getDatabaseKeysMatchingTagName(tagMap, expressionTagName), nil
-	}
+	var retrievedDBEntry dbEntry
 
-	matchingDatabaseKeys, err := s.getDatabaseKeysMatchingTagNameAndValue(tagMap, expressionTagName, expressionTagValue)
+	err = json.Unmarshal(retrievedDBEntryBytes, &retrievedDBEntry)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get database keys matching tag name and value: %w", err)
+		return dbEntry{}, fmt.Errorf("failed to unmarshaled retrieved DB entry: %w", err)
 	}
 
-	return matchingDatabaseKeys, nil
-}
-
-func (s *store) getDatabaseKeysMatchingTagNameAndValue(tagMap tagMapping,
-	expressionTagName, expressionTagValue string) ([]string, error) {
-	var matchingDatabaseKeys []string
+	retrievedDBEntry.version = version
 
-	for tagName, databaseKeysSet := range tagMap {
-		if tagName == expressionTagName {
-			for databaseKey := range databaseKeysSet {
-				tags, err := s.GetTags(databaseKey)
-				if err != nil {
-					return nil, fmt.Errorf("failed to get tags: %w", err)
-				}
-
-				for _, tag := range tags {
-					if tag.Name == expressionTagName && tag.Value == expressionTagValue {
-						matchingDatabaseKeys = append(matchingDatabaseKeys, databaseKey)
+	return retrievedDBEntry, nil
+}
 
-						break
-					}
-				}
-			}
+type iterator struct {
+	ctx        context.Context
+	store      *store
+	query      string
+	args       []interface{}
+	pageSize   int
+	offset     int
+	rows       *sql.Rows
+	pageRows   int
+	countQuery string
+	countArgs  []interface{}
+	current    *dbEntry
+	currentKey string
+}
 
-			break
-		}
+// fetchPage runs the query for the page of results starting at the iterator's offset.
+func (i *iterator) fetchPage() error {
+	rows, err := i.store.db.QueryContext(i.ctx, i.query+" LIMIT ? OFFSET ?", append(i.args, i.pageSize, i.offset)...)
+	if err != nil {
+		return fmt.Errorf(failureWhileQueryingRowsErrMsg, err)
 	}
 
-	return matchingDatabaseKeys, nil
-}
+	i.rows = rows
+	i.pageRows = 0
 
-type iterator struct {
-	keys         []string
-	currentIndex int
-	currentKey   string
-	store        *store
+	return nil
 }
 
 func (i *iterator) Next() (bool, error) {
-	if len(i.keys) == i.currentIndex || len(i.keys) == 0 {
-		if len(i.keys) == i.currentIndex || len(i.keys) == 0 {
+	i.current = nil
+
+	for !i.rows.Next() {
+		err := i.rows.Err()
+		if err != nil {
+			return false, fmt.Errorf(failureWhileQueryingRowsErrMsg, err)
+		}
+
+		// A page with fewer rows than the page size is the last one.
+		if i.pageRows < i.pageSize {
 			return false, nil
 		}
+
+		err = i.rows.Close()
+		if err != nil {
+			return false, fmt.Errorf("failed to close result rows before fetching new page: %w", err)
+		}
+
+		i.offset += i.pageSize
+
+		err = i.fetchPage()
+		if err != nil {
+			return false, err
+		}
 	}
 
-	i.currentKey = i.keys[i.currentIndex]
+	i.pageRows++
+
+	key, entry, err := scanEntry(i.rows)
+	if err != nil {
+		return false, err
+	}
 
-	i.currentIndex++
+	i.currentKey = key
+	i.current = entry
 
 	return true, nil
 }
 
 func (i *iterator) Key() (string, error) {
+	if i.current == nil {
+		return "", errNoCurrentEntry
+	}
+
 	return i.currentKey, nil
 }
 
 func (i *iterator) Value() ([]byte, error) {
-	value, err := i.store.Get(i.currentKey)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get value from store: %w", err)
+	if i.current == nil {
+		return nil, errNoCurrentEntry
 	}
 
-	return value, nil
+	return i.current.Value, nil
 }
 
 func (i *iterator) Tags() ([]storage.Tag, error) {
-	tags, err := i.store.GetTags(i.currentKey)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get tags from store: %w", err)
+	if i.current == nil {
+		return nil, errNoCurrentEntry
 	}
 
-	return tags, nil
+	return i.current.Tags, nil
 }
 
 func (i *iterator) TotalItems() (int, error) {
-	return len(i.keys), nil
+	var count int
+
+	err := i.store.db.QueryRowContext(i.ctx, i.countQuery, i.countArgs...).Scan(&count)
+	if err != nil {
+		return -1, fmt.Errorf(failureWhileQueryingRowErrMsg, err)
+	}
+
+	return count, nil
 }
 
 func (i *iterator) Close() error {
-	return nil
+	return i.rows.Close()
+}
+
+// collectValues reads the values of all the rows by key.
+func collectValues(rows *sql.Rows) (map[string][]byte, error) {
+	valuesByKey := make(map[string][]byte)
+
+	for rows.Next() {
+		key, entry, err := scanEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		valuesByKey[key] = entry.Value
+	}
+
+	err := rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf(failureWhileQueryingRowsErrMsg, err)
+	}
+
+	return valuesByKey, nil
+}
+
+// scanEntry reads the key and DB entry from the current row of rows.
+func scanEntry(rows *sql.Rows) (string, *dbEntry, error) {
+	var key string
+
+	var entryBytes []byte
+
+	err := rows.Scan(&key, &entryBytes)
+	if err != nil {
+		return "", nil, fmt.Errorf(failureWhileQueryingRowsErrMsg, err)
+	}
+
+	var entry dbEntry
+
+	err = json.Unmarshal(entryBytes, &entry)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to unmarshal retrieved DB entry: %w", err)
+	}
+
+	return key, &entry, nil
 }
 
 func validatePutInput(key string, value []byte, tags []storage.Tag) error {
@@ -711,24 +1363,87 @@ func validatePutInput(key string, value []byte, tags []storage.Tag) error {
 		if strings.Contains(tag.Value, ":") {
 			return fmt.Errorf(invalidTagValue, tag.Value)
 		}
+
+		if utf8.RuneCountInString(tag.Name) > maxTagLength {
+			return fmt.Errorf(tagNameTooLong, tag.Name)
+		}
+
+		if utf8.RuneCountInString(tag.Value) > maxTagLength {
+			return fmt.Errorf(tagValueTooLong, tag.Value)
+		}
 	}
 
 	return nil
 }
 
-func checkForUnsupportedQueryOptions(options []storage.QueryOption) error {
-	querySettings := getQueryOptions(options)
+// tagCondition is a condition on a tag, as found in a query expression. A blank operator means that the tag only
+// needs to exist.
+type tagCondition struct {
+	name     string
+	operator string
+	value    string
+}
+
+// parseQueryExpression splits expression into terms joined by ||, each of which is a list of tag conditions joined
+// by &&.
+func parseQueryExpression(expression string) ([][]tagCondition, error) {
+	if expression == "" {
+		return nil, fmt.Errorf(invalidQueryExpressionFormat, expression)
+	}
+
+	var disjunction [][]tagCondition
+
+	for _, conjunctionExpression := range strings.Split(expression, "||") {
+		var conjunction []tagCondition
+
+		for _, conditionExpression := range strings.Split(conjunctionExpression, "&&") {
+			condition, ok := parseTagCondition(conditionExpression)
+			if !ok {
+				return nil, fmt.Errorf(invalidQueryExpressionFormat, expression)
+			}
+
+			conjunction = append(conjunction, condition)
+		}
+
+		disjunction = append(disjunction, conjunction)
+	}
+
+	return disjunction, nil
+}
+
+// parseTagCondition parses a condition in one of the formats TagName, TagName:TagValue, TagName:TagValuePrefix*,
+// TagName<TagValue, TagName<=TagValue, TagName>TagValue or TagName>=TagValue. It returns false if conditionExpression
+// isn't in any of these formats.
+func parseTagCondition(conditionExpression string) (tagCondition, bool) {
+	operatorIndex := strings.IndexAny(conditionExpression, ":<>")
+	if operatorIndex == -1 {
+		return tagCondition{name: conditionExpression}, conditionExpression != ""
+	}
 
-	if querySettings.InitialPageNum != 0 {
-		return errors.New("mySQL provider does not currently support " +
-			"setting the initial page number of query results")
+	condition := tagCondition{
+		name:     conditionExpression[:operatorIndex],
+		operator: conditionExpression[operatorIndex : operatorIndex+1],
+		value:    conditionExpression[operatorIndex+1:],
 	}
 
-	if querySettings.SortOptions != nil {
-		return errors.New("mySQL provider does not currently support custom sort options for query results")
+	switch {
+	case condition.operator != equalsOperator:
+		if strings.HasPrefix(condition.value, "=") {
+			condition.operator += "="
+			condition.value = condition.value[1:]
+		}
+
+		if condition.value == "" {
+			return condition, false
+		}
+	case strings.HasSuffix(condition.value, "*"):
+		condition.operator = prefixOperator
+		condition.value = strings.TrimSuffix(condition.value, "*")
+	case condition.value == "":
+		condition.operator = ""
 	}
 
-	return nil
+	return condition, condition.name != "" && !strings.Contains(condition.value, ":")
 }
 
 func getQueryOptions(options []storage.QueryOption) storage.QueryOptions {
@@ -738,21 +1453,13 @@ func getQueryOptions(options []storage.QueryOption) storage.QueryOptions {
 		option(&queryOptions)
 	}
 
-	return queryOptions
-}
-
-func getDatabaseKeysMatchingTagName(tagMap tagMapping, expressionTagName string) []string {
-	var matchingDatabaseKeys []string
-
-	for tagName, databaseKeysSet := range tagMap {
-		if tagName == expressionTagName {
-			for databaseKey := range databaseKeysSet {
-				matchingDatabaseKeys = append(matchingDatabaseKeys, databaseKey)
-			}
+	if queryOptions.PageSize < 1 {
+		queryOptions.PageSize = defaultPageSize
+	}
 
-			break
-		}
+	if queryOptions.InitialPageNum < 0 {
+		queryOptions.InitialPageNum = 0
 	}
 
-	return matchingDatabaseKeys
+	return queryOptions
 }
@@ -7,9 +7,13 @@ SPDX-License-Identifier: Apache-2.0
 package mysql
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"fmt"
 	"testing"
 
+	mysqldriver "github.com/go-sql-driver/mysql"
 	"github.com/stretchr/testify/require"
 )
 
@@ -24,3 +28,57 @@ func TestStore_OpenStore_Internal(t *testing.T) {
 		"Access denied for user 'root'@'172.17.0.1' (using password: YES)")
 	require.Nil(t, store)
 }
+
+func TestStore_InTransaction_Internal(t *testing.T) {
+	db, err := sql.Open("mysql", "root:my-secret-pw@tcp(127.0.0.1:3301)/")
+	require.NoError(t, err)
+
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	s := &store{db: db}
+
+	t.Run("Deadlocks and lock wait timeouts are retried", func(t *testing.T) {
+		var attempts int
+
+		err := s.inTransaction(context.Background(), func(tx *sql.Tx) error {
+			attempts++
+
+			switch attempts {
+			case 1:
+				return fmt.Errorf("failure while updating tags: %w", &mysqldriver.MySQLError{Number: deadlockErrCode})
+			case 2:
+				return &mysqldriver.MySQLError{Number: lockWaitTimeoutErrCode}
+			default:
+				return nil
+			}
+		})
+		require.NoError(t, err)
+		require.Equal(t, 3, attempts)
+	})
+	t.Run("Retries are limited", func(t *testing.T) {
+		var attempts int
+
+		deadlock := &mysqldriver.MySQLError{Number: deadlockErrCode}
+
+		err := s.inTransaction(context.Background(), func(tx *sql.Tx) error {
+			attempts++
+
+			return deadlock
+		})
+		require.True(t, errors.Is(err, deadlock), "unexpected error or no error")
+		require.Equal(t, maxTransactionAttempts, attempts)
+	})
+	t.Run("Other errors aren't retried", func(t *testing.T) {
+		var attempts int
+
+		err := s.inTransaction(context.Background(), func(tx *sql.Tx) error {
+			attempts++
+
+			return &mysqldriver.MySQLError{Number: duplicateEntryErrCode}
+		})
+		require.Error(t, err)
+		require.Equal(t, 1, attempts)
+	})
+}
@@ -6,11 +6,15 @@ SPDX-License-Identifier: Apache-2.0
 package mysql_test
 
 import (
+	"context"
 	"database/sql"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"log"
 	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -31,6 +35,29 @@ type mysqlLogger struct{}
 // Print ignores MySQL logs.
 func (*mysqlLogger) Print(...interface{}) {}
 
+type stringLogger struct {
+	log  string
+	lock sync.Mutex
+}
+
+func (s *stringLogger) Infof(msg string, args ...interface{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.log += fmt.Sprintf(msg, args...)
+}
+
+func (s *stringLogger) Warnf(msg string, args ...interface{}) {
+	s.Infof(msg, args...)
+}
+
+func (s *stringLogger) String() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.log
+}
+
 const (
 	dockerMySQLImage = "mysql"
 	dockerMySQLTag   = "8.0.20"
@@ -175,23 +202,6 @@ func TestSQLDBStore(t *testing.T) {
 	})
 }
 
-func TestNotImplementedMethods(t *testing.T) {
-	t.Run("Not implemented methods", func(t *testing.T) {
-		prov, err := NewProvider(sqlStoreDBURL)
-		require.NoError(t, err)
-
-		require.Panics(t, func() {
-			prov.GetOpenStores()
-		})
-
-		store, err := prov.OpenStore("storename")
-		require.NoError(t, err)
-
-		_, err = store.GetBulk()
-		require.EqualError(t, err, "not implemented")
-	})
-}
-
 func TestSqlDBProvider_GetStoreConfig(t *testing.T) {
 	t.Run("Fail to get store configuration", func(t *testing.T) {
 		provider, err := NewProvider(sqlStoreDBURL)
@@ -210,72 +220,251 @@ func TestSqlDBProvider_GetStoreConfig(t *testing.T) {
 	})
 }
 
+func TestSqlDBProvider_ConnectionPool(t *testing.T) {
+	provider, err := NewProvider(sqlStoreDBURL, WithMaxOpenConns(1), WithMaxIdleConns(1),
+		WithConnMaxLifetime(time.Minute), WithConnMaxIdleTime(time.Minute))
+	require.NoError(t, err)
+
+	require.Equal(t, 1, provider.Stats().MaxOpenConnections)
+
+	for i := 0; i < 5; i++ {
+		testStore, errOpen := provider.OpenStore(randomStoreName())
+		require.NoError(t, errOpen)
+
+		require.NoError(t, testStore.Put("key", []byte("value")))
+		require.NoError(t, testStore.Close())
+	}
+
+	// The stores share the provider's connections, so they are still limited to one.
+	require.Equal(t, 1, provider.Stats().OpenConnections)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	require.NoError(t, provider.Ping(ctx))
+	require.NoError(t, provider.Close())
+
+	err = provider.Ping(ctx)
+	require.EqualError(t, err, "failure while pinging MySQL: sql: database is closed")
+}
+
+func TestSqlDBStore_ConcurrentPuts(t *testing.T) {
+	testStore := newStore(t, randomStoreName())
+
+	const puts = 20
+
+	// Puts of new, adjacent keys lock overlapping gaps in the tag table, which can deadlock.
+	errs := make(chan error, puts)
+
+	for i := 0; i < puts; i++ {
+		go func(i int) {
+			errs <- testStore.Put(fmt.Sprintf("key%02d", i), []byte("value"),
+				storage.Tag{Name: "TagName1", Value: "TagValue1"})
+		}(i)
+	}
+
+	expectedKeys := make([]string, puts)
+
+	for i := 0; i < puts; i++ {
+		require.NoError(t, <-errs)
+
+		expectedKeys[i] = fmt.Sprintf("key%02d", i)
+	}
+
+	requireQueryKeys(t, testStore, "TagName1:TagValue1", expectedKeys...)
+}
+
 func TestSqlDBStore_Put(t *testing.T) {
-	t.Run("Fail to update tag map since the DB connection was closed", func(t *testing.T) {
+	t.Run("Fail to begin transaction since the DB connection was closed", func(t *testing.T) {
 		provider, err := NewProvider(sqlStoreDBURL)
 		require.NoError(t, err)
 
 		testStore, err := provider.OpenStore(randomStoreName())
 		require.NoError(t, err)
 
-		err = testStore.Close()
+		err = provider.Close()
 		require.NoError(t, err)
 
 		err = testStore.Put("key", []byte("value"), storage.Tag{})
-		require.EqualError(t, err, "failed to update tag map: failed to get tag map: failed to get data: "+
-			"failed to get DB entry: failure while querying row: sql: database is closed")
+		require.EqualError(t, err, "failure while beginning transaction: sql: database is closed")
 	})
-	t.Run("Fail to unmarshal tag map bytes", func(t *testing.T) {
-		provider, err := NewProvider(sqlStoreDBURL)
+	t.Run("Tags are replaced", func(t *testing.T) {
+		testStore := newStore(t, randomStoreName())
+
+		err := testStore.Put("key", []byte("value"), storage.Tag{Name: "TagName1", Value: "TagValue1"})
 		require.NoError(t, err)
 
-		testStore, err := provider.OpenStore(randomStoreName())
+		err = testStore.Put("key", []byte("value"), storage.Tag{Name: "TagName2"})
 		require.NoError(t, err)
 
-		err = testStore.Put("TagMap", []byte("Not a proper tag map"))
+		requireQueryKeys(t, testStore, "TagName1")
+		requireQueryKeys(t, testStore, "TagName2", "key")
+	})
+	t.Run("Tag values are case-sensitive", func(t *testing.T) {
+		testStore := newStore(t, randomStoreName())
+
+		err := testStore.Put("key1", []byte("value"), storage.Tag{Name: "TagName1", Value: "TagValue"},
+			storage.Tag{Name: "TagName1", Value: "tagvalue"})
 		require.NoError(t, err)
 
-		err = testStore.Put("key", []byte("value"), storage.Tag{})
-		require.EqualError(t, err, "failed to update tag map: failed to get tag map: "+
-			"failed to unmarshal tag map bytes: invalid character 'N' looking for beginning of value")
+		err = testStore.Put("key2", []byte("value"), storage.Tag{Name: "TagName1", Value: "TAGVALUE"})
+		require.NoError(t, err)
+
+		tags, err := testStore.GetTags("key1")
+		require.NoError(t, err)
+		require.ElementsMatch(t, []storage.Tag{
+			{Name: "TagName1", Value: "TagValue"}, {Name: "TagName1", Value: "tagvalue"},
+		}, tags)
+
+		requireQueryKeys(t, testStore, "TagName1:tagvalue", "key1")
+		requireQueryKeys(t, testStore, "TagName1:TAGVALUE", "key2")
+		requireQueryKeys(t, testStore, "TagName1:TAG*", "key2")
+		requireQueryKeys(t, testStore, "tagname1")
+	})
+	t.Run("Tags that are too long", func(t *testing.T) {
+		testStore := newStore(t, randomStoreName())
+
+		longString := strings.Repeat("a", 256)
+
+		err := testStore.Put("key", []byte("value"), storage.Tag{Name: longString})
+		require.EqualError(t, err, `"`+longString+`" is an invalid tag name since it's longer than 255 characters`)
+
+		err = testStore.Batch([]storage.Operation{
+			{Key: "key", Value: []byte("value"), Tags: []storage.Tag{{Name: "TagName1", Value: longString}}},
+		})
+		require.EqualError(t, err, `"`+longString+`" is an invalid tag value since it's longer than 255 characters`)
+
+		err = testStore.Put("key", []byte("value"), storage.Tag{Name: "TagName1", Value: strings.Repeat("é", 255)})
+		require.NoError(t, err)
 	})
 }
 
 func TestSqlDBStore_Query(t *testing.T) {
-	t.Run("Fail to get tag map since the DB connection was closed", func(t *testing.T) {
+	t.Run("Fail to query since the DB connection was closed", func(t *testing.T) {
 		provider, err := NewProvider(sqlStoreDBURL)
 		require.NoError(t, err)
 
 		testStore, err := provider.OpenStore(randomStoreName())
 		require.NoError(t, err)
 
-		err = testStore.Close()
+		err = provider.Close()
 		require.NoError(t, err)
 
 		itr, err := testStore.Query("expression")
-		require.EqualError(t, err, "failed to get database keys matching query: failed to get tag map: "+
-			"failed to get data: failed to get DB entry: failure while querying row: sql: database is closed")
+		require.EqualError(t, err, "failure while querying rows: sql: database is closed")
 		require.Nil(t, itr)
 	})
-	t.Run("Not supported options", func(t *testing.T) {
-		provider, err := NewProvider(sqlStoreDBURL)
-		require.NoError(t, err)
+}
 
-		store, err := provider.OpenStore("TestStore")
-		require.NoError(t, err)
+func TestSqlDBStore_QueryWithBooleanExpressions(t *testing.T) {
+	provider, err := NewProvider(sqlStoreDBURL)
+	require.NoError(t, err)
+
+	defer func() {
+		require.NoError(t, provider.Close())
+	}()
+
+	testStore, err := provider.OpenStore(randomStoreName())
+	require.NoError(t, err)
+
+	require.NoError(t, testStore.Put("key1", []byte("value1"),
+		storage.Tag{Name: "TagName1", Value: "TagValue1"}, storage.Tag{Name: "TagName2", Value: "2"}))
+	require.NoError(t, testStore.Put("key2", []byte("value2"),
+		storage.Tag{Name: "TagName1", Value: "TagValue1"}, storage.Tag{Name: "TagName2", Value: "10"}))
+	require.NoError(t, testStore.Put("key3", []byte("value3"), storage.Tag{Name: "TagName1", Value: "TagValue3"}))
+	require.NoError(t, testStore.Put("key4", []byte("value4"), storage.Tag{Name: "TagName3"}))
+
+	t.Run("Valid expressions", func(t *testing.T) {
+		requireQueryKeys(t, testStore, "TagName1:TagValue1&&TagName2:2", "key1")
+		requireQueryKeys(t, testStore, "TagName1:TagValue1&&TagName2", "key1", "key2")
+		requireQueryKeys(t, testStore, "TagName1:TagValue1||TagName1:TagValue3", "key1", "key2", "key3")
+		requireQueryKeys(t, testStore, "TagName2:10||TagName3", "key2", "key4")
+		requireQueryKeys(t, testStore, "TagName1:TagValue3||TagName1&&TagName2:2", "key1", "key3")
+		requireQueryKeys(t, testStore, "TagName1:TagValue3&&TagName2")
+	})
+	t.Run("Sorted and counted", func(t *testing.T) {
+		itr, errQuery := testStore.Query("TagName2||TagName3", storage.WithSortOrder(&storage.SortOptions{
+			Order:   storage.SortDescending,
+			TagName: "TagName2",
+		}))
+		require.NoError(t, errQuery)
+
+		var keys []string
+
+		for {
+			more, errNext := itr.Next()
+			require.NoError(t, errNext)
+
+			if !more {
+				break
+			}
 
-		iterator, err := store.Query("TagName:TagValue", storage.WithInitialPageNum(1))
-		require.EqualError(t, err, "mySQL provider does not currently support "+
-			"setting the initial page number of query results")
-		require.Nil(t, iterator)
+			key, errKey := itr.Key()
+			require.NoError(t, errKey)
 
-		iterator, err = store.Query("TagName:TagValue", storage.WithSortOrder(&storage.SortOptions{}))
-		require.EqualError(t, err, "mySQL provider does not currently support custom sort options for "+
-			"query results")
-		require.Nil(t, iterator)
+			keys = append(keys, key)
+		}
+
+		require.Equal(t, []string{"key2", "key1", "key4"}, keys)
+
+		count, errTotalItems := itr.TotalItems()
+		require.NoError(t, errTotalItems)
+		require.Equal(t, 3, count)
+		require.NoError(t, itr.Close())
+	})
+	t.Run("Invalid expressions", func(t *testing.T) {
+		for _, expression := range []string{
+			"TagName1&&", "||TagName1", "TagName1:TagValue1&&:TagValue2", "TagName1<", "TagName1>=TagValue1:TagValue2",
+		} {
+			itr, errQuery := testStore.Query(expression)
+			require.EqualError(t, errQuery, `"`+expression+`" is not in a valid expression format. `+
+				"it must be in the following format: TagName:TagValue, optionally combined with others using && and ||")
+			require.Nil(t, itr)
+		}
 	})
 }
 
+func TestSqlDBStore_QueryWithRangesAndPrefixes(t *testing.T) {
+	provider, err := NewProvider(sqlStoreDBURL)
+	require.NoError(t, err)
+
+	defer func() {
+		require.NoError(t, provider.Close())
+	}()
+
+	testStore, err := provider.OpenStore(randomStoreName())
+	require.NoError(t, err)
+
+	require.NoError(t, testStore.Put("key1", []byte("value1"),
+		storage.Tag{Name: "expiry", Value: "1600000000"}, storage.Tag{Name: "type", Value: "credential-vc"}))
+	require.NoError(t, testStore.Put("key2", []byte("value2"),
+		storage.Tag{Name: "expiry", Value: "1700000000"}, storage.Tag{Name: "type", Value: "credential_vp"}))
+	require.NoError(t, testStore.Put("key3", []byte("value3"),
+		storage.Tag{Name: "expiry", Value: "900000000.5"}, storage.Tag{Name: "type", Value: "did%document"}))
+	require.NoError(t, testStore.Put("key4", []byte("value4"),
+		storage.Tag{Name: "expiry", Value: "never"}, storage.Tag{Name: "type", Value: "didxdocument"}))
+
+	// 900000000.5 is less than 1700000000 as a number, but not lexicographically.
+	requireQueryKeys(t, testStore, "expiry<=1700000000", "key1", "key2", "key3")
+	requireQueryKeys(t, testStore, "expiry<1700000000", "key1", "key3")
+	requireQueryKeys(t, testStore, "expiry>1000000000", "key1", "key2")
+	requireQueryKeys(t, testStore, "expiry>=1700000000.5")
+	requireQueryKeys(t, testStore, "expiry>m", "key4")
+	requireQueryKeys(t, testStore, "type:credential*", "key1", "key2")
+	// The LIKE wildcards in prefixes are matched literally.
+	requireQueryKeys(t, testStore, "type:credential_*", "key2")
+	requireQueryKeys(t, testStore, "type:did%*", "key3")
+	requireQueryKeys(t, testStore, "type:credential*&&expiry<1700000000||type:didx*", "key1", "key4")
+
+	itr, err := testStore.Query("type:credential*")
+	require.NoError(t, err)
+
+	count, err := itr.TotalItems()
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+	require.NoError(t, itr.Close())
+}
+
 func TestSqlDBIterator(t *testing.T) {
 	provider, err := NewProvider(sqlStoreDBURL)
 	require.NoError(t, err)
@@ -291,16 +480,29 @@ func TestSqlDBIterator(t *testing.T) {
 	itr, err := testStore.Query("expression")
 	require.NoError(t, err)
 
-	t.Run("Fail to get value from store", func(t *testing.T) {
+	t.Run("Fail to get key before Next", func(t *testing.T) {
+		key, errKey := itr.Key()
+		require.EqualError(t, errKey, "iterator has no current entry")
+		require.Empty(t, key)
+	})
+	t.Run("Fail to get value before Next", func(t *testing.T) {
 		value, errValue := itr.Value()
-		require.EqualError(t, errValue, "failed to get value from store: failed to get DB entry: key is mandatory")
+		require.EqualError(t, errValue, "iterator has no current entry")
 		require.Nil(t, value)
 	})
-	t.Run("Fail to get tags from store", func(t *testing.T) {
+	t.Run("Fail to get tags before Next", func(t *testing.T) {
 		tags, errGetTags := itr.Tags()
-		require.EqualError(t, errGetTags, "failed to get tags from store: failed to get DB entry: key is mandatory")
+		require.EqualError(t, errGetTags, "iterator has no current entry")
 		require.Nil(t, tags)
 	})
+	t.Run("Fail to get total items since the DB connection was closed", func(t *testing.T) {
+		require.NoError(t, itr.Close())
+		require.NoError(t, provider.Close())
+
+		count, errTotal := itr.TotalItems()
+		require.EqualError(t, errTotal, "failure while querying row: sql: database is closed")
+		require.Equal(t, -1, count)
+	})
 }
 
 func TestSqlDBStore_Common(t *testing.T) {
@@ -314,8 +516,11 @@ func TestSqlDBStore_Common(t *testing.T) {
 		commontest.TestStoreQuery(t, provider)
 		commontest.TestStoreDelete(t, provider)
 		commontest.TestStoreClose(t, provider)
-		commontest.TestProviderClose(t, provider)
 		commontest.TestStoreBatch(t, provider)
+		commontest.TestStoreGetBulk(t, provider)
+		commontest.TestStoreQueryWithSortingAndInitialPageOptions(t, provider)
+		commontest.TestProviderGetOpenStores(t, provider)
+		commontest.TestProviderClose(t, provider)
 	})
 	t.Run("With prefix", func(t *testing.T) {
 		provider, err := NewProvider(sqlStoreDBURL, WithDBPrefix("db-prefix-"))
@@ -327,8 +532,11 @@ func TestSqlDBStore_Common(t *testing.T) {
 		commontest.TestStoreQuery(t, provider)
 		commontest.TestStoreDelete(t, provider)
 		commontest.TestStoreClose(t, provider)
-		commontest.TestProviderClose(t, provider)
 		commontest.TestStoreBatch(t, provider)
+		commontest.TestStoreGetBulk(t, provider)
+		commontest.TestStoreQueryWithSortingAndInitialPageOptions(t, provider)
+		commontest.TestProviderGetOpenStores(t, provider)
+		commontest.TestProviderClose(t, provider)
 	})
 }
 
@@ -340,95 +548,381 @@ func TestSqlDBStore_Batch(t *testing.T) {
 		require.Equal(t, err.Error(), "key cannot be empty")
 	})
 
-	t.Run("error removing key from tagMap", func(t *testing.T) {
-		storeName := randomStoreName()
-		s := newStore(t, storeName)
+	t.Run("tags are replaced and removed", func(t *testing.T) {
+		s := newStore(t, randomStoreName())
 
-		db, err := sql.Open("mysql", sqlStoreDBURL)
+		err := s.Batch([]storage.Operation{
+			{Key: "key1", Value: []byte("value"), Tags: []storage.Tag{{Name: "TagName1", Value: "TagValue1"}}},
+			{Key: "key2", Value: []byte("value"), Tags: []storage.Tag{{Name: "TagName1", Value: "TagValue1"}}},
+		})
+		require.NoError(t, err)
+
+		requireQueryKeys(t, s, "TagName1:TagValue1", "key1", "key2")
+
+		err = s.Batch([]storage.Operation{
+			{Key: "key1", Value: []byte("value"), Tags: []storage.Tag{{Name: "TagName2"}}},
+			{Key: "key2"},
+		})
+		require.NoError(t, err)
+
+		requireQueryKeys(t, s, "TagName1:TagValue1")
+		requireQueryKeys(t, s, "TagName2", "key1")
+	})
+
+	t.Run("DSN without multiStatements or interpolateParams", func(t *testing.T) {
+		provider, err := NewProvider("root:my-secret-pw@tcp(127.0.0.1:3301)/")
+		require.NoError(t, err)
+
+		defer func() {
+			require.NoError(t, provider.Close())
+		}()
+
+		s, err := provider.OpenStore(randomStoreName())
 		require.NoError(t, err)
 
-		_, err = db.Exec(
-			fmt.Sprintf("INSERT INTO `%s`.`%s` VALUES (?,?)", storeName, storeName),
-			"TagMap", []byte("{"),
-		)
+		err = s.Batch([]storage.Operation{
+			{Key: "key1", Value: []byte("value"), Tags: []storage.Tag{{Name: "TagName1", Value: "TagValue1"}}},
+			{Key: "key2", Value: []byte("value"), Tags: []storage.Tag{{Name: "TagName1", Value: "TagValue1"}}},
+			{Key: "key1"},
+		})
+		require.NoError(t, err)
+
+		requireQueryKeys(t, s, "TagName1:TagValue1", "key2")
+	})
+
+	t.Run("failed batch is rolled back", func(t *testing.T) {
+		s := newStore(t, randomStoreName())
+
+		err := s.Put("key1", []byte("value"), storage.Tag{Name: "TagName1"})
 		require.NoError(t, err)
 
-		err = s.Batch([]storage.Operation{{
-			Key:   "test",
-			Value: nil,
-			Tags: []storage.Tag{{
-				Name:  "test",
-				Value: "value",
-			}},
-		}})
+		// The key is too long for the key column, so the second upsert fails.
+		err = s.Batch([]storage.Operation{
+			{Key: "key1"},
+			{Key: "key2", Value: []byte("value"), Tags: []storage.Tag{{Name: "TagName1"}}},
+			{Key: strings.Repeat("k", 300), Value: []byte("value")},
+		})
 		require.Error(t, err)
-		require.Contains(t, err.Error(), "failed to remove key from tag map")
+		require.Contains(t, err.Error(), "failure while executing batch upsert on table")
+
+		value, err := s.Get("key1")
+		require.NoError(t, err)
+		require.Equal(t, []byte("value"), value)
+
+		_, err = s.Get("key2")
+		require.True(t, errors.Is(err, storage.ErrDataNotFound), "unexpected error or no error")
+
+		requireQueryKeys(t, s, "TagName1", "key1")
 	})
 
-	t.Run("error removing key from tagMap", func(t *testing.T) {
+	t.Run("operations spanning several statements", func(t *testing.T) {
+		s := newStore(t, randomStoreName())
+
+		var operations []storage.Operation
+
+		for i := 0; i < 250; i++ {
+			operations = append(operations, storage.Operation{
+				Key:   fmt.Sprintf("key%d", i),
+				Value: []byte("value"),
+				Tags:  []storage.Tag{{Name: "TagName1"}},
+			})
+		}
+
+		// Deleting then putting the same key again in a later operation keeps the key.
+		operations = append(operations, storage.Operation{Key: "key0"}, storage.Operation{Key: "key1"},
+			storage.Operation{Key: "key0", Value: []byte("updated value")})
+
+		require.NoError(t, s.Batch(operations))
+
+		value, err := s.Get("key0")
+		require.NoError(t, err)
+		require.Equal(t, []byte("updated value"), value)
+
+		_, err = s.Get("key1")
+		require.True(t, errors.Is(err, storage.ErrDataNotFound), "unexpected error or no error")
+
+		itr, err := s.Query("TagName1")
+		require.NoError(t, err)
+
+		count, err := itr.TotalItems()
+		require.NoError(t, err)
+		require.Equal(t, 248, count)
+		require.NoError(t, itr.Close())
+	})
+}
+
+func TestSqlDBStore_GetBulk(t *testing.T) {
+	t.Run("Fail to query since the DB connection was closed", func(t *testing.T) {
+		provider, err := NewProvider(sqlStoreDBURL)
+		require.NoError(t, err)
+
+		testStore, err := provider.OpenStore(randomStoreName())
+		require.NoError(t, err)
+
+		require.NoError(t, provider.Close())
+
+		values, err := testStore.GetBulk("key")
+		require.EqualError(t, err, "failure while querying rows: sql: database is closed")
+		require.Nil(t, values)
+	})
+	t.Run("Fail to unmarshal DB entry", func(t *testing.T) {
 		storeName := randomStoreName()
-		s := newStore(t, storeName)
+		testStore := newStore(t, storeName)
 
 		db, err := sql.Open("mysql", sqlStoreDBURL)
 		require.NoError(t, err)
 
-		_, err = db.Exec(
-			fmt.Sprintf("INSERT INTO `%s`.`%s` VALUES (?,?)", storeName, storeName),
-			"TagMap", []byte("{"),
-		)
+		defer func() {
+			require.NoError(t, db.Close())
+		}()
+
+		_, err = db.Exec(fmt.Sprintf("INSERT INTO `%s`.`%s` (`key`, `value`) VALUES (?, ?)", storeName, storeName),
+			"key", []byte("{"))
 		require.NoError(t, err)
 
-		err = s.Batch([]storage.Operation{{
-			Key:   "test",
-			Value: []byte("value"),
-			Tags: []storage.Tag{{
-				Name:  "test",
-				Value: "value",
-			}},
-		}})
-		require.Error(t, err)
-		require.Contains(t, err.Error(), "failed to update tag map")
+		values, err := testStore.GetBulk("key")
+		require.EqualError(t, err, "failed to unmarshal retrieved DB entry: unexpected end of JSON input")
+		require.Nil(t, values)
 	})
 }
 
-func TestEnsureTagMapIsOnlyCreatedWhenNeeded(t *testing.T) {
-	provider, err := NewProvider(sqlStoreDBURL)
+func TestSqlDBIterator_Paging(t *testing.T) {
+	testStore := newStore(t, randomStoreName())
+
+	for i := 0; i < 5; i++ {
+		err := testStore.Put(fmt.Sprintf("key%d", i), []byte("value"), storage.Tag{Name: "TagName"})
+		require.NoError(t, err)
+	}
+
+	itr, err := testStore.Query("TagName", storage.WithPageSize(2), storage.WithInitialPageNum(1))
 	require.NoError(t, err)
 
-	// We defer creating the tag map entry until we actually have to. This saves on space if a client does not need
-	// to use tags + querying. The only thing that should cause the tag map entry to be created is if a Put is done
-	// with tags.
+	defer func() {
+		require.NoError(t, itr.Close())
+	}()
+
+	var keys []string
 
-	testStore, err := provider.OpenStore("TestStore")
+	for {
+		more, errNext := itr.Next()
+		require.NoError(t, errNext)
+
+		if !more {
+			break
+		}
+
+		key, errKey := itr.Key()
+		require.NoError(t, errKey)
+
+		keys = append(keys, key)
+	}
+
+	require.Equal(t, []string{"key2", "key3", "key4"}, keys)
+
+	count, err := itr.TotalItems()
+	require.NoError(t, err)
+	require.Equal(t, 5, count)
+}
+
+func TestTagMapMigration(t *testing.T) {
+	storeName := randomStoreName()
+
+	db, err := sql.Open("mysql", sqlStoreDBURL)
 	require.NoError(t, err)
 
-	err = provider.SetStoreConfig("TestStore", storage.StoreConfiguration{TagNames: []string{"TagName1"}})
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	// Create the table the way earlier versions of the provider did, without the expiry column.
+	_, err = db.Exec(fmt.Sprintf("CREATE DATABASE `%s`", storeName))
+	require.NoError(t, err)
+
+	_, err = db.Exec(fmt.Sprintf(
+		"CREATE TABLE `%s`.`%s` (`key` varchar(255) NOT NULL ,`value` BLOB, PRIMARY KEY (`key`))", storeName, storeName))
+	require.NoError(t, err)
+
+	// Write the entries the way earlier versions of the provider did, with the tags tracked by a tag map entry.
+	entry := `{"value":"dmFsdWU=","tags":[{"name":"TagName1","value":"TagValue1"},{"name":"TagName2"}]}`
+	tagMap := `{"value":"` + base64.StdEncoding.EncodeToString([]byte(`{"TagName1":{"key":{}},"TagName2":{"key":{}}}`)) +
+		`"}`
+
+	_, err = db.Exec(fmt.Sprintf("INSERT INTO `%s`.`%s` VALUES (?, ?), (?, ?)", storeName, storeName),
+		"key", []byte(entry), "TagMap", []byte(tagMap))
+	require.NoError(t, err)
+
+	// The migration runs in a transaction, which holds the only connection.
+	provider, err := NewProvider(sqlStoreDBURL, WithMaxOpenConns(1))
+	require.NoError(t, err)
+
+	testStore, err := provider.OpenStore(storeName)
 	require.NoError(t, err)
 
 	value, err := testStore.Get("TagMap")
 	require.True(t, errors.Is(err, storage.ErrDataNotFound), "unexpected error or no error")
 	require.Nil(t, value)
 
-	err = testStore.Put("Key", []byte("value"))
+	requireQueryKeys(t, testStore, "TagName1:TagValue1", "key")
+	requireQueryKeys(t, testStore, "TagName2", "key")
+
+	// The expiry and version columns were added.
+	ttlStore, ok := testStore.(TTLStore)
+	require.True(t, ok)
+
+	versionedStore, ok := testStore.(VersionedStore)
+	require.True(t, ok)
+
+	_, version, err := versionedStore.GetWithVersion("key")
 	require.NoError(t, err)
+	require.Equal(t, "0", version)
 
-	value, err = testStore.Get("TagMap")
-	require.True(t, errors.Is(err, storage.ErrDataNotFound))
-	require.Nil(t, value)
+	require.NoError(t, ttlStore.PutWithTTL("key", []byte("value"), time.Minute))
+}
+
+func TestSqlDBStore_PutWithTTL(t *testing.T) {
+	storeName := randomStoreName()
+
+	provider, err := NewProvider(sqlStoreDBURL, WithExpiredEntrySweepInterval(time.Second))
+	require.NoError(t, err)
+
+	defer func() {
+		require.NoError(t, provider.Close())
+	}()
 
-	err = testStore.Delete("Key")
+	testStore, err := provider.OpenStore(storeName)
 	require.NoError(t, err)
 
-	value, err = testStore.Get("TagMap")
+	ttlStore, ok := testStore.(TTLStore)
+	require.True(t, ok)
+
+	err = ttlStore.PutWithTTL("key1", []byte("value1"), 0)
+	require.EqualError(t, err, "ttl must be positive")
+
+	tag := storage.Tag{Name: "TagName1", Value: "TagValue1"}
+
+	require.NoError(t, ttlStore.PutWithTTL("key1", []byte("value1"), time.Second, tag))
+	require.NoError(t, ttlStore.PutWithTTL("key2", []byte("value2"), time.Second, tag))
+	require.NoError(t, ttlStore.PutWithTTL("key3", []byte("value3"), time.Second, tag))
+	require.NoError(t, ttlStore.PutWithTTL("key4", []byte("value4"), time.Hour, tag))
+
+	// Putting the key again without a TTL keeps it, whether it's put on its own or in a batch.
+	require.NoError(t, ttlStore.Put("key2", []byte("value2"), tag))
+	require.NoError(t, ttlStore.Batch([]storage.Operation{
+		{Key: "key3", Value: []byte("value3"), Tags: []storage.Tag{tag}},
+	}))
+
+	time.Sleep(time.Second)
+
+	_, err = ttlStore.Get("key1")
 	require.True(t, errors.Is(err, storage.ErrDataNotFound), "unexpected error or no error")
-	require.Nil(t, value)
 
-	err = testStore.Put("Key", []byte("value"), storage.Tag{Name: "TagName1"})
+	_, err = ttlStore.GetTags("key1")
+	require.True(t, errors.Is(err, storage.ErrDataNotFound), "unexpected error or no error")
+
+	values, err := ttlStore.GetBulk("key1", "key2", "key3", "key4")
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{nil, []byte("value2"), []byte("value3"), []byte("value4")}, values)
+
+	requireQueryKeys(t, ttlStore, "TagName1:TagValue1", "key2", "key3", "key4")
+
+	itr, err := ttlStore.Query("TagName1", storage.WithSortOrder(&storage.SortOptions{TagName: "TagName1"}))
+	require.NoError(t, err)
+
+	count, err := itr.TotalItems()
 	require.NoError(t, err)
+	require.Equal(t, 3, count)
+	require.NoError(t, itr.Close())
 
-	value, err = testStore.Get("TagMap")
+	db, err := sql.Open("mysql", sqlStoreDBURL)
+	require.NoError(t, err)
+
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	// Wait for the expired entry and its tags to be deleted.
+	err = backoff.Retry(func() error {
+		var rowCount int
+
+		errCount := db.QueryRow(fmt.Sprintf("SELECT (SELECT COUNT(*) FROM `%s`.`%s` WHERE `key` = 'key1') + "+
+			"(SELECT COUNT(*) FROM `%s`.`%s_tags` WHERE `key` = 'key1')", storeName, storeName, storeName, storeName)).
+			Scan(&rowCount)
+		if errCount != nil {
+			return backoff.Permanent(errCount)
+		}
+
+		if rowCount > 0 {
+			return errors.New("expired entry hasn't been deleted yet")
+		}
+
+		return nil
+	}, backoff.WithMaxRetries(backoff.NewConstantBackOff(time.Second), 5))
 	require.NoError(t, err)
-	require.Equal(t, `{"TagName1":{"Key":{}}}`, string(value))
+}
+
+func TestSqlDBStore_SweepFailureIsLogged(t *testing.T) {
+	storeName := randomStoreName()
+	logger := &stringLogger{}
+
+	provider, err := NewProvider(sqlStoreDBURL, WithExpiredEntrySweepInterval(100*time.Millisecond),
+		WithLogger(logger))
+	require.NoError(t, err)
+
+	defer func() {
+		require.NoError(t, provider.Close())
+	}()
+
+	_, err = provider.OpenStore(storeName)
+	require.NoError(t, err)
+
+	db, err := sql.Open("mysql", sqlStoreDBURL)
+	require.NoError(t, err)
+
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	_, err = db.Exec(fmt.Sprintf("DROP TABLE `%s`.`%s`", storeName, storeName))
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return strings.Contains(logger.String(),
+			fmt.Sprintf("[Store name: %s] Failed to delete expired entries: ", storeName))
+	}, 5*time.Second, 100*time.Millisecond)
+}
+
+// requireQueryKeys checks that the query matches exactly the expected keys.
+func requireQueryKeys(t *testing.T, s storage.Store, expression string, expectedKeys ...string) {
+	t.Helper()
+
+	itr, err := s.Query(expression)
+	require.NoError(t, err)
+
+	defer func() {
+		require.NoError(t, itr.Close())
+	}()
+
+	var keys []string
+
+	for {
+		more, errNext := itr.Next()
+		require.NoError(t, errNext)
+
+		if !more {
+			break
+		}
+
+		key, errKey := itr.Key()
+		require.NoError(t, errKey)
+
+		keys = append(keys, key)
+	}
+
+	require.ElementsMatch(t, expectedKeys, keys)
+
+	count, err := itr.TotalItems()
+	require.NoError(t, err)
+	require.Equal(t, len(expectedKeys), count)
 }
 
 func randomStoreName() string {
@@ -446,3 +940,292 @@ func newStore(t *testing.T, name string) storage.Store {
 
 	return s
 }
+
+func TestSqlDBStore_PutIfVersion(t *testing.T) {
+	testStore := newStore(t, randomStoreName())
+
+	versionedStore, ok := testStore.(VersionedStore)
+	require.True(t, ok)
+
+	version, err := versionedStore.PutIfVersion("key1", []byte("value1"), "")
+	require.NoError(t, err)
+
+	// The entry exists now.
+	_, err = versionedStore.PutIfVersion("key1", []byte("value1"), "")
+	require.True(t, errors.Is(err, ErrVersionConflict), "unexpected error or no error")
+
+	newVersion, err := versionedStore.PutIfVersion("key1", []byte("value2"), version,
+		storage.Tag{Name: "TagName1", Value: "TagValue1"})
+	require.NoError(t, err)
+	require.NotEqual(t, version, newVersion)
+
+	// The version read by another writer is now stale.
+	_, err = versionedStore.PutIfVersion("key1", []byte("value3"), version)
+	require.True(t, errors.Is(err, ErrVersionConflict), "unexpected error or no error")
+
+	_, err = versionedStore.PutIfVersion("key1", []byte("value3"), "not a version")
+	require.True(t, errors.Is(err, ErrVersionConflict), "unexpected error or no error")
+
+	value, currentVersion, err := versionedStore.GetWithVersion("key1")
+	require.NoError(t, err)
+	require.Equal(t, []byte("value2"), value)
+	require.Equal(t, newVersion, currentVersion)
+
+	requireQueryKeys(t, versionedStore, "TagName1:TagValue1", "key1")
+
+	// Any other put changes the version, whether it's put on its own or in a batch.
+	require.NoError(t, versionedStore.Put("key1", []byte("value4")))
+
+	_, err = versionedStore.PutIfVersion("key1", []byte("value3"), currentVersion)
+	require.True(t, errors.Is(err, ErrVersionConflict), "unexpected error or no error")
+
+	_, currentVersion, err = versionedStore.GetWithVersion("key1")
+	require.NoError(t, err)
+
+	require.NoError(t, versionedStore.Batch([]storage.Operation{{Key: "key1", Value: []byte("value5")}}))
+
+	_, err = versionedStore.PutIfVersion("key1", []byte("value3"), currentVersion)
+	require.True(t, errors.Is(err, ErrVersionConflict), "unexpected error or no error")
+
+	// A deleted entry, or one that has expired, counts as missing.
+	require.NoError(t, versionedStore.Delete("key1"))
+
+	_, err = versionedStore.PutIfVersion("key1", []byte("value6"), "")
+	require.NoError(t, err)
+
+	ttlStore, ok := testStore.(TTLStore)
+	require.True(t, ok)
+
+	require.NoError(t, ttlStore.PutWithTTL("key2", []byte("value"), time.Millisecond))
+
+	time.Sleep(time.Millisecond)
+
+	_, err = versionedStore.PutIfVersion("key2", []byte("value"), "")
+	require.NoError(t, err)
+
+	// The entry no longer expires.
+	time.Sleep(time.Millisecond)
+
+	_, _, err = versionedStore.GetWithVersion("key2")
+	require.NoError(t, err)
+
+	_, _, err = versionedStore.GetWithVersion("key3")
+	require.True(t, errors.Is(err, storage.ErrDataNotFound), "unexpected error or no error")
+}
+
+func TestSqlDBStore_ContextStore(t *testing.T) {
+	testStore := newStore(t, randomStoreName())
+
+	contextStore, ok := testStore.(ContextStore)
+	require.True(t, ok)
+
+	ctx := context.Background()
+
+	require.NoError(t, contextStore.PutWithContext(ctx, "key1", []byte("value1"), storage.Tag{Name: "TagName1"}))
+	require.NoError(t, contextStore.BatchWithContext(ctx, []storage.Operation{
+		{Key: "key2", Value: []byte("value2"), Tags: []storage.Tag{{Name: "TagName1"}}},
+	}))
+
+	value, err := contextStore.GetWithContext(ctx, "key1")
+	require.NoError(t, err)
+	require.Equal(t, []byte("value1"), value)
+
+	tags, err := contextStore.GetTagsWithContext(ctx, "key1")
+	require.NoError(t, err)
+	require.Equal(t, []storage.Tag{{Name: "TagName1"}}, tags)
+
+	values, err := contextStore.GetBulkWithContext(ctx, "key1", "key2")
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte("value1"), []byte("value2")}, values)
+
+	require.NoError(t, contextStore.DeleteWithContext(ctx, "key2"))
+
+	t.Run("Canceled context", func(t *testing.T) {
+		canceledCtx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		err = contextStore.PutWithContext(canceledCtx, "key1", []byte("value2"))
+		require.True(t, errors.Is(err, context.Canceled), "unexpected error or no error")
+
+		err = contextStore.BatchWithContext(canceledCtx, []storage.Operation{{Key: "key1", Value: []byte("value2")}})
+		require.True(t, errors.Is(err, context.Canceled), "unexpected error or no error")
+
+		err = contextStore.DeleteWithContext(canceledCtx, "key1")
+		require.True(t, errors.Is(err, context.Canceled), "unexpected error or no error")
+
+		_, err = contextStore.GetWithContext(canceledCtx, "key1")
+		require.True(t, errors.Is(err, context.Canceled), "unexpected error or no error")
+
+		_, err = contextStore.GetTagsWithContext(canceledCtx, "key1")
+		require.True(t, errors.Is(err, context.Canceled), "unexpected error or no error")
+
+		_, err = contextStore.GetBulkWithContext(canceledCtx, "key1")
+		require.True(t, errors.Is(err, context.Canceled), "unexpected error or no error")
+
+		_, err = contextStore.QueryWithContext(canceledCtx, "TagName1")
+		require.True(t, errors.Is(err, context.Canceled), "unexpected error or no error")
+
+		// Nothing was changed.
+		value, err = testStore.Get("key1")
+		require.NoError(t, err)
+		require.Equal(t, []byte("value1"), value)
+	})
+	t.Run("Iterator uses the query's context", func(t *testing.T) {
+		queryCtx, cancelQuery := context.WithCancel(context.Background())
+
+		iterator, errQuery := contextStore.QueryWithContext(queryCtx, "TagName1")
+		require.NoError(t, errQuery)
+
+		totalItems, errTotalItems := iterator.TotalItems()
+		require.NoError(t, errTotalItems)
+		require.Equal(t, 1, totalItems)
+
+		require.NoError(t, iterator.Close())
+
+		cancelQuery()
+
+		_, errTotalItems = iterator.TotalItems()
+		require.True(t, errors.Is(errTotalItems, context.Canceled), "unexpected error or no error")
+	})
+}
+
+func TestSqlDBStore_Watch(t *testing.T) {
+	provider, err := NewProvider(sqlStoreDBURL, WithChangeLog(time.Hour),
+		WithChangePollInterval(10*time.Millisecond))
+	require.NoError(t, err)
+
+	testStore, err := provider.OpenStore(randomStoreName())
+	require.NoError(t, err)
+
+	watchableStore, ok := testStore.(WatchableStore)
+	require.True(t, ok)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	require.NoError(t, testStore.Put("before", []byte("value")))
+
+	changes, err := watchableStore.Watch(ctx)
+	require.NoError(t, err)
+
+	defer func() {
+		require.NoError(t, changes.Close())
+	}()
+
+	require.NoError(t, testStore.Put("key1", []byte("value1"), storage.Tag{Name: "TagName1", Value: "TagValue1"}))
+	require.NoError(t, testStore.Batch([]storage.Operation{
+		{Key: "key2", Value: []byte("value2")},
+		{Key: "key1"},
+	}))
+
+	put, err := changes.Next()
+	require.NoError(t, err)
+	require.Equal(t, ChangePut, put.Type)
+	require.Equal(t, "key1", put.Key)
+	require.Equal(t, []byte("value1"), put.Value)
+	require.Equal(t, []storage.Tag{{Name: "TagName1", Value: "TagValue1"}}, put.Tags)
+
+	put, err = changes.Next()
+	require.NoError(t, err)
+	require.Equal(t, Change{Type: ChangePut, Key: "key2", Value: []byte("value2"), Checkpoint: put.Checkpoint}, put)
+
+	deletion, err := changes.Next()
+	require.NoError(t, err)
+	require.Equal(t, Change{Type: ChangeDelete, Key: "key1", Checkpoint: deletion.Checkpoint}, deletion)
+
+	t.Run("Resume from a checkpoint with a tag filter", func(t *testing.T) {
+		resumed, errWatch := watchableStore.Watch(ctx, WithCheckpoint(put.Checkpoint),
+			WithTagFilter(storage.Tag{Name: "TagName1"}))
+		require.NoError(t, errWatch)
+
+		require.NoError(t, testStore.Put("key3", []byte("value3")))
+		require.NoError(t, testStore.Put("key4", []byte("value4"), storage.Tag{Name: "TagName1"}))
+
+		change, errNext := resumed.Next()
+		require.NoError(t, errNext)
+		require.Equal(t, Change{Type: ChangeDelete, Key: "key1", Checkpoint: deletion.Checkpoint}, change)
+
+		change, errNext = resumed.Next()
+		require.NoError(t, errNext)
+		require.Equal(t, "key4", change.Key)
+		require.Equal(t, []storage.Tag{{Name: "TagName1"}}, change.Tags)
+
+		require.NoError(t, resumed.Close())
+	})
+	t.Run("Expired entries are reported as deleted", func(t *testing.T) {
+		sweepingProvider, errNew := NewProvider(sqlStoreDBURL, WithChangeLog(time.Hour),
+			WithChangePollInterval(10*time.Millisecond), WithExpiredEntrySweepInterval(100*time.Millisecond))
+		require.NoError(t, errNew)
+
+		sweptStore, errOpen := sweepingProvider.OpenStore(randomStoreName())
+		require.NoError(t, errOpen)
+
+		stream, errWatch := sweptStore.(WatchableStore).Watch(ctx)
+		require.NoError(t, errWatch)
+
+		require.NoError(t, sweptStore.(TTLStore).PutWithTTL("key", []byte("value"), time.Millisecond))
+
+		change, errNext := stream.Next()
+		require.NoError(t, errNext)
+		require.Equal(t, ChangePut, change.Type)
+
+		// Give the sweep time to run.
+		time.Sleep(500 * time.Millisecond)
+
+		change, errNext = stream.Next()
+		require.NoError(t, errNext)
+		require.Equal(t, Change{Type: ChangeDelete, Key: "key", Checkpoint: change.Checkpoint}, change)
+
+		require.NoError(t, sweepingProvider.Close())
+	})
+	t.Run("Changes deleted before being read are reported as skipped", func(t *testing.T) {
+		pruningProvider, errNew := NewProvider(sqlStoreDBURL, WithChangeLog(100*time.Millisecond),
+			WithChangePollInterval(10*time.Millisecond), WithExpiredEntrySweepInterval(100*time.Millisecond))
+		require.NoError(t, errNew)
+
+		prunedStore, errOpen := pruningProvider.OpenStore(randomStoreName())
+		require.NoError(t, errOpen)
+
+		require.NoError(t, prunedStore.Put("key1", []byte("value1")))
+
+		// Give the sweep time to delete the change.
+		time.Sleep(500 * time.Millisecond)
+
+		require.NoError(t, prunedStore.Put("key2", []byte("value2")))
+
+		stream, errWatch := prunedStore.(WatchableStore).Watch(ctx, WithCheckpoint("0"))
+		require.NoError(t, errWatch)
+
+		_, errNext := stream.Next()
+		require.True(t, errors.Is(errNext, ErrChangesSkipped), "unexpected error or no error")
+		require.Contains(t, errNext.Error(), "changes 1 to 1")
+
+		change, errNext := stream.Next()
+		require.NoError(t, errNext)
+		require.Equal(t, "key2", change.Key)
+		require.Equal(t, "2", change.Checkpoint)
+
+		require.NoError(t, pruningProvider.Close())
+	})
+	t.Run("Context done", func(t *testing.T) {
+		canceledCtx, cancelWatch := context.WithCancel(context.Background())
+
+		stream, errWatch := watchableStore.Watch(canceledCtx)
+		require.NoError(t, errWatch)
+
+		cancelWatch()
+
+		_, errNext := stream.Next()
+		require.True(t, errors.Is(errNext, context.Canceled), "unexpected error or no error")
+	})
+	t.Run("Invalid checkpoint", func(t *testing.T) {
+		_, errWatch := watchableStore.Watch(ctx, WithCheckpoint("not a number"))
+		require.EqualError(t, errWatch, "invalid checkpoint: not a number")
+	})
+	t.Run("Change log disabled", func(t *testing.T) {
+		otherStore := newStore(t, randomStoreName())
+
+		_, errWatch := otherStore.(WatchableStore).Watch(ctx)
+		require.EqualError(t, errWatch, "the change log isn't enabled, so the store can't be watched")
+	})
+}
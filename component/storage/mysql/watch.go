@@ -0,0 +1,461 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/aries-framework-go/spi/storage"
+)
+
+const (
+	createChangeTableQuery = "CREATE TABLE IF NOT EXISTS %s (`seq` bigint NOT NULL, " +
+		"`key` varchar(255) NOT NULL, `entry` BLOB NULL, `changed_at` bigint NOT NULL, PRIMARY KEY (`seq`), " +
+		"INDEX `changed_at` (`changed_at`))"
+	// The change sequence table holds a single row with the sequence number of the last change recorded in the change
+	// log. It's initialised from the change log, in case the change log was created without it.
+	createChangeSeqTableQuery = "CREATE TABLE IF NOT EXISTS %s (`id` tinyint NOT NULL, `seq` bigint NOT NULL, " +
+		"PRIMARY KEY (`id`))"
+	initChangeSeqQuery = "INSERT IGNORE INTO %s (`id`, `seq`) SELECT 1, COALESCE(MAX(`seq`), 0) FROM %s"
+
+	defaultChangePollInterval = 500 * time.Millisecond
+	changeColumns             = 4
+	// changePageSize is the maximum number of changes read from the change log by a single poll.
+	changePageSize = 100
+)
+
+// ErrChangesSkipped is returned (wrapped) by ChangeStream.Next when changes the stream hasn't read yet have already
+// been deleted from the change log, because they're older than its retention (see WithChangeLog). Calling Next again
+// continues with the changes that are still in the change log.
+var ErrChangesSkipped = errors.New("changes were deleted from the change log before they could be read")
+
+// ChangeType says what kind of change was made to an entry.
+type ChangeType int
+
+const (
+	// ChangePut is the type of the changes made by putting an entry.
+	ChangePut ChangeType = iota
+	// ChangeDelete is the type of the changes made by deleting an entry, which includes the deletion of expired
+	// entries by the Provider.
+	ChangeDelete
+)
+
+// Change describes a change made to an entry of a store.
+type Change struct {
+	Type ChangeType
+	Key  string
+	// Value and Tags are those the entry was put with. They're nil for deletions.
+	Value []byte
+	Tags  []storage.Tag
+	// Checkpoint identifies this change, which is its sequence number in the store's change log. A watch started with
+	// WithCheckpoint(Checkpoint) resumes with the changes made after this one.
+	Checkpoint string
+}
+
+// ChangeStream streams the changes made to a store's entries, in the order they were made.
+type ChangeStream interface {
+	// Next blocks until there's another change and returns it. Once the context given to Watch is done, it returns
+	// the context's error. If changes were missed because they had already been deleted from the change log, it
+	// returns ErrChangesSkipped (wrapped) once, before the changes that follow them.
+	Next() (Change, error)
+
+	// Close stops the stream.
+	Close() error
+}
+
+// WatchableStore is implemented by the stores opened by a Provider. It lets the changes made to the store's entries,
+// by any Provider using the same MySQL server, be watched. The changes are recorded in a change log table by the
+// transactions that make them, provided the Providers making them were created using the WithChangeLog option, and
+// are read from it by polling (see WithChangePollInterval).
+type WatchableStore interface {
+	storage.Store
+
+	// Watch streams the changes made to the store's entries until ctx is done. Unless WithCheckpoint is used to resume
+	// from an earlier change, only the changes made after Watch is called are streamed. A watch can only resume from
+	// a change that's still in the change log. Watch fails if the Provider wasn't created using WithChangeLog.
+	Watch(ctx context.Context, options ...WatchOption) (ChangeStream, error)
+}
+
+// WatchOption represents an option for WatchableStore.Watch.
+type WatchOption func(opts *watchOptions)
+
+type watchOptions struct {
+	checkpoint string
+	tagFilter  *storage.Tag
+}
+
+// WithCheckpoint is an option for resuming a watch with the changes made after the one identified by checkpoint,
+// such as after a restart. checkpoint is the Checkpoint of a Change.
+func WithCheckpoint(checkpoint string) WatchOption {
+	return func(opts *watchOptions) {
+		opts.checkpoint = checkpoint
+	}
+}
+
+// WithTagFilter is an option for only streaming the puts of entries that have a tag with tag's name and, unless it's
+// blank, tag's value. Deletions are always streamed, since the tags of the deleted entries aren't known.
+func WithTagFilter(tag storage.Tag) WatchOption {
+	return func(opts *watchOptions) {
+		opts.tagFilter = &tag
+	}
+}
+
+// WithChangeLog option has the changes made to each store's entries recorded in a change log table, which is what
+// WatchableStore.Watch streams changes from. Changes are kept for retention, after which they're deleted along with
+// the expired entries (see WithExpiredEntrySweepInterval). If this option isn't used, no changes are recorded and the
+// stores can't be watched.
+func WithChangeLog(retention time.Duration) Option {
+	return func(opts *Provider) {
+		opts.changeLogRetention = retention
+	}
+}
+
+// WithChangePollInterval option sets how often a WatchableStore.Watch stream polls the change log for new changes.
+// If this option isn't used, or interval isn't positive, the change log is polled twice a second.
+func WithChangePollInterval(interval time.Duration) Option {
+	return func(opts *Provider) {
+		opts.changePollInterval = interval
+	}
+}
+
+// recordChanges adds a change to the change log for each of keys, if the change log is enabled. entries holds the
+// marshalled entries put under keys, or nil for the keys that were deleted.
+func (s *store) recordChanges(ctx context.Context, tx *sql.Tx, keys []string, entries [][]byte) error {
+	if s.changeTableName == "" || len(keys) == 0 {
+		return nil
+	}
+
+	seq, err := s.reserveChangeSeqs(ctx, tx, len(keys))
+	if err != nil {
+		return err
+	}
+
+	now := unixMilli(time.Now())
+
+	for start := 0; start < len(keys); start += batchChunkSize {
+		end := start + batchChunkSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		values := make([]interface{}, 0, changeColumns*(end-start))
+
+		for i := start; i < end; i++ {
+			values = append(values, seq+int64(i), keys[i], entries[i], now)
+		}
+
+		_, err = tx.ExecContext(ctx, "INSERT INTO "+s.changeTableName+" (`seq`, `key`, `entry`, `changed_at`) "+
+			"VALUES "+placeholders("(?, ?, ?, ?)", end-start), values...)
+		if err != nil {
+			return fmt.Errorf(failureWhileExecutingInsertStatementErrMsg, s.changeTableName, err)
+		}
+	}
+
+	return nil
+}
+
+// reserveChangeSeqs reserves count sequence numbers for the changes made by tx and returns the first one.
+//
+// The sequence numbers aren't taken from an AUTO_INCREMENT column, since those are assigned when rows are inserted
+// rather than when they're committed: a watch could read a change before one with a lower sequence number is
+// committed, and rolled back transactions would leave gaps. Instead, the row of the change sequence table stays
+// locked until tx is committed or rolled back, so the changes are numbered in the order they're committed, without
+// gaps. This serialises the commits of the transactions that change the store, which is why the changes are always
+// recorded last.
+func (s *store) reserveChangeSeqs(ctx context.Context, tx *sql.Tx, count int) (int64, error) {
+	_, err := tx.ExecContext(ctx, "UPDATE "+s.changeSeqTableName+" SET `seq` = `seq` + ? WHERE `id` = 1", count)
+	if err != nil {
+		return 0, fmt.Errorf("failure while reserving change sequence numbers: %w", err)
+	}
+
+	var lastSeq int64
+
+	err = tx.QueryRowContext(ctx, "SELECT `seq` FROM "+s.changeSeqTableName+" WHERE `id` = 1").Scan(&lastSeq)
+	if err != nil {
+		return 0, fmt.Errorf(failureWhileQueryingRowErrMsg, err)
+	}
+
+	return lastSeq - int64(count) + 1, nil
+}
+
+// createChangeTableIfEnabled creates the store's change log and change sequence tables, if the change log is enabled.
+func (s *store) createChangeTableIfEnabled() error {
+	if s.changeLogRetention == 0 {
+		return nil
+	}
+
+	changeTableName := fmt.Sprintf("`%s`.`%s_changes`", s.name, s.name)
+	changeSeqTableName := fmt.Sprintf("`%s`.`%s_change_seq`", s.name, s.name)
+
+	_, err := s.db.Exec(fmt.Sprintf(createChangeTableQuery, changeTableName))
+	if err != nil {
+		return fmt.Errorf(failureWhileCreatingTableErrMsg, s.name+"_changes", err)
+	}
+
+	_, err = s.db.Exec(fmt.Sprintf(createChangeSeqTableQuery, changeSeqTableName))
+	if err != nil {
+		return fmt.Errorf(failureWhileCreatingTableErrMsg, s.name+"_change_seq", err)
+	}
+
+	_, err = s.db.Exec(fmt.Sprintf(initChangeSeqQuery, changeSeqTableName, changeTableName))
+	if err != nil {
+		return fmt.Errorf(failureWhileExecutingInsertStatementErrMsg, s.name+"_change_seq", err)
+	}
+
+	s.changeTableName = changeTableName
+	s.changeSeqTableName = changeSeqTableName
+
+	return nil
+}
+
+// recordExpiredEntries adds a deletion to the change log for each entry that has expired as of now (in Unix
+// milliseconds), if the change log is enabled.
+func (s *store) recordExpiredEntries(ctx context.Context, tx *sql.Tx, now int64) error {
+	if s.changeTableName == "" {
+		return nil
+	}
+
+	// The entries are locked, so that the ones deleted next are exactly the ones recorded.
+	rows, err := tx.QueryContext(ctx, "SELECT `key` FROM "+s.tableName+" WHERE `expires_at` <= ? ORDER BY `key` "+
+		"FOR UPDATE", now)
+	if err != nil {
+		return fmt.Errorf(failureWhileQueryingRowsErrMsg, err)
+	}
+
+	var keys []string
+
+	for rows.Next() {
+		var key string
+
+		err = rows.Scan(&key)
+		if err != nil {
+			break
+		}
+
+		keys = append(keys, key)
+	}
+
+	if err == nil {
+		err = rows.Err()
+	}
+
+	errClose := rows.Close()
+	if err != nil {
+		return fmt.Errorf(failureWhileQueryingRowsErrMsg, err)
+	}
+
+	if errClose != nil {
+		return fmt.Errorf("failed to close result rows: %w", errClose)
+	}
+
+	return s.recordChanges(ctx, tx, keys, make([][]byte, len(keys)))
+}
+
+// pruneChanges deletes the changes that were made longer than the change log's retention before now (in Unix
+// milliseconds), if the change log is enabled.
+func (s *store) pruneChanges(ctx context.Context, tx *sql.Tx, now int64) error {
+	if s.changeTableName == "" {
+		return nil
+	}
+
+	_, err := tx.ExecContext(ctx, "DELETE FROM "+s.changeTableName+" WHERE `changed_at` <= ?",
+		now-s.changeLogRetention.Milliseconds())
+	if err != nil {
+		return fmt.Errorf("failure while deleting old changes from table %s: %w", s.changeTableName, err)
+	}
+
+	return nil
+}
+
+// Watch streams the changes recorded in the store's change log until ctx is done.
+func (s *store) Watch(ctx context.Context, options ...WatchOption) (ChangeStream, error) {
+	if s.changeTableName == "" {
+		return nil, errChangeLogDisabled
+	}
+
+	var opts watchOptions
+
+	for _, option := range options {
+		option(&opts)
+	}
+
+	var lastSeq int64
+
+	if opts.checkpoint == "" {
+		// The change sequence table is used rather than the change log, since all of the changes may have been
+		// deleted from the change log.
+		err := s.db.QueryRowContext(ctx, "SELECT `seq` FROM "+s.changeSeqTableName+" WHERE `id` = 1").Scan(&lastSeq)
+		if err != nil {
+			return nil, fmt.Errorf(failureWhileQueryingRowErrMsg, err)
+		}
+	} else {
+		var err error
+
+		lastSeq, err = strconv.ParseInt(opts.checkpoint, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid checkpoint: %s", opts.checkpoint)
+		}
+	}
+
+	return &changeStream{
+		ctx: ctx, store: s, lastSeq: lastSeq, tagFilter: opts.tagFilter, pollInterval: s.changePollInterval,
+	}, nil
+}
+
+type changeStream struct {
+	ctx          context.Context
+	store        *store
+	lastSeq      int64
+	tagFilter    *storage.Tag
+	pollInterval time.Duration
+	pending      []Change
+}
+
+// Next returns the next change that passes the tag filter, polling the change log until there is one.
+func (c *changeStream) Next() (Change, error) {
+	for len(c.pending) == 0 {
+		err := c.poll()
+		if err != nil {
+			return Change{}, err
+		}
+
+		if len(c.pending) > 0 {
+			break
+		}
+
+		select {
+		case <-c.ctx.Done():
+			return Change{}, c.ctx.Err()
+		case <-time.After(c.pollInterval):
+		}
+	}
+
+	change := c.pending[0]
+	c.pending = c.pending[1:]
+
+	return change, nil
+}
+
+// Close stops the stream. There's nothing to release, since the stream doesn't hold on to a connection between polls.
+func (c *changeStream) Close() error {
+	return nil
+}
+
+// poll reads the changes after the last one read. Since changes are numbered in the order they're committed, without
+// gaps, a gap in the sequence numbers means the changes in it were deleted from the change log before being read.
+func (c *changeStream) poll() error {
+	rows, err := c.store.db.QueryContext(c.ctx, "SELECT `seq`, `key`, `entry` FROM "+c.store.changeTableName+
+		" WHERE `seq` > ? ORDER BY `seq` LIMIT ?", c.lastSeq, changePageSize)
+	if err != nil {
+		return fmt.Errorf(failureWhileQueryingRowsErrMsg, err)
+	}
+
+	err = c.readChanges(rows)
+
+	errClose := rows.Close()
+	if err != nil {
+		return err
+	}
+
+	if errClose != nil {
+		return fmt.Errorf("failed to close result rows: %w", errClose)
+	}
+
+	return nil
+}
+
+func (c *changeStream) readChanges(rows *sql.Rows) error {
+	for rows.Next() {
+		var (
+			seq   int64
+			key   string
+			entry []byte
+		)
+
+		err := rows.Scan(&seq, &key, &entry)
+		if err != nil {
+			return fmt.Errorf("failure while scanning change: %w", err)
+		}
+
+		if seq != c.lastSeq+1 {
+			return c.skipTo(seq)
+		}
+
+		c.lastSeq = seq
+
+		change, err := newChange(seq, key, entry)
+		if err != nil {
+			return err
+		}
+
+		if change.Type == ChangeDelete || matchesTagFilter(c.tagFilter, change.Tags) {
+			c.pending = append(c.pending, change)
+		}
+	}
+
+	err := rows.Err()
+	if err != nil {
+		return fmt.Errorf(failureWhileQueryingRowsErrMsg, err)
+	}
+
+	return nil
+}
+
+// skipTo skips the changes before seq, which are missing from the change log, and reports this. If changes read before
+// the gap are pending, they're returned first, and the gap is found again by the next poll.
+func (c *changeStream) skipTo(seq int64) error {
+	if len(c.pending) > 0 {
+		return nil
+	}
+
+	firstSkipped := c.lastSeq + 1
+	c.lastSeq = seq - 1
+
+	return fmt.Errorf("%w: changes %d to %d", ErrChangesSkipped, firstSkipped, seq-1)
+}
+
+// newChange returns the change recorded in the change log with the given sequence number, key and entry.
+func newChange(seq int64, key string, entry []byte) (Change, error) {
+	change := Change{Type: ChangeDelete, Key: key, Checkpoint: strconv.FormatInt(seq, 10)}
+
+	if entry == nil {
+		return change, nil
+	}
+
+	var changedEntry dbEntry
+
+	err := json.Unmarshal(entry, &changedEntry)
+	if err != nil {
+		return Change{}, fmt.Errorf("failed to unmarshal changed entry: %w", err)
+	}
+
+	change.Type = ChangePut
+	change.Value = changedEntry.Value
+	change.Tags = changedEntry.Tags
+
+	return change, nil
+}
+
+// matchesTagFilter returns whether tags include one matching tagFilter, if there is a filter.
+func matchesTagFilter(tagFilter *storage.Tag, tags []storage.Tag) bool {
+	if tagFilter == nil {
+		return true
+	}
+
+	for _, tag := range tags {
+		if tag.Name == tagFilter.Name && (tagFilter.Value == "" || tag.Value == tagFilter.Value) {
+			return true
+		}
+	}
+
+	return false
+}
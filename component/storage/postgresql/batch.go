@@ -0,0 +1,170 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package postgresql
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/hyperledger/aries-framework-go/spi/storage"
+	"github.com/lib/pq"
+)
+
+// batchChunkSize is the maximum number of entries written by a single statement of a batch.
+const batchChunkSize = 100
+
+// batchOperation is a storage.Operation ready to be written. tags is the JSON for the tags column, or "" if the key
+// is to be deleted.
+type batchOperation struct {
+	key   string
+	value []byte
+	tags  string
+}
+
+// preparedStatements prepares each distinct statement of a batch once within its transaction.
+// The statements are closed when the transaction is committed or rolled back.
+type preparedStatements struct {
+	tx    *sql.Tx
+	stmts map[string]*sql.Stmt
+}
+
+func (p *preparedStatements) exec(query string, args ...interface{}) error {
+	stmt, ok := p.stmts[query]
+	if !ok {
+		var err error
+
+		stmt, err = p.tx.Prepare(query)
+		if err != nil {
+			return fmt.Errorf("failed to prepare statement: %w", err)
+		}
+
+		p.stmts[query] = stmt
+	}
+
+	_, err := stmt.Exec(args...)
+
+	return err
+}
+
+// Batch performs batch upserts and deletions preserving the batch's ordering.
+// All operations are done in a single transaction, so either the whole batch is applied or none of it is.
+// Consecutive upserts are grouped into multi-row statements of up to batchChunkSize entries, and consecutive
+// deletions into a single statement.
+func (s *store) Batch(batch []storage.Operation) error {
+	if len(batch) == 0 {
+		return errors.New("batch requires at least one operation")
+	}
+
+	operations := make([]batchOperation, len(batch))
+
+	for i, b := range batch {
+		if b.Key == "" {
+			return errors.New("key cannot be empty")
+		}
+
+		operations[i] = batchOperation{key: b.Key, value: b.Value}
+
+		if len(b.Value) > 0 {
+			err := validatePutInput(b.Key, b.Value, b.Tags)
+			if err != nil {
+				return err
+			}
+
+			tags, err := marshalTags(b.Tags)
+			if err != nil {
+				return err
+			}
+
+			operations[i].tags = tags
+		}
+	}
+
+	return s.inTransaction(func(tx *sql.Tx) error {
+		stmts := &preparedStatements{tx: tx, stmts: make(map[string]*sql.Stmt)}
+
+		for _, run := range groupOperations(operations) {
+			err := s.writeRun(stmts, run)
+			if err != nil {
+				return fmt.Errorf(failureWhileExecutingBatchErrMsg, s.name, err)
+			}
+		}
+
+		return nil
+	})
+}
+
+// writeRun writes operations of the same kind on distinct keys.
+func (s *store) writeRun(stmts *preparedStatements, run []batchOperation) error {
+	if run[0].tags == "" {
+		keys := make([]string, len(run))
+
+		for i, operation := range run {
+			keys[i] = operation.key
+		}
+
+		return stmts.exec("DELETE FROM "+s.tableName+" WHERE key = ANY($1)", pq.Array(keys))
+	}
+
+	for start := 0; start < len(run); start += batchChunkSize {
+		end := start + batchChunkSize
+		if end > len(run) {
+			end = len(run)
+		}
+
+		values := make([]interface{}, 0, 3*(end-start)) // nolint:gomnd // three columns per entry
+
+		for _, operation := range run[start:end] {
+			values = append(values, operation.key, operation.value, operation.tags)
+		}
+
+		err := stmts.exec(s.upsertStmt(end-start), values...)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// groupOperations splits operations into runs of consecutive upserts or deletions, which can be written together
+// without changing the outcome of the batch. Within a run, only the last operation on each key is kept, since
+// PostgreSQL doesn't allow a statement to upsert the same row twice.
+func groupOperations(operations []batchOperation) [][]batchOperation {
+	var runs [][]batchOperation
+
+	for start := 0; start < len(operations); {
+		end := start + 1
+
+		for end < len(operations) && (operations[end].tags == "") == (operations[start].tags == "") {
+			end++
+		}
+
+		runs = append(runs, lastPerKey(operations[start:end]))
+		start = end
+	}
+
+	return runs
+}
+
+// lastPerKey drops the operations that are superseded by a later one on the same key.
+func lastPerKey(operations []batchOperation) []batchOperation {
+	last := make(map[string]int, len(operations))
+
+	for i, operation := range operations {
+		last[operation.key] = i
+	}
+
+	result := make([]batchOperation, 0, len(last))
+
+	for i, operation := range operations {
+		if last[operation.key] == i {
+			result = append(result, operation)
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,33 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package postgresql
+
+import "errors"
+
+const (
+	// Error messages we return.
+	failureWhileOpeningConnectionErrMsg        = "failure while opening PostgreSQL connection: %w"
+	failureWhileClosingConnectionErrMsg        = "failure while closing PostgreSQL DB connection: %w"
+	failureWhilePingingErrMsg                  = "failure while pinging PostgreSQL: %w"
+	failureWhileCreatingTableErrMsg            = "failure while creating table %s: %w"
+	failureWhileCreatingIndexErrMsg            = "failure while creating tag index on table %s: %w"
+	failureWhileDroppingIndexErrMsg            = "failure while dropping tag index on table %s: %w"
+	failureWhileExecutingUpsertErrMsg          = "failure while executing upsert statement on table %s: %w"
+	failureWhileExecutingDeleteErrMsg          = "failure while executing delete statement on table %s: %w"
+	failureWhileExecutingBatchErrMsg           = "failure while executing batch on table %s: %w"
+	failureWhileQueryingRowErrMsg              = "failure while querying row: %w"
+	failureWhileQueryingRowsErrMsg             = "failure while querying rows: %w"
+	failureWhileBeginningTransactionErrMsg     = "failure while beginning transaction: %w"
+	failureWhileCommittingTransactionErrMsg    = "failure while committing transaction: %w"
+	failureWhileCheckingStoreExistenceErrMsg   = "failure while checking whether store %s exists: %w"
+	failureWhileUnmarshallingDBEntryTagsErrMsg = "failed to unmarshal tags of retrieved DB entry: %w"
+)
+
+var (
+	errBlankConnectionString = errors.New("connection string for new PostgreSQL provider can't be blank")
+	errBlankStoreName        = errors.New("store name is required")
+	errNoCurrentEntry        = errors.New("iterator has no current entry")
+)
@@ -0,0 +1,16 @@
+// Copyright SecureKey Technologies Inc. All Rights Reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+module github.com/hyperledger/aries-framework-go-ext/component/storage/postgresql
+
+go 1.15
+
+require (
+	github.com/cenkalti/backoff/v4 v4.1.0
+	github.com/google/uuid v1.2.0
+	github.com/hyperledger/aries-framework-go/spi v0.0.0-20210820175050-dcc7a225178d
+	github.com/hyperledger/aries-framework-go/test/component v0.0.0-20210820175050-dcc7a225178d
+	github.com/lib/pq v1.10.2
+	github.com/ory/dockertest/v3 v3.6.3
+	github.com/stretchr/testify v1.7.0
+)
@@ -0,0 +1,29 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package redis
+
+import "errors"
+
+const (
+	// Error messages we return.
+	failureWhileParsingURLErrMsg               = "failure while parsing Redis URL: %w"
+	failureWhilePingingErrMsg                  = "failure while pinging Redis: %w"
+	failureWhileClosingClientErrMsg            = "failure while closing Redis client: %w"
+	failureWhileCreatingStoreErrMsg            = "failure while creating store %s: %w"
+	failureWhileCheckingStoreExistenceErrMsg   = "failure while checking whether store %s exists: %w"
+	failureWhileUpdatingIndexesErrMsg          = "failure while updating tag indexes of store %s: %w"
+	failureWhileWritingEntryErrMsg             = "failure while writing entry to store %s: %w"
+	failureWhileExecutingBatchErrMsg           = "failure while executing batch on store %s: %w"
+	failureWhileReadingEntryErrMsg             = "failure while reading entry: %w"
+	failureWhileReadingEntriesErrMsg           = "failure while reading entries: %w"
+	failureWhileUnmarshallingDBEntryTagsErrMsg = "failed to unmarshal tags of retrieved DB entry: %w"
+)
+
+var (
+	errBlankURL       = errors.New("URL for new Redis provider can't be blank")
+	errBlankStoreName = errors.New("store name is required")
+	errNoCurrentEntry = errors.New("iterator has no current entry")
+)
@@ -0,0 +1,15 @@
+// Copyright SecureKey Technologies Inc. All Rights Reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+module github.com/hyperledger/aries-framework-go-ext/component/storage/redis
+
+go 1.15
+
+require (
+	github.com/alicebob/miniredis/v2 v2.15.1
+	github.com/go-redis/redis/v8 v8.11.3
+	github.com/google/uuid v1.2.0
+	github.com/hyperledger/aries-framework-go/spi v0.0.0-20210820175050-dcc7a225178d
+	github.com/hyperledger/aries-framework-go/test/component v0.0.0-20210820175050-dcc7a225178d
+	github.com/stretchr/testify v1.7.0
+)
@@ -0,0 +1,107 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package redis
+
+import "github.com/go-redis/redis/v8"
+
+// The scripts below keep a store's tag indexes consistent with its entries. Scripts run atomically, so entries and
+// indexes can't get out of step even when several providers share a Redis server.
+//
+// The keys a script is known to touch before it runs are passed in KEYS, so that a Redis Cluster client can send
+// the script to the node that holds them. The index sets of the tags an entry had before a write can only be known
+// once the entry has been read by the script, so their names are built from the store's key prefix, given in ARGV.
+// Since all the keys of a store share the hash tag in its prefix, they're in the same hash slot as the keys in KEYS.
+// Redis doesn't check that undeclared keys are, so this relies on every key of a store being built from its prefix.
+
+// writeScript puts or deletes an entry, moving its key between the index sets of the tag names the store indexes.
+// KEYS: the entry's hash, the set of the store's keys, the set of the tag names the store indexes.
+// ARGV: key prefix of the store, "put" or "delete", key, value, tags as JSON, TTL in milliseconds (0 for none).
+var writeScript = redis.NewScript(`
+local entryKey, keysKey, indexedKey = KEYS[1], KEYS[2], KEYS[3]
+local prefix, operation, key = ARGV[1], ARGV[2], ARGV[3]
+
+local indexed = {}
+for _, name in ipairs(redis.call('SMEMBERS', indexedKey)) do
+	indexed[name] = true
+end
+
+local function updateIndexes(tagsJSON, command)
+	for _, tag in ipairs(cjson.decode(tagsJSON)) do
+		if indexed[tag.name] then
+			redis.call(command, prefix .. ':tag:' .. tag.name, key)
+			redis.call(command, prefix .. ':tag:' .. tag.name .. ':' .. (tag.value or ''), key)
+		end
+	end
+end
+
+local oldTags = redis.call('HGET', entryKey, 'tags')
+if oldTags then
+	updateIndexes(oldTags, 'SREM')
+end
+
+if operation == 'delete' then
+	redis.call('DEL', entryKey)
+	redis.call('SREM', keysKey, key)
+
+	return 0
+end
+
+redis.call('HSET', entryKey, 'value', ARGV[4], 'tags', ARGV[5])
+
+local ttl = tonumber(ARGV[6])
+if ttl > 0 then
+	redis.call('PEXPIRE', entryKey, ttl)
+else
+	redis.call('PERSIST', entryKey)
+end
+
+redis.call('SADD', keysKey, key)
+updateIndexes(ARGV[5], 'SADD')
+
+return 0
+`)
+
+// indexScript adds an existing entry to the index sets of a tag name that has just become indexed.
+// KEYS: the entry's hash, the set of the store's keys, the index set of the tag name.
+// ARGV: tag name, key.
+var indexScript = redis.NewScript(`
+local entryKey, keysKey, tagNameKey = KEYS[1], KEYS[2], KEYS[3]
+local tagName, key = ARGV[1], ARGV[2]
+
+local tagsJSON = redis.call('HGET', entryKey, 'tags')
+if not tagsJSON then
+	redis.call('SREM', keysKey, key)
+
+	return 0
+end
+
+for _, tag in ipairs(cjson.decode(tagsJSON)) do
+	if tag.name == tagName then
+		redis.call('SADD', tagNameKey, key)
+		redis.call('SADD', tagNameKey .. ':' .. (tag.value or ''), key)
+	end
+end
+
+return 0
+`)
+
+// removeKeysScript removes the keys of entries that no longer exist from sets. Keys whose entries have been put again
+// since they were found missing are kept.
+// KEYS: the sets, followed by the entries' hashes.
+// ARGV: the number of sets, followed by the keys, in the same order as the entries' hashes.
+var removeKeysScript = redis.NewScript(`
+local setCount = tonumber(ARGV[1])
+
+for i = 2, #ARGV do
+	if redis.call('EXISTS', KEYS[setCount + i - 1]) == 0 then
+		for j = 1, setCount do
+			redis.call('SREM', KEYS[j], ARGV[i])
+		end
+	end
+end
+
+return 0
+`)
@@ -0,0 +1,1157 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// Package redis implements a storage interface for Aries (aries-framework-go).
+//
+// Each entry of a store is a Redis hash holding its value and tags. For the tag names in the store's configuration
+// (see Provider.SetStoreConfig), the keys of the entries with each tag name, and with each tag name and value, are
+// kept in Redis sets, which Store.Query reads to find matching entries. Queries on other tag names look through all
+// the entries of the store, and log a warning.
+//
+// All the Redis keys of a store start with the store name in braces, e.g. "{name}:entry:key", so in a Redis Cluster
+// they share a hash slot, and a store is kept on a single node. The scripts that keep the index sets up to date
+// declare the keys they're given in KEYS, but also touch index sets whose names are only known once they've run (see
+// scripts.go), which works since they're in the same slot.
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/hyperledger/aries-framework-go/spi/storage"
+)
+
+const (
+	defaultTimeout = time.Second * 10
+
+	expressionTagNameOnlyLength     = 1
+	expressionTagNameAndValueLength = 2
+	defaultPageSize                 = 25
+	indexBatchSize                  = 100
+	invalidQueryExpressionFormat    = `"%s" is not in a valid expression format. ` +
+		"it must be in the following format: TagName:TagValue"
+	invalidTagName  = `"%s" is an invalid tag name since it contains one or more ':' characters`
+	invalidTagValue = `"%s" is an invalid tag value since it contains one or more ':' characters`
+)
+
+// ErrKeyRequired is returned when key is mandatory.
+var ErrKeyRequired = errors.New("key is mandatory")
+
+type closer func(storeName string)
+
+type logger interface {
+	Infof(msg string, args ...interface{})
+	Warnf(msg string, args ...interface{})
+}
+
+type defaultLogger struct {
+	logger *log.Logger
+}
+
+func (d *defaultLogger) Infof(msg string, args ...interface{}) {
+	d.logger.Printf(msg, args...)
+}
+
+func (d *defaultLogger) Warnf(msg string, args ...interface{}) {
+	d.logger.Printf(msg, args...)
+}
+
+type dbEntry struct {
+	Value []byte
+	Tags  []storage.Tag
+}
+
+// TTLStore is implemented by the stores opened by a Provider. It lets entries be put with a time to live.
+type TTLStore interface {
+	storage.Store
+
+	// PutWithTTL stores the key + value pair along with the (optional) tags, like Put, and has Redis remove the entry
+	// once ttl has elapsed. A later Put of the same key removes the TTL. The key of an expired entry is left in the
+	// store's sets until a query comes across it.
+	PutWithTTL(key string, value []byte, ttl time.Duration, tags ...storage.Tag) error
+}
+
+// Provider represents a Redis implementation of the storage.Provider interface.
+type Provider struct {
+	client   *redis.Client
+	dbs      map[string]*store
+	dbPrefix string
+	timeout  time.Duration
+	logger   logger
+	lock     sync.RWMutex
+}
+
+// Option configures the Redis provider.
+type Option func(opts *Provider)
+
+// WithDBPrefix option is for adding a prefix to the names of stores.
+func WithDBPrefix(dbPrefix string) Option {
+	return func(opts *Provider) {
+		opts.dbPrefix = dbPrefix
+	}
+}
+
+// WithTimeout option sets the timeout for each call made to Redis by the provider and its stores.
+// The timeout is 10 seconds by default.
+func WithTimeout(timeout time.Duration) Option {
+	return func(opts *Provider) {
+		opts.timeout = timeout
+	}
+}
+
+// WithLogger is an option for specifying a custom logger.
+// The standard Golang logger will be used if this option is not provided.
+func WithLogger(logger logger) Option {
+	return func(opts *Provider) {
+		opts.logger = logger
+	}
+}
+
+// NewProvider instantiates Provider.
+// Example URL: redis://:my-secret-pw@127.0.0.1:6379/0
+// See redis.ParseURL in https://pkg.go.dev/github.com/go-redis/redis/v8 for the supported formats and parameters.
+func NewProvider(url string, opts ...Option) (*Provider, error) {
+	if url == "" {
+		return nil, errBlankURL
+	}
+
+	clientOptions, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf(failureWhileParsingURLErrMsg, err)
+	}
+
+	p := &Provider{
+		client:  redis.NewClient(clientOptions),
+		dbs:     map[string]*store{},
+		timeout: defaultTimeout,
+	}
+
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	if p.logger == nil {
+		p.logger = &defaultLogger{
+			log.New(os.Stdout, "Redis-Provider ", log.Ldate|log.Ltime|log.LUTC),
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+
+	err = p.Ping(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Ping checks that the Redis server can be reached, e.g. for a health check.
+func (p *Provider) Ping(ctx context.Context) error {
+	err := p.client.Ping(ctx).Err()
+	if err != nil {
+		return fmt.Errorf(failureWhilePingingErrMsg, err)
+	}
+
+	return nil
+}
+
+// OpenStore opens a store with the given name and returns a handle, which is also a TTLStore.
+// If the store has never been opened before, then it is created.
+// Store names are not case-sensitive. If name is blank, then an error will be returned.
+func (p *Provider) OpenStore(name string) (storage.Store, error) {
+	if name == "" {
+		return nil, errBlankStoreName
+	}
+
+	name = p.storeName(name)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	// Check cache first
+	cachedStore, existsInCache := p.dbs[name]
+	if existsInCache {
+		return cachedStore, nil
+	}
+
+	store := &store{
+		client:  p.client,
+		name:    name,
+		prefix:  "{" + name + "}",
+		timeout: p.timeout,
+		logger:  p.logger,
+		close:   p.removeStore,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+
+	// The store's configuration is what marks it as existing, so it starts out empty.
+	err := p.client.SetNX(ctx, store.configKey(), "{}", 0).Err()
+	if err != nil {
+		return nil, fmt.Errorf(failureWhileCreatingStoreErrMsg, name, err)
+	}
+
+	p.dbs[name] = store
+
+	return store, nil
+}
+
+// SetStoreConfig sets the configuration on a store.
+// The tag names in the configuration are indexed. Entries already in the store are added to the indexes of tag
+// names that weren't indexed before, and the indexes of tag names that are no longer in the configuration are
+// deleted.
+func (p *Provider) SetStoreConfig(name string, config storage.StoreConfiguration) error {
+	for _, tagName := range config.TagNames {
+		if strings.Contains(tagName, ":") {
+			return fmt.Errorf(invalidTagName, tagName)
+		}
+	}
+
+	name = p.storeName(name)
+	s := &store{client: p.client, name: name, prefix: "{" + name + "}"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+
+	err := p.checkStoreExists(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	configBytes, err := json.Marshal(config)
+	if err != nil {
+		return fmt.Errorf("failed to marshal store configuration: %w", err)
+	}
+
+	previousTagNames, err := p.client.SMembers(ctx, s.indexedKey()).Result()
+	if err != nil {
+		return fmt.Errorf(failureWhileUpdatingIndexesErrMsg, name, err)
+	}
+
+	_, err = p.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, s.configKey(), configBytes, 0)
+		pipe.Del(ctx, s.indexedKey())
+
+		for _, tagName := range config.TagNames {
+			pipe.SAdd(ctx, s.indexedKey(), tagName)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to put store configuration: %w", err)
+	}
+
+	err = s.updateIndexes(ctx, previousTagNames, config.TagNames)
+	if err != nil {
+		return fmt.Errorf(failureWhileUpdatingIndexesErrMsg, name, err)
+	}
+
+	return nil
+}
+
+// GetStoreConfig returns the store's configuration.
+func (p *Provider) GetStoreConfig(name string) (storage.StoreConfiguration, error) {
+	name = p.storeName(name)
+	s := &store{name: name, prefix: "{" + name + "}"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+
+	configBytes, err := p.client.Get(ctx, s.configKey()).Bytes()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return storage.StoreConfiguration{}, storage.ErrStoreNotFound
+		}
+
+		return storage.StoreConfiguration{},
+			fmt.Errorf(`failed to get store configuration for "%s": %w`, name, err)
+	}
+
+	var storeConfig storage.StoreConfiguration
+
+	err = json.Unmarshal(configBytes, &storeConfig)
+	if err != nil {
+		return storage.StoreConfiguration{}, fmt.Errorf("failed to unmarshal store configuration: %w", err)
+	}
+
+	return storeConfig, nil
+}
+
+// GetOpenStores returns all Stores currently open in this Provider.
+func (p *Provider) GetOpenStores() []storage.Store {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	openStores := make([]storage.Store, 0, len(p.dbs))
+
+	for _, openStore := range p.dbs {
+		openStores = append(openStores, openStore)
+	}
+
+	return openStores
+}
+
+// Close closes all stores created under this store provider, and the client they share.
+func (p *Provider) Close() error {
+	p.lock.RLock()
+
+	openStoresSnapshot := make([]*store, 0, len(p.dbs))
+
+	for _, openStore := range p.dbs {
+		openStoresSnapshot = append(openStoresSnapshot, openStore)
+	}
+	p.lock.RUnlock()
+
+	for _, openStore := range openStoresSnapshot {
+		err := openStore.Close()
+		if err != nil {
+			return fmt.Errorf(`failed to close open store with name "%s": %w`, openStore.name, err)
+		}
+	}
+
+	err := p.client.Close()
+	if err != nil {
+		return fmt.Errorf(failureWhileClosingClientErrMsg, err)
+	}
+
+	return nil
+}
+
+func (p *Provider) removeStore(name string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	delete(p.dbs, name)
+}
+
+// storeName returns the full name of the store with the given name.
+func (p *Provider) storeName(name string) string {
+	name = strings.ToLower(name)
+
+	if p.dbPrefix != "" {
+		name = p.dbPrefix + "_" + name
+	}
+
+	return name
+}
+
+// checkStoreExists returns storage.ErrStoreNotFound if the store has never been opened.
+func (p *Provider) checkStoreExists(ctx context.Context, s *store) error {
+	count, err := p.client.Exists(ctx, s.configKey()).Result()
+	if err != nil {
+		return fmt.Errorf(failureWhileCheckingStoreExistenceErrMsg, s.name, err)
+	}
+
+	if count == 0 {
+		return storage.ErrStoreNotFound
+	}
+
+	return nil
+}
+
+type store struct {
+	client  *redis.Client
+	name    string
+	prefix  string
+	timeout time.Duration
+	logger  logger
+	close   closer
+}
+
+func (s *store) Put(key string, value []byte, tags ...storage.Tag) error {
+	return s.put(key, value, 0, tags)
+}
+
+// PutWithTTL stores the key + value pair along with the (optional) tags and has Redis remove the entry once ttl has
+// elapsed. ttl must be positive.
+func (s *store) PutWithTTL(key string, value []byte, ttl time.Duration, tags ...storage.Tag) error {
+	if ttl <= 0 {
+		return errors.New("ttl must be positive")
+	}
+
+	return s.put(key, value, ttl, tags)
+}
+
+func (s *store) put(key string, value []byte, ttl time.Duration, tags []storage.Tag) error {
+	errInputValidation := validatePutInput(key, value, tags)
+	if errInputValidation != nil {
+		return errInputValidation
+	}
+
+	tagsJSON, err := marshalTags(tags)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	err = writeScript.Run(ctx, s.client, s.writeKeys(key), s.putArgs(key, value, tagsJSON, ttl)...).Err()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return fmt.Errorf(failureWhileWritingEntryErrMsg, s.name, err)
+	}
+
+	return nil
+}
+
+func (s *store) Get(k string) ([]byte, error) {
+	value, err := s.getField(k, "value")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get DB entry: %w", err)
+	}
+
+	return value, nil
+}
+
+func (s *store) GetTags(key string) ([]storage.Tag, error) {
+	tagsJSON, err := s.getField(key, "tags")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get DB entry: %w", err)
+	}
+
+	return unmarshalTags(tagsJSON)
+}
+
+// GetBulk fetches the values associated with the given keys in a single round trip.
+// If a key doesn't exist, then a nil []byte is returned for that value. It is not considered an error.
+func (s *store) GetBulk(keys ...string) ([][]byte, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("keys slice must contain at least one key")
+	}
+
+	for _, key := range keys {
+		if key == "" {
+			return nil, ErrKeyRequired
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	entries, err := s.getEntries(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([][]byte, len(keys))
+
+	for i, entry := range entries {
+		if entry != nil {
+			values[i] = entry.Value
+		}
+	}
+
+	return values, nil
+}
+
+// Query does a query for data as defined by the documentation in storage.Store (the interface).
+// Matching entries are found using the index sets of the tag name if it's indexed, and by looking through all the
+// entries otherwise, which is logged as a warning. Only their tags are read to match and sort them, and their values
+// are fetched a page at a time (see storage.WithPageSize). When sorting, tag values that are decimal numbers are
+// compared numerically and all others lexicographically.
+func (s *store) Query(expression string, options ...storage.QueryOption) (storage.Iterator, error) {
+	if expression == "" {
+		return nil, fmt.Errorf(invalidQueryExpressionFormat, expression)
+	}
+
+	expressionSplit := strings.Split(expression, ":")
+
+	var tag storage.Tag
+
+	switch len(expressionSplit) {
+	case expressionTagNameOnlyLength:
+		tag.Name = expressionSplit[0]
+	case expressionTagNameAndValueLength:
+		tag.Name = expressionSplit[0]
+		tag.Value = expressionSplit[1]
+	default:
+		return nil, fmt.Errorf(invalidQueryExpressionFormat, expression)
+	}
+
+	queryOptions := getQueryOptions(options)
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	matches, err := s.matchingEntries(ctx, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	sortEntries(matches, queryOptions.SortOptions)
+
+	keys := make([]string, 0, len(matches))
+
+	for i := queryOptions.InitialPageNum * queryOptions.PageSize; i < len(matches); i++ {
+		keys = append(keys, matches[i].key)
+	}
+
+	return &iterator{
+		store:      s,
+		keys:       keys,
+		pageSize:   queryOptions.PageSize,
+		totalItems: len(matches),
+	}, nil
+}
+
+// Delete will delete record with k key.
+func (s *store) Delete(k string) error {
+	if k == "" {
+		return ErrKeyRequired
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	err := writeScript.Run(ctx, s.client, s.writeKeys(k), s.deleteArgs(k)...).Err()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return fmt.Errorf(failureWhileWritingEntryErrMsg, s.name, err)
+	}
+
+	return nil
+}
+
+// Batch performs batch upserts and deletions preserving the batch's ordering.
+// The operations are sent in a single pipeline wrapped in MULTI/EXEC, so no other client sees the batch partially
+// applied. The operations are checked before they're sent, since Redis doesn't roll back a transaction when one of
+// its commands fails.
+func (s *store) Batch(batch []storage.Operation) error {
+	if len(batch) == 0 {
+		return errors.New("batch requires at least one operation")
+	}
+
+	args := make([][]interface{}, len(batch))
+
+	for i, b := range batch {
+		if b.Key == "" {
+			return errors.New("key cannot be empty")
+		}
+
+		if len(b.Value) == 0 {
+			args[i] = s.deleteArgs(b.Key)
+
+			continue
+		}
+
+		err := validatePutInput(b.Key, b.Value, b.Tags)
+		if err != nil {
+			return err
+		}
+
+		tagsJSON, err := marshalTags(b.Tags)
+		if err != nil {
+			return err
+		}
+
+		args[i] = s.putArgs(b.Key, b.Value, tagsJSON, 0)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	// A script that isn't loaded would fail within the transaction, so make sure it is first.
+	err := writeScript.Load(ctx, s.client).Err()
+	if err != nil {
+		return fmt.Errorf(failureWhileExecutingBatchErrMsg, s.name, err)
+	}
+
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, operationArgs := range args {
+			writeScript.EvalSha(ctx, pipe, s.writeKeys(batch[i].Key), operationArgs...)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf(failureWhileExecutingBatchErrMsg, s.name, err)
+	}
+
+	return nil
+}
+
+// Redis store doesn't queue values, so there's never anything to flush.
+func (s *store) Flush() error {
+	return nil
+}
+
+// Close removes the store from the provider's open stores. The client it uses is shared with the other stores and
+// is closed by Provider.Close.
+func (s *store) Close() error {
+	s.close(s.name)
+
+	return nil
+}
+
+func (s *store) entryKey(key string) string {
+	return s.prefix + ":entry:" + key
+}
+
+// keysKey is the set of the keys of all the entries in the store.
+func (s *store) keysKey() string {
+	return s.prefix + ":keys"
+}
+
+func (s *store) configKey() string {
+	return s.prefix + ":config"
+}
+
+// indexedKey is the set of the tag names the store indexes.
+func (s *store) indexedKey() string {
+	return s.prefix + ":indexed"
+}
+
+// indexKey is the index set of the entries with the tag name, and the tag value if it isn't blank.
+func (s *store) indexKey(tag storage.Tag) string {
+	if tag.Value == "" {
+		return s.prefix + ":tag:" + tag.Name
+	}
+
+	return s.prefix + ":tag:" + tag.Name + ":" + tag.Value
+}
+
+// writeKeys returns the KEYS of writeScript for key.
+func (s *store) writeKeys(key string) []string {
+	return []string{s.entryKey(key), s.keysKey(), s.indexedKey()}
+}
+
+func (s *store) putArgs(key string, value []byte, tagsJSON string, ttl time.Duration) []interface{} {
+	return []interface{}{s.prefix, "put", key, value, tagsJSON, ttl.Milliseconds()}
+}
+
+func (s *store) deleteArgs(key string) []interface{} {
+	return []interface{}{s.prefix, "delete", key, "", "[]", 0}
+}
+
+func (s *store) getField(key, field string) ([]byte, error) {
+	if key == "" {
+		return nil, ErrKeyRequired
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	value, err := s.client.HGet(ctx, s.entryKey(key), field).Bytes()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, storage.ErrDataNotFound
+		}
+
+		return nil, fmt.Errorf(failureWhileReadingEntryErrMsg, err)
+	}
+
+	return value, nil
+}
+
+// getEntries reads the entries with the given keys. The entries that don't exist are nil.
+func (s *store) getEntries(ctx context.Context, keys []string) ([]*dbEntry, error) {
+	cmds := make([]*redis.SliceCmd, len(keys))
+
+	_, err := s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			cmds[i] = pipe.HMGet(ctx, s.entryKey(key), "value", "tags")
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf(failureWhileReadingEntriesErrMsg, err)
+	}
+
+	entries := make([]*dbEntry, len(keys))
+
+	for i, cmd := range cmds {
+		fields := cmd.Val()
+
+		value, ok := fields[0].(string)
+		if !ok {
+			continue
+		}
+
+		tagsJSON, _ := fields[1].(string) // nolint:errcheck // Always set along with the value.
+
+		tags, err := unmarshalTags([]byte(tagsJSON))
+		if err != nil {
+			return nil, err
+		}
+
+		entries[i] = &dbEntry{Value: []byte(value), Tags: tags}
+	}
+
+	return entries, nil
+}
+
+// getEntryTags reads the tags of the entries with the given keys, without their values. The entries that don't exist
+// are nil.
+func (s *store) getEntryTags(ctx context.Context, keys []string) ([]*dbEntry, error) {
+	cmds := make([]*redis.StringCmd, len(keys))
+
+	_, err := s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			cmds[i] = pipe.HGet(ctx, s.entryKey(key), "tags")
+		}
+
+		return nil
+	})
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, fmt.Errorf(failureWhileReadingEntriesErrMsg, err)
+	}
+
+	entries := make([]*dbEntry, len(keys))
+
+	for i, cmd := range cmds {
+		tagsJSON, err := cmd.Bytes()
+		if err != nil {
+			continue
+		}
+
+		tags, err := unmarshalTags(tagsJSON)
+		if err != nil {
+			return nil, err
+		}
+
+		entries[i] = &dbEntry{Tags: tags}
+	}
+
+	return entries, nil
+}
+
+// keyedEntry is a DB entry along with its key.
+type keyedEntry struct {
+	*dbEntry
+	key string
+}
+
+// matchingEntries returns the entries with the tag, without their values. They're looked up in the tag's index sets
+// if the tag name is indexed. Keys of entries that no longer exist, e.g. because their TTL elapsed, are removed from
+// the sets read.
+func (s *store) matchingEntries(ctx context.Context, tag storage.Tag) ([]keyedEntry, error) {
+	indexed, err := s.client.SIsMember(ctx, s.indexedKey(), tag.Name).Result()
+	if err != nil {
+		return nil, fmt.Errorf(failureWhileReadingEntriesErrMsg, err)
+	}
+
+	setKeys := []string{s.keysKey()}
+
+	if indexed {
+		setKeys = append(setKeys, s.indexKey(tag))
+	} else {
+		s.logger.Warnf("[Store name: %s] Tag name %s isn't indexed, so the query reads the tags of all the "+
+			"entries in the store. To resolve this, make sure the store configuration has been set using the "+
+			"Provider.SetStoreConfig method. The store configuration must contain the tag name used in the query.",
+			s.name, tag.Name)
+	}
+
+	keys, err := s.client.SMembers(ctx, setKeys[len(setKeys)-1]).Result()
+	if err != nil {
+		return nil, fmt.Errorf(failureWhileReadingEntriesErrMsg, err)
+	}
+
+	entries, err := s.getEntryTags(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		matches []keyedEntry
+		missing []string
+	)
+
+	for i, entry := range entries {
+		if entry == nil {
+			missing = append(missing, keys[i])
+		} else if hasTag(entry.Tags, tag) {
+			matches = append(matches, keyedEntry{dbEntry: entry, key: keys[i]})
+		}
+	}
+
+	if len(missing) > 0 {
+		err = s.removeMissingKeys(ctx, setKeys, missing)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return matches, nil
+}
+
+// removeMissingKeys removes keys from sets if their entries still don't exist once the removal runs, since they may
+// have been put again after they were found missing.
+func (s *store) removeMissingKeys(ctx context.Context, setKeys, keys []string) error {
+	scriptKeys := append([]string{}, setKeys...)
+	args := []interface{}{len(setKeys)}
+
+	for _, key := range keys {
+		scriptKeys = append(scriptKeys, s.entryKey(key))
+		args = append(args, key)
+	}
+
+	err := removeKeysScript.Run(ctx, s.client, scriptKeys, args...).Err()
+	if err != nil {
+		return fmt.Errorf(failureWhileUpdatingIndexesErrMsg, s.name, err)
+	}
+
+	return nil
+}
+
+// updateIndexes deletes the index sets of the tag names that are no longer indexed and fills in those of the tag
+// names that are newly indexed.
+func (s *store) updateIndexes(ctx context.Context, previousTagNames, tagNames []string) error {
+	for _, tagName := range previousTagNames {
+		if !contains(tagNames, tagName) {
+			err := s.deleteIndex(ctx, tagName)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, tagName := range tagNames {
+		if !contains(previousTagNames, tagName) {
+			err := s.buildIndex(ctx, tagName)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *store) deleteIndex(ctx context.Context, tagName string) error {
+	err := s.client.Del(ctx, s.indexKey(storage.Tag{Name: tagName})).Err()
+	if err != nil {
+		return err
+	}
+
+	pattern := escapePattern(s.indexKey(storage.Tag{Name: tagName})) + ":*"
+
+	iter := s.client.Scan(ctx, 0, pattern, indexBatchSize).Iterator()
+
+	for iter.Next(ctx) {
+		err = s.client.Del(ctx, iter.Val()).Err()
+		if err != nil {
+			return err
+		}
+	}
+
+	return iter.Err()
+}
+
+// buildIndex adds the entries in the store to the index sets of tagName, a batch at a time.
+func (s *store) buildIndex(ctx context.Context, tagName string) error {
+	err := indexScript.Load(ctx, s.client).Err()
+	if err != nil {
+		return err
+	}
+
+	iter := s.client.SScan(ctx, s.keysKey(), 0, "", indexBatchSize).Iterator()
+
+	pipe := s.client.Pipeline()
+
+	for queued := 1; iter.Next(ctx); queued++ {
+		indexScript.EvalSha(ctx, pipe,
+			[]string{s.entryKey(iter.Val()), s.keysKey(), s.indexKey(storage.Tag{Name: tagName})},
+			tagName, iter.Val())
+
+		if queued%indexBatchSize == 0 {
+			_, err = pipe.Exec(ctx)
+			if err != nil && !errors.Is(err, redis.Nil) {
+				return err
+			}
+		}
+	}
+
+	if iter.Err() != nil {
+		return iter.Err()
+	}
+
+	_, err = pipe.Exec(ctx)
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return err
+	}
+
+	return nil
+}
+
+type iterator struct {
+	store      *store
+	keys       []string
+	pageSize   int
+	page       []keyedEntry
+	pageIndex  int
+	totalItems int
+	current    *keyedEntry
+}
+
+// fetchPage reads the entries of the next page of keys. Entries that no longer exist are left out.
+func (i *iterator) fetchPage() error {
+	pageKeys := i.keys
+
+	if len(pageKeys) > i.pageSize {
+		pageKeys = pageKeys[:i.pageSize]
+	}
+
+	i.keys = i.keys[len(pageKeys):]
+
+	ctx, cancel := context.WithTimeout(context.Background(), i.store.timeout)
+	defer cancel()
+
+	entries, err := i.store.getEntries(ctx, pageKeys)
+	if err != nil {
+		return err
+	}
+
+	i.page = i.page[:0]
+	i.pageIndex = 0
+
+	for j, entry := range entries {
+		if entry != nil {
+			i.page = append(i.page, keyedEntry{dbEntry: entry, key: pageKeys[j]})
+		}
+	}
+
+	return nil
+}
+
+func (i *iterator) Next() (bool, error) {
+	i.current = nil
+
+	for i.pageIndex == len(i.page) {
+		if len(i.keys) == 0 {
+			return false, nil
+		}
+
+		err := i.fetchPage()
+		if err != nil {
+			return false, err
+		}
+	}
+
+	i.current = &i.page[i.pageIndex]
+	i.pageIndex++
+
+	return true, nil
+}
+
+func (i *iterator) Key() (string, error) {
+	if i.current == nil {
+		return "", errNoCurrentEntry
+	}
+
+	return i.current.key, nil
+}
+
+func (i *iterator) Value() ([]byte, error) {
+	if i.current == nil {
+		return nil, errNoCurrentEntry
+	}
+
+	return i.current.Value, nil
+}
+
+func (i *iterator) Tags() ([]storage.Tag, error) {
+	if i.current == nil {
+		return nil, errNoCurrentEntry
+	}
+
+	return i.current.Tags, nil
+}
+
+// TotalItems returns the number of entries that matched the query when it was made.
+func (i *iterator) TotalItems() (int, error) {
+	return i.totalItems, nil
+}
+
+// Close releases the current page of results. The query holds no Redis resources between pages.
+func (i *iterator) Close() error {
+	i.keys = nil
+	i.page = nil
+	i.current = nil
+
+	return nil
+}
+
+// sortEntries sorts entries as set by sortOptions, or by key if it's nil.
+func sortEntries(entries []keyedEntry, sortOptions *storage.SortOptions) {
+	if sortOptions == nil {
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].key < entries[j].key
+		})
+
+		return
+	}
+
+	sortValues := make(map[string]sortValue, len(entries))
+
+	for _, entry := range entries {
+		sortValues[entry.key] = newSortValue(entry.Tags, sortOptions.TagName)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := sortValues[entries[i].key], sortValues[entries[j].key]
+
+		if sortOptions.Order == storage.SortDescending {
+			a, b = b, a
+		}
+
+		if a.equal(b) {
+			return (entries[i].key < entries[j].key) == (sortOptions.Order != storage.SortDescending)
+		}
+
+		return a.less(b)
+	})
+}
+
+// sortValue is the value of the tag an entry is sorted by. Entries without the tag come first, then those whose
+// tag values aren't decimal numbers, in lexicographic order, then those whose tag values are, in numeric order.
+type sortValue struct {
+	hasTag    bool
+	isNumeric bool
+	number    float64
+	value     string
+}
+
+func newSortValue(tags []storage.Tag, tagName string) sortValue {
+	for _, tag := range tags {
+		if tag.Name == tagName {
+			number, err := strconv.ParseFloat(tag.Value, 64)
+
+			return sortValue{
+				hasTag:    true,
+				isNumeric: err == nil && !math.IsInf(number, 0) && !math.IsNaN(number),
+				number:    number,
+				value:     tag.Value,
+			}
+		}
+	}
+
+	return sortValue{}
+}
+
+func (v sortValue) less(other sortValue) bool {
+	switch {
+	case v.hasTag != other.hasTag:
+		return !v.hasTag
+	case v.isNumeric != other.isNumeric:
+		return !v.isNumeric
+	case v.isNumeric && v.number != other.number:
+		return v.number < other.number
+	default:
+		return v.value < other.value
+	}
+}
+
+func (v sortValue) equal(other sortValue) bool {
+	return !v.less(other) && !other.less(v)
+}
+
+func hasTag(tags []storage.Tag, queryTag storage.Tag) bool {
+	for _, tag := range tags {
+		if tag.Name == queryTag.Name && (queryTag.Value == "" || tag.Value == queryTag.Value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// escapePattern escapes the characters that have a meaning in the patterns of the Redis SCAN command.
+func escapePattern(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`).Replace(s)
+}
+
+// marshalTags returns the JSON array stored in an entry's hash for tags.
+func marshalTags(tags []storage.Tag) (string, error) {
+	if tags == nil {
+		tags = []storage.Tag{}
+	}
+
+	tagsJSON, err := json.Marshal(tags)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal tags: %w", err)
+	}
+
+	return string(tagsJSON), nil
+}
+
+func unmarshalTags(tagsJSON []byte) ([]storage.Tag, error) {
+	var tags []storage.Tag
+
+	err := json.Unmarshal(tagsJSON, &tags)
+	if err != nil {
+		return nil, fmt.Errorf(failureWhileUnmarshallingDBEntryTagsErrMsg, err)
+	}
+
+	if len(tags) == 0 {
+		return nil, nil
+	}
+
+	return tags, nil
+}
+
+func validatePutInput(key string, value []byte, tags []storage.Tag) error {
+	if key == "" {
+		return errors.New("key cannot be empty")
+	}
+
+	if value == nil {
+		return errors.New("value cannot be nil")
+	}
+
+	for _, tag := range tags {
+		if strings.Contains(tag.Name, ":") {
+			return fmt.Errorf(invalidTagName, tag.Name)
+		}
+
+		if strings.Contains(tag.Value, ":") {
+			return fmt.Errorf(invalidTagValue, tag.Value)
+		}
+	}
+
+	return nil
+}
+
+func getQueryOptions(options []storage.QueryOption) storage.QueryOptions {
+	var queryOptions storage.QueryOptions
+
+	for _, option := range options {
+		option(&queryOptions)
+	}
+
+	if queryOptions.PageSize < 1 {
+		queryOptions.PageSize = defaultPageSize
+	}
+
+	if queryOptions.InitialPageNum < 0 {
+		queryOptions.InitialPageNum = 0
+	}
+
+	return queryOptions
+}
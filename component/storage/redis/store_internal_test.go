@@ -0,0 +1,54 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package redis
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/hyperledger/aries-framework-go/spi/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore_RemoveMissingKeys_Internal(t *testing.T) {
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+
+	defer server.Close()
+
+	provider, err := NewProvider("redis://" + server.Addr())
+	require.NoError(t, err)
+
+	defer func() {
+		require.NoError(t, provider.Close())
+	}()
+
+	testStore, err := provider.OpenStore("TestStore")
+	require.NoError(t, err)
+
+	require.NoError(t, provider.SetStoreConfig("TestStore", storage.StoreConfiguration{TagNames: []string{"TagName1"}}))
+
+	tag := storage.Tag{Name: "TagName1", Value: "TagValue1"}
+
+	require.NoError(t, testStore.Put("key1", []byte("value"), tag))
+	require.NoError(t, testStore.Put("key2", []byte("value"), tag))
+
+	s, ok := testStore.(*store)
+	require.True(t, ok)
+
+	require.NoError(t, s.client.Del(context.Background(), s.entryKey("key1")).Err())
+
+	// key2 was found missing, but was put again before its key was removed, so it's kept.
+	setKeys := []string{s.keysKey(), s.indexKey(tag)}
+	require.NoError(t, s.removeMissingKeys(context.Background(), setKeys, []string{"key1", "key2"}))
+
+	for _, setKey := range setKeys {
+		members, errMembers := server.Members(setKey)
+		require.NoError(t, errMembers)
+		require.Equal(t, []string{"key2"}, members)
+	}
+}
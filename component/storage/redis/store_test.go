@@ -0,0 +1,422 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package redis_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/google/uuid"
+	"github.com/hyperledger/aries-framework-go/spi/storage"
+	commontest "github.com/hyperledger/aries-framework-go/test/component/storage"
+	"github.com/stretchr/testify/require"
+
+	. "github.com/hyperledger/aries-framework-go-ext/component/storage/redis"
+)
+
+func TestRedis_Common(t *testing.T) {
+	server := newServer(t)
+
+	t.Run("Without prefix", func(t *testing.T) {
+		provider, err := NewProvider("redis://" + server.Addr())
+		require.NoError(t, err)
+
+		commontest.TestAll(t, provider)
+	})
+	t.Run("With prefix", func(t *testing.T) {
+		provider, err := NewProvider("redis://"+server.Addr(), WithDBPrefix("db-prefix"))
+		require.NoError(t, err)
+
+		commontest.TestAll(t, provider)
+	})
+}
+
+func TestNewProvider(t *testing.T) {
+	t.Run("Blank URL", func(t *testing.T) {
+		provider, err := NewProvider("")
+		require.EqualError(t, err, "URL for new Redis provider can't be blank")
+		require.Nil(t, provider)
+	})
+	t.Run("Invalid URL", func(t *testing.T) {
+		provider, err := NewProvider("http://127.0.0.1:6379")
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "failure while parsing Redis URL")
+		require.Nil(t, provider)
+	})
+	t.Run("Server can't be reached", func(t *testing.T) {
+		provider, err := NewProvider("redis://127.0.0.1:45454", WithTimeout(time.Second))
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "failure while pinging Redis")
+		require.Nil(t, provider)
+	})
+}
+
+func TestProvider_StoreConfig(t *testing.T) {
+	server := newServer(t)
+	storeName := randomStoreName()
+
+	provider, err := NewProvider("redis://" + server.Addr())
+	require.NoError(t, err)
+
+	testStore, err := provider.OpenStore(storeName)
+	require.NoError(t, err)
+
+	require.NoError(t, testStore.Put("key1", []byte("value"), storage.Tag{Name: "TagName1", Value: "TagValue1"}))
+	require.NoError(t, testStore.Put("key2", []byte("value"), storage.Tag{Name: "TagName2"}))
+
+	t.Run("Entries already in the store are indexed", func(t *testing.T) {
+		err = provider.SetStoreConfig(storeName, storage.StoreConfiguration{TagNames: []string{"TagName1"}})
+		require.NoError(t, err)
+
+		members, errMembers := server.Members("{" + storeName + "}:tag:TagName1:TagValue1")
+		require.NoError(t, errMembers)
+		require.Equal(t, []string{"key1"}, members)
+
+		requireQueryKeys(t, testStore, "TagName1:TagValue1", "key1")
+	})
+	t.Run("Indexes of tag names no longer configured are deleted", func(t *testing.T) {
+		err = provider.SetStoreConfig(storeName, storage.StoreConfiguration{TagNames: []string{"TagName2"}})
+		require.NoError(t, err)
+
+		require.False(t, server.Exists("{"+storeName+"}:tag:TagName1"))
+		require.False(t, server.Exists("{"+storeName+"}:tag:TagName1:TagValue1"))
+		require.True(t, server.Exists("{"+storeName+"}:tag:TagName2"))
+
+		// Tag names that aren't indexed can still be queried.
+		requireQueryKeys(t, testStore, "TagName1", "key1")
+		requireQueryKeys(t, testStore, "TagName2", "key2")
+	})
+	t.Run("Store opened by another provider", func(t *testing.T) {
+		otherProvider, errNew := NewProvider("redis://" + server.Addr())
+		require.NoError(t, errNew)
+
+		config, errGet := otherProvider.GetStoreConfig(storeName)
+		require.NoError(t, errGet)
+		require.Equal(t, []string{"TagName2"}, config.TagNames)
+
+		otherStore, errOpen := otherProvider.OpenStore(storeName)
+		require.NoError(t, errOpen)
+
+		// Entries put through either provider are indexed.
+		require.NoError(t, otherStore.Put("key3", []byte("value"), storage.Tag{Name: "TagName2"}))
+		requireQueryKeys(t, testStore, "TagName2", "key2", "key3")
+		require.NoError(t, otherProvider.Close())
+	})
+	t.Run("Fail since the connection was closed", func(t *testing.T) {
+		require.NoError(t, provider.Close())
+
+		err = provider.SetStoreConfig(storeName, storage.StoreConfiguration{})
+		require.EqualError(t, err, "failure while checking whether store "+storeName+
+			" exists: redis: client is closed")
+
+		config, errGet := provider.GetStoreConfig(storeName)
+		require.EqualError(t, errGet, `failed to get store configuration for "`+storeName+
+			`": redis: client is closed`)
+		require.Empty(t, config)
+	})
+}
+
+func TestStore_PutWithTTL(t *testing.T) {
+	server := newServer(t)
+	storeName := randomStoreName()
+
+	provider, err := NewProvider("redis://" + server.Addr())
+	require.NoError(t, err)
+
+	testStore, err := provider.OpenStore(storeName)
+	require.NoError(t, err)
+
+	require.NoError(t, provider.SetStoreConfig(storeName, storage.StoreConfiguration{TagNames: []string{"TagName1"}}))
+
+	ttlStore, ok := testStore.(TTLStore)
+	require.True(t, ok)
+
+	err = ttlStore.PutWithTTL("key1", []byte("value"), 0)
+	require.EqualError(t, err, "ttl must be positive")
+
+	tag := storage.Tag{Name: "TagName1", Value: "TagValue1"}
+
+	require.NoError(t, ttlStore.PutWithTTL("key1", []byte("value"), time.Minute, tag))
+	require.NoError(t, ttlStore.PutWithTTL("key2", []byte("value"), time.Minute, tag))
+
+	// Putting the key again without a TTL keeps it.
+	require.NoError(t, ttlStore.Put("key2", []byte("value"), tag))
+
+	server.FastForward(time.Minute)
+
+	_, err = ttlStore.Get("key1")
+	require.True(t, errors.Is(err, storage.ErrDataNotFound), "unexpected error or no error")
+
+	requireQueryKeys(t, ttlStore, "TagName1:TagValue1", "key2")
+
+	// The query removed the expired key from the sets it read.
+	members, err := server.Members("{" + storeName + "}:tag:TagName1:TagValue1")
+	require.NoError(t, err)
+	require.Equal(t, []string{"key2"}, members)
+
+	members, err = server.Members("{" + storeName + "}:keys")
+	require.NoError(t, err)
+	require.Equal(t, []string{"key2"}, members)
+}
+
+func TestStore_Batch(t *testing.T) {
+	testStore := newStore(t)
+
+	var operations []storage.Operation
+
+	for i := 0; i < 250; i++ {
+		operations = append(operations, storage.Operation{
+			Key:   fmt.Sprintf("key%d", i),
+			Value: []byte("value"),
+			Tags:  []storage.Tag{{Name: "TagName1"}},
+		})
+	}
+
+	// Deleting then putting the same key again in a later operation keeps the key.
+	operations = append(operations, storage.Operation{Key: "key0"}, storage.Operation{Key: "key1"},
+		storage.Operation{Key: "key0", Value: []byte("updated value")})
+
+	require.NoError(t, testStore.Batch(operations))
+
+	value, err := testStore.Get("key0")
+	require.NoError(t, err)
+	require.Equal(t, []byte("updated value"), value)
+
+	_, err = testStore.Get("key1")
+	require.True(t, errors.Is(err, storage.ErrDataNotFound), "unexpected error or no error")
+
+	itr, err := testStore.Query("TagName1")
+	require.NoError(t, err)
+
+	count, err := itr.TotalItems()
+	require.NoError(t, err)
+	require.Equal(t, 248, count)
+	require.NoError(t, itr.Close())
+
+	t.Run("Invalid tags are rejected before anything is written", func(t *testing.T) {
+		err = testStore.Batch([]storage.Operation{
+			{Key: "key2"},
+			{Key: "key3", Value: []byte("value"), Tags: []storage.Tag{{Name: "TagName1:TagValue1"}}},
+		})
+		require.EqualError(t, err, `"TagName1:TagValue1" is an invalid tag name since it contains one or more `+
+			`':' characters`)
+
+		err = testStore.Batch([]storage.Operation{
+			{Key: "key3", Value: []byte("value"), Tags: []storage.Tag{{Name: "TagName1", Value: "a:b"}}},
+		})
+		require.EqualError(t, err, `"a:b" is an invalid tag value since it contains one or more ':' characters`)
+
+		_, err = testStore.Get("key2")
+		require.NoError(t, err)
+	})
+}
+
+func TestStore_Failures(t *testing.T) {
+	server := newServer(t)
+	storeName := randomStoreName()
+
+	provider, err := NewProvider("redis://" + server.Addr())
+	require.NoError(t, err)
+
+	testStore, err := provider.OpenStore(storeName)
+	require.NoError(t, err)
+
+	require.NoError(t, testStore.Put("key", []byte("value"), storage.Tag{Name: "TagName1"}))
+
+	itr, err := testStore.Query("TagName1")
+	require.NoError(t, err)
+
+	t.Run("Fail to get iterator entry before Next", func(t *testing.T) {
+		key, errKey := itr.Key()
+		require.EqualError(t, errKey, "iterator has no current entry")
+		require.Empty(t, key)
+
+		value, errValue := itr.Value()
+		require.EqualError(t, errValue, "iterator has no current entry")
+		require.Nil(t, value)
+
+		tags, errTags := itr.Tags()
+		require.EqualError(t, errTags, "iterator has no current entry")
+		require.Nil(t, tags)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	require.NoError(t, provider.Ping(ctx))
+	require.NoError(t, provider.Close())
+
+	t.Run("Fail since the connection was closed", func(t *testing.T) {
+		err = provider.Ping(ctx)
+		require.EqualError(t, err, "failure while pinging Redis: redis: client is closed")
+
+		err = testStore.Put("key", []byte("value"))
+		require.EqualError(t, err, "failure while writing entry to store "+storeName+": redis: client is closed")
+
+		value, errGet := testStore.Get("key")
+		require.EqualError(t, errGet, "failed to get DB entry: failure while reading entry: redis: client is closed")
+		require.Nil(t, value)
+
+		values, errGetBulk := testStore.GetBulk("key")
+		require.EqualError(t, errGetBulk, "failure while reading entries: redis: client is closed")
+		require.Nil(t, values)
+
+		queryItr, errQuery := testStore.Query("TagName1")
+		require.EqualError(t, errQuery, "failure while reading entries: redis: client is closed")
+		require.Nil(t, queryItr)
+
+		more, errNext := itr.Next()
+		require.EqualError(t, errNext, "failure while reading entries: redis: client is closed")
+		require.False(t, more)
+
+		err = testStore.Delete("key")
+		require.EqualError(t, err, "failure while writing entry to store "+storeName+": redis: client is closed")
+
+		err = testStore.Batch([]storage.Operation{{Key: "key"}})
+		require.EqualError(t, err, "failure while executing batch on store "+storeName+": redis: client is closed")
+	})
+}
+
+func TestStore_QueryWarnsAboutUnindexedTagNames(t *testing.T) {
+	server := newServer(t)
+	storeName := randomStoreName()
+	logger := &stringLogger{}
+
+	provider, err := NewProvider("redis://"+server.Addr(), WithLogger(logger))
+	require.NoError(t, err)
+
+	testStore, err := provider.OpenStore(storeName)
+	require.NoError(t, err)
+
+	require.NoError(t, provider.SetStoreConfig(storeName, storage.StoreConfiguration{TagNames: []string{"TagName1"}}))
+	require.NoError(t, testStore.Put("key", []byte("value"), storage.Tag{Name: "TagName1"}, storage.Tag{Name: "TagName2"}))
+
+	itr, err := testStore.Query("TagName1")
+	require.NoError(t, err)
+	require.NoError(t, itr.Close())
+	require.Empty(t, logger.log)
+
+	itr, err = testStore.Query("TagName2")
+	require.NoError(t, err)
+
+	count, err := itr.TotalItems()
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+	require.NoError(t, itr.Close())
+	require.Contains(t, logger.log, fmt.Sprintf("[Store name: %s] Tag name TagName2 isn't indexed", storeName))
+}
+
+func TestIterator_Paging(t *testing.T) {
+	testStore := newStore(t)
+
+	for i := 0; i < 5; i++ {
+		err := testStore.Put(fmt.Sprintf("key%d", i), []byte("value"), storage.Tag{Name: "TagName"})
+		require.NoError(t, err)
+	}
+
+	itr, err := testStore.Query("TagName", storage.WithPageSize(2), storage.WithInitialPageNum(1))
+	require.NoError(t, err)
+
+	defer func() {
+		require.NoError(t, itr.Close())
+	}()
+
+	var keys []string
+
+	for {
+		more, errNext := itr.Next()
+		require.NoError(t, errNext)
+
+		if !more {
+			break
+		}
+
+		key, errKey := itr.Key()
+		require.NoError(t, errKey)
+
+		keys = append(keys, key)
+	}
+
+	require.Equal(t, []string{"key2", "key3", "key4"}, keys)
+
+	count, err := itr.TotalItems()
+	require.NoError(t, err)
+	require.Equal(t, 5, count)
+}
+
+func requireQueryKeys(t *testing.T, s storage.Store, expression string, expectedKeys ...string) {
+	t.Helper()
+
+	itr, err := s.Query(expression)
+	require.NoError(t, err)
+
+	var keys []string
+
+	for {
+		more, errNext := itr.Next()
+		require.NoError(t, errNext)
+
+		if !more {
+			break
+		}
+
+		key, errKey := itr.Key()
+		require.NoError(t, errKey)
+
+		keys = append(keys, key)
+	}
+
+	require.Equal(t, expectedKeys, keys)
+	require.NoError(t, itr.Close())
+}
+
+func randomStoreName() string {
+	return "store-" + uuid.New().String()
+}
+
+// newServer starts an in-process Redis server that is stopped at the end of the test.
+type stringLogger struct {
+	log string
+}
+
+func (s *stringLogger) Infof(msg string, args ...interface{}) {
+	s.log += fmt.Sprintf(msg, args...)
+}
+
+func (s *stringLogger) Warnf(msg string, args ...interface{}) {
+	s.log += fmt.Sprintf(msg, args...)
+}
+
+func newServer(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func newStore(t *testing.T) storage.Store {
+	t.Helper()
+
+	p, err := NewProvider("redis://" + newServer(t).Addr())
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		require.NoError(t, p.Close())
+	})
+
+	s, err := p.OpenStore(randomStoreName())
+	require.NoError(t, err)
+
+	return s
+}
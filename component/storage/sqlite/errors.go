@@ -0,0 +1,32 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package sqlite
+
+import "errors"
+
+const (
+	// Error messages we return.
+	failureWhileOpeningDBErrMsg                = "failure while opening SQLite database %s: %w"
+	failureWhileClosingDBErrMsg                = "failure while closing SQLite database: %w"
+	failureWhilePingingErrMsg                  = "failure while pinging SQLite database: %w"
+	failureWhileCreatingTableErrMsg            = "failure while creating table %s: %w"
+	failureWhileExecutingUpsertErrMsg          = "failure while executing upsert statement on table %s: %w"
+	failureWhileExecutingDeleteErrMsg          = "failure while executing delete statement on table %s: %w"
+	failureWhileExecutingBatchErrMsg           = "failure while executing batch on table %s: %w"
+	failureWhileUpdatingTagsErrMsg             = "failure while updating tags in table %s: %w"
+	failureWhileQueryingRowErrMsg              = "failure while querying row: %w"
+	failureWhileQueryingRowsErrMsg             = "failure while querying rows: %w"
+	failureWhileBeginningTransactionErrMsg     = "failure while beginning transaction: %w"
+	failureWhileCommittingTransactionErrMsg    = "failure while committing transaction: %w"
+	failureWhileCheckingStoreExistenceErrMsg   = "failure while checking whether store %s exists: %w"
+	failureWhileUnmarshallingDBEntryTagsErrMsg = "failed to unmarshal tags of retrieved DB entry: %w"
+)
+
+var (
+	errBlankPath      = errors.New("path for new SQLite provider can't be blank")
+	errBlankStoreName = errors.New("store name is required")
+	errNoCurrentEntry = errors.New("iterator has no current entry")
+)
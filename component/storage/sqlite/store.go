@@ -0,0 +1,850 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// Package sqlite implements a storage interface for Aries (aries-framework-go).
+//
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/hyperledger/aries-framework-go/spi/storage"
+	_ "modernc.org/sqlite" // Registers the pure-Go "sqlite" driver.
+)
+
+const (
+	createTableQuery = "CREATE TABLE IF NOT EXISTS %s (key TEXT NOT NULL PRIMARY KEY, value BLOB NOT NULL, " +
+		"tags TEXT NOT NULL DEFAULT '[]')"
+	createTagTableQuery = "CREATE TABLE IF NOT EXISTS %s (key TEXT NOT NULL, name TEXT NOT NULL, " +
+		"value TEXT NOT NULL, numeric_value REAL NULL, PRIMARY KEY (key, name, value))"
+	createTagIndexQuery         = "CREATE INDEX IF NOT EXISTS %s ON %s (name, value)"
+	createStoreConfigTableQuery = "CREATE TABLE IF NOT EXISTS " + storeConfigTable +
+		" (name TEXT NOT NULL PRIMARY KEY, config TEXT NOT NULL)"
+	storeConfigTable = "aries_store_configs"
+
+	expressionTagNameOnlyLength     = 1
+	expressionTagNameAndValueLength = 2
+	defaultPageSize                 = 25
+	tagColumns                      = 4
+	invalidQueryExpressionFormat    = `"%s" is not in a valid expression format. ` +
+		"it must be in the following format: TagName:TagValue"
+	invalidTagName  = `"%s" is an invalid tag name since it contains one or more ':' characters`
+	invalidTagValue = `"%s" is an invalid tag value since it contains one or more ':' characters`
+)
+
+// ErrKeyRequired is returned when key is mandatory.
+var ErrKeyRequired = errors.New("key is mandatory")
+
+type closer func(storeName string)
+
+type dbEntry struct {
+	Value []byte
+	Tags  []storage.Tag
+}
+
+// Provider represents an SQLite implementation of the storage.Provider interface.
+// All stores live in a single database file, each as a table, with their tags in a second, indexed table.
+// SQLite allows only one writer at a time, so the Provider uses a single connection to the database and shouldn't
+// share its file with another Provider.
+type Provider struct {
+	db       *sql.DB
+	dbs      map[string]*store
+	dbPrefix string
+	lock     sync.RWMutex
+}
+
+// Option configures the SQLite provider.
+type Option func(opts *Provider)
+
+// WithDBPrefix option is for adding a prefix to the table names of stores.
+func WithDBPrefix(dbPrefix string) Option {
+	return func(opts *Provider) {
+		opts.dbPrefix = dbPrefix
+	}
+}
+
+// NewProvider instantiates Provider, creating the database file at path if it doesn't exist.
+// Example path: /var/lib/aries/agent.db
+// The path ":memory:" gives a database that is kept in memory and discarded when the Provider is closed, e.g. for
+// tests.
+func NewProvider(path string, opts ...Option) (*Provider, error) {
+	if path == "" {
+		return nil, errBlankPath
+	}
+
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf(failureWhileOpeningDBErrMsg, path, err)
+	}
+
+	// Every connection to ":memory:" has a database of its own, and connections to a file would have to wait on each
+	// other's locks anyway.
+	db.SetMaxOpenConns(1)
+
+	p := &Provider{
+		db:  db,
+		dbs: map[string]*store{},
+	}
+
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	_, err = db.Exec(createStoreConfigTableQuery)
+	if err != nil {
+		return nil, fmt.Errorf(failureWhileOpeningDBErrMsg, path, err)
+	}
+
+	return p, nil
+}
+
+// Ping checks that the database can be used, e.g. for a health check.
+func (p *Provider) Ping(ctx context.Context) error {
+	err := p.db.PingContext(ctx)
+	if err != nil {
+		return fmt.Errorf(failureWhilePingingErrMsg, err)
+	}
+
+	return nil
+}
+
+// OpenStore opens a store with the given name and returns a handle.
+// If the store has never been opened before, then it is created.
+// Store names are not case-sensitive. If name is blank, then an error will be returned.
+func (p *Provider) OpenStore(name string) (storage.Store, error) {
+	if name == "" {
+		return nil, errBlankStoreName
+	}
+
+	name = p.tableName(name)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	// Check cache first
+	cachedStore, existsInCache := p.dbs[name]
+	if existsInCache {
+		return cachedStore, nil
+	}
+
+	store := &store{
+		db:           p.db,
+		name:         name,
+		tableName:    quoteIdentifier(name),
+		tagTableName: quoteIdentifier(name + "_tags"),
+		close:        p.removeStore,
+	}
+
+	err := store.createTables()
+	if err != nil {
+		return nil, err
+	}
+
+	p.dbs[name] = store
+
+	return store, nil
+}
+
+// SetStoreConfig sets the configuration on a store.
+// Tags are kept in a table of their own with an index on tag name and value, which serves queries for any of the
+// configured tag names, so no further indexes are created here.
+func (p *Provider) SetStoreConfig(name string, config storage.StoreConfiguration) error {
+	for _, tagName := range config.TagNames {
+		if strings.Contains(tagName, ":") {
+			return fmt.Errorf(invalidTagName, tagName)
+		}
+	}
+
+	name = p.tableName(name)
+
+	err := p.checkStoreExists(name)
+	if err != nil {
+		return err
+	}
+
+	configBytes, err := json.Marshal(config)
+	if err != nil {
+		return fmt.Errorf("failed to marshal store configuration: %w", err)
+	}
+
+	_, err = p.db.Exec("INSERT INTO "+storeConfigTable+" (name, config) VALUES (?, ?) "+
+		"ON CONFLICT (name) DO UPDATE SET config = excluded.config", name, string(configBytes))
+	if err != nil {
+		return fmt.Errorf("failed to put store configuration: %w", err)
+	}
+
+	return nil
+}
+
+// GetStoreConfig returns the store's configuration.
+// A store that exists but never had a configuration set has an empty one.
+func (p *Provider) GetStoreConfig(name string) (storage.StoreConfiguration, error) {
+	name = p.tableName(name)
+
+	err := p.checkStoreExists(name)
+	if err != nil {
+		return storage.StoreConfiguration{}, err
+	}
+
+	var configBytes []byte
+
+	err = p.db.QueryRow("SELECT config FROM "+storeConfigTable+" WHERE name = ?", name).Scan(&configBytes)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return storage.StoreConfiguration{}, nil
+		}
+
+		return storage.StoreConfiguration{},
+			fmt.Errorf(`failed to get store configuration for "%s": %w`, name, err)
+	}
+
+	var storeConfig storage.StoreConfiguration
+
+	err = json.Unmarshal(configBytes, &storeConfig)
+	if err != nil {
+		return storage.StoreConfiguration{}, fmt.Errorf("failed to unmarshal store configuration: %w", err)
+	}
+
+	return storeConfig, nil
+}
+
+// GetOpenStores returns all Stores currently open in this Provider.
+func (p *Provider) GetOpenStores() []storage.Store {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	openStores := make([]storage.Store, 0, len(p.dbs))
+
+	for _, openStore := range p.dbs {
+		openStores = append(openStores, openStore)
+	}
+
+	return openStores
+}
+
+// Close closes all stores created under this store provider, and the database they share.
+func (p *Provider) Close() error {
+	p.lock.RLock()
+
+	openStoresSnapshot := make([]*store, 0, len(p.dbs))
+
+	for _, openStore := range p.dbs {
+		openStoresSnapshot = append(openStoresSnapshot, openStore)
+	}
+	p.lock.RUnlock()
+
+	for _, openStore := range openStoresSnapshot {
+		err := openStore.Close()
+		if err != nil {
+			return fmt.Errorf(`failed to close open store with name "%s": %w`, openStore.name, err)
+		}
+	}
+
+	err := p.db.Close()
+	if err != nil {
+		return fmt.Errorf(failureWhileClosingDBErrMsg, err)
+	}
+
+	return nil
+}
+
+func (p *Provider) removeStore(name string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	delete(p.dbs, name)
+}
+
+// tableName returns the name of the table for the store with the given name.
+func (p *Provider) tableName(name string) string {
+	name = strings.ToLower(name)
+
+	if p.dbPrefix != "" {
+		name = p.dbPrefix + "_" + name
+	}
+
+	return name
+}
+
+// checkStoreExists returns storage.ErrStoreNotFound if the store has neither been opened by this provider nor has a
+// table in the database.
+func (p *Provider) checkStoreExists(name string) error {
+	p.lock.RLock()
+	_, ok := p.dbs[name]
+	p.lock.RUnlock()
+
+	if ok {
+		return nil
+	}
+
+	var count int
+
+	err := p.db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", name).Scan(&count)
+	if err != nil {
+		return fmt.Errorf(failureWhileCheckingStoreExistenceErrMsg, name, err)
+	}
+
+	if count == 0 {
+		return storage.ErrStoreNotFound
+	}
+
+	return nil
+}
+
+type store struct {
+	db           *sql.DB
+	name         string
+	tableName    string
+	tagTableName string
+	close        closer
+}
+
+// createTables creates the store's table and its tag table, indexed by tag name and value for queries.
+func (s *store) createTables() error {
+	_, err := s.db.Exec(fmt.Sprintf(createTableQuery, s.tableName))
+	if err != nil {
+		return fmt.Errorf(failureWhileCreatingTableErrMsg, s.name, err)
+	}
+
+	_, err = s.db.Exec(fmt.Sprintf(createTagTableQuery, s.tagTableName))
+	if err != nil {
+		return fmt.Errorf(failureWhileCreatingTableErrMsg, s.name+"_tags", err)
+	}
+
+	_, err = s.db.Exec(fmt.Sprintf(createTagIndexQuery, quoteIdentifier(s.name+"_tags_name_value"), s.tagTableName))
+	if err != nil {
+		return fmt.Errorf(failureWhileCreatingTableErrMsg, s.name+"_tags", err)
+	}
+
+	return nil
+}
+
+func (s *store) Put(key string, value []byte, tags ...storage.Tag) error {
+	errInputValidation := validatePutInput(key, value, tags)
+	if errInputValidation != nil {
+		return errInputValidation
+	}
+
+	tagsJSON, err := marshalTags(tags)
+	if err != nil {
+		return err
+	}
+
+	return s.inTransaction(func(tx *sql.Tx) error {
+		_, err = tx.Exec(s.upsertStmt(1), key, value, tagsJSON)
+		if err != nil {
+			return fmt.Errorf(failureWhileExecutingUpsertErrMsg, s.name, err)
+		}
+
+		return s.replaceTags(tx, key, tags)
+	})
+}
+
+func (s *store) Get(k string) ([]byte, error) {
+	retrievedDBEntry, err := s.getDBEntry(k)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get DB entry: %w", err)
+	}
+
+	return retrievedDBEntry.Value, nil
+}
+
+func (s *store) GetTags(key string) ([]storage.Tag, error) {
+	retrievedDBEntry, err := s.getDBEntry(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get DB entry: %w", err)
+	}
+
+	return retrievedDBEntry.Tags, nil
+}
+
+// GetBulk fetches the values associated with the given keys in a single query.
+// If a key doesn't exist, then a nil []byte is returned for that value. It is not considered an error.
+func (s *store) GetBulk(keys ...string) ([][]byte, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("keys slice must contain at least one key")
+	}
+
+	args := make([]interface{}, len(keys))
+
+	for i, key := range keys {
+		if key == "" {
+			return nil, ErrKeyRequired
+		}
+
+		args[i] = key
+	}
+
+	entries, err := s.queryEntries("SELECT key, value, tags FROM "+s.tableName+
+		" WHERE key IN ("+placeholders("?", len(keys))+")", args...)
+	if err != nil {
+		return nil, err
+	}
+
+	valuesByKey := make(map[string][]byte, len(entries))
+
+	for _, entry := range entries {
+		valuesByKey[entry.key] = entry.Value
+	}
+
+	values := make([][]byte, len(keys))
+
+	for i, key := range keys {
+		values[i] = valuesByKey[key]
+	}
+
+	return values, nil
+}
+
+// Query does a query for data as defined by the documentation in storage.Store (the interface).
+// Results are fetched a page at a time (see storage.WithPageSize), using the index on the tag table. When sorting,
+// tag values that are decimal numbers are compared numerically and all others lexicographically.
+func (s *store) Query(expression string, options ...storage.QueryOption) (storage.Iterator, error) {
+	if expression == "" {
+		return nil, fmt.Errorf(invalidQueryExpressionFormat, expression)
+	}
+
+	expressionSplit := strings.Split(expression, ":")
+
+	var expressionTagName string
+
+	var expressionTagValue string
+
+	switch len(expressionSplit) {
+	case expressionTagNameOnlyLength:
+		expressionTagName = expressionSplit[0]
+	case expressionTagNameAndValueLength:
+		expressionTagName = expressionSplit[0]
+		expressionTagValue = expressionSplit[1]
+	default:
+		return nil, fmt.Errorf(invalidQueryExpressionFormat, expression)
+	}
+
+	tagFilter := "name = ?"
+	args := []interface{}{expressionTagName}
+
+	if expressionTagValue != "" {
+		tagFilter += " AND value = ?"
+		args = append(args, expressionTagValue)
+	}
+
+	queryOptions := getQueryOptions(options)
+
+	itr := &iterator{
+		store:      s,
+		pageSize:   queryOptions.PageSize,
+		offset:     queryOptions.InitialPageNum * queryOptions.PageSize,
+		countQuery: "SELECT COUNT(DISTINCT key) FROM " + s.tagTableName + " WHERE " + tagFilter,
+		countArgs:  args,
+	}
+
+	itr.query, itr.args = s.selectMatchingEntries(tagFilter, args, queryOptions.SortOptions)
+
+	err := itr.fetchPage()
+	if err != nil {
+		return nil, err
+	}
+
+	return itr, nil
+}
+
+// selectMatchingEntries returns a query, without its LIMIT clause, for the entries with tags matching tagFilter,
+// in the order set by sortOptions, along with its arguments.
+func (s *store) selectMatchingEntries(tagFilter string, tagFilterArgs []interface{},
+	sortOptions *storage.SortOptions) (string, []interface{}) {
+	matchingKeys := "SELECT key FROM " + s.tagTableName + " WHERE " + tagFilter
+
+	if sortOptions == nil {
+		return "SELECT key, value, tags FROM " + s.tableName + " WHERE key IN (" + matchingKeys + ") ORDER BY key",
+			tagFilterArgs
+	}
+
+	order := "ASC"
+	if sortOptions.Order == storage.SortDescending {
+		order = "DESC"
+	}
+
+	// An entry may have several values for the tag it's sorted by, so it's grouped by key to be returned once.
+	query := fmt.Sprintf("SELECT e.key, e.value, e.tags FROM %s e LEFT JOIN %s t ON t.key = e.key AND t.name = ? "+
+		"WHERE e.key IN (%s) GROUP BY e.key ORDER BY MIN(t.numeric_value) %s, MIN(t.value) %s, e.key %s",
+		s.tableName, s.tagTableName, matchingKeys, order, order, order)
+
+	return query, append([]interface{}{sortOptions.TagName}, tagFilterArgs...)
+}
+
+// Delete will delete record with k key.
+func (s *store) Delete(k string) error {
+	if k == "" {
+		return ErrKeyRequired
+	}
+
+	return s.inTransaction(func(tx *sql.Tx) error {
+		_, err := tx.Exec("DELETE FROM "+s.tableName+" WHERE key = ?", k)
+		if err != nil {
+			return fmt.Errorf(failureWhileExecutingDeleteErrMsg, s.name, err)
+		}
+
+		return s.replaceTags(tx, k, nil)
+	})
+}
+
+// SQLite store doesn't queue values, so there's never anything to flush.
+func (s *store) Flush() error {
+	return nil
+}
+
+// Close removes the store from the provider's open stores. The database it uses is shared with the other stores and
+// is closed by Provider.Close.
+func (s *store) Close() error {
+	s.close(s.name)
+
+	return nil
+}
+
+// upsertStmt returns a statement that inserts or updates rowCount entries, each given by a key, value and tags.
+func (s *store) upsertStmt(rowCount int) string {
+	return "INSERT INTO " + s.tableName + " (key, value, tags) VALUES " + placeholders("(?, ?, ?)", rowCount) +
+		" ON CONFLICT (key) DO UPDATE SET value = excluded.value, tags = excluded.tags"
+}
+
+// replaceTags replaces the tags of key in the tag table.
+func (s *store) replaceTags(tx *sql.Tx, key string, tags []storage.Tag) error {
+	_, err := tx.Exec("DELETE FROM "+s.tagTableName+" WHERE key = ?", key)
+	if err != nil {
+		return fmt.Errorf(failureWhileUpdatingTagsErrMsg, s.name+"_tags", err)
+	}
+
+	if len(tags) == 0 {
+		return nil
+	}
+
+	values := make([]interface{}, 0, len(tags)*tagColumns)
+
+	for _, tag := range tags {
+		values = append(values, tagRow(key, tag)...)
+	}
+
+	_, err = tx.Exec(s.insertTagsStmt(len(tags)), values...)
+	if err != nil {
+		return fmt.Errorf(failureWhileUpdatingTagsErrMsg, s.name+"_tags", err)
+	}
+
+	return nil
+}
+
+// insertTagsStmt returns a statement that inserts rowCount tags into the tag table, each given by the values from
+// tagRow. Duplicate tags are ignored.
+func (s *store) insertTagsStmt(rowCount int) string {
+	return "INSERT OR IGNORE INTO " + s.tagTableName + " (key, name, value, numeric_value) VALUES " +
+		placeholders("(?, ?, ?, ?)", rowCount)
+}
+
+// inTransaction runs fn in a transaction, which is committed if fn succeeds and rolled back otherwise.
+func (s *store) inTransaction(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf(failureWhileBeginningTransactionErrMsg, err)
+	}
+
+	err = fn(tx)
+	if err != nil {
+		if errRollback := tx.Rollback(); errRollback != nil {
+			return fmt.Errorf("%w (rollback also failed: %s)", err, errRollback.Error())
+		}
+
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf(failureWhileCommittingTransactionErrMsg, err)
+	}
+
+	return nil
+}
+
+func (s *store) getDBEntry(key string) (*dbEntry, error) {
+	if key == "" {
+		return nil, ErrKeyRequired
+	}
+
+	var (
+		value    []byte
+		tagsJSON []byte
+	)
+
+	err := s.db.QueryRow("SELECT value, tags FROM "+s.tableName+" WHERE key = ?", key).Scan(&value, &tagsJSON)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, storage.ErrDataNotFound
+		}
+
+		return nil, fmt.Errorf(failureWhileQueryingRowErrMsg, err)
+	}
+
+	tags, err := unmarshalTags(tagsJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dbEntry{Value: value, Tags: tags}, nil
+}
+
+// keyedEntry is a DB entry read along with its key.
+type keyedEntry struct {
+	dbEntry
+	key string
+}
+
+// queryEntries runs query, which selects the key, value and tags of entries, and reads all the resulting entries.
+// They're read in full so that the provider's only connection is free again when it returns.
+func (s *store) queryEntries(query string, args ...interface{}) ([]keyedEntry, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf(failureWhileQueryingRowsErrMsg, err)
+	}
+
+	entries, err := collectEntries(rows)
+
+	errClose := rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if errClose != nil {
+		return nil, fmt.Errorf("failed to close result rows: %w", errClose)
+	}
+
+	return entries, nil
+}
+
+type iterator struct {
+	store      *store
+	query      string
+	args       []interface{}
+	pageSize   int
+	offset     int
+	page       []keyedEntry
+	pageIndex  int
+	countQuery string
+	countArgs  []interface{}
+	current    *keyedEntry
+}
+
+// fetchPage reads the page of results starting at the iterator's offset.
+func (i *iterator) fetchPage() error {
+	page, err := i.store.queryEntries(i.query+" LIMIT ? OFFSET ?", append(i.args, i.pageSize, i.offset)...)
+	if err != nil {
+		return err
+	}
+
+	i.page = page
+	i.pageIndex = 0
+
+	return nil
+}
+
+func (i *iterator) Next() (bool, error) {
+	i.current = nil
+
+	if i.pageIndex == len(i.page) {
+		// A page with fewer entries than the page size is the last one.
+		if len(i.page) < i.pageSize {
+			return false, nil
+		}
+
+		i.offset += i.pageSize
+
+		err := i.fetchPage()
+		if err != nil {
+			return false, err
+		}
+
+		if len(i.page) == 0 {
+			return false, nil
+		}
+	}
+
+	i.current = &i.page[i.pageIndex]
+	i.pageIndex++
+
+	return true, nil
+}
+
+func (i *iterator) Key() (string, error) {
+	if i.current == nil {
+		return "", errNoCurrentEntry
+	}
+
+	return i.current.key, nil
+}
+
+func (i *iterator) Value() ([]byte, error) {
+	if i.current == nil {
+		return nil, errNoCurrentEntry
+	}
+
+	return i.current.Value, nil
+}
+
+func (i *iterator) Tags() ([]storage.Tag, error) {
+	if i.current == nil {
+		return nil, errNoCurrentEntry
+	}
+
+	return i.current.Tags, nil
+}
+
+func (i *iterator) TotalItems() (int, error) {
+	var count int
+
+	err := i.store.db.QueryRow(i.countQuery, i.countArgs...).Scan(&count)
+	if err != nil {
+		return -1, fmt.Errorf(failureWhileQueryingRowErrMsg, err)
+	}
+
+	return count, nil
+}
+
+// Close releases the current page of results. The query holds no database resources between pages.
+func (i *iterator) Close() error {
+	i.page = nil
+	i.current = nil
+
+	return nil
+}
+
+// collectEntries reads the entries of all the rows.
+func collectEntries(rows *sql.Rows) ([]keyedEntry, error) {
+	var entries []keyedEntry
+
+	for rows.Next() {
+		var (
+			entry    keyedEntry
+			tagsJSON []byte
+		)
+
+		err := rows.Scan(&entry.key, &entry.Value, &tagsJSON)
+		if err != nil {
+			return nil, fmt.Errorf(failureWhileQueryingRowsErrMsg, err)
+		}
+
+		entry.Tags, err = unmarshalTags(tagsJSON)
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, entry)
+	}
+
+	err := rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf(failureWhileQueryingRowsErrMsg, err)
+	}
+
+	return entries, nil
+}
+
+// quoteIdentifier quotes a table or index name for use in a statement.
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// tagRow returns the values of the tag table's columns for a tag of key.
+func tagRow(key string, tag storage.Tag) []interface{} {
+	return []interface{}{key, tag.Name, tag.Value, numericValue(tag.Value)}
+}
+
+// placeholders returns count comma-separated copies of placeholder.
+func placeholders(placeholder string, count int) string {
+	return strings.TrimSuffix(strings.Repeat(placeholder+", ", count), ", ")
+}
+
+// numericValue returns the number a tag value represents, for sorting, or nil if it isn't a decimal number.
+func numericValue(tagValue string) interface{} {
+	number, err := strconv.ParseFloat(tagValue, 64)
+	if err != nil || math.IsInf(number, 0) || math.IsNaN(number) {
+		return nil
+	}
+
+	return number
+}
+
+// marshalTags returns the JSON array stored in the tags column for tags.
+func marshalTags(tags []storage.Tag) (string, error) {
+	if tags == nil {
+		tags = []storage.Tag{}
+	}
+
+	tagsJSON, err := json.Marshal(tags)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal tags: %w", err)
+	}
+
+	return string(tagsJSON), nil
+}
+
+func unmarshalTags(tagsJSON []byte) ([]storage.Tag, error) {
+	var tags []storage.Tag
+
+	err := json.Unmarshal(tagsJSON, &tags)
+	if err != nil {
+		return nil, fmt.Errorf(failureWhileUnmarshallingDBEntryTagsErrMsg, err)
+	}
+
+	if len(tags) == 0 {
+		return nil, nil
+	}
+
+	return tags, nil
+}
+
+func validatePutInput(key string, value []byte, tags []storage.Tag) error {
+	if key == "" {
+		return errors.New("key cannot be empty")
+	}
+
+	if value == nil {
+		return errors.New("value cannot be nil")
+	}
+
+	for _, tag := range tags {
+		if strings.Contains(tag.Name, ":") {
+			return fmt.Errorf(invalidTagName, tag.Name)
+		}
+
+		if strings.Contains(tag.Value, ":") {
+			return fmt.Errorf(invalidTagValue, tag.Value)
+		}
+	}
+
+	return nil
+}
+
+func getQueryOptions(options []storage.QueryOption) storage.QueryOptions {
+	var queryOptions storage.QueryOptions
+
+	for _, option := range options {
+		option(&queryOptions)
+	}
+
+	if queryOptions.PageSize < 1 {
+		queryOptions.PageSize = defaultPageSize
+	}
+
+	if queryOptions.InitialPageNum < 0 {
+		queryOptions.InitialPageNum = 0
+	}
+
+	return queryOptions
+}
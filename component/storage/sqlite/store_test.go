@@ -0,0 +1,344 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package sqlite_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hyperledger/aries-framework-go/spi/storage"
+	commontest "github.com/hyperledger/aries-framework-go/test/component/storage"
+	"github.com/stretchr/testify/require"
+
+	. "github.com/hyperledger/aries-framework-go-ext/component/storage/sqlite"
+)
+
+const inMemory = ":memory:"
+
+func TestSQLite_Common(t *testing.T) {
+	t.Run("In memory", func(t *testing.T) {
+		provider, err := NewProvider(inMemory)
+		require.NoError(t, err)
+
+		commontest.TestAll(t, provider)
+	})
+	t.Run("In a file, with prefix", func(t *testing.T) {
+		provider, err := NewProvider(filepath.Join(t.TempDir(), "aries.db"), WithDBPrefix("db-prefix"))
+		require.NoError(t, err)
+
+		commontest.TestAll(t, provider)
+	})
+}
+
+func TestNewProvider(t *testing.T) {
+	t.Run("Blank path", func(t *testing.T) {
+		provider, err := NewProvider("")
+		require.EqualError(t, err, "path for new SQLite provider can't be blank")
+		require.Nil(t, provider)
+	})
+	t.Run("Directory doesn't exist", func(t *testing.T) {
+		provider, err := NewProvider(filepath.Join(t.TempDir(), "missing", "aries.db"))
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "failure while opening SQLite database")
+		require.Nil(t, provider)
+	})
+	t.Run("Data is kept in the file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "aries.db")
+
+		provider, err := NewProvider(path)
+		require.NoError(t, err)
+
+		testStore, err := provider.OpenStore("store")
+		require.NoError(t, err)
+
+		require.NoError(t, testStore.Put("key", []byte("value"), storage.Tag{Name: "TagName1"}))
+		require.NoError(t, provider.SetStoreConfig("store", storage.StoreConfiguration{TagNames: []string{"TagName1"}}))
+		require.NoError(t, provider.Close())
+
+		provider, err = NewProvider(path)
+		require.NoError(t, err)
+
+		config, err := provider.GetStoreConfig("store")
+		require.NoError(t, err)
+		require.Equal(t, []string{"TagName1"}, config.TagNames)
+
+		testStore, err = provider.OpenStore("store")
+		require.NoError(t, err)
+
+		tags, err := testStore.GetTags("key")
+		require.NoError(t, err)
+		require.Equal(t, []storage.Tag{{Name: "TagName1"}}, tags)
+		require.NoError(t, provider.Close())
+	})
+}
+
+func TestProvider_Ping(t *testing.T) {
+	provider, err := NewProvider(inMemory)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	require.NoError(t, provider.Ping(ctx))
+	require.NoError(t, provider.Close())
+
+	err = provider.Ping(ctx)
+	require.EqualError(t, err, "failure while pinging SQLite database: sql: database is closed")
+}
+
+func TestProvider_OpenStore(t *testing.T) {
+	provider, err := NewProvider(inMemory)
+	require.NoError(t, err)
+
+	t.Run("Store name that needs quoting", func(t *testing.T) {
+		testStore, errOpen := provider.OpenStore(`store "name"; DROP TABLE aries_store_configs`)
+		require.NoError(t, errOpen)
+
+		require.NoError(t, testStore.Put("key", []byte("value")))
+
+		_, errGet := provider.GetStoreConfig(`store "name"; DROP TABLE aries_store_configs`)
+		require.NoError(t, errGet)
+	})
+	t.Run("Fail to create table since the DB connection was closed", func(t *testing.T) {
+		require.NoError(t, provider.Close())
+
+		testStore, errOpen := provider.OpenStore("store")
+		require.EqualError(t, errOpen, "failure while creating table store: sql: database is closed")
+		require.Nil(t, testStore)
+	})
+}
+
+func TestProvider_StoreConfig(t *testing.T) {
+	provider, err := NewProvider(inMemory)
+	require.NoError(t, err)
+
+	_, err = provider.OpenStore("store")
+	require.NoError(t, err)
+
+	t.Run("Store without a configuration", func(t *testing.T) {
+		config, errGet := provider.GetStoreConfig("store")
+		require.NoError(t, errGet)
+		require.Empty(t, config)
+	})
+	t.Run("Fail since the DB connection was closed", func(t *testing.T) {
+		require.NoError(t, provider.Close())
+
+		err = provider.SetStoreConfig("store", storage.StoreConfiguration{})
+		require.EqualError(t, err, "failure while checking whether store store exists: sql: database is closed")
+
+		config, errGet := provider.GetStoreConfig("store")
+		require.EqualError(t, errGet, "failure while checking whether store store exists: sql: database is closed")
+		require.Empty(t, config)
+	})
+}
+
+func TestStore_Failures(t *testing.T) {
+	provider, err := NewProvider(inMemory)
+	require.NoError(t, err)
+
+	testStore, err := provider.OpenStore("store")
+	require.NoError(t, err)
+
+	itr, err := testStore.Query("TagName1")
+	require.NoError(t, err)
+
+	t.Run("Fail to get iterator entry before Next", func(t *testing.T) {
+		key, errKey := itr.Key()
+		require.EqualError(t, errKey, "iterator has no current entry")
+		require.Empty(t, key)
+
+		value, errValue := itr.Value()
+		require.EqualError(t, errValue, "iterator has no current entry")
+		require.Nil(t, value)
+
+		tags, errTags := itr.Tags()
+		require.EqualError(t, errTags, "iterator has no current entry")
+		require.Nil(t, tags)
+	})
+
+	require.NoError(t, itr.Close())
+	require.NoError(t, provider.Close())
+
+	t.Run("Fail since the DB connection was closed", func(t *testing.T) {
+		err = testStore.Put("key", []byte("value"))
+		require.EqualError(t, err, "failure while beginning transaction: sql: database is closed")
+
+		value, errGet := testStore.Get("key")
+		require.EqualError(t, errGet, "failed to get DB entry: failure while querying row: sql: database is closed")
+		require.Nil(t, value)
+
+		values, errGetBulk := testStore.GetBulk("key")
+		require.EqualError(t, errGetBulk, "failure while querying rows: sql: database is closed")
+		require.Nil(t, values)
+
+		queryItr, errQuery := testStore.Query("TagName1")
+		require.EqualError(t, errQuery, "failure while querying rows: sql: database is closed")
+		require.Nil(t, queryItr)
+
+		count, errTotal := itr.TotalItems()
+		require.EqualError(t, errTotal, "failure while querying row: sql: database is closed")
+		require.Equal(t, -1, count)
+
+		err = testStore.Delete("key")
+		require.EqualError(t, err, "failure while beginning transaction: sql: database is closed")
+
+		err = testStore.Batch([]storage.Operation{{Key: "key"}})
+		require.EqualError(t, err, "failure while beginning transaction: sql: database is closed")
+	})
+}
+
+func TestStore_Batch(t *testing.T) {
+	t.Run("Failed batch is rolled back", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "aries.db")
+
+		provider, err := NewProvider(path)
+		require.NoError(t, err)
+
+		testStore, err := provider.OpenStore("store")
+		require.NoError(t, err)
+
+		err = testStore.Put("key1", []byte("value"), storage.Tag{Name: "TagName1"})
+		require.NoError(t, err)
+
+		// Without the tag table, the batch fails after its first statement.
+		db, err := sql.Open("sqlite", path)
+		require.NoError(t, err)
+
+		_, err = db.Exec(`DROP TABLE "store_tags"`)
+		require.NoError(t, err)
+		require.NoError(t, db.Close())
+
+		err = testStore.Batch([]storage.Operation{
+			{Key: "key1", Value: []byte("updated value")},
+			{Key: "key2", Value: []byte("value")},
+		})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "failure while executing batch on table store")
+
+		value, err := testStore.Get("key1")
+		require.NoError(t, err)
+		require.Equal(t, []byte("value"), value)
+
+		_, err = testStore.Get("key2")
+		require.True(t, errors.Is(err, storage.ErrDataNotFound), "unexpected error or no error")
+		require.NoError(t, provider.Close())
+	})
+	t.Run("Invalid tags are rejected before anything is written", func(t *testing.T) {
+		testStore := newStore(t)
+
+		err := testStore.Batch([]storage.Operation{
+			{Key: "key1", Value: []byte("value")},
+			{Key: "key2", Value: []byte("value"), Tags: []storage.Tag{{Name: "TagName1", Value: "a:b"}}},
+		})
+		require.EqualError(t, err, `"a:b" is an invalid tag value since it contains one or more ':' characters`)
+
+		err = testStore.Batch([]storage.Operation{
+			{Key: "key1", Value: []byte("value"), Tags: []storage.Tag{{Name: "a:b"}}},
+		})
+		require.EqualError(t, err, `"a:b" is an invalid tag name since it contains one or more ':' characters`)
+
+		_, err = testStore.Get("key1")
+		require.True(t, errors.Is(err, storage.ErrDataNotFound), "unexpected error or no error")
+	})
+	t.Run("Operations spanning several statements", func(t *testing.T) {
+		testStore := newStore(t)
+
+		var operations []storage.Operation
+
+		for i := 0; i < 250; i++ {
+			operations = append(operations, storage.Operation{
+				Key:   fmt.Sprintf("key%d", i),
+				Value: []byte("value"),
+				Tags:  []storage.Tag{{Name: "TagName1"}},
+			})
+		}
+
+		// Deleting then putting the same key again in a later operation keeps the key.
+		operations = append(operations, storage.Operation{Key: "key0"}, storage.Operation{Key: "key1"},
+			storage.Operation{Key: "key0", Value: []byte("updated value")})
+
+		require.NoError(t, testStore.Batch(operations))
+
+		value, err := testStore.Get("key0")
+		require.NoError(t, err)
+		require.Equal(t, []byte("updated value"), value)
+
+		_, err = testStore.Get("key1")
+		require.True(t, errors.Is(err, storage.ErrDataNotFound), "unexpected error or no error")
+
+		itr, err := testStore.Query("TagName1")
+		require.NoError(t, err)
+
+		count, err := itr.TotalItems()
+		require.NoError(t, err)
+		require.Equal(t, 248, count)
+		require.NoError(t, itr.Close())
+	})
+}
+
+func TestIterator_Paging(t *testing.T) {
+	testStore := newStore(t)
+
+	for i := 0; i < 5; i++ {
+		err := testStore.Put(fmt.Sprintf("key%d", i), []byte("value"), storage.Tag{Name: "TagName"})
+		require.NoError(t, err)
+	}
+
+	itr, err := testStore.Query("TagName", storage.WithPageSize(2), storage.WithInitialPageNum(1))
+	require.NoError(t, err)
+
+	defer func() {
+		require.NoError(t, itr.Close())
+	}()
+
+	var keys []string
+
+	for {
+		more, errNext := itr.Next()
+		require.NoError(t, errNext)
+
+		if !more {
+			break
+		}
+
+		key, errKey := itr.Key()
+		require.NoError(t, errKey)
+
+		// The provider's only connection isn't held between pages, so the store can be used while iterating.
+		_, errGet := testStore.Get(key)
+		require.NoError(t, errGet)
+
+		keys = append(keys, key)
+	}
+
+	require.Equal(t, []string{"key2", "key3", "key4"}, keys)
+
+	count, err := itr.TotalItems()
+	require.NoError(t, err)
+	require.Equal(t, 5, count)
+}
+
+func newStore(t *testing.T) storage.Store {
+	t.Helper()
+
+	p, err := NewProvider(inMemory)
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		require.NoError(t, p.Close())
+	})
+
+	s, err := p.OpenStore("store-" + uuid.New().String())
+	require.NoError(t, err)
+
+	return s
+}